@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Public market data in the formats listing sites (CoinMarketCap, CoinGecko) poll.
+// No login is needed, responses may be cached for a short while and any origin may
+// read them.
+
+// aggregatorPair is the market's name in these endpoints
+const aggregatorPair = "KCN_LTC"
+
+// How long clients and proxies may cache each endpoint, in seconds
+const (
+	summaryMaxAge   = 60
+	orderbookMaxAge = 10
+	tradesMaxAge    = 30
+)
+
+// maxAggregatorTrades caps /api/v1/trades, which covers the last 24 hours
+const maxAggregatorTrades = 1000
+
+// aggregatorSummary is one market in /api/v1/summary
+type aggregatorSummary struct {
+	TradingPairs          string  `json:"trading_pairs"`
+	BaseCurrency          string  `json:"base_currency"`
+	QuoteCurrency         string  `json:"quote_currency"`
+	LastPrice             float64 `json:"last_price"`
+	LowestAsk             float64 `json:"lowest_ask"`
+	HighestBid            float64 `json:"highest_bid"`
+	BaseVolume            float64 `json:"base_volume"`
+	QuoteVolume           float64 `json:"quote_volume"`
+	PriceChangePercent24h float64 `json:"price_change_percent_24h"`
+	HighestPrice24h       float64 `json:"highest_price_24h"`
+	LowestPrice24h        float64 `json:"lowest_price_24h"`
+}
+
+// aggregatorTicker is one market in /api/v1/ticker
+type aggregatorTicker struct {
+	LastPrice   float64 `json:"last_price"`
+	BaseVolume  float64 `json:"base_volume"`
+	QuoteVolume float64 `json:"quote_volume"`
+	IsFrozen    int     `json:"isFrozen"`
+}
+
+// aggregatorTrade is one fill in /api/v1/trades/{pair}
+type aggregatorTrade struct {
+	TradeID     int64   `json:"trade_id"`
+	Price       float64 `json:"price"`
+	BaseVolume  float64 `json:"base_volume"`
+	QuoteVolume float64 `json:"quote_volume"`
+	Timestamp   int64   `json:"timestamp"` // milliseconds
+	Type        string  `json:"type"`      // the taker's side
+}
+
+// publicAPI serves a GET endpoint to any origin with a Cache-Control max-age
+func publicAPI(maxAge int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		next(w, r)
+	}
+}
+
+// publicError replies with a status code, which these clients rely on
+func publicError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// knownPair accepts the pair as KCN_LTC or KCN-LTC, in any case
+func knownPair(pair string) bool {
+	return strings.EqualFold(strings.ReplaceAll(pair, "-", "_"), aggregatorPair)
+}
+
+// formatAmount writes a price or size the way aggregators expect order book entries
+func formatAmount(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// handleAggregatorSummary returns /api/v1/summary
+func (s *Server) handleAggregatorSummary(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	ticker, err := s.candles.Ticker(time.Now())
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[API] Failed to build summary: %v", err)
+		publicError(w, http.StatusInternalServerError, "Failed to load summary")
+		return
+	}
+
+	summary := aggregatorSummary{
+		TradingPairs:          aggregatorPair,
+		BaseCurrency:          "KCN",
+		QuoteCurrency:         "LTC",
+		LastPrice:             ticker.Last,
+		BaseVolume:            ticker.Volume,
+		QuoteVolume:           ticker.QuoteVolume,
+		PriceChangePercent24h: ticker.ChangePercent,
+		HighestPrice24h:       ticker.High,
+		LowestPrice24h:        ticker.Low,
+	}
+	if s.book != nil {
+		top := s.book.Depth(1, -1)
+		if len(top.Asks) > 0 {
+			summary.LowestAsk = top.Asks[0].Price
+		}
+		if len(top.Bids) > 0 {
+			summary.HighestBid = top.Bids[0].Price
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]aggregatorSummary{summary})
+}
+
+// handleAggregatorTicker returns /api/v1/ticker
+func (s *Server) handleAggregatorTicker(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	ticker, err := s.candles.Ticker(time.Now())
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[API] Failed to build ticker: %v", err)
+		publicError(w, http.StatusInternalServerError, "Failed to load ticker")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]aggregatorTicker{
+		aggregatorPair: {
+			LastPrice:   ticker.Last,
+			BaseVolume:  ticker.Volume,
+			QuoteVolume: ticker.QuoteVolume,
+		},
+	})
+}
+
+// handleAggregatorOrderBook returns /api/v1/orderbook/{pair}?depth=&level=. depth is
+// split between the two sides and 0 means the whole book. Level 1 is the best bid
+// and ask, level 2 is aggregated by price and level 3 lists every order.
+func (s *Server) handleAggregatorOrderBook(w http.ResponseWriter, r *http.Request) {
+	if !knownPair(r.PathValue("pair")) || s.book == nil {
+		publicError(w, http.StatusNotFound, "Unknown pair: "+r.PathValue("pair"))
+		return
+	}
+
+	query := r.URL.Query()
+	depth := 0
+	if v := query.Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			publicError(w, http.StatusBadRequest, "depth must be 0 or more")
+			return
+		}
+		depth = n
+	}
+	level := 2
+	if v := query.Get("level"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 3 {
+			publicError(w, http.StatusBadRequest, "level must be 1, 2 or 3")
+			return
+		}
+		level = n
+	}
+
+	perSide := maxBookDepth
+	if depth > 0 && (depth+1)/2 < perSide {
+		perSide = (depth + 1) / 2
+	}
+	if level == 1 {
+		perSide = 1
+	}
+
+	bids, asks := [][2]string{}, [][2]string{}
+	if level == 3 {
+		// Best price first, oldest first within a price
+		orders, _ := s.book.Orders()
+		sort.SliceStable(orders, func(i, j int) bool {
+			if orders[i].Side != orders[j].Side {
+				return orders[i].Side == "buy"
+			}
+			if orders[i].Side == "buy" {
+				return orders[i].Price > orders[j].Price
+			}
+			return orders[i].Price < orders[j].Price
+		})
+		for _, order := range orders {
+			entry := [2]string{formatAmount(order.Price), formatAmount(order.Remaining)}
+			if order.Side == "buy" && len(bids) < perSide {
+				bids = append(bids, entry)
+			} else if order.Side == "sell" && len(asks) < perSide {
+				asks = append(asks, entry)
+			}
+		}
+	} else {
+		book := s.book.Depth(perSide, -1)
+		for _, l := range book.Bids {
+			bids = append(bids, [2]string{formatAmount(l.Price), formatAmount(l.Size)})
+		}
+		for _, l := range book.Asks {
+			asks = append(asks, [2]string{formatAmount(l.Price), formatAmount(l.Size)})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timestamp": time.Now().UnixMilli(),
+		"bids":      bids,
+		"asks":      asks,
+	})
+}
+
+// handleAggregatorTrades returns /api/v1/trades/{pair}: the fills of the last 24
+// hours, newest first
+func (s *Server) handleAggregatorTrades(w http.ResponseWriter, r *http.Request) {
+	if !knownPair(r.PathValue("pair")) {
+		publicError(w, http.StatusNotFound, "Unknown pair: "+r.PathValue("pair"))
+		return
+	}
+
+	s.mu.RLock()
+	fills, err := s.getRecentFills(maxAggregatorTrades)
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[API] Failed to load trades: %v", err)
+		publicError(w, http.StatusInternalServerError, "Failed to load trades")
+		return
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	trades := []aggregatorTrade{}
+	for _, fill := range fills {
+		if fill.Time.Before(since) {
+			break
+		}
+		trades = append(trades, aggregatorTrade{
+			TradeID:     fill.ID,
+			Price:       fill.Price,
+			BaseVolume:  fill.Size,
+			QuoteVolume: fill.Size * fill.Price,
+			Timestamp:   fill.Time.UnixMilli(),
+			Type:        fill.Side,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trades)
+}
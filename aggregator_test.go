@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// getPublic fetches an aggregator endpoint without a session
+func getPublic(t *testing.T, ex *testExchange, path string, out interface{}) *http.Response {
+	t.Helper()
+
+	resp, err := ex.ts.Client().Get(ex.ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("GET %s: decode: %v", path, err)
+		}
+	}
+	return resp
+}
+
+func TestAggregatorEndpoints(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 50, litecoin = 5`)
+
+	// Alice asks 10 KCN at 0.1 and 5 at 0.2, Bob bids for 10 at 0.05 and takes 4 of the 0.1 ask
+	asks := []map[string]interface{}{
+		{"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1},
+		{"coin_selling": "kernelcoin", "amount_selling": 5, "coin_buying": "litecoin", "amount_buying": 1},
+	}
+	var askIDs []interface{}
+	for _, order := range asks {
+		resp := alice.call("/api/trade/create", order)
+		askIDs = append(askIDs, resp["trade_id"])
+	}
+	bob.call("/api/trade/create", map[string]interface{}{"coin_selling": "litecoin", "amount_selling": 0.5, "coin_buying": "kernelcoin", "amount_buying": 10})
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": askIDs[0], "quantity": 4}); resp["success"] != true {
+		t.Fatalf("execute: %v", resp)
+	}
+
+	var summary []aggregatorSummary
+	resp := getPublic(t, ex, "/api/v1/summary", &summary)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("summary headers = %v", resp.Header)
+	}
+	if len(summary) != 1 || summary[0].TradingPairs != "KCN_LTC" || summary[0].LastPrice != 0.1 ||
+		summary[0].LowestAsk != 0.1 || summary[0].HighestBid != 0.05 || summary[0].BaseVolume != 4 {
+		t.Errorf("summary = %+v", summary)
+	}
+
+	var ticker map[string]aggregatorTicker
+	getPublic(t, ex, "/api/v1/ticker", &ticker)
+	if ticker["KCN_LTC"].LastPrice != 0.1 || ticker["KCN_LTC"].BaseVolume != 4 {
+		t.Errorf("ticker = %+v", ticker)
+	}
+
+	var book struct {
+		Timestamp int64       `json:"timestamp"`
+		Bids      [][2]string `json:"bids"`
+		Asks      [][2]string `json:"asks"`
+	}
+	getPublic(t, ex, "/api/v1/orderbook/KCN_LTC?depth=0&level=2", &book)
+	if len(book.Asks) != 2 || book.Asks[0] != [2]string{"0.1", "6"} || book.Asks[1] != [2]string{"0.2", "5"} {
+		t.Errorf("asks = %v", book.Asks)
+	}
+	if len(book.Bids) != 1 || book.Bids[0] != [2]string{"0.05", "10"} || book.Timestamp == 0 {
+		t.Errorf("bids = %v at %d", book.Bids, book.Timestamp)
+	}
+	getPublic(t, ex, "/api/v1/orderbook/kcn-ltc?level=1", &book)
+	if len(book.Asks) != 1 || len(book.Bids) != 1 {
+		t.Errorf("level 1 book = %+v, want only the best bid and ask", book)
+	}
+
+	var trades []aggregatorTrade
+	getPublic(t, ex, "/api/v1/trades/KCN_LTC", &trades)
+	if len(trades) != 1 || trades[0].Type != "buy" || trades[0].BaseVolume != 4 || trades[0].Timestamp == 0 {
+		t.Errorf("trades = %+v", trades)
+	}
+	assertAmount(t, "quote volume", trades[0].QuoteVolume, 0.4)
+
+	if resp := getPublic(t, ex, "/api/v1/trades/BTC_LTC", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown pair: status %d", resp.StatusCode)
+	}
+
+	// Browsers on other sites may read these endpoints
+	req, _ := http.NewRequest(http.MethodOptions, ex.ts.URL+"/api/v1/summary", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	preflight, err := ex.ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("preflight: %v", err)
+	}
+	preflight.Body.Close()
+	if preflight.StatusCode != http.StatusNoContent || preflight.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("preflight: status %d, headers %v", preflight.StatusCode, preflight.Header)
+	}
+}
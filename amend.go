@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Amendment is one change to an order's price or remaining size, in KCN
+type Amendment struct {
+	ID            int64   `json:"id"`
+	TradeID       int     `json:"trade_id"`
+	OldPrice      float64 `json:"old_price"`
+	NewPrice      float64 `json:"new_price"`
+	OldRemaining  float64 `json:"old_remaining"`
+	NewRemaining  float64 `json:"new_remaining"`
+	EscrowChange  float64 `json:"escrow_change"` // in the coin the order sells; negative is refunded
+	PriorityReset bool    `json:"priority_reset"`
+	AmendedAt     string  `json:"amended_at"`
+}
+
+// orderEscrow is what a side escrows for a remaining size at a price
+func orderEscrow(side string, remaining, price float64) float64 {
+	if side == "sell" {
+		return remaining
+	}
+	return remaining * price
+}
+
+// amendOrder changes the price and remaining size of a user's open order, keeping
+// its ID. Escrow moves by the difference. The order keeps its place in time
+// priority unless its price changes or it grows. Everything is checked before
+// anything is written. Caller must hold s.mu.
+func (s *Server) amendOrder(tradeID, userID int, price, remaining float64) (*Amendment, error) {
+	order, err := s.getOrder(tradeID)
+	if err == sql.ErrNoRows || (err == nil && order.SellerID != userID) {
+		return nil, ruleError(errUnknownOrder, "No order %d of yours", tradeID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != "open" {
+		return nil, ruleError(errOrderNotOpen, "Order %d is no longer open", tradeID)
+	}
+	if !validAmount(price) || !validAmount(remaining) {
+		return nil, ruleError(errInvalidAmount, "Price and quantity must be positive numbers")
+	}
+	if price == order.Price && math.Abs(remaining-order.Remaining) <= 1e-9 {
+		return nil, ruleError(errInvalidAmount, "Nothing to amend")
+	}
+	last, err := s.lastPrice()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rules.CheckAmend(order, price, remaining, last); err != nil {
+		return nil, err
+	}
+
+	coinSelling := "litecoin"
+	if order.Side == "sell" {
+		coinSelling = "kernelcoin"
+	}
+	var escrow float64
+	err = s.db.QueryRow(`SELECT `+orderEscrowSQL+` FROM trades t WHERE t.id = ?`, tradeID).Scan(&escrow)
+	if err != nil {
+		return nil, err
+	}
+	change := orderEscrow(order.Side, remaining, price) - escrow
+	if change > 0 {
+		balance, err := s.getUserBalance(userID)
+		if err != nil {
+			return nil, err
+		}
+		available := balance.Kernelcoin
+		if coinSelling == "litecoin" {
+			available = balance.Litecoin
+		}
+		if available < change {
+			return nil, ruleError(errInsufficientBalance, "Insufficient balance")
+		}
+	}
+
+	// The order is restated as if all of it were at the new price, so what has
+	// been filled plus the new remainder is its size and orderEscrowSQL still holds.
+	// Fills keep the price they were made at.
+	size := order.Size - order.Remaining + remaining
+	amountSelling, amountBuying := size, size*price
+	if order.Side == "buy" {
+		amountSelling, amountBuying = size*price, size
+	}
+	reset := price != order.Price || remaining > order.Remaining+1e-9
+
+	// The escrow, the order and its amendment history change together or not at all
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := adjustBalance(tx, userID, coinSelling, -change); err != nil {
+		return nil, err
+	}
+	query := `UPDATE trades SET amount_selling = ?, amount_buying = ?, price_per_unit = ?`
+	if reset {
+		query += `, queue_seq = ` + nextQueueSQL
+	}
+	_, err = tx.Exec(query+` WHERE id = ?`, amountSelling, amountBuying, price, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO order_amendments (trade_id, old_price, new_price, old_remaining, new_remaining, escrow_change, priority_reset)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, tradeID, order.Price, price, order.Remaining, remaining, change, reset)
+	if err != nil {
+		return nil, err
+	}
+	amendmentID, _ := result.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publishOrder(tradeID, "order_updated")
+	s.publishBalance(userID)
+	return &Amendment{
+		ID:            amendmentID,
+		TradeID:       tradeID,
+		OldPrice:      order.Price,
+		NewPrice:      price,
+		OldRemaining:  order.Remaining,
+		NewRemaining:  remaining,
+		EscrowChange:  change,
+		PriorityReset: reset,
+	}, nil
+}
+
+// getAmendments retrieves an order's amendments, oldest first
+func (s *Server) getAmendments(tradeID int) ([]*Amendment, error) {
+	rows, err := s.db.Query(`
+		SELECT id, trade_id, old_price, new_price, old_remaining, new_remaining, escrow_change, priority_reset, amended_at
+		FROM order_amendments
+		WHERE trade_id = ?
+		ORDER BY id
+	`, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	amendments := []*Amendment{}
+	for rows.Next() {
+		a := &Amendment{}
+		if err := rows.Scan(&a.ID, &a.TradeID, &a.OldPrice, &a.NewPrice, &a.OldRemaining, &a.NewRemaining,
+			&a.EscrowChange, &a.PriorityReset, &a.AmendedAt); err != nil {
+			return nil, err
+		}
+		amendments = append(amendments, a)
+	}
+	return amendments, rows.Err()
+}
+
+// handleAmendTrade changes an open order in place: {"trade_id", "price", "quantity"}.
+// price is in LTC per KCN and quantity is the new remaining size in KCN; either may
+// be left out to keep it.
+func (s *Server) handleAmendTrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		TradeID  int      `json:"trade_id"`
+		Price    *float64 `json:"price"`
+		Quantity *float64 `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	price, quantity := 0.0, 0.0
+	if order, err := s.getOrder(req.TradeID); err == nil {
+		price, quantity = order.Price, order.Remaining
+	}
+	if req.Price != nil {
+		price = *req.Price
+	}
+	if req.Quantity != nil {
+		quantity = *req.Quantity
+	}
+
+	amendment, err := s.amendOrder(req.TradeID, session.UserID, price, quantity)
+	if err != nil {
+		if errorCode(err) == "" {
+			log.Printf("[TRADE] Failed to amend order %d for user %d: %v", req.TradeID, session.UserID, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+			"code":    errorCode(err),
+		})
+		return
+	}
+	order, err := s.getOrder(req.TradeID)
+	if err != nil {
+		log.Printf("[TRADE] Failed to load amended order %d: %v", req.TradeID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"order":     order,
+		"amendment": amendment,
+	})
+}
+
+// handleGetAmendments lists the amendments of one of the user's orders: ?trade_id=
+func (s *Server) handleGetAmendments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tradeID, _ := strconv.Atoi(r.URL.Query().Get("trade_id"))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, err := s.getOrder(tradeID)
+	if err != nil || order.SellerID != session.UserID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+		return
+	}
+	amendments, err := s.getAmendments(tradeID)
+	if err != nil {
+		log.Printf("[TRADE] Failed to load amendments of order %d: %v", tradeID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load amendments"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order":      order,
+		"amendments": amendments,
+	})
+}
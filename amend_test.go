@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAmendKeepsIDAndAdjustsEscrow(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 100, litecoin = 10`)
+
+	create := func(coinSelling string, amountSelling float64, coinBuying string, amountBuying float64) int {
+		t.Helper()
+		resp := alice.call("/api/trade/create", map[string]interface{}{
+			"coin_selling": coinSelling, "amount_selling": amountSelling, "coin_buying": coinBuying, "amount_buying": amountBuying,
+		})
+		if resp["success"] != true {
+			t.Fatalf("create: %v", resp)
+		}
+		return int(resp["trade_id"].(float64))
+	}
+	execute := func(tradeID int, quantity float64) {
+		t.Helper()
+		if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": tradeID, "quantity": quantity}); resp["success"] != true {
+			t.Fatalf("execute %d: %v", tradeID, resp)
+		}
+	}
+	type amendResponse struct {
+		Success   bool       `json:"success"`
+		Code      string     `json:"code"`
+		Order     *BookOrder `json:"order"`
+		Amendment *Amendment `json:"amendment"`
+	}
+	amend := func(user *testUser, body map[string]interface{}) amendResponse {
+		t.Helper()
+		var resp amendResponse
+		user.post("/api/trade/amend", body, &resp)
+		return resp
+	}
+
+	first := create("kernelcoin", 10, "litecoin", 1)
+	second := create("kernelcoin", 10, "litecoin", 1)
+	execute(first, 4)
+
+	// Shrinking keeps the order's place and refunds the difference
+	resp := amend(alice, map[string]interface{}{"trade_id": first, "quantity": 3})
+	if !resp.Success || resp.Order.ID != first || resp.Amendment.PriorityReset {
+		t.Fatalf("reduce = %+v", resp)
+	}
+	assertAmount(t, "escrow change", resp.Amendment.EscrowChange, -3)
+	assertAmount(t, "alice KCN after reducing", alice.balance()["kernelcoin"], 83)
+	if orders, _ := ex.server.book.Orders(); orders[0].ID != first {
+		t.Errorf("reducing lost priority: %+v", orders)
+	}
+
+	// Repricing sends it to the back of the queue; the earlier fill keeps its price
+	resp = amend(alice, map[string]interface{}{"trade_id": first, "price": 0.12})
+	if !resp.Success || !resp.Amendment.PriorityReset || resp.Order.Price != 0.12 {
+		t.Fatalf("reprice = %+v", resp)
+	}
+	assertAmount(t, "remaining after reprice", resp.Order.Remaining, 3)
+	if orders, _ := ex.server.book.Orders(); orders[0].ID != second || orders[1].ID != first {
+		t.Errorf("book after reprice: %+v %+v", orders[0], orders[1])
+	}
+	if fills, _ := ex.server.getRecentFills(1); fills[0].Price != 0.1 {
+		t.Errorf("earlier fill repriced to %v", fills[0].Price)
+	}
+
+	if resp := amend(bob, map[string]interface{}{"trade_id": first, "price": 0.2}); resp.Code != errUnknownOrder {
+		t.Errorf("bob amending alice's order = %+v", resp)
+	}
+	if resp := amend(alice, map[string]interface{}{"trade_id": first, "quantity": 1000}); resp.Code != errInsufficientBalance {
+		t.Errorf("growing past the balance = %+v", resp)
+	}
+
+	execute(first, 3)
+	assertAmount(t, "alice LTC after both fills", alice.balance()["litecoin"], 10+0.4+0.36)
+	if order, _ := ex.server.getOrder(first); order.Status != "completed" || order.Size != 7 {
+		t.Errorf("amended order after filling = %+v", order)
+	}
+
+	// A partly filled bid repriced lower gets back the LTC it no longer needs
+	bid := create("litecoin", 1, "kernelcoin", 10)
+	execute(bid, 5)
+	resp = amend(alice, map[string]interface{}{"trade_id": bid, "price": 0.08})
+	if !resp.Success {
+		t.Fatalf("bid reprice = %+v", resp)
+	}
+	assertAmount(t, "bid escrow change", resp.Amendment.EscrowChange, -0.1)
+	execute(bid, 5)
+	assertAmount(t, "alice LTC after the bid", alice.balance()["litecoin"], 10.76-1+0.1)
+	assertAmount(t, "alice KCN after the bid", alice.balance()["kernelcoin"], 93)
+
+	var history struct {
+		Amendments []*Amendment `json:"amendments"`
+	}
+	alice.get("/api/trade/amendments?trade_id="+strconv.Itoa(first), &history)
+	if len(history.Amendments) != 2 || history.Amendments[0].NewRemaining != 3 || history.Amendments[1].OldPrice != 0.1 ||
+		!history.Amendments[1].PriorityReset {
+		t.Errorf("amendments = %+v", history.Amendments)
+	}
+}
+
+func TestAmendAfterMigrationAndFailedAmend(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 100, litecoin = 10`)
+
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1,
+	})
+	tradeID := int(created["trade_id"].(float64))
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": tradeID, "quantity": 4}); resp["success"] != true {
+		t.Fatalf("execute: %v", resp)
+	}
+
+	// A fill made before fills recorded their price gets it from the migration
+	db.Exec(`UPDATE trade_completions SET price = NULL`)
+	if err := migrateDB(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if resp := alice.call("/api/trade/amend", map[string]interface{}{"trade_id": tradeID, "price": 0.12}); resp["success"] != true {
+		t.Fatalf("amend: %v", resp)
+	}
+	fills, err := ex.server.getRecentFills(1)
+	if err != nil || len(fills) != 1 {
+		t.Fatalf("fills = %v, %v", fills, err)
+	}
+	if fills[0].Price != 0.1 {
+		t.Errorf("fill from before the migration repriced to %v", fills[0].Price)
+	}
+
+	// An amendment that cannot be recorded moves no escrow and leaves the order as it was
+	if _, err := db.Exec(`CREATE TRIGGER fail_amendment BEFORE INSERT ON order_amendments
+		BEGIN SELECT RAISE(ABORT, 'amendment failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if resp := alice.call("/api/trade/amend", map[string]interface{}{"trade_id": tradeID, "quantity": 2}); resp["success"] == true {
+		t.Fatalf("amend with a failing history insert: %v", resp)
+	}
+	assertAmount(t, "alice KCN after a failed amend", alice.balance()["kernelcoin"], 90)
+	order, err := ex.server.getOrder(tradeID)
+	if err != nil || order.Price != 0.12 || order.Remaining != 6 {
+		t.Errorf("order after a failed amend = %+v, %v", order, err)
+	}
+}
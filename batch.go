@@ -0,0 +1,586 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchOrders caps the orders in one batch request
+const maxBatchOrders = 50
+
+// defaultOpenOrderLimit is the open order cap for roles without one of their own
+const defaultOpenOrderLimit = 10
+
+// defaultRole is the role every account starts with
+const defaultRole = "user"
+
+// Limits on the dead man's switch timeout
+const (
+	minHeartbeatTimeout = 5 * time.Second
+	maxHeartbeatTimeout = 10 * time.Minute
+)
+
+// Error codes for batch operations, next to the market rule codes
+const (
+	errOrderLimit          = "order_limit"
+	errInsufficientBalance = "insufficient_balance"
+	errUnknownOrder        = "unknown_order"
+	errOrderNotOpen        = "not_open"
+	errBatchRejected       = "batch_rejected"
+)
+
+// BatchOrder is one entry of a batch. Cancels only need TradeID, creates only the
+// order terms and replaces both.
+type BatchOrder struct {
+	TradeID       int     `json:"trade_id"`
+	CoinSelling   string  `json:"coin_selling"`
+	AmountSelling float64 `json:"amount_selling"`
+	CoinBuying    string  `json:"coin_buying"`
+	AmountBuying  float64 `json:"amount_buying"`
+}
+
+// BatchResult is the outcome of one entry, in request order
+type BatchResult struct {
+	Index       int    `json:"index"`
+	Success     bool   `json:"success"`
+	TradeID     int64  `json:"trade_id,omitempty"`     // the new order of a create or replace
+	CancelledID int    `json:"cancelled_id,omitempty"` // the order a cancel or replace removed
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+// batchState is a user's balances and open orders as they would be after the
+// entries of a batch checked so far
+type batchState struct {
+	userID    int
+	balances  map[string]float64
+	open      int
+	limit     int
+	cancelled map[int]bool
+}
+
+// ParseOrderLimits reads open order caps per role written as role=limit,...
+func ParseOrderLimits(spec string) (map[string]int, error) {
+	limits := map[string]int{defaultRole: defaultOpenOrderLimit}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid order limit %q, expected role=limit", entry)
+		}
+		limit, err := strconv.Atoi(kv[1])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid order limit %q", entry)
+		}
+		limits[strings.TrimSpace(kv[0])] = limit
+	}
+	return limits, nil
+}
+
+// openOrderLimit is how many open orders a user's role allows. Caller must hold s.mu.
+func (s *Server) openOrderLimit(userID int) (int, error) {
+	var role string
+	if err := s.db.QueryRow(`SELECT role FROM users WHERE id = ?`, userID).Scan(&role); err != nil {
+		return 0, err
+	}
+	if limit, ok := s.orderLimits[role]; ok {
+		return limit, nil
+	}
+	if limit, ok := s.orderLimits[defaultRole]; ok {
+		return limit, nil
+	}
+	return defaultOpenOrderLimit, nil
+}
+
+// newBatchState loads what a user holds now. Caller must hold s.mu.
+func (s *Server) newBatchState(userID int) (*batchState, error) {
+	balance, err := s.getUserBalance(userID)
+	if err != nil {
+		return nil, err
+	}
+	st := &batchState{
+		userID:    userID,
+		balances:  map[string]float64{"kernelcoin": balance.Kernelcoin, "litecoin": balance.Litecoin},
+		cancelled: make(map[int]bool),
+	}
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM trades WHERE seller_id = ? AND status = 'open'`, userID).Scan(&st.open)
+	if err != nil {
+		return nil, err
+	}
+	if st.limit, err = s.openOrderLimit(userID); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// checkCreate checks a new order against the rules, the open order cap and the
+// balance, and counts it in st if it passes. Caller must hold s.mu.
+func (s *Server) checkCreate(st *batchState, order BatchOrder) error {
+	if err := s.checkOrder(order.CoinSelling, order.AmountSelling, order.CoinBuying, order.AmountBuying); err != nil {
+		return err
+	}
+	if st.open >= st.limit {
+		return ruleError(errOrderLimit, "Maximum of %d active trades allowed per account", st.limit)
+	}
+	if st.balances[order.CoinSelling] < order.AmountSelling {
+		return ruleError(errInsufficientBalance, "Insufficient balance")
+	}
+	st.balances[order.CoinSelling] -= order.AmountSelling
+	st.open++
+	return nil
+}
+
+// checkCancel checks the user may cancel an order and counts its refund in st if
+// so. Caller must hold s.mu.
+func (s *Server) checkCancel(st *batchState, tradeID int) error {
+	var sellerID int
+	var coinSelling, status string
+	var escrow float64
+	err := s.db.QueryRow(`SELECT t.seller_id, t.coin_selling, t.status, `+orderEscrowSQL+` FROM trades t WHERE t.id = ?`, tradeID).
+		Scan(&sellerID, &coinSelling, &status, &escrow)
+	if err == sql.ErrNoRows || (err == nil && sellerID != st.userID) {
+		return ruleError(errUnknownOrder, "No order %d of yours", tradeID)
+	}
+	if err != nil {
+		return err
+	}
+	if status != "open" || st.cancelled[tradeID] {
+		return ruleError(errOrderNotOpen, "Order %d is no longer open", tradeID)
+	}
+	st.cancelled[tradeID] = true
+	st.balances[coinSelling] += escrow
+	st.open--
+	return nil
+}
+
+// checkBatchEntry checks one entry of a batch against st. Caller must hold s.mu.
+func (s *Server) checkBatchEntry(st *batchState, action string, order BatchOrder) error {
+	switch action {
+	case "create":
+		return s.checkCreate(st, order)
+	case "cancel":
+		return s.checkCancel(st, order.TradeID)
+	}
+
+	// A replace only counts if both halves pass
+	saved := &batchState{userID: st.userID, balances: map[string]float64{}, open: st.open, limit: st.limit, cancelled: st.cancelled}
+	for coin, amount := range st.balances {
+		saved.balances[coin] = amount
+	}
+	if err := s.checkCancel(st, order.TradeID); err != nil {
+		return err
+	}
+	if err := s.checkCreate(st, order); err != nil {
+		delete(st.cancelled, order.TradeID)
+		st.balances, st.open = saved.balances, saved.open
+		return err
+	}
+	return nil
+}
+
+// applyBatchEntry carries out one checked entry in tx. Caller must hold s.mu.
+func applyBatchEntry(tx *sql.Tx, userID int, action string, order BatchOrder, result *BatchResult) error {
+	if action == "cancel" || action == "replace" {
+		if err := refundTrade(tx, order.TradeID, userID); err != nil {
+			return err
+		}
+		result.CancelledID = order.TradeID
+	}
+	if action == "create" || action == "replace" {
+		tradeID, err := insertTrade(tx, userID, order.CoinSelling, order.AmountSelling, order.CoinBuying, order.AmountBuying)
+		if err != nil {
+			return err
+		}
+		result.TradeID = tradeID
+	}
+	return nil
+}
+
+// runBatch creates, cancels or replaces orders for a user. Every entry is checked
+// first, in order and counting the entries before it. An atomic batch with any
+// entry rejected changes nothing; a best-effort batch applies the entries that
+// passed. The entries are applied in one transaction, so a failure part way
+// through changes nothing either, and holding s.mu throughout, no other request
+// sees a batch half done. Caller must hold s.mu.
+func (s *Server) runBatch(userID int, action string, orders []BatchOrder, atomic bool) ([]BatchResult, error) {
+	st, err := s.newBatchState(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(orders))
+	rejected := false
+	for i, order := range orders {
+		results[i].Index = i
+		if err := s.checkBatchEntry(st, action, order); err != nil {
+			results[i].Error, results[i].Code = err.Error(), errorCode(err)
+			rejected = true
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for i, order := range orders {
+		result := &results[i]
+		if result.Error != "" {
+			continue
+		}
+		if atomic && rejected {
+			result.Error, result.Code = "Not applied: another order in the batch was rejected", errBatchRejected
+			continue
+		}
+		if err := applyBatchEntry(tx, userID, action, order, result); err != nil {
+			return nil, fmt.Errorf("%s order %d: %w", action, order.TradeID, err)
+		}
+		result.Success = true
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	applied := false
+	for _, result := range results {
+		if result.CancelledID != 0 {
+			s.publishOrder(result.CancelledID, "order_removed")
+		}
+		if result.TradeID != 0 {
+			s.publishOrder(int(result.TradeID), "order_added")
+		}
+		applied = applied || result.Success
+	}
+	if applied {
+		s.publishBalance(userID)
+	}
+	return results, nil
+}
+
+// cancelAllOrders cancels a user's open orders, on one side ("buy" or "sell") or
+// both (""), and returns their IDs. Caller must hold s.mu.
+func (s *Server) cancelAllOrders(userID int, side string) ([]int, error) {
+	query := `SELECT id FROM trades WHERE seller_id = ? AND status = 'open'`
+	switch side {
+	case "sell":
+		query += ` AND coin_selling = 'kernelcoin'`
+	case "buy":
+		query += ` AND coin_selling = 'litecoin'`
+	}
+	rows, err := s.db.Query(query+` ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cancelled := []int{}
+	for _, id := range ids {
+		if err := s.cancelTrade(id, userID); err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, id)
+	}
+	return cancelled, nil
+}
+
+// DeadManSwitch tracks users who asked for their orders to be cancelled if they
+// stop sending heartbeats. It is kept in memory only, so a restart disarms it.
+// A nil switch is disabled.
+type DeadManSwitch struct {
+	mu        sync.Mutex
+	deadlines map[int]time.Time
+}
+
+// NewDeadManSwitch creates a switch with nobody armed
+func NewDeadManSwitch() *DeadManSwitch {
+	return &DeadManSwitch{deadlines: make(map[int]time.Time)}
+}
+
+// Heartbeat arms or extends a user's switch to now plus timeout, or disarms it
+// with a zero timeout
+func (d *DeadManSwitch) Heartbeat(userID int, timeout time.Duration, now time.Time) time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if timeout == 0 {
+		delete(d.deadlines, userID)
+		return time.Time{}
+	}
+	deadline := now.Add(timeout)
+	d.deadlines[userID] = deadline
+	return deadline
+}
+
+// Expired disarms and returns the users whose deadline has passed
+func (d *DeadManSwitch) Expired(now time.Time) []int {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var users []int
+	for userID, deadline := range d.deadlines {
+		if now.After(deadline) {
+			users = append(users, userID)
+			delete(d.deadlines, userID)
+		}
+	}
+	sort.Ints(users)
+	return users
+}
+
+// triggerDeadMan cancels every order of the users whose switch has expired
+func (s *Server) triggerDeadMan(now time.Time) {
+	for _, userID := range s.deadman.Expired(now) {
+		s.mu.Lock()
+		cancelled, err := s.cancelAllOrders(userID, "")
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("[BATCH] Dead man's switch for user %d failed after cancelling %v: %v", userID, cancelled, err)
+			continue
+		}
+		log.Printf("[BATCH] Dead man's switch for user %d cancelled orders %v", userID, cancelled)
+	}
+}
+
+// RunDeadManSwitch checks for missed heartbeats every interval
+func (s *Server) RunDeadManSwitch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.triggerDeadMan(now)
+	}
+}
+
+// handleBatch serves /api/trade/batch/{create,cancel,replace}:
+// {"mode": "atomic" or "best_effort", "orders": [...]}. Atomic is the default.
+func (s *Server) handleBatch(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session := s.getSession(r)
+		if session == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Mode   string       `json:"mode"`
+			Orders []BatchOrder `json:"orders"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = "atomic"
+		}
+		if req.Mode != "atomic" && req.Mode != "best_effort" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "mode must be atomic or best_effort"})
+			return
+		}
+		if len(req.Orders) == 0 || len(req.Orders) > maxBatchOrders {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("A batch needs 1 to %d orders", maxBatchOrders)})
+			return
+		}
+
+		s.mu.Lock()
+		results, err := s.runBatch(session.UserID, action, req.Orders, req.Mode == "atomic")
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("[BATCH] Failed to run batch %s for user %d: %v", action, session.UserID, err)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to process batch"})
+			return
+		}
+
+		success := true
+		for _, result := range results {
+			success = success && result.Success
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": success,
+			"mode":    req.Mode,
+			"results": results,
+		})
+	}
+}
+
+// handleCancelAll cancels the user's open orders: {"market": "KCN-LTC", "side": "buy"}.
+// Both fields are optional.
+func (s *Server) handleCancelAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Market string `json:"market"`
+		Side   string `json:"side"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+	if req.Market != "" && req.Market != marketKCNLTC {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown market: " + req.Market})
+		return
+	}
+	if req.Side != "" && req.Side != "buy" && req.Side != "sell" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "side must be buy or sell"})
+		return
+	}
+
+	s.mu.Lock()
+	cancelled, err := s.cancelAllOrders(session.UserID, req.Side)
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("[BATCH] Cancel-all for user %d failed after cancelling %v: %v", session.UserID, cancelled, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   false,
+			"error":     "Failed to cancel every order",
+			"cancelled": cancelled,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"cancelled": cancelled,
+	})
+}
+
+// handleHeartbeat arms or extends the user's dead man's switch: {"timeout": seconds}.
+// Without another heartbeat within timeout every open order of the user is
+// cancelled. A timeout of 0 disarms the switch.
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if s.deadman == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Dead man's switch is not available"})
+		return
+	}
+
+	var req struct {
+		Timeout float64 `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+	timeout := time.Duration(req.Timeout * float64(time.Second))
+	if timeout != 0 && (timeout < minHeartbeatTimeout || timeout > maxHeartbeatTimeout) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("timeout must be 0 or between %v and %v seconds",
+			minHeartbeatTimeout.Seconds(), maxHeartbeatTimeout.Seconds())})
+		return
+	}
+
+	deadline := s.deadman.Heartbeat(session.UserID, timeout, time.Now())
+	resp := map[string]interface{}{"success": true, "armed": timeout != 0}
+	if timeout != 0 {
+		resp["cancel_at"] = deadline.UTC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdminUserRole sets a user's role, which decides their open order cap:
+// POST {"username", "role"}. GET lists the caps.
+func (s *Server) handleAdminUserRole(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Username string `json:"username"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.orderLimits[req.Role]; !ok && req.Role != defaultRole {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unknown role: " + req.Role})
+			return
+		}
+
+		s.mu.Lock()
+		result, err := s.db.Exec(`UPDATE users SET role = ? WHERE username = ?`, req.Role, req.Username)
+		s.mu.Unlock()
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				err = fmt.Errorf("unknown user %q", req.Username)
+			}
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("[BATCH] Admin %s gave %s the role %s", session.Username, req.Username, req.Role)
+	}
+
+	limits := map[string]int{defaultRole: defaultOpenOrderLimit}
+	for role, limit := range s.orderLimits {
+		limits[role] = limit
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"order_limits": limits})
+}
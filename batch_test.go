@@ -0,0 +1,183 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchOrdersAndDeadManSwitch(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	ex.server.orderLimits, _ = ParseOrderLimits("user=3,market_maker=10")
+	ex.server.deadman = NewDeadManSwitch()
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	admin := ex.newUser(t, "admin")
+	db.Exec(`UPDATE balances SET kernelcoin = 100, litecoin = 10`)
+
+	ask := func(kcn, ltc float64) BatchOrder {
+		return BatchOrder{CoinSelling: "kernelcoin", AmountSelling: kcn, CoinBuying: "litecoin", AmountBuying: ltc}
+	}
+	order := func(id int) *BookOrder {
+		t.Helper()
+		o, err := ex.server.getOrder(id)
+		if err != nil {
+			t.Fatalf("order %d: %v", id, err)
+		}
+		return o
+	}
+	type batchResponse struct {
+		Success bool          `json:"success"`
+		Results []BatchResult `json:"results"`
+	}
+	batch := func(user *testUser, action, mode string, orders ...BatchOrder) batchResponse {
+		t.Helper()
+		var resp batchResponse
+		user.post("/api/trade/batch/"+action, map[string]interface{}{"mode": mode, "orders": orders}, &resp)
+		if len(resp.Results) != len(orders) {
+			t.Fatalf("%s batch: %+v", action, resp)
+		}
+		return resp
+	}
+
+	// Four orders are over the cap of three, so an atomic batch places none
+	resp := batch(alice, "create", "", ask(10, 1), ask(10, 1.1), ask(10, 1.2), ask(10, 1.3))
+	if resp.Success || resp.Results[3].Code != errOrderLimit || resp.Results[0].Code != errBatchRejected {
+		t.Errorf("batch over the cap = %+v", resp)
+	}
+	assertAmount(t, "alice KCN after a rejected batch", alice.balance()["kernelcoin"], 100)
+
+	var roles struct {
+		OrderLimits map[string]int `json:"order_limits"`
+	}
+	admin.post("/api/admin/user-role", map[string]string{"username": "alice", "role": "market_maker"}, &roles)
+	if roles.OrderLimits["market_maker"] != 10 {
+		t.Fatalf("order limits = %v", roles.OrderLimits)
+	}
+	if resp := admin.call("/api/admin/user-role", map[string]string{"username": "alice", "role": "whale"}); resp["error"] == nil {
+		t.Errorf("unknown role accepted: %v", resp)
+	}
+
+	resp = batch(alice, "create", "atomic", ask(10, 1), ask(10, 1.1), ask(10, 1.2), ask(10, 1.3),
+		BatchOrder{CoinSelling: "litecoin", AmountSelling: 0.9, CoinBuying: "kernelcoin", AmountBuying: 10})
+	if !resp.Success {
+		t.Fatalf("batch as a market maker = %+v", resp)
+	}
+	assertAmount(t, "alice KCN in escrow", alice.balance()["kernelcoin"], 60)
+	ids := make([]int, len(resp.Results))
+	for i, result := range resp.Results {
+		ids[i] = int(result.TradeID)
+	}
+
+	// Balances count the orders before them in the batch
+	resp = batch(alice, "create", "atomic", ask(50, 5), ask(20, 2))
+	if resp.Success || resp.Results[1].Code != errInsufficientBalance {
+		t.Errorf("batch over the balance = %+v", resp)
+	}
+	resp = batch(alice, "create", "best_effort", ask(50, 5), ask(20, 2))
+	if resp.Success || !resp.Results[0].Success || resp.Results[1].Code != errInsufficientBalance {
+		t.Errorf("best effort batch = %+v", resp)
+	}
+	assertAmount(t, "alice KCN after best effort", alice.balance()["kernelcoin"], 10)
+
+	// A replace frees the old order's escrow for the new one
+	replace := ask(20, 2.2)
+	replace.TradeID = ids[0]
+	again := ask(10, 1.5)
+	again.TradeID = ids[0]
+	resp = batch(alice, "replace", "atomic", replace, again)
+	if resp.Success || resp.Results[1].Code != errOrderNotOpen {
+		t.Errorf("replacing one order twice = %+v", resp)
+	}
+	resp = batch(alice, "replace", "atomic", replace)
+	if !resp.Success || resp.Results[0].CancelledID != ids[0] || resp.Results[0].TradeID == 0 {
+		t.Fatalf("replace = %+v", resp)
+	}
+	replacement := order(int(resp.Results[0].TradeID))
+	assertAmount(t, "replacement price", replacement.Price, 0.11)
+	assertAmount(t, "replacement size", replacement.Size, 20)
+	assertAmount(t, "alice KCN after replace", alice.balance()["kernelcoin"], 0)
+
+	// Other users' orders cannot be cancelled
+	resp = batch(bob, "cancel", "best_effort", BatchOrder{TradeID: ids[1]})
+	if resp.Results[0].Code != errUnknownOrder || order(ids[1]).Status != "open" {
+		t.Errorf("bob cancelling alice's order = %+v", resp)
+	}
+	resp = batch(alice, "cancel", "atomic", BatchOrder{TradeID: ids[1]})
+	if !resp.Success {
+		t.Errorf("cancel = %+v", resp)
+	}
+
+	cancelled := alice.call("/api/trade/cancel-all", map[string]string{"market": marketKCNLTC, "side": "sell"})
+	if cancelled["success"] != true || len(cancelled["cancelled"].([]interface{})) != 4 {
+		t.Errorf("cancel-all sells = %v", cancelled)
+	}
+	if o := order(ids[4]); o.Status != "open" {
+		t.Errorf("bid after cancelling sells = %+v", o)
+	}
+	assertAmount(t, "alice KCN after cancel-all", alice.balance()["kernelcoin"], 100)
+
+	// Without a heartbeat in time the remaining bid is cancelled
+	if resp := alice.call("/api/trade/heartbeat", map[string]float64{"timeout": 1}); resp["error"] == nil {
+		t.Errorf("heartbeat with a 1s timeout: %v", resp)
+	}
+	if resp := alice.call("/api/trade/heartbeat", map[string]float64{"timeout": 5}); resp["armed"] != true {
+		t.Fatalf("heartbeat: %v", resp)
+	}
+	ex.server.triggerDeadMan(time.Now())
+	if o := order(ids[4]); o.Status != "open" {
+		t.Errorf("bid cancelled before the deadline")
+	}
+	ex.server.triggerDeadMan(time.Now().Add(10 * time.Second))
+	if o := order(ids[4]); o.Status != "cancelled" {
+		t.Errorf("bid after the deadline = %+v", o)
+	}
+	assertAmount(t, "alice LTC after the switch", alice.balance()["litecoin"], 10)
+}
+
+func TestOrderWritesFailClosed(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+
+	alice := ex.newUser(t, "alice")
+	db.Exec(`UPDATE balances SET kernelcoin = 100, litecoin = 10`)
+
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1,
+	})
+	if created["success"] != true {
+		t.Fatalf("create: %v", created)
+	}
+	tradeID := int(created["trade_id"].(float64))
+
+	// The replacement fails after the old order is cancelled, so the cancel is undone
+	if _, err := db.Exec(`CREATE TRIGGER fail_insert BEFORE INSERT ON trades
+		BEGIN SELECT RAISE(ABORT, 'insert failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	replace := BatchOrder{TradeID: tradeID, CoinSelling: "kernelcoin", AmountSelling: 20, CoinBuying: "litecoin", AmountBuying: 2}
+	for _, mode := range []string{"atomic", "best_effort"} {
+		resp := alice.call("/api/trade/batch/replace", map[string]interface{}{"mode": mode, "orders": []BatchOrder{replace}})
+		if resp["error"] == nil {
+			t.Errorf("%s replace with a failing insert = %v", mode, resp)
+		}
+	}
+	if o, err := ex.server.getOrder(tradeID); err != nil || o.Status != "open" {
+		t.Errorf("order after a failed replace = %+v, %v", o, err)
+	}
+	assertAmount(t, "alice KCN after a failed replace", alice.balance()["kernelcoin"], 90)
+	db.Exec(`DROP TRIGGER fail_insert`)
+
+	// Without the user's role the open order cap is unknown, so no order is placed
+	if _, err := db.Exec(`ALTER TABLE users RENAME COLUMN role TO old_role`); err != nil {
+		t.Fatal(err)
+	}
+	resp := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1,
+	})
+	if resp["success"] == true || resp["error"] == nil {
+		t.Errorf("create without an order limit = %v", resp)
+	}
+	assertAmount(t, "alice KCN after a refused order", alice.balance()["kernelcoin"], 90)
+}
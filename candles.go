@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// candleIntervals are the rollups kept for every market, shortest first
+var candleIntervals = []struct {
+	name    string
+	seconds int64
+}{
+	{"1m", 60},
+	{"5m", 5 * 60},
+	{"1h", 60 * 60},
+	{"1d", 24 * 60 * 60},
+}
+
+// Limits for /api/candles
+const (
+	defaultCandles = 300
+	maxCandles     = 1000
+)
+
+// Candle is the trading in one interval. Time is the interval's start in Unix
+// seconds, prices are LTC per KCN, Volume is in KCN and QuoteVolume in LTC.
+type Candle struct {
+	Time        int64   `json:"time"`
+	Open        float64 `json:"open"`
+	High        float64 `json:"high"`
+	Low         float64 `json:"low"`
+	Close       float64 `json:"close"`
+	Volume      float64 `json:"volume"`
+	QuoteVolume float64 `json:"quote_volume"`
+	Trades      int     `json:"trades"`
+}
+
+// Ticker summarises the last 24 hours of a market. Change is against the last
+// price 24 hours ago, or the first trade since then if there was none before.
+type Ticker struct {
+	Market        string  `json:"market"`
+	Last          float64 `json:"last"`
+	High          float64 `json:"high"`
+	Low           float64 `json:"low"`
+	Volume        float64 `json:"volume"`
+	QuoteVolume   float64 `json:"quote_volume"`
+	Change        float64 `json:"change"`
+	ChangePercent float64 `json:"change_percent"`
+	Trades        int     `json:"trades"`
+}
+
+// Candles rolls trade_completions up into OHLCV candles stored in the database
+type Candles struct {
+	db *sql.DB
+}
+
+// NewCandles creates a candle aggregator
+func NewCandles(db *sql.DB) *Candles {
+	return &Candles{db: db}
+}
+
+// candleInterval returns the length of a named interval in seconds
+func candleInterval(name string) (int64, bool) {
+	for _, interval := range candleIntervals {
+		if interval.name == name {
+			return interval.seconds, true
+		}
+	}
+	return 0, false
+}
+
+// Rollup adds every fill not yet counted to the candles. It runs after each fill and
+// at startup, which also builds candles for trades made before they existed.
+func (c *Candles) Rollup() error {
+	if c == nil {
+		return nil
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(last_completion_id), 0) FROM candle_rollups WHERE market = ?`, marketKCNLTC).Scan(&last)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT tc.id, CAST(strftime('%s', tc.completed_at) AS INTEGER), `+fillPriceSQL+`, tc.quantity
+		FROM trade_completions tc
+		JOIN trades t ON t.id = tc.trade_id
+		WHERE tc.id > ?
+		ORDER BY tc.id
+	`, last)
+	if err != nil {
+		return err
+	}
+	type fill struct {
+		id, at      int64
+		price, size float64
+	}
+	var fills []fill
+	for rows.Next() {
+		var f fill
+		if err := rows.Scan(&f.id, &f.at, &f.price, &f.size); err != nil {
+			rows.Close()
+			return err
+		}
+		fills = append(fills, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(fills) == 0 {
+		return nil
+	}
+
+	for _, f := range fills {
+		for _, interval := range candleIntervals {
+			start := f.at - f.at%interval.seconds
+			_, err := tx.Exec(`
+				INSERT INTO candles (market, interval, start, open, high, low, close, volume, quote_volume, trades)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+				ON CONFLICT(market, interval, start) DO UPDATE SET
+					high = MAX(high, excluded.high),
+					low = MIN(low, excluded.low),
+					close = excluded.close,
+					volume = volume + excluded.volume,
+					quote_volume = quote_volume + excluded.quote_volume,
+					trades = trades + 1
+			`, marketKCNLTC, interval.name, start, f.price, f.price, f.price, f.price, f.size, f.size*f.price)
+			if err != nil {
+				return err
+			}
+		}
+		last = f.id
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO candle_rollups (market, last_completion_id) VALUES (?, ?)
+		ON CONFLICT(market) DO UPDATE SET last_completion_id = excluded.last_completion_id
+	`, marketKCNLTC, last)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Range returns the candles of an interval that start in [from, to], oldest first.
+// Intervals without trades are left out.
+func (c *Candles) Range(interval string, from, to int64) ([]Candle, error) {
+	rows, err := c.db.Query(`
+		SELECT start, open, high, low, close, volume, quote_volume, trades
+		FROM candles
+		WHERE market = ? AND interval = ? AND start >= ? AND start <= ?
+		ORDER BY start
+		LIMIT ?
+	`, marketKCNLTC, interval, from, to, maxCandles)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candles := []Candle{}
+	for rows.Next() {
+		var candle Candle
+		if err := rows.Scan(&candle.Time, &candle.Open, &candle.High, &candle.Low, &candle.Close, &candle.Volume, &candle.QuoteVolume, &candle.Trades); err != nil {
+			return nil, err
+		}
+		candles = append(candles, candle)
+	}
+	return candles, rows.Err()
+}
+
+// LastPrice returns the price of the latest fill, or 0 before the first one
+func (c *Candles) LastPrice() (float64, error) {
+	var last float64
+	err := c.db.QueryRow(`
+		SELECT close FROM candles WHERE market = ? AND interval = '1m' ORDER BY start DESC LIMIT 1
+	`, marketKCNLTC).Scan(&last)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return last, err
+}
+
+// Ticker summarises the 24 hours before now from the 1m candles
+func (c *Candles) Ticker(now time.Time) (*Ticker, error) {
+	ticker := &Ticker{Market: marketKCNLTC}
+
+	last, err := c.LastPrice()
+	if err != nil || last == 0 {
+		return ticker, err
+	}
+	ticker.Last = last
+
+	// Aggregated in SQL: a day is 1440 1m candles, more than Range returns
+	since := now.Unix() - 24*60*60
+	since -= since % 60
+	var count int64
+	var high, low, volume, quoteVolume, open sql.NullFloat64
+	var trades sql.NullInt64
+	err = c.db.QueryRow(`
+		SELECT COUNT(*), MAX(high), MIN(low), SUM(volume), SUM(quote_volume), SUM(trades),
+			(SELECT open FROM candles WHERE market = ? AND interval = '1m' AND start >= ? AND start <= ? ORDER BY start LIMIT 1)
+		FROM candles
+		WHERE market = ? AND interval = '1m' AND start >= ? AND start <= ?
+	`, marketKCNLTC, since, now.Unix(), marketKCNLTC, since, now.Unix()).
+		Scan(&count, &high, &low, &volume, &quoteVolume, &trades, &open)
+	if err != nil {
+		return nil, err
+	}
+
+	var reference float64
+	err = c.db.QueryRow(`
+		SELECT close FROM candles WHERE market = ? AND interval = '1m' AND start < ? ORDER BY start DESC LIMIT 1
+	`, marketKCNLTC, since).Scan(&reference)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if count > 0 {
+		ticker.High, ticker.Low = high.Float64, low.Float64
+		ticker.Volume, ticker.QuoteVolume = volume.Float64, quoteVolume.Float64
+		ticker.Trades = int(trades.Int64)
+		if reference == 0 {
+			reference = open.Float64
+		}
+	}
+
+	if reference > 0 {
+		ticker.Change = ticker.Last - reference
+		ticker.ChangePercent = ticker.Change / reference * 100
+	}
+	return ticker, nil
+}
+
+// rollupCandles counts a new fill in the candles. A failure is only logged: the fill
+// stands and the next rollup picks it up. Caller must hold s.mu.
+func (s *Server) rollupCandles() {
+	if err := s.candles.Rollup(); err != nil {
+		log.Printf("[CANDLES] Rollup failed: %v", err)
+	}
+}
+
+// handleGetCandles returns candles: /api/candles?interval=1h&from=<unix>&to=<unix>.
+// to defaults to now and from to 300 intervals before to.
+func (s *Server) handleGetCandles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("interval")
+	if name == "" {
+		name = "1h"
+	}
+	seconds, ok := candleInterval(name)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "interval must be one of 1m, 5m, 1h, 1d"})
+		return
+	}
+	if market := query.Get("market"); market != "" && market != marketKCNLTC {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown market: " + market})
+		return
+	}
+
+	to := time.Now().Unix()
+	if v := query.Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "to must be a Unix time in seconds"})
+			return
+		}
+		to = n
+	}
+	from := to - defaultCandles*seconds
+	if v := query.Get("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "from must be a Unix time in seconds"})
+			return
+		}
+		from = n
+	}
+	if from > to {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "from must not be after to"})
+		return
+	}
+	if (to-from)/seconds >= maxCandles {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("At most %d candles per request", maxCandles)})
+		return
+	}
+
+	s.mu.RLock()
+	candles, err := s.candles.Range(name, from-from%seconds, to)
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[CANDLES] Failed to load %s candles: %v", name, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load candles"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"market":   marketKCNLTC,
+		"interval": name,
+		"candles":  candles,
+	})
+}
+
+// handleGetTicker returns the 24h ticker
+func (s *Server) handleGetTicker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if market := r.URL.Query().Get("market"); market != "" && market != marketKCNLTC {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown market: " + market})
+		return
+	}
+
+	s.mu.RLock()
+	ticker, err := s.candles.Ticker(time.Now())
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[CANDLES] Failed to build ticker: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load ticker"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticker)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// addFill records a fill at price and time directly in the database
+func addFill(t *testing.T, db *sql.DB, price, quantity float64, at time.Time) {
+	t.Helper()
+
+	result, err := db.Exec(`INSERT INTO trades (seller_id, coin_selling, amount_selling, coin_buying, amount_buying, price_per_unit, status)
+		VALUES (1, 'kernelcoin', ?, 'litecoin', ?, ?, 'completed')`, quantity, quantity*price, price)
+	if err != nil {
+		t.Fatalf("insert trade: %v", err)
+	}
+	tradeID, _ := result.LastInsertId()
+	_, err = db.Exec(`INSERT INTO trade_completions (trade_id, buyer_id, quantity, completed_at) VALUES (?, 2, ?, ?)`,
+		tradeID, quantity, at.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		t.Fatalf("insert completion: %v", err)
+	}
+}
+
+func TestCandleRollups(t *testing.T) {
+	db := newTestDB(t)
+	candles := NewCandles(db)
+	hour := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	addFill(t, db, 0.10, 5, hour.Add(10*time.Second))
+	addFill(t, db, 0.12, 1, hour.Add(40*time.Second))
+	addFill(t, db, 0.09, 2, hour.Add(50*time.Second))
+	if err := candles.Rollup(); err != nil {
+		t.Fatalf("rollup: %v", err)
+	}
+	addFill(t, db, 0.11, 4, hour.Add(6*time.Minute))
+	if err := candles.Rollup(); err != nil {
+		t.Fatalf("second rollup: %v", err)
+	}
+	// Nothing new: a rollup must not count fills twice
+	if err := candles.Rollup(); err != nil {
+		t.Fatalf("empty rollup: %v", err)
+	}
+
+	minutes, err := candles.Range("1m", hour.Unix(), hour.Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	if len(minutes) != 2 {
+		t.Fatalf("1m candles = %+v, want 2", minutes)
+	}
+	first := minutes[0]
+	if first.Time != hour.Unix() || first.Open != 0.10 || first.High != 0.12 || first.Low != 0.09 || first.Close != 0.09 || first.Trades != 3 {
+		t.Errorf("first minute = %+v", first)
+	}
+	assertAmount(t, "first minute volume", first.Volume, 8)
+	assertAmount(t, "first minute quote volume", first.QuoteVolume, 0.5+0.12+0.18)
+
+	fives, _ := candles.Range("5m", hour.Unix(), hour.Add(time.Hour).Unix())
+	if len(fives) != 2 || fives[1].Time != hour.Add(5*time.Minute).Unix() {
+		t.Errorf("5m candles = %+v, want 12:00 and 12:05", fives)
+	}
+	hours, _ := candles.Range("1h", hour.Unix(), hour.Unix())
+	if len(hours) != 1 || hours[0].Open != 0.10 || hours[0].Close != 0.11 || hours[0].Trades != 4 {
+		t.Errorf("1h candles = %+v", hours)
+	}
+	assertAmount(t, "hour volume", hours[0].Volume, 12)
+}
+
+func TestTicker(t *testing.T) {
+	db := newTestDB(t)
+	candles := NewCandles(db)
+	now := time.Date(2026, 3, 2, 12, 0, 30, 0, time.UTC)
+
+	ticker, err := candles.Ticker(now)
+	if err != nil || ticker.Last != 0 || ticker.Trades != 0 {
+		t.Fatalf("ticker with no trades = %+v, %v", ticker, err)
+	}
+
+	addFill(t, db, 0.08, 10, now.Add(-30*time.Hour)) // before the window: the reference price
+	addFill(t, db, 0.09, 1, now.Add(-20*time.Hour))
+	addFill(t, db, 0.12, 2, now.Add(-2*time.Hour))
+	addFill(t, db, 0.10, 3, now.Add(-time.Minute))
+	if err := candles.Rollup(); err != nil {
+		t.Fatalf("rollup: %v", err)
+	}
+
+	ticker, err = candles.Ticker(now)
+	if err != nil {
+		t.Fatalf("ticker: %v", err)
+	}
+	if ticker.Last != 0.10 || ticker.High != 0.12 || ticker.Low != 0.09 || ticker.Trades != 3 {
+		t.Errorf("ticker = %+v", ticker)
+	}
+	assertAmount(t, "24h volume", ticker.Volume, 6)
+	assertAmount(t, "change", ticker.Change, 0.02)
+	assertAmount(t, "change percent", ticker.ChangePercent, 25)
+}
+
+func TestTickerCoversAFullDayOfMinutes(t *testing.T) {
+	db := newTestDB(t)
+	candles := NewCandles(db)
+	now := time.Date(2026, 3, 2, 12, 0, 30, 0, time.UTC)
+
+	// A trade every minute for a day is 1440 candles, more than Range returns
+	tx, _ := db.Begin()
+	first := now.Unix() - now.Unix()%60 - 1439*60
+	for i := int64(0); i < 1440; i++ {
+		price := 0.10
+		if i == 1439 {
+			price = 0.20 // the newest minute holds the day's high
+		}
+		if _, err := tx.Exec(`INSERT INTO candles (market, interval, start, open, high, low, close, volume, quote_volume, trades)
+			VALUES (?, '1m', ?, ?, ?, ?, ?, 1, ?, 1)`, marketKCNLTC, first+i*60, price, price, price, price, price); err != nil {
+			t.Fatalf("insert candle: %v", err)
+		}
+	}
+	tx.Commit()
+
+	ticker, err := candles.Ticker(now)
+	if err != nil {
+		t.Fatalf("ticker: %v", err)
+	}
+	if ticker.Last != 0.20 || ticker.High != 0.20 || ticker.Low != 0.10 || ticker.Trades != 1440 {
+		t.Errorf("ticker = %+v", ticker)
+	}
+	assertAmount(t, "24h volume", ticker.Volume, 1440)
+	assertAmount(t, "change percent", ticker.ChangePercent, 100)
+}
+
+func TestCandlesEndpoint(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 50, litecoin = 5`)
+
+	// A fill through the API shows up in the candles and the ticker straight away
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1,
+	})
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 10}); resp["success"] != true {
+		t.Fatalf("execute trade: %v", resp)
+	}
+
+	var resp struct {
+		Interval string   `json:"interval"`
+		Candles  []Candle `json:"candles"`
+	}
+	bob.get("/api/candles?interval=1m", &resp)
+	if len(resp.Candles) != 1 || resp.Candles[0].Close != 0.1 || resp.Candles[0].Volume != 10 {
+		t.Fatalf("candles = %+v", resp)
+	}
+
+	var ticker Ticker
+	bob.get("/api/ticker", &ticker)
+	if ticker.Last != 0.1 || ticker.Volume != 10 {
+		t.Errorf("ticker = %+v", ticker)
+	}
+
+	for _, query := range []string{"interval=2m", "interval=1m&from=10&to=5", fmt.Sprintf("interval=1m&from=0&to=%d", time.Now().Unix())} {
+		var failed map[string]interface{}
+		bob.get("/api/candles?"+query, &failed)
+		if failed["error"] == nil {
+			t.Errorf("/api/candles?%s = %v, want an error", query, failed)
+		}
+	}
+}
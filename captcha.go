@@ -1,35 +1,240 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/bits"
 	"sync"
 	"time"
 
+	"github.com/wenlng/go-captcha-assets/resources/images"
 	"github.com/wenlng/go-captcha-assets/resources/imagesv2"
+	"github.com/wenlng/go-captcha-assets/resources/shapes"
 	"github.com/wenlng/go-captcha-assets/resources/tiles"
+	"github.com/wenlng/go-captcha/v2/base/option"
+	"github.com/wenlng/go-captcha/v2/click"
+	"github.com/wenlng/go-captcha/v2/rotate"
 	"github.com/wenlng/go-captcha/v2/slide"
 )
 
+var (
+	// errCaptchaLimit is returned when an IP already has too many unsolved challenges
+	errCaptchaLimit = errors.New("too many outstanding captchas")
+	// errCaptchaLocked is returned when an IP has failed too many challenges recently
+	errCaptchaLocked = errors.New("too many failed captcha attempts")
+)
+
+// Challenge produces captcha puzzles of one kind and checks answers to them.
+// Implementations must never put the answer in the public data.
+type Challenge interface {
+	Kind() string
+	// Generate returns the data sent to the client and the answer kept on the server
+	Generate() (public map[string]interface{}, answer interface{}, err error)
+	// Verify checks a client's response against the stored answer
+	Verify(answer interface{}, response json.RawMessage) bool
+}
+
+// CaptchaConfig controls challenge lifetime and abuse limits
+type CaptchaConfig struct {
+	TTL           time.Duration
+	MaxPerIP      int
+	MaxFailures   int
+	FailureWindow time.Duration
+}
+
+// CaptchaService issues challenges and validates answers
 type CaptchaService struct {
-	captcha  slide.Captcha
-	sessions map[string]*CaptchaSession
-	mu       sync.RWMutex
+	challenge   Challenge
+	config      CaptchaConfig
+	sessions    map[string]*CaptchaSession
+	outstanding map[string]int
+	failures    map[string]*captchaFailures
+	mu          sync.RWMutex
 }
 
+// CaptchaSession is an unsolved challenge awaiting an answer
 type CaptchaSession struct {
-	Data   *slide.Block
+	Answer interface{}
+	IP     string
 	Expiry time.Time
 }
 
-type CaptchaResponse struct {
-	CaptchaID   string `json:"captcha_id"`
-	MasterImage string `json:"master_image"`
-	TileImage   string `json:"tile_image"`
-	TileX       int    `json:"tile_x"`
-	TileY       int    `json:"tile_y"`
+// captchaFailures counts failed answers from one IP within the failure window
+type captchaFailures struct {
+	count int
+	since time.Time
+}
+
+// CaptchaFields are the captcha answer fields accepted by protected endpoints.
+// captcha_x/captcha_y are kept for older slide clients.
+type CaptchaFields struct {
+	CaptchaID     string          `json:"captcha_id"`
+	CaptchaAnswer json.RawMessage `json:"captcha_answer"`
+	CaptchaX      int             `json:"captcha_x"`
+	CaptchaY      int             `json:"captcha_y"`
+}
+
+// answer returns the client's response in the generic JSON form
+func (c CaptchaFields) answer() json.RawMessage {
+	if len(c.CaptchaAnswer) > 0 {
+		return c.CaptchaAnswer
+	}
+	legacy, _ := json.Marshal(map[string]int{"x": c.CaptchaX, "y": c.CaptchaY})
+	return legacy
+}
+
+// NewCaptchaService creates a captcha service for the given challenge type
+func NewCaptchaService(challenge Challenge, config CaptchaConfig) *CaptchaService {
+	return &CaptchaService{
+		challenge:   challenge,
+		config:      config,
+		sessions:    make(map[string]*CaptchaSession),
+		outstanding: make(map[string]int),
+		failures:    make(map[string]*captchaFailures),
+	}
+}
+
+// NewChallenge builds the challenge implementation named by kind
+func NewChallenge(kind string, tolerance, powDifficulty int) (Challenge, error) {
+	switch kind {
+	case "slide":
+		return NewSlideChallenge(tolerance), nil
+	case "click":
+		return NewClickChallenge(tolerance), nil
+	case "rotate":
+		return NewRotateChallenge(tolerance), nil
+	case "pow":
+		return NewProofOfWorkChallenge(powDifficulty), nil
+	default:
+		return nil, fmt.Errorf("unknown captcha kind %q", kind)
+	}
+}
+
+// Kind returns the type of challenge being issued
+func (cs *CaptchaService) Kind() string {
+	return cs.challenge.Kind()
+}
+
+// GenerateCaptcha issues a new challenge for the client at ip
+func (cs *CaptchaService) GenerateCaptcha(ip string) (map[string]interface{}, error) {
+	cs.mu.Lock()
+	if f, ok := cs.failures[ip]; ok && f.count >= cs.config.MaxFailures && time.Since(f.since) < cs.config.FailureWindow {
+		cs.mu.Unlock()
+		return nil, errCaptchaLocked
+	}
+	if cs.outstanding[ip] >= cs.config.MaxPerIP {
+		cs.mu.Unlock()
+		return nil, errCaptchaLimit
+	}
+	// Reserve the slot before the (slow) image generation so concurrent requests cannot overshoot
+	cs.outstanding[ip]++
+	cs.mu.Unlock()
+
+	public, answer, err := cs.challenge.Generate()
+	if err == nil && answer == nil {
+		err = errors.New("challenge generated no answer")
+	}
+	var sessionID string
+	if err == nil {
+		sessionID, err = generateSessionToken()
+	}
+	if err != nil {
+		cs.mu.Lock()
+		cs.release(ip)
+		cs.mu.Unlock()
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	cs.sessions[sessionID] = &CaptchaSession{
+		Answer: answer,
+		IP:     ip,
+		Expiry: time.Now().Add(cs.config.TTL),
+	}
+	cs.mu.Unlock()
+
+	log.Printf("[CAPTCHA] Generated %s challenge - ID: %s", cs.challenge.Kind(), sessionID)
+
+	public["captcha_id"] = sessionID
+	public["kind"] = cs.challenge.Kind()
+	return public, nil
+}
+
+// release frees an outstanding slot for ip. Caller must hold cs.mu.
+func (cs *CaptchaService) release(ip string) {
+	cs.outstanding[ip]--
+	if cs.outstanding[ip] <= 0 {
+		delete(cs.outstanding, ip)
+	}
+}
+
+// ValidateCaptcha checks an answer from the client at ip. Every challenge is single-use.
+func (cs *CaptchaService) ValidateCaptcha(captchaID, ip string, response json.RawMessage) bool {
+	cs.mu.Lock()
+	session, exists := cs.sessions[captchaID]
+	if exists {
+		delete(cs.sessions, captchaID)
+		cs.release(session.IP)
+	}
+	cs.mu.Unlock()
+
+	isValid := exists && !session.Expiry.Before(time.Now()) && cs.challenge.Verify(session.Answer, response)
+	log.Printf("[CAPTCHA] Validation result for ID %s: %v", captchaID, isValid)
+
+	if !isValid {
+		cs.mu.Lock()
+		f, ok := cs.failures[ip]
+		if !ok || time.Since(f.since) >= cs.config.FailureWindow {
+			f = &captchaFailures{since: time.Now()}
+			cs.failures[ip] = f
+		}
+		f.count++
+		cs.mu.Unlock()
+	}
+	return isValid
+}
+
+// CleanupExpired removes expired challenges and stale failure counters
+func (cs *CaptchaService) CleanupExpired() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range cs.sessions {
+		if session.Expiry.Before(now) {
+			delete(cs.sessions, id)
+			cs.release(session.IP)
+		}
+	}
+	for ip, f := range cs.failures {
+		if now.Sub(f.since) >= cs.config.FailureWindow {
+			delete(cs.failures, ip)
+		}
+	}
+}
+
+// RunSweeper periodically removes expired challenges
+func (cs *CaptchaService) RunSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cs.CleanupExpired()
+	}
 }
 
-func NewCaptchaService() *CaptchaService {
+// SlideChallenge asks the user to drag a puzzle piece into its gap
+type SlideChallenge struct {
+	captcha   slide.Captcha
+	tolerance int
+}
+
+// NewSlideChallenge creates a drag-and-drop slide challenge
+func NewSlideChallenge(tolerance int) *SlideChallenge {
 	builder := slide.NewBuilder(
 		slide.WithGenGraphNumber(1),
 	)
@@ -62,88 +267,258 @@ func NewCaptchaService() *CaptchaService {
 		slide.WithBackgrounds(imgs),
 	)
 
-	return &CaptchaService{
-		captcha:  builder.MakeDragDrop(),
-		sessions: make(map[string]*CaptchaSession),
+	return &SlideChallenge{captcha: builder.MakeDragDrop(), tolerance: tolerance}
+}
+
+func (c *SlideChallenge) Kind() string { return "slide" }
+
+func (c *SlideChallenge) Generate() (map[string]interface{}, interface{}, error) {
+	captData, err := c.captcha.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block := captData.GetData()
+	if block == nil {
+		return nil, nil, errors.New("slide captcha returned no data")
+	}
+
+	masterBase64, err := captData.GetMasterImage().ToBase64()
+	if err != nil {
+		return nil, nil, err
+	}
+	tileBase64, err := captData.GetTileImage().ToBase64()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only the tile's starting position is sent; its target position is the answer
+	return map[string]interface{}{
+		"master_image": masterBase64,
+		"tile_image":   tileBase64,
+		"tile_width":   block.Width,
+		"tile_height":  block.Height,
+		"start_x":      block.DX,
+		"start_y":      block.DY,
+	}, block, nil
+}
+
+func (c *SlideChallenge) Verify(answer interface{}, response json.RawMessage) bool {
+	block, ok := answer.(*slide.Block)
+	if !ok {
+		return false
+	}
+	var pos struct {
+		X int `json:"x"`
+		Y int `json:"y"`
 	}
+	if err := json.Unmarshal(response, &pos); err != nil {
+		return false
+	}
+	return slide.Validate(pos.X, pos.Y, block.X, block.Y, c.tolerance)
+}
+
+// ClickChallenge asks the user to click shapes in the order shown in a thumbnail
+type ClickChallenge struct {
+	captcha   click.Captcha
+	tolerance int
 }
 
-func (cs *CaptchaService) GenerateCaptcha() (*CaptchaResponse, error) {
-	captData, err := cs.captcha.Generate()
+// NewClickChallenge creates a click-the-shapes challenge
+func NewClickChallenge(tolerance int) *ClickChallenge {
+	builder := click.NewBuilder(
+		click.WithRangeLen(option.RangeVal{Min: 3, Max: 5}),
+		click.WithRangeVerifyLen(option.RangeVal{Min: 2, Max: 3}),
+	)
+
+	imgs, err := imagesv2.GetImages()
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to load captcha images: %v", err)
 	}
 
-	dotData := captData.GetData()
-	if dotData == nil {
-		return nil, err
+	shapeMaps, err := shapes.GetShapes()
+	if err != nil {
+		log.Fatalf("Failed to load captcha shapes: %v", err)
 	}
 
-	// Generate session ID
-	sessionID, err := generateSessionToken()
+	builder.SetResources(
+		click.WithShapes(shapeMaps),
+		click.WithBackgrounds(imgs),
+	)
+
+	return &ClickChallenge{captcha: builder.MakeWithShape(), tolerance: tolerance}
+}
+
+func (c *ClickChallenge) Kind() string { return "click" }
+
+func (c *ClickChallenge) Generate() (map[string]interface{}, interface{}, error) {
+	captData, err := c.captcha.Generate()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Store captcha data
-	cs.mu.Lock()
-	cs.sessions[sessionID] = &CaptchaSession{
-		Data:   dotData,
-		Expiry: time.Now().Add(5 * time.Minute),
+	dots := captData.GetData()
+	if len(dots) == 0 {
+		return nil, nil, errors.New("click captcha returned no data")
 	}
-	cs.mu.Unlock()
 
-	// Get base64 images
 	masterBase64, err := captData.GetMasterImage().ToBase64()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	thumbBase64, err := captData.GetThumbImage().ToBase64()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	tileBase64, err := captData.GetTileImage().ToBase64()
+	return map[string]interface{}{
+		"master_image": masterBase64,
+		"thumb_image":  thumbBase64,
+		"count":        len(dots),
+	}, dots, nil
+}
+
+func (c *ClickChallenge) Verify(answer interface{}, response json.RawMessage) bool {
+	dots, ok := answer.(map[int]*click.Dot)
+	if !ok {
+		return false
+	}
+	var resp struct {
+		Points []struct {
+			X int `json:"x"`
+			Y int `json:"y"`
+		} `json:"points"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil || len(resp.Points) != len(dots) {
+		return false
+	}
+	for i, p := range resp.Points {
+		dot, ok := dots[i]
+		if !ok || !click.Validate(p.X, p.Y, dot.X, dot.Y, dot.Width, dot.Height, c.tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// RotateChallenge asks the user to rotate a thumbnail until it lines up with the image
+type RotateChallenge struct {
+	captcha   rotate.Captcha
+	tolerance int
+}
+
+// NewRotateChallenge creates a rotate-to-align challenge
+func NewRotateChallenge(tolerance int) *RotateChallenge {
+	imgs, err := images.GetImages()
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to load captcha images: %v", err)
 	}
 
-	log.Printf("[CAPTCHA] Generated puzzle - ID: %s", sessionID)
+	builder := rotate.NewBuilder()
+	builder.SetResources(
+		rotate.WithImages(imgs),
+	)
 
-	return &CaptchaResponse{
-		CaptchaID:   sessionID,
-		MasterImage: masterBase64,
-		TileImage:   tileBase64,
-		TileX:       dotData.X,
-		TileY:       dotData.Y,
-	}, nil
+	return &RotateChallenge{captcha: builder.Make(), tolerance: tolerance}
 }
 
-func (cs *CaptchaService) ValidateCaptcha(captchaID string, userX, userY int) bool {
-	cs.mu.RLock()
-	session, exists := cs.sessions[captchaID]
-	cs.mu.RUnlock()
+func (c *RotateChallenge) Kind() string { return "rotate" }
+
+func (c *RotateChallenge) Generate() (map[string]interface{}, interface{}, error) {
+	captData, err := c.captcha.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block := captData.GetData()
+	if block == nil {
+		return nil, nil, errors.New("rotate captcha returned no data")
+	}
+
+	masterBase64, err := captData.GetMasterImage().ToBase64()
+	if err != nil {
+		return nil, nil, err
+	}
+	thumbBase64, err := captData.GetThumbImage().ToBase64()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return map[string]interface{}{
+		"master_image": masterBase64,
+		"thumb_image":  thumbBase64,
+		"thumb_size":   block.Width,
+	}, block, nil
+}
 
-	if !exists || session.Expiry.Before(time.Now()) {
+func (c *RotateChallenge) Verify(answer interface{}, response json.RawMessage) bool {
+	block, ok := answer.(*rotate.Block)
+	if !ok {
 		return false
 	}
+	var resp struct {
+		Angle int `json:"angle"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil {
+		return false
+	}
+	return rotate.Validate(resp.Angle, block.Angle, c.tolerance)
+}
 
-	// Clean up session
-	cs.mu.Lock()
-	delete(cs.sessions, captchaID)
-	cs.mu.Unlock()
+// ProofOfWorkChallenge asks the client to find a nonce such that
+// SHA-256(prefix + nonce) starts with the required number of zero bits.
+// It needs no user interaction and has no images to solve automatically.
+type ProofOfWorkChallenge struct {
+	difficulty int
+}
 
-	// Validate with padding tolerance
-	log.Printf("[CAPTCHA] Validating puzzle - ID: %s, Expected: X=%d, Y=%d | Received: X=%d, Y=%d", captchaID, session.Data.X, session.Data.Y, userX, userY)
-	isValid := slide.Validate(userX, userY, session.Data.X, session.Data.Y, 10)
-	log.Printf("[CAPTCHA] Validation result for ID %s: %v (tolerance: 10px)", captchaID, isValid)
-	return isValid
+// powAnswer is the server-side record of a proof-of-work challenge
+type powAnswer struct {
+	prefix     string
+	difficulty int
 }
 
-func (cs *CaptchaService) CleanupExpired() {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+// NewProofOfWorkChallenge creates a proof-of-work challenge of the given difficulty in bits
+func NewProofOfWorkChallenge(difficulty int) *ProofOfWorkChallenge {
+	return &ProofOfWorkChallenge{difficulty: difficulty}
+}
 
-	now := time.Now()
-	for id, session := range cs.sessions {
-		if session.Expiry.Before(now) {
-			delete(cs.sessions, id)
+func (c *ProofOfWorkChallenge) Kind() string { return "pow" }
+
+func (c *ProofOfWorkChallenge) Generate() (map[string]interface{}, interface{}, error) {
+	prefix := make([]byte, 16)
+	if _, err := randRead(prefix); err != nil {
+		return nil, nil, err
+	}
+	answer := &powAnswer{prefix: hex.EncodeToString(prefix), difficulty: c.difficulty}
+	return map[string]interface{}{
+		"prefix":     answer.prefix,
+		"difficulty": answer.difficulty,
+	}, answer, nil
+}
+
+func (c *ProofOfWorkChallenge) Verify(answer interface{}, response json.RawMessage) bool {
+	pow, ok := answer.(*powAnswer)
+	if !ok {
+		return false
+	}
+	var resp struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil || resp.Nonce == "" || len(resp.Nonce) > 64 {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(pow.prefix+resp.Nonce))) >= pow.difficulty
+}
+
+// leadingZeroBits counts the zero bits at the start of a hash
+func leadingZeroBits(hash [32]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
 		}
+		n += 8
 	}
+	return n
 }
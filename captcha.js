@@ -1,4 +1,4 @@
-class SlideCaptcha {
+class Captcha {
     constructor(containerId) {
         this.container = document.getElementById(containerId);
         this.captchaData = null;
@@ -10,6 +10,9 @@ class SlideCaptcha {
         this.currentY = 0;
         this.tile = null;
         this.puzzle = null;
+        this.clickPoints = [];
+        this.rotateAngle = 0;
+        this.powNonce = null;
         
         this.init();
     }
@@ -18,25 +21,48 @@ class SlideCaptcha {
         try {
             await this.loadCaptcha();
             this.render();
-            this.bindEvents();
         } catch (error) {
             console.error('Failed to initialize captcha:', error);
-            this.showError('Failed to load captcha');
+            this.showError(error.message || 'Failed to load captcha');
         }
     }
 
     async loadCaptcha() {
         const response = await fetch('/api/captcha/generate');
-        if (!response.ok) {
-            throw new Error('Failed to generate captcha');
+        const data = await response.json();
+        if (!response.ok || data.error) {
+            throw new Error(data.error || 'Failed to generate captcha');
         }
-        this.captchaData = await response.json();
+        this.captchaData = data;
         this.isCompleted = false;
-        // Reset register button when loading new captcha
+        this.clickPoints = [];
+        this.rotateAngle = 0;
+        this.powNonce = null;
+        // Reset submit button when loading new captcha
         this.updateRegisterButton(false);
     }
 
+    /**
+     * Render the challenge type chosen by the server
+     */
     render() {
+        switch (this.captchaData.kind) {
+            case 'click':
+                this.renderClick();
+                break;
+            case 'rotate':
+                this.renderRotate();
+                break;
+            case 'pow':
+                this.renderPow();
+                break;
+            default:
+                this.renderSlide();
+                this.bindEvents();
+        }
+    }
+
+    renderSlide() {
         this.container.innerHTML = `
             <div class="captcha-puzzle" id="puzzle-${this.container.id}">
                 <button class="captcha-refresh" onclick="window.captchaInstances['${this.container.id}'].refresh()" title="Refresh captcha">↻</button>
@@ -55,13 +81,9 @@ class SlideCaptcha {
         // Check actual image dimensions
         this.checkImageDimensions();
         
-        // Store target coordinates for validation
-        this.serverTargetX = this.captchaData.tile_x;
-        this.serverTargetY = this.captchaData.tile_y;
-        
-        // Position tile at starting position (left side, same Y as target)
-        const startX = 0;
-        const startY = this.captchaData.tile_y;
+        // Position tile at the starting position chosen by the server
+        const startX = this.captchaData.start_x || 0;
+        const startY = this.captchaData.start_y || 0;
         this.tile.style.left = `${startX}px`;
         this.tile.style.top = `${startY}px`;
         
@@ -72,9 +94,115 @@ class SlideCaptcha {
         this.updateRegisterButton(false);
     }
 
+    renderClick() {
+        this.container.innerHTML = `
+            <div class="captcha-instructions">
+                Click the shapes in this order:
+                <img src="${this.captchaData.thumb_image}" alt="" class="captcha-thumb">
+            </div>
+            <div class="captcha-puzzle" id="puzzle-${this.container.id}" style="cursor: crosshair;">
+                <button class="captcha-refresh" onclick="window.captchaInstances['${this.container.id}'].refresh()" title="Refresh captcha">↻</button>
+            </div>
+        `;
+
+        this.puzzle = document.getElementById(`puzzle-${this.container.id}`);
+        this.puzzle.style.backgroundImage = `url(${this.captchaData.master_image})`;
+        this.puzzle.addEventListener('click', (e) => {
+            if (this.isCompleted || e.target.classList.contains('captcha-refresh')) return;
+
+            const rect = this.puzzle.getBoundingClientRect();
+            const x = Math.round(e.clientX - rect.left);
+            const y = Math.round(e.clientY - rect.top);
+            this.clickPoints.push({ x, y });
+
+            const marker = document.createElement('div');
+            marker.className = 'captcha-click-marker';
+            marker.textContent = this.clickPoints.length;
+            marker.style.left = `${x - 10}px`;
+            marker.style.top = `${y - 10}px`;
+            this.puzzle.appendChild(marker);
+
+            if (this.clickPoints.length >= this.captchaData.count) {
+                this.markCompleted();
+            }
+        });
+    }
+
+    renderRotate() {
+        const size = this.captchaData.thumb_size || 100;
+        this.container.innerHTML = `
+            <div class="captcha-puzzle captcha-rotate" id="puzzle-${this.container.id}">
+                <button class="captcha-refresh" onclick="window.captchaInstances['${this.container.id}'].refresh()" title="Refresh captcha">↻</button>
+                <img src="${this.captchaData.thumb_image}" alt="" class="captcha-rotate-thumb" id="tile-${this.container.id}"
+                     style="width: ${size}px; height: ${size}px; margin-left: -${size / 2}px; margin-top: -${size / 2}px;">
+            </div>
+            <input type="range" min="0" max="359" value="0" class="captcha-rotate-slider" id="slider-${this.container.id}">
+            <div class="captcha-instructions">Drag the slider until the picture is upright</div>
+        `;
+
+        this.puzzle = document.getElementById(`puzzle-${this.container.id}`);
+        this.tile = document.getElementById(`tile-${this.container.id}`);
+        this.puzzle.style.backgroundImage = `url(${this.captchaData.master_image})`;
+
+        const slider = document.getElementById(`slider-${this.container.id}`);
+        slider.addEventListener('input', () => {
+            this.rotateAngle = parseInt(slider.value, 10);
+            this.tile.style.transform = `rotate(${this.rotateAngle}deg)`;
+        });
+        slider.addEventListener('change', () => {
+            if (this.rotateAngle > 0) {
+                this.markCompleted();
+            }
+        });
+    }
+
+    async renderPow() {
+        this.container.innerHTML = '<div class="captcha-loading">Checking your browser...</div>';
+
+        const captchaId = this.captchaData.captcha_id;
+        const nonce = await this.solveProofOfWork(this.captchaData.prefix, this.captchaData.difficulty);
+        if (!this.captchaData || this.captchaData.captcha_id !== captchaId) {
+            return; // refreshed while solving
+        }
+
+        this.powNonce = nonce;
+        this.container.innerHTML = '<div class="captcha-loading">Verified</div>';
+        this.isCompleted = true;
+        this.updateRegisterButton(true);
+    }
+
+    /**
+     * Find a nonce so that SHA-256(prefix + nonce) has the required leading zero bits
+     */
+    async solveProofOfWork(prefix, difficulty) {
+        const encoder = new TextEncoder();
+        for (let nonce = 0; ; nonce++) {
+            const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', encoder.encode(prefix + nonce)));
+            let zeroBits = 0;
+            for (const byte of digest) {
+                if (byte === 0) {
+                    zeroBits += 8;
+                    continue;
+                }
+                zeroBits += Math.clz32(byte) - 24;
+                break;
+            }
+            if (zeroBits >= difficulty) {
+                return String(nonce);
+            }
+        }
+    }
+
+    markCompleted() {
+        this.showSuccess();
+        this.isCompleted = true;
+        this.updateRegisterButton(true);
+    }
+
     updateRegisterButton(isCompleted) {
-        const registerBtn = document.querySelector('button[type="submit"]');
-        if (registerBtn && registerBtn.closest('#registerForm')) {
+        const form = this.container.closest('form');
+        const registerBtn = form ? form.querySelector('button[type="submit"]') : null;
+        if (registerBtn) {
             if (isCompleted) {
                 registerBtn.style.backgroundColor = '#4CAF50';
                 registerBtn.style.color = 'white';
@@ -215,14 +343,12 @@ class SlideCaptcha {
     }
 
     checkCompletion() {
-        const tolerance = 15;
-        const deltaX = Math.abs(this.currentX - this.serverTargetX);
-        const deltaY = Math.abs(this.currentY - this.serverTargetY);
-        
-        if (deltaX <= tolerance && deltaY <= tolerance) {
-            this.showSuccess();
-            this.isCompleted = true;
-            this.updateRegisterButton(true);
+        // The answer is only known to the server; any placement away from the start is submitted
+        const movedX = Math.abs(this.currentX - (this.captchaData.start_x || 0));
+        const movedY = Math.abs(this.currentY - (this.captchaData.start_y || 0));
+        
+        if (movedX > 5 || movedY > 5) {
+            this.markCompleted();
         } else {
             this.showBriefError();
         }
@@ -237,7 +363,7 @@ class SlideCaptcha {
         
         const successDiv = document.createElement('div');
         successDiv.className = 'captcha-success';
-        successDiv.innerHTML = 'Confirmed';
+        successDiv.innerHTML = 'Done';
         successDiv.style.cssText = 'position: absolute; top: 0; left: 0; right: 0; height: 40px; background: rgba(76, 175, 80, 0.9); display: flex; align-items: center; justify-content: center; color: white; font-weight: bold; font-size: 16px; z-index: 30;';
         this.puzzle.appendChild(successDiv);
         
@@ -245,7 +371,7 @@ class SlideCaptcha {
         this.successDiv = successDiv;
         
         // Hide the "Are you human?" label
-        const captchaLabel = document.getElementById('regCaptchaLabel');
+        const captchaLabel = this.container.parentNode && this.container.parentNode.querySelector('label');
         if (captchaLabel) {
             captchaLabel.style.display = 'none';
         }
@@ -277,14 +403,18 @@ class SlideCaptcha {
     }
 
     async refresh() {
+        this.container.style.display = '';
+        const captchaLabel = this.container.parentNode && this.container.parentNode.querySelector('label');
+        if (captchaLabel) {
+            captchaLabel.style.display = 'block';
+        }
         this.container.innerHTML = '<div class="captcha-loading">Loading captcha...</div>';
         try {
             await this.loadCaptcha();
             this.render();
-            this.bindEvents();
         } catch (error) {
             console.error('Failed to refresh captcha:', error);
-            this.showError('Failed to load captcha');
+            this.showError(error.message || 'Failed to load captcha');
         }
     }
 
@@ -296,10 +426,24 @@ class SlideCaptcha {
         // Clear success message when form is submitted
         this.clearSuccess();
         
+        let answer;
+        switch (this.captchaData.kind) {
+            case 'click':
+                answer = { points: this.clickPoints };
+                break;
+            case 'rotate':
+                answer = { angle: this.rotateAngle };
+                break;
+            case 'pow':
+                answer = { nonce: this.powNonce };
+                break;
+            default:
+                answer = { x: Math.round(this.currentX), y: Math.round(this.currentY) };
+        }
+
         return {
             captcha_id: this.captchaData.captcha_id,
-            captcha_x: Math.round(this.currentX),
-            captcha_y: Math.round(this.currentY)
+            captcha_answer: answer
         };
     }
 
@@ -339,17 +483,44 @@ class SlideCaptcha {
 // Global captcha instances
 window.captchaInstances = {};
 
-// Initialize captcha for auth forms - only for registration
-function initAuthCaptchas() {
+// Where the server requires captchas, fetched once from /api/captcha/config
+let captchaConfigRequest = null;
+function getCaptchaConfig() {
+    if (!captchaConfigRequest) {
+        captchaConfigRequest = fetch('/api/captcha/config')
+            .then(response => response.json())
+            .catch(() => ({ register: true, login: false, withdraw: false }));
+    }
+    return captchaConfigRequest;
+}
+
+// Create (or refresh) the captcha in a container
+function initCaptcha(containerId) {
+    if (!document.getElementById(containerId)) {
+        return;
+    }
+    if (window.captchaInstances[containerId]) {
+        window.captchaInstances[containerId].refresh();
+        return;
+    }
+    window.captchaInstances[containerId] = new Captcha(containerId);
+}
+
+// Initialize captchas for auth forms
+async function initAuthCaptchas() {
     if (document.getElementById('regCaptchaContainer') && !window.captchaInstances['regCaptchaContainer']) {
-        window.captchaInstances['regCaptchaContainer'] = new SlideCaptcha('regCaptchaContainer');
+        window.captchaInstances['regCaptchaContainer'] = new Captcha('regCaptchaContainer');
+    }
+
+    const config = await getCaptchaConfig();
+    const loginGroup = document.getElementById('loginCaptchaGroup');
+    if (config.login && loginGroup && !window.captchaInstances['loginCaptchaContainer']) {
+        loginGroup.style.display = 'block';
+        window.captchaInstances['loginCaptchaContainer'] = new Captcha('loginCaptchaContainer');
     }
-    
-    // Remove login captcha initialization
-    // if (document.getElementById('loginCaptchaContainer') && !window.captchaInstances['loginCaptchaContainer']) {
-    //     window.captchaInstances['loginCaptchaContainer'] = new SlideCaptcha('loginCaptchaContainer');
-    // }
 }
 
-// Make function globally available
-window.initAuthCaptchas = initAuthCaptchas;
\ No newline at end of file
+// Make functions globally available
+window.initAuthCaptchas = initAuthCaptchas;
+window.initCaptcha = initCaptcha;
+window.getCaptchaConfig = getCaptchaConfig;
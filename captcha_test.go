@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCaptcha(challenge Challenge) *CaptchaService {
+	return NewCaptchaService(challenge, CaptchaConfig{
+		TTL:           time.Minute,
+		MaxPerIP:      3,
+		MaxFailures:   3,
+		FailureWindow: time.Hour,
+	})
+}
+
+// solvePoW finds a nonce meeting the challenge's difficulty, or one missing it
+func solvePoW(t *testing.T, public map[string]interface{}, valid bool) json.RawMessage {
+	t.Helper()
+	prefix := public["prefix"].(string)
+	difficulty := public["difficulty"].(int)
+	for i := 0; i < 1<<20; i++ {
+		nonce := strconv.Itoa(i)
+		if (leadingZeroBits(sha256.Sum256([]byte(prefix+nonce))) >= difficulty) == valid {
+			resp, _ := json.Marshal(map[string]string{"nonce": nonce})
+			return resp
+		}
+	}
+	t.Fatal("no nonce found")
+	return nil
+}
+
+func TestProofOfWorkCaptcha(t *testing.T) {
+	cs := newTestCaptcha(NewProofOfWorkChallenge(8))
+
+	public, err := cs.GenerateCaptcha("1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public["kind"] != "pow" || public["difficulty"] != 8 || len(public["prefix"].(string)) != 32 {
+		t.Fatalf("challenge = %v", public)
+	}
+	id := public["captcha_id"].(string)
+	if cs.ValidateCaptcha(id, "1.2.3.4", solvePoW(t, public, false)) {
+		t.Error("wrong nonce accepted")
+	}
+	// The failed attempt used the challenge up
+	if cs.ValidateCaptcha(id, "1.2.3.4", solvePoW(t, public, true)) {
+		t.Error("challenge accepted after a failed attempt")
+	}
+
+	public, _ = cs.GenerateCaptcha("1.2.3.4")
+	id = public["captcha_id"].(string)
+	for _, resp := range []string{`{}`, `{"nonce": ""}`, `{"nonce": "` + strings.Repeat("0", 65) + `"}`, `not json`} {
+		if cs.challenge.Verify(cs.sessions[id].Answer, json.RawMessage(resp)) {
+			t.Errorf("%s accepted", resp)
+		}
+	}
+	nonce := solvePoW(t, public, true)
+	if !cs.ValidateCaptcha(id, "1.2.3.4", nonce) {
+		t.Error("right nonce rejected")
+	}
+	if cs.ValidateCaptcha(id, "1.2.3.4", nonce) {
+		t.Error("challenge accepted twice")
+	}
+
+	// A right answer after the challenge expired is refused. 1.2.3.4 has
+	// failed three times by now and is locked out.
+	if _, err := cs.GenerateCaptcha("1.2.3.4"); err != errCaptchaLocked {
+		t.Fatalf("after 3 failures: %v", err)
+	}
+	public, err = cs.GenerateCaptcha("5.6.7.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = public["captcha_id"].(string)
+	cs.sessions[id].Expiry = time.Now().Add(-time.Second)
+	if cs.ValidateCaptcha(id, "5.6.7.8", solvePoW(t, public, true)) {
+		t.Error("expired challenge accepted")
+	}
+}
+
+func TestCaptchaPerIPLimit(t *testing.T) {
+	cs := newTestCaptcha(NewProofOfWorkChallenge(1))
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		public, err := cs.GenerateCaptcha("1.2.3.4")
+		if err != nil {
+			t.Fatalf("captcha %d: %v", i, err)
+		}
+		ids = append(ids, public["captcha_id"].(string))
+	}
+	if _, err := cs.GenerateCaptcha("1.2.3.4"); err != errCaptchaLimit {
+		t.Fatalf("captcha over the limit: %v", err)
+	}
+	if _, err := cs.GenerateCaptcha("5.6.7.8"); err != nil {
+		t.Errorf("other IP: %v", err)
+	}
+
+	// Answering one, right or wrong, frees its slot
+	cs.ValidateCaptcha(ids[0], "1.2.3.4", json.RawMessage(`{}`))
+	if _, err := cs.GenerateCaptcha("1.2.3.4"); err != nil {
+		t.Errorf("after answering: %v", err)
+	}
+	if _, err := cs.GenerateCaptcha("1.2.3.4"); err != errCaptchaLimit {
+		t.Errorf("back over the limit: %v", err)
+	}
+}
+
+func TestCaptchaFailureLockout(t *testing.T) {
+	cs := newTestCaptcha(NewProofOfWorkChallenge(1))
+
+	for i := 0; i < 3; i++ {
+		public, err := cs.GenerateCaptcha("1.2.3.4")
+		if err != nil {
+			t.Fatalf("captcha %d: %v", i, err)
+		}
+		cs.ValidateCaptcha(public["captcha_id"].(string), "1.2.3.4", json.RawMessage(`{}`))
+	}
+	if _, err := cs.GenerateCaptcha("1.2.3.4"); err != errCaptchaLocked {
+		t.Fatalf("after 3 failures: %v", err)
+	}
+	// Guessing an unknown ID is a failure too, but only for the guessing IP
+	cs.ValidateCaptcha("no-such-id", "5.6.7.8", json.RawMessage(`{}`))
+	if _, err := cs.GenerateCaptcha("5.6.7.8"); err != nil {
+		t.Errorf("other IP: %v", err)
+	}
+
+	// The lockout ends with the failure window
+	cs.failures["1.2.3.4"].since = time.Now().Add(-time.Hour)
+	if _, err := cs.GenerateCaptcha("1.2.3.4"); err != nil {
+		t.Errorf("after the window: %v", err)
+	}
+}
+
+func TestCaptchaSweeperFreesExpired(t *testing.T) {
+	cs := newTestCaptcha(NewProofOfWorkChallenge(1))
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		public, _ := cs.GenerateCaptcha("1.2.3.4")
+		ids = append(ids, public["captcha_id"].(string))
+	}
+	cs.ValidateCaptcha("no-such-id", "1.2.3.4", json.RawMessage(`{}`))
+	cs.ValidateCaptcha("no-such-id", "5.6.7.8", json.RawMessage(`{}`))
+	cs.failures["5.6.7.8"].since = time.Now().Add(-time.Hour)
+
+	cs.sessions[ids[0]].Expiry = time.Now().Add(-time.Second)
+	cs.sessions[ids[1]].Expiry = time.Now().Add(-time.Second)
+	cs.CleanupExpired()
+
+	if len(cs.sessions) != 1 || cs.sessions[ids[2]] == nil {
+		t.Errorf("sessions after sweep = %v", cs.sessions)
+	}
+	if cs.outstanding["1.2.3.4"] != 1 {
+		t.Errorf("outstanding = %d, want 1", cs.outstanding["1.2.3.4"])
+	}
+	if cs.failures["1.2.3.4"] == nil || cs.failures["5.6.7.8"] != nil {
+		t.Errorf("failures after sweep = %v", cs.failures)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cs.GenerateCaptcha("1.2.3.4"); err != nil {
+			t.Errorf("captcha %d after sweep: %v", i, err)
+		}
+	}
+
+	// Once every challenge has gone the IP's counter goes too
+	for _, session := range cs.sessions {
+		session.Expiry = time.Now().Add(-time.Second)
+	}
+	cs.CleanupExpired()
+	if len(cs.sessions) != 0 || len(cs.outstanding) != 0 {
+		t.Errorf("after sweeping everything: %d sessions, outstanding %v", len(cs.sessions), cs.outstanding)
+	}
+}
+
+func TestCaptchaAnswerNotPublic(t *testing.T) {
+	for _, kind := range []string{"slide", "click", "rotate"} {
+		t.Run(kind, func(t *testing.T) {
+			challenge, err := NewChallenge(kind, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs := newTestCaptcha(challenge)
+			public, err := cs.GenerateCaptcha("1.2.3.4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := json.Marshal(public)
+			var fields map[string]interface{}
+			json.Unmarshal(data, &fields)
+			for _, key := range []string{"x", "y", "angle", "dots", "answer", "block"} {
+				if _, ok := fields[key]; ok {
+					t.Errorf("challenge has %q", key)
+				}
+			}
+
+			answer, _ := json.Marshal(cs.sessions[public["captcha_id"].(string)].Answer)
+			if strings.Contains(string(data), string(answer)) {
+				t.Errorf("challenge contains the answer %s", answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeStatus is a wallet backend's view of the chain and network
+type NodeStatus struct {
+	Height    int64   // best block the backend has
+	Headers   int64   // best block the network is known to have
+	BestHash  string  // empty when the backend does not report it
+	Progress  float64 // verification progress, 0 to 1
+	Syncing   bool
+	Peers     int
+	Connected bool
+}
+
+// HealthReporter is implemented by wallet backends that can report node status.
+// Backends without it are judged on ChainTip alone.
+type HealthReporter interface {
+	Health() (*NodeStatus, error)
+}
+
+// HealthConfig sets the thresholds at which a coin's deposits and withdrawals are paused
+type HealthConfig struct {
+	Interval    time.Duration // how often backends are polled
+	MaxLag      int64         // blocks the backend may trail the network's headers
+	MinPeers    int
+	MinProgress float64       // verification progress below which the node counts as syncing
+	StaleAfter  time.Duration // pause if the tip has not moved for this long; 0 disables
+}
+
+// CoinHealth is the latest health assessment for one coin
+type CoinHealth struct {
+	Coin          string    `json:"coin"`
+	Symbol        string    `json:"symbol"`
+	Healthy       bool      `json:"healthy"`
+	Reason        string    `json:"reason,omitempty"`
+	ManualPause   string    `json:"manual_pause,omitempty"`
+	Height        int64     `json:"height"`
+	Headers       int64     `json:"headers"`
+	BestHash      string    `json:"best_hash,omitempty"`
+	Progress      float64   `json:"progress"`
+	Peers         int       `json:"peers"`
+	LastTipChange time.Time `json:"last_tip_change"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// paused reports whether deposits and withdrawals for the coin are suspended, and why
+func (h *CoinHealth) paused() (string, bool) {
+	if h.ManualPause != "" {
+		return h.ManualPause, true
+	}
+	if !h.Healthy {
+		return h.Reason, true
+	}
+	return "", false
+}
+
+// ChainMonitor polls each coin's wallet backend and suspends deposits and
+// withdrawals for coins whose node is unreachable, syncing, behind or stale
+type ChainMonitor struct {
+	mu     sync.RWMutex
+	assets map[string]*Asset
+	config HealthConfig
+	health map[string]*CoinHealth
+}
+
+// NewChainMonitor creates a monitor for the given assets. Until the first check
+// completes every coin is treated as paused.
+func NewChainMonitor(assets map[string]*Asset, config HealthConfig) *ChainMonitor {
+	health := make(map[string]*CoinHealth, len(assets))
+	for name, asset := range assets {
+		health[name] = &CoinHealth{Coin: name, Symbol: asset.Symbol, Reason: "node status not checked yet"}
+	}
+	return &ChainMonitor{assets: assets, config: config, health: health}
+}
+
+// status fetches a backend's node status, falling back to its chain tip
+func status(wallet WalletBackend) (*NodeStatus, error) {
+	if reporter, ok := wallet.(HealthReporter); ok {
+		return reporter.Health()
+	}
+	tip, err := wallet.ChainTip()
+	if err != nil {
+		return nil, err
+	}
+	return &NodeStatus{Height: tip.Height, Headers: tip.Height, BestHash: tip.Hash, Progress: 1, Peers: 1, Connected: true}, nil
+}
+
+// assess returns why a node is unfit to process deposits and withdrawals, or "" if it is fine
+func (m *ChainMonitor) assess(node *NodeStatus, lastTipChange time.Time, now time.Time) string {
+	switch {
+	case !node.Connected:
+		return "node is not connected to the network"
+	case node.Syncing || node.Progress < m.config.MinProgress:
+		return fmt.Sprintf("node is syncing (%.2f%%)", node.Progress*100)
+	case node.Peers < m.config.MinPeers:
+		return fmt.Sprintf("node has %d peers", node.Peers)
+	case node.Headers-node.Height > m.config.MaxLag:
+		return fmt.Sprintf("node is %d blocks behind the network", node.Headers-node.Height)
+	case m.config.StaleAfter > 0 && now.Sub(lastTipChange) > m.config.StaleAfter:
+		return fmt.Sprintf("no new block for %s", now.Sub(lastTipChange).Round(time.Minute))
+	}
+	return ""
+}
+
+// Check polls every backend once and updates the health table
+func (m *ChainMonitor) Check() {
+	for name, asset := range m.assets {
+		node, err := status(asset.Wallet)
+		now := time.Now()
+
+		m.mu.Lock()
+		h := m.health[name]
+		wasHealthy := h.Healthy
+		h.CheckedAt = now
+		if err != nil {
+			h.Healthy = false
+			h.Reason = "wallet unavailable"
+			log.Printf("[HEALTH] %s check failed: %v", asset.Symbol, err)
+		} else {
+			if node.Height != h.Height || node.BestHash != h.BestHash || h.LastTipChange.IsZero() {
+				if node.Height < h.Height {
+					log.Printf("[HEALTH] %s tip went back from %d to %d (reorg or node switched chains)", asset.Symbol, h.Height, node.Height)
+				}
+				h.LastTipChange = now
+			}
+			h.Height = node.Height
+			h.Headers = node.Headers
+			h.BestHash = node.BestHash
+			h.Progress = node.Progress
+			h.Peers = node.Peers
+			h.Reason = m.assess(node, h.LastTipChange, now)
+			h.Healthy = h.Reason == ""
+		}
+		if wasHealthy != h.Healthy {
+			if h.Healthy {
+				log.Printf("[HEALTH] %s healthy at height %d, deposits and withdrawals resumed", asset.Symbol, h.Height)
+			} else {
+				log.Printf("[HEALTH] %s unhealthy (%s), deposits and withdrawals paused", asset.Symbol, h.Reason)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Run checks the backends every interval
+func (m *ChainMonitor) Run() {
+	m.Check()
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Check()
+	}
+}
+
+// Paused reports whether deposits and withdrawals for a coin are suspended, and why
+func (m *ChainMonitor) Paused(coin string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h, ok := m.health[coin]
+	if !ok {
+		return "", false
+	}
+	return h.paused()
+}
+
+// SetManualPause suspends (non-empty reason) or resumes a coin regardless of node health
+func (m *ChainMonitor) SetManualPause(coin, reason string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.health[coin]
+	if !ok {
+		return false
+	}
+	h.ManualPause = reason
+	return true
+}
+
+// Snapshot returns a copy of every coin's health, ordered by coin name
+func (m *ChainMonitor) Snapshot() []CoinHealth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot := make([]CoinHealth, 0, len(m.health))
+	for _, h := range m.health {
+		snapshot = append(snapshot, *h)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Coin < snapshot[j].Coin })
+	return snapshot
+}
+
+// coinPaused reports whether deposits and withdrawals for a coin are suspended, and why
+func (s *Server) coinPaused(coin string) (string, bool) {
+	if s.chainMonitor == nil {
+		return "", false
+	}
+	return s.chainMonitor.Paused(coin)
+}
+
+// handleWalletStatus tells the UI which coins currently accept deposits and withdrawals
+func (s *Server) handleWalletStatus(w http.ResponseWriter, r *http.Request) {
+	coins := make(map[string]interface{}, len(s.assets))
+	for name, asset := range s.assets {
+		reason, paused := s.coinPaused(name)
+		coins[name] = map[string]interface{}{
+			"symbol":              asset.Symbol,
+			"deposits_enabled":    !paused,
+			"withdrawals_enabled": !paused,
+			"reason":              reason,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"coins": coins})
+}
+
+// handleAdminHealth shows node health for every coin (GET) or manually pauses
+// and resumes a coin (POST {"coin", "paused", "reason"})
+func (s *Server) handleAdminHealth(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if s.chainMonitor == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Health monitoring is disabled"})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Coin   string `json:"coin"`
+			Paused bool   `json:"paused"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+
+		reason := ""
+		if req.Paused {
+			reason = strings.TrimSpace(req.Reason)
+			if reason == "" {
+				reason = "paused by an administrator"
+			}
+		}
+		if !s.chainMonitor.SetManualPause(req.Coin, reason) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported coin: " + req.Coin})
+			return
+		}
+		log.Printf("[HEALTH] Admin %s %s deposits and withdrawals for %s", session.Username, map[bool]string{true: "paused", false: "resumed"}[req.Paused], req.Coin)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"coins": s.chainMonitor.Snapshot()})
+}
@@ -0,0 +1,70 @@
+// Command verify-liabilities checks a proof-of-liabilities inclusion proof offline.
+//
+// Download your proof from /api/liabilities/proof while logged in, then run
+//
+//	verify-liabilities -root <published root> proof.json
+//
+// It recomputes the Merkle sum tree path from your balances to the root and
+// fails if the result does not match the root the exchange published.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"exchange/proof"
+)
+
+func main() {
+	root := flag.String("root", "", "Root published at /api/liabilities to check the proof against")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-root hash] [proof.json]\nReads the proof from stdin if no file is given.\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var input io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open proof: %v\n", err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	// Accept both the bare proof and the API response that wraps it
+	var doc struct {
+		proof.Proof
+		Wrapped *proof.Proof `json:"proof"`
+	}
+	if err := json.NewDecoder(input).Decode(&doc); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read proof: %v\n", err)
+		os.Exit(2)
+	}
+	p := &doc.Proof
+	if doc.Wrapped != nil {
+		p = doc.Wrapped
+	}
+
+	if err := proof.Verify(p); err != nil {
+		fmt.Printf("INVALID: %v\n", err)
+		os.Exit(1)
+	}
+	if *root != "" && *root != p.Root {
+		fmt.Printf("INVALID: proof root %s is not the published root %s\n", p.Root, *root)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Valid proof for user %d under root %s\n", p.UserID, p.Root)
+	for i, asset := range p.Assets {
+		fmt.Printf("  %-12s your balance %.8f of total liabilities %.8f\n", asset, float64(p.Balances[i])/1e8, float64(p.Totals[i])/1e8)
+	}
+	if *root == "" {
+		fmt.Println("Compare the root with the one published at /api/liabilities, or pass it with -root.")
+	}
+}
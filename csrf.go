@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// csrfHeader is the request header that must echo the CSRF cookie on state-changing requests
+const csrfHeader = "X-CSRF-Token"
+
+// CookieConfig controls the attributes of the cookies issued by the server
+type CookieConfig struct {
+	Secure     bool
+	HostPrefix bool
+	SameSite   http.SameSite
+}
+
+// parseSameSite converts a -cookie-samesite flag value into an http.SameSite mode
+func parseSameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteStrictMode
+	}
+}
+
+// name returns the cookie name, adding the __Host- prefix when enabled.
+// Browsers only accept __Host- cookies that are Secure, have Path=/ and no Domain.
+func (c CookieConfig) name(base string) string {
+	if c.HostPrefix && c.Secure {
+		return "__Host-" + base
+	}
+	return base
+}
+
+// SessionName returns the name of the session cookie
+func (c CookieConfig) SessionName() string {
+	return c.name("session")
+}
+
+// CSRFName returns the name of the CSRF cookie
+func (c CookieConfig) CSRFName() string {
+	return c.name("csrf")
+}
+
+// newCookie builds a cookie with the configured security attributes
+func (c CookieConfig) newCookie(name, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   c.Secure,
+		SameSite: c.SameSite,
+	}
+}
+
+// setSessionCookie issues the session cookie
+func (s *Server) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, s.cookies.newCookie(s.cookies.SessionName(), token, expires, true))
+}
+
+// clearSessionCookie expires the session cookie
+func (s *Server) clearSessionCookie(w http.ResponseWriter) {
+	cookie := s.cookies.newCookie(s.cookies.SessionName(), "", time.Time{}, true)
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// issueCSRFToken sets a fresh CSRF cookie and mirrors the token in a response header
+func (s *Server) issueCSRFToken(w http.ResponseWriter) (string, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	// The cookie is readable by the page on purpose: the double-submit scheme relies on
+	// same-origin script echoing it back in the X-CSRF-Token header.
+	http.SetCookie(w, s.cookies.newCookie(s.cookies.CSRFName(), token, time.Now().Add(24*time.Hour), false))
+	w.Header().Set(csrfHeader, token)
+	return token, nil
+}
+
+// csrfToken returns the CSRF token carried by the request cookie, if any
+func (s *Server) csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(s.cookies.CSRFName())
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// isSafeMethod reports whether a method cannot change state and is exempt from CSRF checks
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin reports whether the Origin (or Referer) header, when present, matches the request host
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+// validCSRF checks the double-submit token for a state-changing request
+func (s *Server) validCSRF(r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	if !sameOrigin(r) {
+		return false
+	}
+	cookieToken := s.csrfToken(r)
+	headerToken := r.Header.Get(csrfHeader)
+	if cookieToken == "" || headerToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) == 1
+}
+
+// csrfMiddleware rejects state-changing requests that do not carry a matching CSRF token
+func (s *Server) csrfMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.validCSRF(r) {
+			log.Printf("[CSRF] Rejected %s %s (origin: %q)", r.Method, r.URL.Path, r.Header.Get("Origin"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid CSRF token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleGetCSRFToken returns the caller's CSRF token, issuing one if needed
+func (s *Server) handleGetCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := s.csrfToken(r)
+	if token == "" {
+		var err error
+		token, err = s.issueCSRFToken(w)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to issue CSRF token"})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"csrf_token": token})
+}
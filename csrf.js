@@ -0,0 +1,57 @@
+/**
+ * CSRF Module
+ * Attaches the double-submit CSRF token to every state-changing same-origin request
+ */
+
+(function () {
+    const originalFetch = window.fetch.bind(window);
+    const safeMethods = ['GET', 'HEAD', 'OPTIONS'];
+    let csrfToken = null;
+    let tokenRequest = null;
+
+    /**
+     * Remember a token the server sent back (it rotates at login)
+     */
+    function rememberToken(response) {
+        const token = response.headers.get('X-CSRF-Token');
+        if (token) {
+            csrfToken = token;
+        }
+        return response;
+    }
+
+    /**
+     * Fetch the current token once and share the result between callers
+     */
+    function loadToken() {
+        if (csrfToken) {
+            return Promise.resolve(csrfToken);
+        }
+        if (!tokenRequest) {
+            tokenRequest = originalFetch('/api/csrf', { credentials: 'include' })
+                .then(response => response.json())
+                .then(data => {
+                    csrfToken = data.csrf_token;
+                    return csrfToken;
+                })
+                .finally(() => {
+                    tokenRequest = null;
+                });
+        }
+        return tokenRequest;
+    }
+
+    window.fetch = async function (input, init = {}) {
+        const method = (init.method || 'GET').toUpperCase();
+        const url = new URL(typeof input === 'string' ? input : input.url, window.location.href);
+
+        if (safeMethods.includes(method) || url.origin !== window.location.origin) {
+            return originalFetch(input, init).then(rememberToken);
+        }
+
+        const token = await loadToken();
+        const headers = new Headers(init.headers || {});
+        headers.set('X-CSRF-Token', token);
+        return originalFetch(input, { ...init, headers }).then(rememberToken);
+    };
+})();
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newCSRFTestServer starts a TLS test server with a single user "alice" / "secret"
+func newCSRFTestServer(t *testing.T, cookies CookieConfig) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initDB(db); err != nil {
+		t.Fatalf("init db: %v", err)
+	}
+
+	server := &Server{
+		db:       db,
+		sessions: make(map[string]*Session),
+		assets:   newSimAssets(t, db),
+		cookies:  cookies,
+	}
+
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	if _, err := server.createUser("alice", hash); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	server.RegisterRoutes(mux)
+	ts := httptest.NewTLSServer(mux)
+	t.Cleanup(ts.Close)
+
+	client := ts.Client()
+	client.Jar, _ = cookiejar.New(nil)
+	return ts, client
+}
+
+// fetchCSRFToken asks the server for the caller's CSRF token
+func fetchCSRFToken(t *testing.T, ts *httptest.Server, client *http.Client) string {
+	t.Helper()
+
+	resp, err := client.Get(ts.URL + "/api/csrf")
+	if err != nil {
+		t.Fatalf("get csrf token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.CSRFToken == "" {
+		t.Fatalf("decode csrf token: %v", err)
+	}
+	return body.CSRFToken
+}
+
+// postJSON sends a JSON POST with optional CSRF token and Origin headers
+func postJSON(t *testing.T, client *http.Client, url, body, token, origin string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(csrfHeader, token)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("post %s: %v", url, err)
+	}
+	return resp
+}
+
+func findCookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestCSRFRejectsMissingToken(t *testing.T) {
+	ts, client := newCSRFTestServer(t, CookieConfig{SameSite: http.SameSiteStrictMode})
+	fetchCSRFToken(t, ts, client)
+
+	resp := postJSON(t, client, ts.URL+"/api/login", `{"username":"alice","password":"secret"}`, "", "")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without CSRF header, got %d", resp.StatusCode)
+	}
+}
+
+func TestCSRFRejectsMismatchedToken(t *testing.T) {
+	ts, client := newCSRFTestServer(t, CookieConfig{SameSite: http.SameSiteStrictMode})
+	fetchCSRFToken(t, ts, client)
+
+	resp := postJSON(t, client, ts.URL+"/api/login", `{"username":"alice","password":"secret"}`, "forged", "")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 with mismatched CSRF header, got %d", resp.StatusCode)
+	}
+}
+
+func TestCSRFRejectsCrossOrigin(t *testing.T) {
+	ts, client := newCSRFTestServer(t, CookieConfig{SameSite: http.SameSiteStrictMode})
+	token := fetchCSRFToken(t, ts, client)
+
+	resp := postJSON(t, client, ts.URL+"/api/login", `{"username":"alice","password":"secret"}`, token, "https://evil.example")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for cross-origin request, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoginIssuesHardenedCookies(t *testing.T) {
+	cookies := CookieConfig{Secure: true, HostPrefix: true, SameSite: http.SameSiteStrictMode}
+	ts, client := newCSRFTestServer(t, cookies)
+	token := fetchCSRFToken(t, ts, client)
+
+	resp := postJSON(t, client, ts.URL+"/api/login", `{"username":"alice","password":"secret"}`, token, ts.URL)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login failed with status %d", resp.StatusCode)
+	}
+
+	session := findCookie(resp, "__Host-session")
+	if session == nil {
+		t.Fatalf("expected __Host-session cookie, got %v", resp.Cookies())
+	}
+	if !session.Secure || !session.HttpOnly || session.SameSite != http.SameSiteStrictMode || session.Path != "/" || session.Domain != "" {
+		t.Errorf("session cookie not hardened: %+v", session)
+	}
+
+	csrf := findCookie(resp, "__Host-csrf")
+	if csrf == nil || csrf.Value == token {
+		t.Errorf("expected CSRF token to rotate at login")
+	}
+	if resp.Header.Get(csrfHeader) != csrf.Value {
+		t.Errorf("expected rotated token to be mirrored in %s header", csrfHeader)
+	}
+}
+
+func TestCSRFProtectsAuthenticatedRoutes(t *testing.T) {
+	ts, client := newCSRFTestServer(t, CookieConfig{Secure: true, HostPrefix: true, SameSite: http.SameSiteStrictMode})
+	token := fetchCSRFToken(t, ts, client)
+
+	resp := postJSON(t, client, ts.URL+"/api/login", `{"username":"alice","password":"secret"}`, token, "")
+	resp.Body.Close()
+	token = resp.Header.Get(csrfHeader)
+
+	body := `{"litecoin_address":"simltcexample"}`
+	resp = postJSON(t, client, ts.URL+"/api/update-addresses", body, "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without CSRF header, got %d", resp.StatusCode)
+	}
+
+	resp = postJSON(t, client, ts.URL+"/api/update-addresses", body, token, "")
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result["success"] != true {
+		t.Fatalf("expected address update to succeed with CSRF token, got %d %v", resp.StatusCode, result)
+	}
+}
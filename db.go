@@ -3,11 +3,8 @@ package main
 import (
 	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
-	"strings"
-
-	"golang.org/x/crypto/argon2"
+	"time"
 )
 
 // randRead is a wrapper around crypto/rand.Read
@@ -15,61 +12,6 @@ func randRead(b []byte) (int, error) {
 	return rand.Read(b)
 }
 
-// generateSalt creates a random salt for password hashing
-func generateSalt(length int) (string, error) {
-	salt := make([]byte, length)
-	if _, err := randRead(salt); err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(salt), nil
-}
-
-// hashPassword hashes a password using Argon2id with a randomly generated salt
-func hashPassword(password string) (string, error) {
-	// Generate a random salt (16 bytes = 128 bits)
-	salt, err := generateSalt(16)
-	if err != nil {
-		return "", err
-	}
-
-	// Decode the salt for hashing
-	saltBytes, _ := base64.StdEncoding.DecodeString(salt)
-
-	// Argon2id parameters (balanced between security and performance)
-	hash := argon2.IDKey([]byte(password), saltBytes, 1, 64*1024, 4, 32)
-
-	// Encode hash to base64
-	hashStr := base64.StdEncoding.EncodeToString(hash)
-
-	// Return combined salt:hash format for storage
-	return salt + ":" + hashStr, nil
-}
-
-// verifyPassword compares a password with a stored hash
-func verifyPassword(password, storedHash string) bool {
-	// Split the stored hash into salt and hash
-	parts := strings.Split(storedHash, ":")
-	if len(parts) != 2 {
-		return false
-	}
-
-	salt := parts[0]
-	hashStr := parts[1]
-
-	// Decode the salt
-	saltBytes, err := base64.StdEncoding.DecodeString(salt)
-	if err != nil {
-		return false
-	}
-
-	// Hash the provided password with the same salt
-	hash := argon2.IDKey([]byte(password), saltBytes, 1, 64*1024, 4, 32)
-	hashStr2 := base64.StdEncoding.EncodeToString(hash)
-
-	// Compare hashes
-	return hashStr == hashStr2
-}
-
 // initDB initializes the database schema
 func initDB(db *sql.DB) error {
 	schema := `
@@ -129,13 +71,272 @@ func initDB(db *sql.DB) error {
 		FOREIGN KEY(buyer_id) REFERENCES users(id)
 	);
 
+	CREATE TABLE IF NOT EXISTS password_resets (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS hot_wallet_ledger (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		coin TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		amount REAL NOT NULL,
+		address TEXT,
+		tx_hash TEXT,
+		status TEXT NOT NULL,
+		hot_balance REAL NOT NULL,
+		pending_withdrawals REAL NOT NULL,
+		note TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS reconciliation_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		coin TEXT NOT NULL,
+		user_balances REAL NOT NULL,
+		locked REAL NOT NULL,
+		pending_withdrawals REAL NOT NULL,
+		liabilities REAL NOT NULL,
+		wallet_confirmed REAL NOT NULL,
+		wallet_unconfirmed REAL NOT NULL,
+		cold_storage REAL NOT NULL,
+		holdings REAL NOT NULL,
+		difference REAL NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS liability_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		root TEXT NOT NULL,
+		assets TEXT NOT NULL,
+		totals TEXT NOT NULL,
+		leaf_count INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS liability_leaves (
+		snapshot_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		nonce TEXT NOT NULL,
+		balances TEXT NOT NULL,
+		PRIMARY KEY(snapshot_id, position),
+		FOREIGN KEY(snapshot_id) REFERENCES liability_snapshots(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS sim_blocks (
+		coin TEXT NOT NULL,
+		height INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(coin, height)
+	);
+
+	CREATE TABLE IF NOT EXISTS sim_addresses (
+		coin TEXT NOT NULL,
+		address TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(coin, address)
+	);
+
+	CREATE TABLE IF NOT EXISTS sim_transactions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		coin TEXT NOT NULL,
+		txid TEXT NOT NULL,
+		address TEXT NOT NULL,
+		amount REAL NOT NULL,
+		fee REAL NOT NULL DEFAULT 0,
+		direction TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		height INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS candles (
+		market TEXT NOT NULL,
+		interval TEXT NOT NULL,
+		start INTEGER NOT NULL,
+		open REAL NOT NULL,
+		high REAL NOT NULL,
+		low REAL NOT NULL,
+		close REAL NOT NULL,
+		volume REAL NOT NULL,
+		quote_volume REAL NOT NULL,
+		trades INTEGER NOT NULL,
+		PRIMARY KEY(market, interval, start)
+	);
+
+	CREATE TABLE IF NOT EXISTS price_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		currency TEXT NOT NULL,
+		price REAL NOT NULL,
+		sources INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS candle_rollups (
+		market TEXT PRIMARY KEY,
+		last_completion_id INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS trade_fees (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		completion_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		coin TEXT NOT NULL,
+		rate REAL NOT NULL,
+		amount REAL NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(completion_id) REFERENCES trade_completions(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS fee_overrides (
+		user_id INTEGER NOT NULL,
+		market TEXT NOT NULL,
+		maker_rate REAL NOT NULL,
+		taker_rate REAL NOT NULL,
+		note TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, market),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS exchange_accounts (
+		account TEXT NOT NULL,
+		coin TEXT NOT NULL,
+		balance REAL NOT NULL DEFAULT 0,
+		PRIMARY KEY(account, coin)
+	);
+
+	CREATE TABLE IF NOT EXISTS referral_codes (
+		code TEXT PRIMARY KEY,
+		user_id INTEGER UNIQUE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS referral_payouts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		referrer_id INTEGER NOT NULL,
+		referee_id INTEGER NOT NULL,
+		completion_id INTEGER NOT NULL,
+		coin TEXT NOT NULL,
+		fee REAL NOT NULL,
+		amount REAL NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(referrer_id) REFERENCES users(id),
+		FOREIGN KEY(referee_id) REFERENCES users(id),
+		FOREIGN KEY(completion_id) REFERENCES trade_completions(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS order_amendments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		trade_id INTEGER NOT NULL,
+		old_price REAL NOT NULL,
+		new_price REAL NOT NULL,
+		old_remaining REAL NOT NULL,
+		new_remaining REAL NOT NULL,
+		escrow_change REAL NOT NULL,
+		priority_reset INTEGER NOT NULL,
+		amended_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(trade_id) REFERENCES trades(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sim_transactions_address ON sim_transactions(coin, address);
 	CREATE INDEX IF NOT EXISTS idx_trades_seller ON trades(seller_id);
 	CREATE INDEX IF NOT EXISTS idx_trades_status ON trades(status);
 	CREATE INDEX IF NOT EXISTS idx_transactions_user ON transactions(user_id);
 	CREATE INDEX IF NOT EXISTS idx_balances_user ON balances(user_id);
+	CREATE INDEX IF NOT EXISTS idx_hot_wallet_ledger_coin ON hot_wallet_ledger(coin, kind, status);
+	CREATE INDEX IF NOT EXISTS idx_trade_completions_trade ON trade_completions(trade_id);
+	CREATE INDEX IF NOT EXISTS idx_trade_fees_completion ON trade_fees(completion_id);
+	CREATE INDEX IF NOT EXISTS idx_referral_payouts_referrer ON referral_payouts(referrer_id);
+	CREATE INDEX IF NOT EXISTS idx_order_amendments_trade ON order_amendments(trade_id);
 	`
 
-	_, err := db.Exec(schema)
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	return migrateDB(db)
+}
+
+// addColumnIfMissing adds a column to an existing table created by an older schema
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// migrateDB brings databases created by older versions up to the current schema
+func migrateDB(db *sql.DB) error {
+	columns := []struct{ table, column, definition string }{
+		{"users", "email", "TEXT"},
+		{"users", "withdrawals_frozen_until", "TIMESTAMP"},
+		{"reconciliation_reports", "exchange_funds", "REAL NOT NULL DEFAULT 0"},
+		{"users", "referred_by", "INTEGER REFERENCES users(id)"},
+		{"users", "referred_at", "TIMESTAMP"},
+		{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"trade_completions", "price", "REAL"},
+		{"trades", "queue_seq", "INTEGER"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	_, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_users_referred_by ON users(referred_by)`)
+	if err != nil {
+		return err
+	}
+
+	// Orders from before amendments queue in the order they were placed
+	_, err = db.Exec(`UPDATE trades SET queue_seq = id WHERE queue_seq IS NULL`)
+	if err != nil {
+		return err
+	}
+	// Fills from before amendments were all at their order's price, which has not
+	// changed yet; record it before an amendment can
+	_, err = db.Exec(`UPDATE trade_completions SET price = (SELECT price_per_unit FROM trades WHERE id = trade_id) WHERE price IS NULL`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_trades_queue_seq ON trades(queue_seq)`)
 	return err
 }
 
@@ -222,6 +423,31 @@ func (s *Server) createUser(username, passwordHash string) (int, error) {
 	return int(userID), nil
 }
 
+// getReserved sums what a user's open orders still hold in escrow, by coin
+func (s *Server) getReserved(userID int) (map[string]float64, error) {
+	rows, err := s.db.Query(`
+		SELECT t.coin_selling, COALESCE(SUM(`+orderEscrowSQL+`), 0)
+		FROM trades t
+		WHERE t.seller_id = ? AND t.status = 'open'
+		GROUP BY t.coin_selling
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reserved := make(map[string]float64)
+	for rows.Next() {
+		var coin string
+		var amount float64
+		if err := rows.Scan(&coin, &amount); err != nil {
+			return nil, err
+		}
+		reserved[coin] = amount
+	}
+	return reserved, rows.Err()
+}
+
 // getUserBalance retrieves a user's balance
 func (s *Server) getUserBalance(userID int) (*Balance, error) {
 	var balance Balance
@@ -273,24 +499,9 @@ func (s *Server) getAllUsers() ([]map[string]interface{}, error) {
 		}
 
 		// Calculate reserved amounts for this user
-		var ltcReserved, kcnReserved float64
-		reservedRows, err := s.db.Query(`
-			SELECT coin_selling, amount_selling FROM trades 
-			WHERE seller_id = ? AND status = 'open'
-		`, id)
-		if err == nil {
-			defer reservedRows.Close()
-			for reservedRows.Next() {
-				var coin string
-				var amount float64
-				if reservedRows.Scan(&coin, &amount) == nil {
-					if coin == "litecoin" {
-						ltcReserved += amount
-					} else {
-						kcnReserved += amount
-					}
-				}
-			}
+		reserved, err := s.getReserved(id)
+		if err != nil {
+			return nil, err
 		}
 
 		user := map[string]interface{}{
@@ -300,8 +511,8 @@ func (s *Server) getAllUsers() ([]map[string]interface{}, error) {
 			"kernelcoin_address": kcnAddr,
 			"litecoin_balance":   ltcBalance,
 			"kernelcoin_balance": kcnBalance,
-			"ltc_reserved":       ltcReserved,
-			"kcn_reserved":       kcnReserved,
+			"ltc_reserved":       reserved["litecoin"],
+			"kcn_reserved":       reserved["kernelcoin"],
 		}
 		users = append(users, user)
 	}
@@ -313,19 +524,29 @@ func (s *Server) getAllUsers() ([]map[string]interface{}, error) {
 func (s *Server) createTrade(sellerID int, coinSelling string, amountSelling float64,
 	coinBuying string, amountBuying float64) (int64, error) {
 
-	// Calculate price per unit correctly based on what's being sold
-	var pricePerUnit float64
-	if coinSelling == "kernelcoin" {
-		// Selling KCN for LTC: price = LTC per KCN
-		pricePerUnit = amountBuying / amountSelling
-	} else {
-		// Selling LTC for KCN: price = LTC per KCN
-		pricePerUnit = amountSelling / amountBuying
+	tradeID, err := insertTrade(s.db, sellerID, coinSelling, amountSelling, coinBuying, amountBuying)
+	if err != nil {
+		return tradeID, err
 	}
 
-	result, err := s.db.Exec(`
-		INSERT INTO trades (seller_id, coin_selling, amount_selling, coin_buying, amount_buying, price_per_unit)
-		VALUES (?, ?, ?, ?, ?, ?)
+	s.publishOrder(int(tradeID), "order_added")
+	s.publishBalance(sellerID)
+	return tradeID, nil
+}
+
+// insertTrade records a new trade and reserves coins, without publishing it
+func insertTrade(db execer, sellerID int, coinSelling string, amountSelling float64,
+	coinBuying string, amountBuying float64) (int64, error) {
+
+	// Price is LTC per KCN whichever coin is being sold
+	pricePerUnit, _, err := orderTerms(coinSelling, amountSelling, coinBuying, amountBuying)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO trades (seller_id, coin_selling, amount_selling, coin_buying, amount_buying, price_per_unit, queue_seq)
+		VALUES (?, ?, ?, ?, ?, ?, `+nextQueueSQL+`)
 	`, sellerID, coinSelling, amountSelling, coinBuying, amountBuying, pricePerUnit)
 
 	if err != nil {
@@ -338,21 +559,21 @@ func (s *Server) createTrade(sellerID int, coinSelling string, amountSelling flo
 	}
 
 	// Reserve coins
-	coinCol := coinSelling
-	_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s - ? WHERE user_id = ?`, coinCol, coinCol),
-		amountSelling, sellerID)
-
-	return tradeID, err
+	if err := adjustBalance(db, sellerID, coinSelling, -amountSelling); err != nil {
+		return tradeID, err
+	}
+	return tradeID, nil
 }
 
 // getOpenTrades retrieves all open trades
 func (s *Server) getOpenTrades() ([]map[string]interface{}, error) {
 	rows, err := s.db.Query(`
-		SELECT id, seller_id, coin_selling, amount_selling, coin_buying, amount_buying, 
-		       price_per_unit, status, created_at
-		FROM trades
-		WHERE status = 'open'
-		ORDER BY created_at DESC
+		SELECT t.id, t.seller_id, COALESCE(u.username, ''), t.coin_selling, t.amount_selling, t.coin_buying, t.amount_buying,
+		       t.price_per_unit, t.status, t.created_at
+		FROM trades t
+		LEFT JOIN users u ON u.id = t.seller_id
+		WHERE t.status = 'open'
+		ORDER BY t.created_at DESC
 	`)
 
 	if err != nil {
@@ -363,20 +584,16 @@ func (s *Server) getOpenTrades() ([]map[string]interface{}, error) {
 	var trades []map[string]interface{}
 	for rows.Next() {
 		var id, sellerID int
-		var coinSelling, coinBuying, status string
+		var sellerName, coinSelling, coinBuying, status string
 		var amountSelling, amountBuying, pricePerUnit float64
 		var createdAt string
 
-		err := rows.Scan(&id, &sellerID, &coinSelling, &amountSelling, &coinBuying, &amountBuying,
+		err := rows.Scan(&id, &sellerID, &sellerName, &coinSelling, &amountSelling, &coinBuying, &amountBuying,
 			&pricePerUnit, &status, &createdAt)
 		if err != nil {
 			continue
 		}
 
-		// Get seller name
-		var sellerName string
-		s.db.QueryRow(`SELECT username FROM users WHERE id = ?`, sellerID).Scan(&sellerName)
-
 		trade := map[string]interface{}{
 			"id":             id,
 			"seller_id":      sellerID,
@@ -401,14 +618,14 @@ func (s *Server) getUserTrades(userID int) ([]map[string]interface{}, error) {
 	// Get trades where user was the seller
 	rows, err := s.db.Query(`
 		SELECT t.id, t.seller_id, t.coin_selling, t.amount_selling, t.coin_buying, t.amount_buying, 
-		       t.price_per_unit, t.status, t.created_at, NULL as counterparty
+		       t.price_per_unit, t.status, t.created_at, NULL as counterparty, NULL as fill_id
 		FROM trades t
 		WHERE t.seller_id = ?
 		UNION ALL
 		SELECT t.id, t.seller_id, t.coin_buying as coin_selling, tc.quantity as amount_selling, 
-		       t.coin_selling as coin_buying, (tc.quantity * t.price_per_unit) as amount_buying,
-		       t.price_per_unit, 'completed' as status, tc.completed_at as created_at,
-		       u.username as counterparty
+		       t.coin_selling as coin_buying, (tc.quantity * `+fillPriceSQL+`) as amount_buying,
+		       `+fillPriceSQL+`, 'completed' as status, tc.completed_at as created_at,
+		       u.username as counterparty, tc.id as fill_id
 		FROM trade_completions tc
 		JOIN trades t ON tc.trade_id = t.id
 		JOIN users u ON t.seller_id = u.id
@@ -421,15 +638,21 @@ func (s *Server) getUserTrades(userID int) ([]map[string]interface{}, error) {
 	}
 	defer rows.Close()
 
+	makerFills, takerFees, err := s.getUserFees(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	var trades []map[string]interface{}
 	for rows.Next() {
 		var id, sellerID int
 		var coinSelling, coinBuying, status, createdAt string
 		var amountSelling, amountBuying, pricePerUnit float64
 		var counterparty sql.NullString
+		var fillID sql.NullInt64
 
 		err := rows.Scan(&id, &sellerID, &coinSelling, &amountSelling, &coinBuying, &amountBuying,
-			&pricePerUnit, &status, &createdAt, &counterparty)
+			&pricePerUnit, &status, &createdAt, &counterparty, &fillID)
 		if err != nil {
 			continue
 		}
@@ -445,17 +668,199 @@ func (s *Server) getUserTrades(userID int) ([]map[string]interface{}, error) {
 			"status":         status,
 			"created_at":     createdAt,
 		}
-		
+
 		if counterparty.Valid {
 			trade["counterparty"] = counterparty.String
 		}
 
+		// Fees are paid in the coin received, coin_buying from the user's side.
+		// Executions of someone else's order are one fill as taker; own orders
+		// list every fill so far as maker.
+		if fillID.Valid {
+			fee := takerFees[fillID.Int64]
+			if fee == nil {
+				fee = &FeeCharge{Coin: coinBuying}
+			}
+			trade["fill_id"] = fillID.Int64
+			trade["liquidity"] = "taker"
+			trade["fee"] = fee.Amount
+			trade["fee_coin"] = fee.Coin
+			trade["fee_rate"] = fee.Rate
+		} else {
+			fills := makerFills[id]
+			if fills == nil {
+				fills = []*UserFill{}
+			}
+			var total float64
+			for _, fill := range fills {
+				total += fill.Fee.Amount
+			}
+			trade["liquidity"] = "maker"
+			trade["fills"] = fills
+			trade["fee"] = total
+			trade["fee_coin"] = coinBuying
+		}
+
 		trades = append(trades, trade)
 	}
 
 	return trades, nil
 }
 
+// UserFill is one execution of a user's own order and the maker fee they paid on it
+type UserFill struct {
+	ID          int64      `json:"id"`
+	Quantity    float64    `json:"quantity"`
+	Price       float64    `json:"price"`
+	Fee         *FeeCharge `json:"fee"`
+	CompletedAt string     `json:"completed_at"`
+}
+
+// getUserFees retrieves the fills of a user's orders by order, and the fees the user
+// paid as taker by fill. Fills from before fees were charged have a zero fee.
+func (s *Server) getUserFees(userID int) (map[int][]*UserFill, map[int64]*FeeCharge, error) {
+	rows, err := s.db.Query(`
+		SELECT tc.id, tc.trade_id, tc.quantity, `+fillPriceSQL+`, tc.completed_at, t.coin_buying,
+		       COALESCE(f.rate, 0), COALESCE(f.amount, 0)
+		FROM trade_completions tc
+		JOIN trades t ON t.id = tc.trade_id
+		LEFT JOIN trade_fees f ON f.completion_id = tc.id AND f.role = 'maker'
+		WHERE t.seller_id = ?
+		ORDER BY tc.id
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	makerFills := make(map[int][]*UserFill)
+	for rows.Next() {
+		var tradeID int
+		fill := &UserFill{Fee: &FeeCharge{}}
+		if err := rows.Scan(&fill.ID, &tradeID, &fill.Quantity, &fill.Price, &fill.CompletedAt, &fill.Fee.Coin, &fill.Fee.Rate, &fill.Fee.Amount); err != nil {
+			return nil, nil, err
+		}
+		makerFills[tradeID] = append(makerFills[tradeID], fill)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT completion_id, coin, rate, amount FROM trade_fees WHERE user_id = ? AND role = 'taker'`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	takerFees := make(map[int64]*FeeCharge)
+	for rows.Next() {
+		var fillID int64
+		fee := &FeeCharge{}
+		if err := rows.Scan(&fillID, &fee.Coin, &fee.Rate, &fee.Amount); err != nil {
+			return nil, nil, err
+		}
+		takerFees[fillID] = fee
+	}
+	return makerFills, takerFees, rows.Err()
+}
+
+// Fills are recorded in trade_completions.quantity in KCN, whichever coin the order sells.
+const (
+	// orderFilledSQL is how much of order t has been filled, in KCN
+	orderFilledSQL = `COALESCE((SELECT SUM(tc.quantity) FROM trade_completions tc WHERE tc.trade_id = t.id), 0)`
+	// orderSizeSQL is order t's full size in KCN
+	orderSizeSQL = `(CASE WHEN t.coin_selling = 'kernelcoin' THEN t.amount_selling ELSE t.amount_buying END)`
+	// orderEscrowSQL is what is still escrowed for order t, in the coin it sells.
+	// Amending an order restates its amounts at the new price to keep this true.
+	orderEscrowSQL = `(t.amount_selling - CASE WHEN t.coin_selling = 'kernelcoin' THEN ` + orderFilledSQL + ` ELSE ` + orderFilledSQL + ` * t.price_per_unit END)`
+	// fillPriceSQL is the price of fill tc of order t. Fills record their price since
+	// orders can be repriced; migrateDB fills it in for older fills.
+	fillPriceSQL = `COALESCE(tc.price, t.price_per_unit)`
+	// nextQueueSQL is the back of the time priority queue
+	nextQueueSQL = `(SELECT COALESCE(MAX(queue_seq), 0) + 1 FROM trades)`
+)
+
+// orderColumns selects a BookOrder from trades t
+const orderColumns = `t.id, t.seller_id, t.coin_selling, t.price_per_unit, ` + orderSizeSQL + `, ` + orderFilledSQL + `, t.status, t.created_at, COALESCE(t.queue_seq, t.id)`
+
+// scanOrder reads a row selected with orderColumns
+func scanOrder(row interface{ Scan(...interface{}) error }) (*BookOrder, error) {
+	order := &BookOrder{Market: marketKCNLTC}
+	var coinSelling string
+	var filled float64
+	if err := row.Scan(&order.ID, &order.SellerID, &coinSelling, &order.Price, &order.Size, &filled, &order.Status, &order.CreatedAt, &order.Queue); err != nil {
+		return nil, err
+	}
+	order.Side = "buy"
+	if coinSelling == "kernelcoin" {
+		order.Side = "sell"
+	}
+	order.Remaining = order.Size - filled
+	if order.Remaining < 1e-9 {
+		order.Remaining = 0
+	}
+	return order, nil
+}
+
+// getOrder retrieves a trade as an order with its remaining size
+func (s *Server) getOrder(tradeID int) (*BookOrder, error) {
+	return scanOrder(s.db.QueryRow(`SELECT `+orderColumns+` FROM trades t WHERE t.id = ?`, tradeID))
+}
+
+// getOpenOrders retrieves every open order in time priority
+func (s *Server) getOpenOrders() ([]*BookOrder, error) {
+	rows, err := s.db.Query(`SELECT ` + orderColumns + ` FROM trades t WHERE t.status = 'open' ORDER BY COALESCE(t.queue_seq, t.id), t.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*BookOrder{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// getRecentFills retrieves the latest executions, newest first
+func (s *Server) getRecentFills(limit int) ([]*Fill, error) {
+	rows, err := s.db.Query(`
+		SELECT tc.id, tc.trade_id, t.coin_selling, `+fillPriceSQL+`, tc.quantity, tc.completed_at, t.seller_id, tc.buyer_id
+		FROM trade_completions tc
+		JOIN trades t ON tc.trade_id = t.id
+		ORDER BY tc.id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fills := []*Fill{}
+	for rows.Next() {
+		fill := &Fill{Market: marketKCNLTC}
+		var coinSelling string
+		if err := rows.Scan(&fill.ID, &fill.OrderID, &coinSelling, &fill.Price, &fill.Size, &fill.Time, &fill.MakerID, &fill.TakerID); err != nil {
+			return nil, err
+		}
+		fill.Side = takerSide(coinSelling)
+		fills = append(fills, fill)
+	}
+	return fills, rows.Err()
+}
+
+// takerSide is the side of whoever executes an order selling coinSelling
+func takerSide(coinSelling string) string {
+	if coinSelling == "kernelcoin" {
+		return "buy"
+	}
+	return "sell"
+}
+
 // getTrade retrieves a specific trade
 func (s *Server) getTrade(tradeID int) (map[string]interface{}, error) {
 	var id, sellerID int
@@ -491,12 +896,28 @@ func (s *Server) executeTrade(tradeID int, buyerID int, quantity float64) error
 	if err != nil {
 		return err
 	}
+	order, err := s.getOrder(tradeID)
+	if err != nil {
+		return err
+	}
 
 	sellerID := trade["seller_id"].(int)
-	coinSelling := trade["coin_selling"].(string)
 	coinBuying := trade["coin_buying"].(string)
 	pricePerUnit := trade["price_per_unit"].(float64)
-	amountBuying := trade["amount_buying"].(float64)
+
+	if order.Status != "open" {
+		return fmt.Errorf("trade is no longer open")
+	}
+	if quantity <= 0 {
+		return fmt.Errorf("invalid quantity")
+	}
+	// Quantities are in KCN; what is left of the order is still escrowed by the seller
+	if quantity > order.Remaining+1e-9 {
+		return fmt.Errorf("trade amount unavailable")
+	}
+	if err := s.rules.CheckFill(order, quantity); err != nil {
+		return err
+	}
 
 	// The quantity parameter represents how much KCN is being traded
 	// Determine what the buyer is giving and receiving based on the trade structure
@@ -519,11 +940,8 @@ func (s *Server) executeTrade(tradeID int, buyerID int, quantity float64) error
 		buyerReceivesAmount = quantity
 	}
 
-	// Check balances
-	buyerBal, _ := s.getUserBalance(buyerID)
-	sellerBal, _ := s.getUserBalance(sellerID)
-
 	// Check buyer has enough of what they're giving
+	buyerBal, _ := s.getUserBalance(buyerID)
 	var buyerBalance float64
 	if buyerGives == "litecoin" {
 		buyerBalance = buyerBal.Litecoin
@@ -535,77 +953,135 @@ func (s *Server) executeTrade(tradeID int, buyerID int, quantity float64) error
 		return fmt.Errorf("insufficient balance")
 	}
 
-	// Check seller has enough reserved coins
-	var sellerCoinBalance float64
-	if coinSelling == "litecoin" {
-		sellerCoinBalance = sellerBal.Litecoin
-	} else {
-		sellerCoinBalance = sellerBal.Kernelcoin
+	// Rates depend on volume before this fill
+	now := time.Now()
+	makerRates, err := s.fees.Rates(marketKCNLTC, sellerID, now)
+	if err != nil {
+		return err
+	}
+	takerRates, err := s.fees.Rates(marketKCNLTC, buyerID, now)
+	if err != nil {
+		return err
 	}
 
-	if sellerCoinBalance < buyerReceivesAmount {
-		return fmt.Errorf("trade amount unavailable")
+	// The balances, the fill, its fees and the order's status change together or not at all
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
 	// Execute the trade:
 	// 1. Buyer loses what they're giving
-	_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s - ? WHERE user_id = ?`, buyerGives, buyerGives),
-		buyerGivesAmount, buyerID)
-	if err != nil {
+	if err := adjustBalance(tx, buyerID, buyerGives, -buyerGivesAmount); err != nil {
 		return err
 	}
 
 	// 2. Buyer receives what they're getting
-	_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s + ? WHERE user_id = ?`, buyerReceives, buyerReceives),
-		buyerReceivesAmount, buyerID)
-	if err != nil {
+	if err := adjustBalance(tx, buyerID, buyerReceives, buyerReceivesAmount); err != nil {
 		return err
 	}
 
 	// 3. Seller receives what buyer gave
-	_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s + ? WHERE user_id = ?`, buyerGives, buyerGives),
-		buyerGivesAmount, sellerID)
-	if err != nil {
+	if err := adjustBalance(tx, sellerID, buyerGives, buyerGivesAmount); err != nil {
 		return err
 	}
 
 	// Note: Seller's coinSelling was already deducted when the trade was created (reserved)
 
-	_, err = s.db.Exec(`INSERT INTO trade_completions (trade_id, buyer_id, quantity) VALUES (?, ?, ?)`,
-		tradeID, buyerID, quantity)
+	result, err := tx.Exec(`INSERT INTO trade_completions (trade_id, buyer_id, quantity, price) VALUES (?, ?, ?, ?)`,
+		tradeID, buyerID, quantity, pricePerUnit)
+	if err != nil {
+		return err
+	}
+	fillID, _ := result.LastInsertId()
 
-	// Check if trade is fully completed
-	if quantity >= amountBuying {
-		_, err = s.db.Exec(`UPDATE trades SET status = 'completed' WHERE id = ?`, tradeID)
+	// 4. Both sides pay their fee out of what they received
+	makerFee, err := s.chargeFee(tx, fillID, sellerID, "maker", buyerGives, makerRates.Maker, buyerGivesAmount)
+	if err != nil {
+		return err
+	}
+	takerFee, err := s.chargeFee(tx, fillID, buyerID, "taker", buyerReceives, takerRates.Taker, buyerReceivesAmount)
+	if err != nil {
+		return err
 	}
 
-	return err
+	// Check if trade is fully completed
+	eventType := "order_updated"
+	if order.Remaining-quantity <= 1e-9 {
+		eventType = "order_removed"
+		_, err = tx.Exec(`UPDATE trades SET status = 'completed' WHERE id = ?`, tradeID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.rollupCandles()
+
+	s.publishFill(&Fill{
+		ID:       fillID,
+		OrderID:  tradeID,
+		Market:   marketKCNLTC,
+		Side:     takerSide(trade["coin_selling"].(string)),
+		Price:    pricePerUnit,
+		Size:     quantity,
+		Time:     now.UTC(),
+		MakerID:  sellerID,
+		TakerID:  buyerID,
+		makerFee: makerFee,
+		takerFee: takerFee,
+	})
+	s.publishOrder(tradeID, eventType)
+	s.publishBalance(sellerID)
+	if buyerID != sellerID {
+		s.publishBalance(buyerID)
+	}
+	for _, fee := range []*FeeCharge{makerFee, takerFee} {
+		if fee.referrerID != 0 {
+			s.publishBalance(fee.referrerID)
+		}
+	}
+	return nil
 }
 
 // cancelTrade cancels a trade and returns coins to seller
 func (s *Server) cancelTrade(tradeID int, userID int) error {
-	trade, err := s.getTrade(tradeID)
+	if err := refundTrade(s.db, tradeID, userID); err != nil {
+		return err
+	}
+
+	s.publishOrder(tradeID, "order_removed")
+	s.publishBalance(userID)
+	return nil
+}
+
+// refundTrade cancels a trade and returns coins to seller, without publishing it
+func refundTrade(db execer, tradeID int, userID int) error {
+	var sellerID int
+	var coinSelling, status string
+	var escrow float64
+	// Only the unfilled part is still escrowed
+	err := db.QueryRow(`SELECT t.seller_id, t.coin_selling, t.status, `+orderEscrowSQL+` FROM trades t WHERE t.id = ?`, tradeID).
+		Scan(&sellerID, &coinSelling, &status, &escrow)
 	if err != nil {
 		return err
 	}
 
-	sellerID := trade["seller_id"].(int)
 	if sellerID != userID {
 		return fmt.Errorf("cannot cancel trade you don't own")
 	}
 
-	coinSelling := trade["coin_selling"].(string)
-	amountSelling := trade["amount_selling"].(float64)
+	if status != "open" {
+		return fmt.Errorf("trade is no longer open")
+	}
 
-	_, err = s.db.Exec(
-		fmt.Sprintf(`UPDATE balances SET %s = %s + ? WHERE user_id = ?`, coinSelling, coinSelling),
-		amountSelling, userID,
-	)
-	if err != nil {
+	if err := adjustBalance(db, userID, coinSelling, escrow); err != nil {
 		return err
 	}
 
-	_, err = s.db.Exec(`UPDATE trades SET status = 'cancelled', cancelled_at = CURRENT_TIMESTAMP WHERE id = ?`, tradeID)
+	_, err = db.Exec(`UPDATE trades SET status = 'cancelled', cancelled_at = CURRENT_TIMESTAMP WHERE id = ?`, tradeID)
 	return err
 }
 
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ElectrumConfig configures the connection to an Electrum daemon's JSON-RPC interface.
+// The daemon's credentials are set with `electrum setconfig rpcuser/rpcpassword/rpcport`.
+type ElectrumConfig struct {
+	URL         string
+	User        string
+	Password    string
+	WalletPath  string // wallet to load on connect; empty for the daemon's default wallet
+	Timeout     time.Duration
+	WithdrawFee float64
+}
+
+// ElectrumError is an error returned by the Electrum daemon for a command
+type ElectrumError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *ElectrumError) Error() string {
+	return fmt.Sprintf("electrum %s error %d: %s", e.Method, e.Code, e.Message)
+}
+
+// walletNotLoaded reports whether the daemon rejected a command because no wallet is open
+func (e *ElectrumError) walletNotLoaded() bool {
+	return strings.Contains(strings.ToLower(e.Message), "wallet not loaded")
+}
+
+// ElectrumCall is one command in a batch. Result is decoded into when the call succeeds.
+type ElectrumCall struct {
+	Method string
+	Params map[string]interface{}
+	Result interface{}
+	Err    error
+}
+
+// ElectrumClient talks to the Electrum daemon over HTTP JSON-RPC
+type ElectrumClient struct {
+	url         string
+	user        string
+	password    string
+	walletPath  string
+	withdrawFee float64
+	httpClient  *http.Client
+	timeout     time.Duration
+	breaker     *circuitBreaker
+	nextID      atomic.Int64
+	noBatch     atomic.Bool // the daemon does not accept batch requests
+
+	loadMu sync.Mutex
+	loaded bool
+}
+
+type electrumRequest struct {
+	JSONRPC string                 `json:"jsonrpc"`
+	ID      int64                  `json:"id"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+type electrumResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// NewElectrumClient creates a client for the Electrum daemon
+func NewElectrumClient(cfg ElectrumConfig) *ElectrumClient {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	return &ElectrumClient{
+		url:         cfg.URL,
+		user:        cfg.User,
+		password:    cfg.Password,
+		walletPath:  cfg.WalletPath,
+		withdrawFee: cfg.WithdrawFee,
+		httpClient:  &http.Client{Transport: rpcTransport},
+		timeout:     cfg.Timeout,
+		breaker:     newCircuitBreaker("ELECTRUM"),
+	}
+}
+
+// post sends one JSON-RPC payload (a request or a batch) and returns the raw body.
+// Failures to get a response are returned as a TransportError.
+func (e *ElectrumClient) post(method string, payload interface{}) ([]byte, error) {
+	if !e.breaker.allow() {
+		return nil, &TransportError{Method: method, Err: ErrWalletUnavailable}
+	}
+
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.SetBasicAuth(e.user, e.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		transportErr := newTransportError(method, err)
+		e.breaker.failure(transportErr)
+		return nil, transportErr
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		transportErr := &TransportError{Method: method, Sent: true, Err: err}
+		e.breaker.failure(transportErr)
+		return nil, transportErr
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		transportErr := &TransportError{Method: method, Sent: true, Err: fmt.Errorf("electrum daemon rejected credentials (check rpcuser/rpcpassword)")}
+		e.breaker.failure(transportErr)
+		return nil, transportErr
+	}
+	// Daemon errors come back as JSON; anything else (a proxy's 502/503) is a transport problem
+	if resp.StatusCode != http.StatusOK && !json.Valid(body) {
+		transportErr := &TransportError{Method: method, Sent: true, Err: fmt.Errorf("HTTP %s", resp.Status)}
+		e.breaker.failure(transportErr)
+		return nil, transportErr
+	}
+
+	e.breaker.success()
+	return body, nil
+}
+
+// decodeElectrumResponse turns a JSON-RPC response into either a decoded result or an ElectrumError
+func decodeElectrumResponse(method string, response electrumResponse, result interface{}) error {
+	if response.Error != nil {
+		return &ElectrumError{Method: method, Code: response.Error.Code, Message: response.Error.Message}
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("unexpected electrum %s response: %w", method, err)
+	}
+	return nil
+}
+
+// call performs a single command
+func (e *ElectrumClient) call(method string, params map[string]interface{}, result interface{}) error {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	body, err := e.post(method, electrumRequest{JSONRPC: "2.0", ID: e.nextID.Add(1), Method: method, Params: params})
+	if err != nil {
+		log.Printf("[ELECTRUM] %s ERROR: %v", method, err)
+		return err
+	}
+
+	var response electrumResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.Printf("[ELECTRUM] %s ERROR: Failed to parse response: %v", method, err)
+		return fmt.Errorf("unmarshal error: %w", err)
+	}
+	if err := decodeElectrumResponse(method, response, result); err != nil {
+		log.Printf("[ELECTRUM] %s ERROR: %v", method, err)
+		return err
+	}
+	return nil
+}
+
+// LoadWallet opens the configured wallet in the daemon. Loading a wallet that is
+// already open succeeds, so this is safe to repeat.
+func (e *ElectrumClient) LoadWallet() error {
+	e.loadMu.Lock()
+	defer e.loadMu.Unlock()
+
+	params := map[string]interface{}{}
+	if e.walletPath != "" {
+		params["wallet_path"] = e.walletPath
+	}
+	if err := e.call("load_wallet", params, nil); err != nil {
+		return err
+	}
+	e.loaded = true
+	log.Printf("[ELECTRUM] Wallet loaded")
+	return nil
+}
+
+// ensureWallet loads the wallet the first time a wallet command is made
+func (e *ElectrumClient) ensureWallet() error {
+	e.loadMu.Lock()
+	loaded := e.loaded
+	e.loadMu.Unlock()
+	if loaded {
+		return nil
+	}
+	return e.LoadWallet()
+}
+
+// walletCall performs a command on the exchange's wallet, loading it first and
+// reloading it once if the daemon was restarted
+func (e *ElectrumClient) walletCall(method string, params map[string]interface{}, result interface{}) error {
+	if err := e.ensureWallet(); err != nil {
+		return err
+	}
+
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	if e.walletPath != "" {
+		params["wallet"] = e.walletPath
+	}
+
+	err := e.call(method, params, result)
+	if electrumErr, ok := err.(*ElectrumError); ok && electrumErr.walletNotLoaded() {
+		e.loadMu.Lock()
+		e.loaded = false
+		e.loadMu.Unlock()
+		if err := e.LoadWallet(); err != nil {
+			return err
+		}
+		err = e.call(method, params, result)
+	}
+	return err
+}
+
+// Batch sends several network commands in one request. Each call's Err is set
+// individually; the returned error is only for failures affecting the whole batch.
+func (e *ElectrumClient) Batch(calls ...*ElectrumCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	requests := make([]electrumRequest, len(calls))
+	byID := make(map[int64]*ElectrumCall, len(calls))
+	for i, c := range calls {
+		params := c.Params
+		if params == nil {
+			params = map[string]interface{}{}
+		}
+		requests[i] = electrumRequest{JSONRPC: "2.0", ID: e.nextID.Add(1), Method: c.Method, Params: params}
+		byID[requests[i].ID] = c
+	}
+
+	if e.noBatch.Load() {
+		e.callEach(calls)
+		return nil
+	}
+
+	body, err := e.post("batch", requests)
+	if err != nil {
+		log.Printf("[ELECTRUM] batch ERROR: %v", err)
+		return err
+	}
+
+	// Some daemons (Electrum-LTC 4.2) answer an array with a single error object.
+	// Those get one request per call from then on.
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		log.Printf("[ELECTRUM] Daemon rejected a batch request, sending calls one at a time")
+		e.noBatch.Store(true)
+		e.callEach(calls)
+		return nil
+	}
+
+	var responses []electrumResponse
+	if err := json.Unmarshal(body, &responses); err != nil {
+		log.Printf("[ELECTRUM] batch ERROR: Failed to parse response: %v", err)
+		return fmt.Errorf("unmarshal error: %w", err)
+	}
+
+	for _, response := range responses {
+		if c, ok := byID[response.ID]; ok {
+			c.Err = decodeElectrumResponse(c.Method, response, c.Result)
+			delete(byID, response.ID)
+		}
+	}
+	for _, c := range byID {
+		c.Err = fmt.Errorf("electrum %s: no response in batch", c.Method)
+	}
+	return nil
+}
+
+// callEach performs a batch's calls as separate requests
+func (e *ElectrumClient) callEach(calls []*ElectrumCall) {
+	for _, c := range calls {
+		c.Err = e.call(c.Method, c.Params, c.Result)
+	}
+}
+
+// CreateNewAddress creates a new address using Electrum
+func (e *ElectrumClient) CreateNewAddress() (string, error) {
+	log.Printf("[ELECTRUM] CreateNewAddress: Generating new address")
+	var address string
+	if err := e.walletCall("createnewaddress", nil, &address); err != nil {
+		return "", err
+	}
+	log.Printf("[ELECTRUM] CreateNewAddress SUCCESS: %s", address)
+	return address, nil
+}
+
+// GetAddressBalance gets the balance for an address using Electrum
+func (e *ElectrumClient) GetAddressBalance(address string) (float64, float64, error) {
+	log.Printf("[ELECTRUM] GetAddressBalance: Checking address %s", address)
+	var result struct {
+		Confirmed   string `json:"confirmed"`
+		Unconfirmed string `json:"unconfirmed"`
+	}
+	if err := e.call("getaddressbalance", map[string]interface{}{"address": address}, &result); err != nil {
+		return 0, 0, err
+	}
+
+	confirmed, _ := strconv.ParseFloat(result.Confirmed, 64)
+	unconfirmed, _ := strconv.ParseFloat(result.Unconfirmed, 64)
+
+	log.Printf("[ELECTRUM] GetAddressBalance SUCCESS: confirmed=%.8f, unconfirmed=%.8f", confirmed, unconfirmed)
+	return confirmed, unconfirmed, nil
+}
+
+// ElectrumHistoryItem is a transaction touching an address, as returned by getaddresshistory.
+// Height is 0 or below while the transaction is unconfirmed.
+type ElectrumHistoryItem struct {
+	TxHash string `json:"tx_hash"`
+	Height int64  `json:"height"`
+}
+
+// GetAddressHistory lists every transaction that paid to or spent from an address.
+// Unlike getaddressunspent it keeps deposits that have since been spent.
+func (e *ElectrumClient) GetAddressHistory(address string) ([]ElectrumHistoryItem, error) {
+	log.Printf("[ELECTRUM] GetAddressHistory: Checking address %s", address)
+	var history []ElectrumHistoryItem
+	if err := e.call("getaddresshistory", map[string]interface{}{"address": address}, &history); err != nil {
+		return nil, err
+	}
+	log.Printf("[ELECTRUM] GetAddressHistory SUCCESS: %d transactions", len(history))
+	return history, nil
+}
+
+// ElectrumOutput is a transaction output, as returned by deserialize
+type ElectrumOutput struct {
+	Address   string `json:"address"`
+	ValueSats int64  `json:"value_sats"`
+}
+
+// GetTransactionOutputs fetches a transaction from the network and decodes its outputs
+func (e *ElectrumClient) GetTransactionOutputs(txid string) ([]ElectrumOutput, error) {
+	var raw string
+	if err := e.call("gettransaction", map[string]interface{}{"txid": txid}, &raw); err != nil {
+		return nil, err
+	}
+	var tx struct {
+		Outputs []ElectrumOutput `json:"outputs"`
+	}
+	if err := e.call("deserialize", map[string]interface{}{"tx": raw}, &tx); err != nil {
+		return nil, err
+	}
+	return tx.Outputs, nil
+}
+
+// ElectrumInfo is the subset of getinfo output the exchange uses
+type ElectrumInfo struct {
+	BlockchainHeight int64  `json:"blockchain_height"`
+	ServerHeight     int64  `json:"server_height"`
+	Connected        bool   `json:"connected"`
+	Server           string `json:"server"`
+	SPVNodes         int    `json:"spv_nodes"`
+}
+
+// GetInfo returns the daemon's network status
+func (e *ElectrumClient) GetInfo() (*ElectrumInfo, error) {
+	var info ElectrumInfo
+	if err := e.call("getinfo", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// GetBalance returns the wallet's confirmed and unconfirmed balance
+func (e *ElectrumClient) GetBalance() (float64, float64, error) {
+	var result struct {
+		Confirmed   string `json:"confirmed"`
+		Unconfirmed string `json:"unconfirmed"`
+	}
+	if err := e.walletCall("getbalance", nil, &result); err != nil {
+		return 0, 0, err
+	}
+
+	confirmed, _ := strconv.ParseFloat(result.Confirmed, 64)
+	unconfirmed, _ := strconv.ParseFloat(result.Unconfirmed, 64)
+	return confirmed, unconfirmed, nil
+}
+
+// ValidateAddress checks an address against the wallet's network
+func (e *ElectrumClient) ValidateAddress(address string) (bool, error) {
+	var valid bool
+	if err := e.call("validateaddress", map[string]interface{}{"address": address}, &valid); err != nil {
+		return false, err
+	}
+	return valid, nil
+}
+
+// PayTo sends Litecoin to an address using Electrum with configurable fee
+func (e *ElectrumClient) PayTo(address string, amount float64) (string, error) {
+	fee := e.withdrawFee
+	netAmount := amount - fee
+
+	log.Printf("[ELECTRUM] PayTo: sending %.8f to %s (fee: %.8f, net: %.8f)", amount, address, fee, netAmount)
+
+	if netAmount <= 0 {
+		return "", fmt.Errorf("amount too small after fee deduction")
+	}
+
+	// Step 1: Create and sign the transaction
+	var hex string
+	amountStr := fmt.Sprintf("%.8f", netAmount)
+	if err := e.walletCall("payto", map[string]interface{}{"destination": address, "amount": amountStr}, &hex); err != nil {
+		log.Printf("[ELECTRUM] PayTo Step 1 ERROR: %v", err)
+		// payto only builds and signs the transaction, so nothing was broadcast
+		var transportErr *TransportError
+		if errors.As(err, &transportErr) {
+			transportErr.Sent = false
+		}
+		return "", err
+	}
+	log.Printf("[ELECTRUM] Generated hex: %s", hex)
+
+	// Step 2: Broadcast transaction
+	var txid string
+	if err := e.call("broadcast", map[string]interface{}{"tx": hex}, &txid); err != nil {
+		log.Printf("[ELECTRUM] PayTo Step 2 ERROR: %v", err)
+		return "", err
+	}
+	log.Printf("[ELECTRUM] PayTo SUCCESS: %s (kept %.8f LTC as fee)", txid, fee)
+	return txid, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestElectrumBatchFallsBackToSingleCalls(t *testing.T) {
+	chain := newFakeChain("rltc1q", 2000)
+	electrum := newFakeElectrum(t, chain)
+	client := NewElectrumClient(ElectrumConfig{URL: electrum.URL, User: "user", Password: "electrumpass"})
+	wallet := NewElectrumWallet(client)
+
+	address, err := wallet.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Pay(address, 0.25)
+	chain.Mine(2)
+
+	for i := 0; i < 2; i++ {
+		var info ElectrumInfo
+		var history []ElectrumHistoryItem
+		infoCall := &ElectrumCall{Method: "getinfo", Result: &info}
+		historyCall := &ElectrumCall{Method: "getaddresshistory", Params: map[string]interface{}{"address": address}, Result: &history}
+		if err := client.Batch(infoCall, historyCall); err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+		if infoCall.Err != nil || historyCall.Err != nil || info.BlockchainHeight != 2002 || len(history) != 1 {
+			t.Errorf("batch %d: info %+v (%v), history %+v (%v)", i, info, infoCall.Err, history, historyCall.Err)
+		}
+	}
+	// The rejected batch is not retried
+	if n := chain.Calls("batch"); n != 1 {
+		t.Errorf("batch requests = %d, want 1", n)
+	}
+
+	transfers, err := wallet.IncomingTransfers(address)
+	if err != nil || len(transfers) != 1 || transfers[0].Amount != 0.25 || transfers[0].Confirmations != 2 {
+		t.Errorf("incoming transfers = %+v, %v", transfers, err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// marketKCNLTC is the exchange's only market: KCN priced in LTC
+const marketKCNLTC = "KCN-LTC"
+
+// Feed streams. Every user also has a private stream, see userStream.
+const (
+	streamBook   = "book"
+	streamTrades = "trades"
+)
+
+// How many recent events each stream keeps for clients that missed some
+const (
+	publicReplay = 500
+	userReplay   = 100
+)
+
+// Event is one message on a feed stream. Seq increases by one per event on a
+// stream, so a client that sees a gap knows to resync. Sequences restart when the
+// process does, so snapshots carry the hub's Epoch for clients to resume against.
+type Event struct {
+	Channel string      `json:"channel"`
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"`
+	Epoch   string      `json:"epoch,omitempty"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data"`
+	stream  string
+}
+
+// BookOrder is an order as the order book and feeds see it. Price is LTC per KCN
+// and sizes are in KCN whichever coin the order sells.
+type BookOrder struct {
+	ID        int     `json:"id"`
+	Market    string  `json:"market"`
+	Side      string  `json:"side"` // "sell" offers KCN for LTC, "buy" offers LTC for KCN
+	Price     float64 `json:"price"`
+	Size      float64 `json:"size"`
+	Remaining float64 `json:"remaining"`
+	Status    string  `json:"status"`
+	SellerID  int     `json:"-"`
+	CreatedAt string  `json:"created_at"`
+	Queue     int64   `json:"queue"` // place in time priority, lower first
+}
+
+// Fill is one execution against an order
+type Fill struct {
+	ID      int64      `json:"id"`
+	OrderID int        `json:"order_id"`
+	Market  string     `json:"market"`
+	Side    string     `json:"side"` // the taker's side: "buy" if the taker bought KCN
+	Price   float64    `json:"price"`
+	Size    float64    `json:"size"`
+	Time    time.Time  `json:"time"`
+	MakerID int        `json:"-"`
+	TakerID int        `json:"-"`
+	Role    string     `json:"role,omitempty"` // set on user channels: "maker" or "taker"
+	Fee     *FeeCharge `json:"fee,omitempty"`  // set on user channels
+
+	makerFee, takerFee *FeeCharge
+}
+
+// eventStream is the sequence and recent history of one stream
+type eventStream struct {
+	seq    uint64
+	recent []Event
+	limit  int
+}
+
+// EventHub numbers events per stream and fans them out to subscribers. Events are
+// published while s.mu is held for writing, so a snapshot taken under s.mu.RLock
+// is consistent with the stream's sequence number.
+type EventHub struct {
+	mu          sync.Mutex
+	epoch       string // identifies this process's sequences
+	streams     map[string]*eventStream
+	subscribers map[*feedClient]struct{}
+}
+
+// NewEventHub creates an empty hub with a new epoch
+func NewEventHub() *EventHub {
+	epoch := make([]byte, 8)
+	if _, err := randRead(epoch); err != nil {
+		// Unique enough to tell restarts apart
+		binary.BigEndian.PutUint64(epoch, uint64(time.Now().UnixNano()))
+	}
+	return &EventHub{
+		epoch:       hex.EncodeToString(epoch),
+		streams:     make(map[string]*eventStream),
+		subscribers: make(map[*feedClient]struct{}),
+	}
+}
+
+// Epoch identifies the hub's sequences. Sequence numbers from another epoch mean
+// nothing here.
+func (h *EventHub) Epoch() string {
+	if h == nil {
+		return ""
+	}
+	return h.epoch
+}
+
+// userStream is the private stream for a user
+func userStream(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// channelOf maps a stream to the channel name clients subscribe to
+func channelOf(stream string) string {
+	if stream == streamBook || stream == streamTrades {
+		return stream
+	}
+	return "user"
+}
+
+// stream returns a stream, creating it on first use. Caller must hold h.mu.
+func (h *EventHub) stream(name string) *eventStream {
+	st, ok := h.streams[name]
+	if !ok {
+		limit := publicReplay
+		if channelOf(name) == "user" {
+			limit = userReplay
+		}
+		st = &eventStream{limit: limit}
+		h.streams[name] = st
+	}
+	return st
+}
+
+// Publish appends an event to a stream, sends it to the stream's subscribers and
+// returns its sequence number
+func (h *EventHub) Publish(stream, eventType string, data interface{}) uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.stream(stream)
+	st.seq++
+	event := Event{Channel: channelOf(stream), Type: eventType, Seq: st.seq, Time: time.Now().UTC(), Data: data, stream: stream}
+	st.recent = append(st.recent, event)
+	if len(st.recent) > st.limit {
+		st.recent = st.recent[len(st.recent)-st.limit:]
+	}
+
+	for client := range h.subscribers {
+		if client.subscribed(stream) {
+			client.send(event)
+		}
+	}
+	return st.seq
+}
+
+// Seq returns the sequence number of the last event on a stream
+func (h *EventHub) Seq(stream string) uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stream(stream).seq
+}
+
+// Since returns the events after seq in epoch, or false if some of them are no
+// longer kept or seq is from another epoch
+func (h *EventHub) Since(stream, epoch string, seq uint64) ([]Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if epoch != h.epoch {
+		return nil, false
+	}
+
+	st := h.stream(stream)
+	if seq > st.seq {
+		return nil, false
+	}
+	missed := int(st.seq - seq)
+	if missed > len(st.recent) {
+		return nil, false
+	}
+	return append([]Event(nil), st.recent[len(st.recent)-missed:]...), true
+}
+
+func (h *EventHub) add(client *feedClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[client] = struct{}{}
+}
+
+func (h *EventHub) remove(client *feedClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, client)
+}
+
+// publishOrder applies a new or changed order to the in-memory book and announces
+// it on the book channel and to its owner. Caller must hold s.mu.
+func (s *Server) publishOrder(tradeID int, eventType string) {
+	order, err := s.getOrder(tradeID)
+	if err != nil {
+		log.Printf("[FEED] Failed to load order %d: %v", tradeID, err)
+		return
+	}
+	seq := s.events.Publish(streamBook, eventType, order)
+	s.book.Apply(order, seq)
+	s.events.Publish(userStream(order.SellerID), "order", order)
+}
+
+// publishFill announces an execution on the trade tape and to both parties. Caller must hold s.mu.
+func (s *Server) publishFill(fill *Fill) {
+	if s.events == nil {
+		return
+	}
+	s.events.Publish(streamTrades, "trade", fill)
+
+	maker, taker := *fill, *fill
+	maker.Role, taker.Role = "maker", "taker"
+	maker.Fee, taker.Fee = fill.makerFee, fill.takerFee
+	s.events.Publish(userStream(fill.MakerID), "fill", &maker)
+	s.events.Publish(userStream(fill.TakerID), "fill", &taker)
+}
+
+// publishBalance sends a user their current balances. Caller must hold s.mu.
+func (s *Server) publishBalance(userID int) {
+	if s.events == nil {
+		return
+	}
+	balance, err := s.getUserBalance(userID)
+	if err != nil {
+		log.Printf("[FEED] Failed to load balance for user %d: %v", userID, err)
+		return
+	}
+	s.events.Publish(userStream(userID), "balance", map[string]float64{
+		"kernelcoin": balance.Kernelcoin,
+		"litecoin":   balance.Litecoin,
+	})
+}
+
+// publishTransfer tells a user about a deposit or withdrawal. Caller must hold s.mu.
+func (s *Server) publishTransfer(userID int, eventType, coin string, amount float64, status, txHash string) {
+	if s.events == nil {
+		return
+	}
+	s.events.Publish(userStream(userID), eventType, map[string]interface{}{
+		"coin":    coin,
+		"amount":  amount,
+		"status":  status,
+		"tx_hash": txHash,
+	})
+}
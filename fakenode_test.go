@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTx is a payment into or out of a fake wallet. Height 0 means it is in the mempool.
+type fakeTx struct {
+	TxID     string
+	Address  string
+	Amount   float64
+	Height   int64
+	Incoming bool
+}
+
+// fakeFailure is a scripted error for the next calls to a method
+type fakeFailure struct {
+	code    int
+	message string
+	times   int
+}
+
+// fakeChain is an in-memory chain and wallet shared by the fake daemons. Tests
+// script it with Pay, Mine, Reorg, Drop, FailNext, SetLatency and SetDown.
+type fakeChain struct {
+	mu        sync.Mutex
+	prefix    string // every address on this chain starts with it
+	height    int64
+	hashes    []string // block hash by height
+	reorgs    int
+	nextAddr  int
+	nextTx    int
+	addresses map[string]bool
+	txs       []*fakeTx
+	failures  map[string]*fakeFailure
+	latency   map[string]time.Duration // "" applies to every method
+	down      bool
+	calls     []string
+}
+
+func newFakeChain(prefix string, height int64) *fakeChain {
+	c := &fakeChain{
+		prefix:    prefix,
+		addresses: make(map[string]bool),
+		failures:  make(map[string]*fakeFailure),
+		latency:   make(map[string]time.Duration),
+	}
+	c.hashes = []string{c.blockHash(0)}
+	c.mine(height)
+	return c
+}
+
+// blockHash derives a block hash from its height and how many reorgs happened. Caller must hold c.mu.
+func (c *fakeChain) blockHash(height int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d", c.prefix, c.reorgs, height)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTxID returns a unique transaction ID. Caller must hold c.mu.
+func (c *fakeChain) newTxID() string {
+	c.nextTx++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/tx/%d", c.prefix, c.nextTx)))
+	return hex.EncodeToString(sum[:])
+}
+
+// mine adds blocks, confirming every mempool transaction in the first. Caller must hold c.mu.
+func (c *fakeChain) mine(blocks int64) {
+	for i := int64(0); i < blocks; i++ {
+		c.height++
+		c.hashes = append(c.hashes, c.blockHash(c.height))
+		for _, tx := range c.txs {
+			if tx.Height == 0 {
+				tx.Height = c.height
+			}
+		}
+	}
+}
+
+// confirmations returns how deep a transaction is. Caller must hold c.mu.
+func (c *fakeChain) confirmations(tx *fakeTx) int {
+	if tx.Height == 0 {
+		return 0
+	}
+	return int(c.height - tx.Height + 1)
+}
+
+// balances returns the wallet's confirmed and unconfirmed balance. Caller must hold c.mu.
+func (c *fakeChain) balances() (confirmed, unconfirmed float64) {
+	for _, tx := range c.txs {
+		switch {
+		case !tx.Incoming:
+			confirmed -= tx.Amount
+		case tx.Height > 0:
+			confirmed += tx.Amount
+		default:
+			unconfirmed += tx.Amount
+		}
+	}
+	return confirmed, unconfirmed
+}
+
+// send records a payment out of the wallet. Caller must hold c.mu.
+func (c *fakeChain) send(address string, amount float64) (string, *fakeFailure) {
+	if !c.validAddress(address) {
+		return "", &fakeFailure{code: rpcErrInvalidAddress, message: "Invalid address"}
+	}
+	if confirmed, _ := c.balances(); amount > confirmed+1e-9 {
+		return "", &fakeFailure{code: rpcErrInsufficientFunds, message: "Insufficient funds"}
+	}
+	tx := &fakeTx{TxID: c.newTxID(), Address: address, Amount: amount}
+	c.txs = append(c.txs, tx)
+	return tx.TxID, nil
+}
+
+func (c *fakeChain) validAddress(address string) bool {
+	return strings.HasPrefix(address, c.prefix) && len(address) > len(c.prefix)
+}
+
+// Pay simulates someone paying address; the payment sits in the mempool until mined
+func (c *fakeChain) Pay(address string, amount float64) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx := &fakeTx{TxID: c.newTxID(), Address: address, Amount: amount, Incoming: true}
+	c.txs = append(c.txs, tx)
+	return tx.TxID
+}
+
+// Mine adds blocks
+func (c *fakeChain) Mine(blocks int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mine(int64(blocks))
+}
+
+// Reorg replaces the last depth blocks with an equally long chain that holds none
+// of their transactions, which return to the mempool
+func (c *fakeChain) Reorg(depth int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fork := c.height - int64(depth)
+	for _, tx := range c.txs {
+		if tx.Height > fork {
+			tx.Height = 0
+		}
+	}
+	c.reorgs++
+	c.hashes = c.hashes[:fork+1]
+	for h := fork + 1; h <= fork+int64(depth); h++ {
+		c.hashes = append(c.hashes, c.blockHash(h))
+	}
+}
+
+// Drop removes an unconfirmed transaction, as if it was double spent
+func (c *fakeChain) Drop(txid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, tx := range c.txs {
+		if tx.TxID == txid && tx.Height == 0 {
+			c.txs = append(c.txs[:i], c.txs[i+1:]...)
+			return
+		}
+	}
+}
+
+// FailNext makes the next times calls to method fail with an RPC error
+func (c *fakeChain) FailNext(method string, times, code int, message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[method] = &fakeFailure{code: code, message: message, times: times}
+}
+
+// SetLatency delays responses to method, or to every method when method is ""
+func (c *fakeChain) SetLatency(method string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency[method] = d
+}
+
+// SetDown makes the daemon answer every request with HTTP 503
+func (c *fakeChain) SetDown(down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = down
+}
+
+// Sent returns the payments made out of the wallet
+func (c *fakeChain) Sent() []fakeTx {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sent []fakeTx
+	for _, tx := range c.txs {
+		if !tx.Incoming {
+			sent = append(sent, *tx)
+		}
+	}
+	return sent
+}
+
+// Calls returns how many times method has been called
+func (c *fakeChain) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, call := range c.calls {
+		if call == method {
+			n++
+		}
+	}
+	return n
+}
+
+// begin applies latency and scripted failures before a call is handled
+func (c *fakeChain) begin(method string) *fakeFailure {
+	c.mu.Lock()
+	c.calls = append(c.calls, method)
+	delay := c.latency[""] + c.latency[method]
+	c.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.failures[method]; f != nil && f.times > 0 {
+		f.times--
+		return f
+	}
+	return nil
+}
+
+// fakeRPCRequest is one JSON-RPC request as the exchange sends it. Params are
+// positional for kernelcoind and named for Electrum.
+type fakeRPCRequest struct {
+	ID     int64           `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// fakeRPCResponse is a JSON-RPC response
+type fakeRPCResponse struct {
+	JSONRPC string       `json:"jsonrpc"`
+	Result  interface{}  `json:"result"`
+	Error   *fakeRPCFail `json:"error"`
+	ID      int64        `json:"id"`
+}
+
+type fakeRPCFail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// serveJSONRPC is the HTTP side shared by both fake daemons: authentication,
+// outages, and single or batched requests. Without batches a request array is
+// answered with a single error, as Electrum-LTC 4.2 does.
+func serveJSONRPC(c *fakeChain, user, password string, batches bool, dispatch func(method string, params json.RawMessage) (interface{}, *fakeFailure)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		c.mu.Lock()
+		down := c.down
+		c.mu.Unlock()
+		if down {
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+
+		handle := func(req fakeRPCRequest) fakeRPCResponse {
+			resp := fakeRPCResponse{JSONRPC: "2.0", ID: req.ID}
+			if f := c.begin(req.Method); f != nil {
+				resp.Error = &fakeRPCFail{Code: f.code, Message: f.message}
+				return resp
+			}
+			result, f := dispatch(req.Method, req.Params)
+			if f != nil {
+				resp.Error = &fakeRPCFail{Code: f.code, Message: f.message}
+			} else {
+				resp.Result = result
+			}
+			return resp
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if bytes.HasPrefix(bytes.TrimSpace(body.Bytes()), []byte("[")) {
+			c.mu.Lock()
+			c.calls = append(c.calls, "batch")
+			c.mu.Unlock()
+			if !batches {
+				json.NewEncoder(w).Encode(fakeRPCResponse{JSONRPC: "2.0", Error: &fakeRPCFail{Code: -32600, Message: "Invalid Request"}})
+				return
+			}
+			var reqs []fakeRPCRequest
+			if err := json.Unmarshal(body.Bytes(), &reqs); err != nil {
+				http.Error(w, "bad batch", http.StatusBadRequest)
+				return
+			}
+			resps := make([]fakeRPCResponse, len(reqs))
+			for i, req := range reqs {
+				resps[i] = handle(req)
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+
+		var req fakeRPCRequest
+		if err := json.Unmarshal(body.Bytes(), &req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp := handle(req)
+		if resp.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError) // as bitcoind does
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// newFakeKernelcoind serves the bitcoind JSON-RPC subset RPCWallet uses
+func newFakeKernelcoind(t *testing.T, c *fakeChain) *httptest.Server {
+	t.Helper()
+
+	dispatch := func(method string, raw json.RawMessage) (interface{}, *fakeFailure) {
+		var params []interface{}
+		json.Unmarshal(raw, &params)
+		str := func(i int) string {
+			if i < len(params) {
+				s, _ := params[i].(string)
+				return s
+			}
+			return ""
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		switch method {
+		case "getnewaddress":
+			c.nextAddr++
+			address := fmt.Sprintf("%s%08d", c.prefix, c.nextAddr)
+			c.addresses[address] = true
+			return address, nil
+
+		case "listreceivedbyaddress":
+			address := str(3)
+			entry := map[string]interface{}{"address": address, "amount": 0.0, "confirmations": 0, "txids": []string{}}
+			var txids []string
+			for _, tx := range c.txs {
+				if tx.Incoming && tx.Address == address {
+					txids = append(txids, tx.TxID)
+				}
+			}
+			if len(txids) == 0 {
+				return []interface{}{}, nil
+			}
+			entry["txids"] = txids
+			return []interface{}{entry}, nil
+
+		case "gettransaction":
+			for _, tx := range c.txs {
+				if tx.TxID == str(0) {
+					category, amount := "receive", tx.Amount
+					if !tx.Incoming {
+						category, amount = "send", -tx.Amount
+					}
+					return map[string]interface{}{
+						"txid":          tx.TxID,
+						"amount":        amount,
+						"confirmations": c.confirmations(tx),
+						"details":       []interface{}{map[string]interface{}{"address": tx.Address, "category": category, "amount": amount}},
+					}, nil
+				}
+			}
+			return nil, &fakeFailure{code: rpcErrInvalidAddress, message: "Invalid or non-wallet transaction id"}
+
+		case "sendtoaddress":
+			amount, _ := params[1].(float64)
+			txid, f := c.send(str(0), amount)
+			return txid, f
+
+		case "getbalances":
+			confirmed, unconfirmed := c.balances()
+			return map[string]interface{}{"mine": map[string]float64{"trusted": confirmed, "untrusted_pending": unconfirmed, "immature": 0}}, nil
+
+		case "estimatesmartfee":
+			return map[string]interface{}{"feerate": 0.0001, "blocks": 6}, nil
+
+		case "validateaddress":
+			return map[string]interface{}{"isvalid": c.validAddress(str(0)), "address": str(0)}, nil
+
+		case "getblockchaininfo":
+			return map[string]interface{}{
+				"chain":                "regtest",
+				"blocks":               c.height,
+				"headers":              c.height,
+				"bestblockhash":        c.hashes[c.height],
+				"mediantime":           time.Now().Unix(),
+				"verificationprogress": 1.0,
+				"initialblockdownload": false,
+			}, nil
+
+		case "getnetworkinfo":
+			return map[string]interface{}{"connections": 8, "networkactive": true}, nil
+		}
+		return nil, &fakeFailure{code: -32601, message: "Method not found"}
+	}
+
+	ts := httptest.NewServer(serveJSONRPC(c, "rpcuser", "rpcpass", true, dispatch))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// newFakeElectrum serves the Electrum daemon JSON-RPC subset ElectrumWallet uses
+func newFakeElectrum(t *testing.T, c *fakeChain) *httptest.Server {
+	t.Helper()
+
+	loaded := false
+	unsigned := map[string]struct {
+		address string
+		amount  float64
+	}{}
+
+	dispatch := func(method string, raw json.RawMessage) (interface{}, *fakeFailure) {
+		var params map[string]interface{}
+		json.Unmarshal(raw, &params)
+		str := func(key string) string {
+			s, _ := params[key].(string)
+			return s
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		walletMethod := method == "createnewaddress" || method == "getbalance" || method == "payto"
+		if walletMethod && !loaded {
+			return nil, &fakeFailure{code: 1, message: "Wallet not loaded. Use 'electrum load_wallet'"}
+		}
+
+		switch method {
+		case "load_wallet":
+			loaded = true
+			return true, nil
+
+		case "createnewaddress":
+			c.nextAddr++
+			address := fmt.Sprintf("%s%08d", c.prefix, c.nextAddr)
+			c.addresses[address] = true
+			return address, nil
+
+		case "getaddresshistory":
+			history := []interface{}{}
+			for _, tx := range c.txs {
+				if tx.Incoming && tx.Address == str("address") {
+					history = append(history, map[string]interface{}{"tx_hash": tx.TxID, "height": tx.Height})
+				}
+			}
+			return history, nil
+
+		case "gettransaction":
+			for _, tx := range c.txs {
+				if tx.TxID == str("txid") {
+					return hex.EncodeToString([]byte(tx.TxID)), nil
+				}
+			}
+			return nil, &fakeFailure{code: 1, message: "Transaction not found"}
+
+		case "deserialize":
+			txid, _ := hex.DecodeString(str("tx"))
+			for _, tx := range c.txs {
+				if tx.TxID == string(txid) {
+					// The deposit and a change output back to the payer
+					return map[string]interface{}{"outputs": []interface{}{
+						map[string]interface{}{"address": tx.Address, "value_sats": int64(tx.Amount*1e8 + 0.5)},
+						map[string]interface{}{"address": c.prefix + "change", "value_sats": 12345},
+					}}, nil
+				}
+			}
+			return nil, &fakeFailure{code: 1, message: "Transaction could not be decoded"}
+
+		case "getinfo":
+			return map[string]interface{}{
+				"blockchain_height": c.height,
+				"server_height":     c.height,
+				"connected":         true,
+				"server":            "fake.electrum",
+				"spv_nodes":         5,
+			}, nil
+
+		case "getbalance":
+			confirmed, unconfirmed := c.balances()
+			return map[string]string{
+				"confirmed":   strconv.FormatFloat(confirmed, 'f', 8, 64),
+				"unconfirmed": strconv.FormatFloat(unconfirmed, 'f', 8, 64),
+			}, nil
+
+		case "validateaddress":
+			return c.validAddress(str("address")), nil
+
+		case "payto":
+			amount, _ := strconv.ParseFloat(str("amount"), 64)
+			if !c.validAddress(str("destination")) {
+				return nil, &fakeFailure{code: 1, message: "Invalid bitcoin address"}
+			}
+			if confirmed, _ := c.balances(); amount > confirmed+1e-9 {
+				return nil, &fakeFailure{code: 1, message: "Insufficient funds"}
+			}
+			raw := hex.EncodeToString([]byte(fmt.Sprintf("%s:%d", str("destination"), len(unsigned))))
+			unsigned[raw] = struct {
+				address string
+				amount  float64
+			}{str("destination"), amount}
+			return raw, nil
+
+		case "broadcast":
+			tx, ok := unsigned[str("tx")]
+			if !ok {
+				return nil, &fakeFailure{code: 1, message: "Transaction could not be decoded"}
+			}
+			delete(unsigned, str("tx"))
+			txid, f := c.send(tx.address, tx.amount)
+			return txid, f
+		}
+		return nil, &fakeFailure{code: -32601, message: "Method not found"}
+	}
+
+	ts := httptest.NewServer(serveJSONRPC(c, "user", "electrumpass", false, dispatch))
+	t.Cleanup(ts.Close)
+	return ts
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feeAccount is the exchange account trading fees are booked to
+const feeAccount = "fees"
+
+// feeVolumeWindow is how far back a user's volume counts towards their fee tier
+const feeVolumeWindow = 30 * 24 * time.Hour
+
+// maxFeeRate caps configured fee rates so a typo cannot take a whole fill
+const maxFeeRate = 0.05
+
+// FeeTier is the rates charged from a 30-day volume up. Volume is in LTC, the
+// market's quote coin, counting both sides of every fill.
+type FeeTier struct {
+	MinVolume float64 `json:"min_volume"`
+	Maker     float64 `json:"maker"`
+	Taker     float64 `json:"taker"`
+}
+
+// FeeOverride replaces the tiers for one user in one market
+type FeeOverride struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Market    string    `json:"market"`
+	Maker     float64   `json:"maker"`
+	Taker     float64   `json:"taker"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FeeRates is what a user pays in a market right now
+type FeeRates struct {
+	Market   string  `json:"market"`
+	Maker    float64 `json:"maker"`
+	Taker    float64 `json:"taker"`
+	Volume   float64 `json:"volume_30d"`
+	Tier     int     `json:"tier"` // index into the market's tiers, -1 with an override
+	Override bool    `json:"override"`
+}
+
+// FeeCharge is the fee taken from one side of a fill, in the coin that side received
+type FeeCharge struct {
+	Coin   string  `json:"coin"`
+	Rate   float64 `json:"rate"`
+	Amount float64 `json:"amount"`
+
+	referrerID int // the user paid a share of the fee, or 0
+}
+
+// FeeSchedule holds the fee tiers of every market and looks up what a user pays.
+// Markets without tiers are free.
+type FeeSchedule struct {
+	mu    sync.RWMutex
+	db    *sql.DB
+	tiers map[string][]FeeTier
+}
+
+// NewFeeSchedule creates a schedule with no fees
+func NewFeeSchedule(db *sql.DB) *FeeSchedule {
+	return &FeeSchedule{db: db, tiers: make(map[string][]FeeTier)}
+}
+
+// ParseFeeTiers reads tiers written as volume:maker:taker,... such as
+// "0:0.001:0.002,1000:0.0008:0.0016"
+func ParseFeeTiers(spec string) ([]FeeTier, error) {
+	var tiers []FeeTier
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid fee tier %q, expected volume:maker:taker", entry)
+		}
+		var values [3]float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fee tier %q: %v", entry, err)
+			}
+			values[i] = v
+		}
+		tiers = append(tiers, FeeTier{MinVolume: values[0], Maker: values[1], Taker: values[2]})
+	}
+	return tiers, nil
+}
+
+// validFeeRate reports whether a maker or taker rate may be configured
+func validFeeRate(rate float64) bool {
+	return rate >= 0 && rate <= maxFeeRate
+}
+
+// SetTiers replaces a market's tiers. The first tier must start at zero volume.
+func (f *FeeSchedule) SetTiers(market string, tiers []FeeTier) error {
+	tiers = append([]FeeTier(nil), tiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinVolume < tiers[j].MinVolume })
+	for i, tier := range tiers {
+		if !validFeeRate(tier.Maker) || !validFeeRate(tier.Taker) {
+			return fmt.Errorf("fee rates must be between 0 and %g", maxFeeRate)
+		}
+		if i > 0 && tier.MinVolume == tiers[i-1].MinVolume {
+			return fmt.Errorf("two fee tiers start at volume %g", tier.MinVolume)
+		}
+	}
+	if len(tiers) > 0 && tiers[0].MinVolume != 0 {
+		return fmt.Errorf("the first fee tier must start at volume 0")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tiers[market] = tiers
+	return nil
+}
+
+// Tiers returns a market's tiers, lowest volume first
+func (f *FeeSchedule) Tiers(market string) []FeeTier {
+	if f == nil {
+		return []FeeTier{}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]FeeTier{}, f.tiers[market]...)
+}
+
+// Volume is what a user traded since a time, in LTC, as maker or taker
+func (f *FeeSchedule) Volume(userID int, since time.Time) (float64, error) {
+	var volume float64
+	err := f.db.QueryRow(`
+		SELECT COALESCE(SUM(tc.quantity * `+fillPriceSQL+`), 0)
+		FROM trade_completions tc
+		JOIN trades t ON t.id = tc.trade_id
+		WHERE (tc.buyer_id = ? OR t.seller_id = ?) AND tc.completed_at >= ?
+	`, userID, userID, since.UTC().Format("2006-01-02 15:04:05")).Scan(&volume)
+	return volume, err
+}
+
+// Rates looks up what a user pays in a market: their override if they have one,
+// otherwise the highest tier their 30-day volume reaches
+func (f *FeeSchedule) Rates(market string, userID int, now time.Time) (*FeeRates, error) {
+	rates := &FeeRates{Market: market, Tier: -1}
+	if f == nil {
+		return rates, nil
+	}
+
+	volume, err := f.Volume(userID, now.Add(-feeVolumeWindow))
+	if err != nil {
+		return nil, err
+	}
+	rates.Volume = volume
+
+	err = f.db.QueryRow(`SELECT maker_rate, taker_rate FROM fee_overrides WHERE user_id = ? AND market = ?`,
+		userID, market).Scan(&rates.Maker, &rates.Taker)
+	if err == nil {
+		rates.Override = true
+		return rates, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	for i, tier := range f.Tiers(market) {
+		if volume < tier.MinVolume {
+			break
+		}
+		rates.Tier, rates.Maker, rates.Taker = i, tier.Maker, tier.Taker
+	}
+	return rates, nil
+}
+
+// SetOverride gives a user fixed rates in a market
+func (f *FeeSchedule) SetOverride(userID int, market string, maker, taker float64, note string) error {
+	if !validFeeRate(maker) || !validFeeRate(taker) {
+		return fmt.Errorf("fee rates must be between 0 and %g", maxFeeRate)
+	}
+	_, err := f.db.Exec(`
+		INSERT INTO fee_overrides (user_id, market, maker_rate, taker_rate, note) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, market) DO UPDATE SET
+			maker_rate = excluded.maker_rate,
+			taker_rate = excluded.taker_rate,
+			note = excluded.note,
+			created_at = CURRENT_TIMESTAMP
+	`, userID, market, maker, taker, note)
+	return err
+}
+
+// RemoveOverride puts a user back on the tiers
+func (f *FeeSchedule) RemoveOverride(userID int, market string) error {
+	_, err := f.db.Exec(`DELETE FROM fee_overrides WHERE user_id = ? AND market = ?`, userID, market)
+	return err
+}
+
+// Overrides lists every override, by username
+func (f *FeeSchedule) Overrides() ([]FeeOverride, error) {
+	rows, err := f.db.Query(`
+		SELECT o.user_id, u.username, o.market, o.maker_rate, o.taker_rate, COALESCE(o.note, ''), o.created_at
+		FROM fee_overrides o
+		JOIN users u ON u.id = o.user_id
+		ORDER BY u.username, o.market
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []FeeOverride{}
+	for rows.Next() {
+		var o FeeOverride
+		if err := rows.Scan(&o.UserID, &o.Username, &o.Market, &o.Maker, &o.Taker, &o.Note, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// chargeFee takes a fee on what a user received from a fill and books it to the
+// fee account, less any share due to the user's referrer. The caller has already
+// credited the full amount in tx. Caller must hold s.mu.
+func (s *Server) chargeFee(tx *sql.Tx, fillID int64, userID int, role, coin string, rate, received float64) (*FeeCharge, error) {
+	charge := &FeeCharge{Coin: coin, Rate: rate, Amount: math.Round(received*rate*1e8) / 1e8}
+
+	_, err := tx.Exec(`INSERT INTO trade_fees (completion_id, user_id, role, coin, rate, amount) VALUES (?, ?, ?, ?, ?, ?)`,
+		fillID, userID, role, coin, rate, charge.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if charge.Amount == 0 {
+		return charge, nil
+	}
+
+	if err := adjustBalance(tx, userID, coin, -charge.Amount); err != nil {
+		return nil, err
+	}
+	if err := creditExchangeAccount(tx, feeAccount, coin, charge.Amount); err != nil {
+		return nil, err
+	}
+	referrerID, _, err := s.referrals.Pay(tx, fillID, userID, charge, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	charge.referrerID = referrerID
+	return charge, nil
+}
+
+// creditExchangeAccount adds to (or with a negative amount takes from) one of the
+// exchange's own accounts
+func creditExchangeAccount(db execer, account, coin string, amount float64) error {
+	_, err := db.Exec(`
+		INSERT INTO exchange_accounts (account, coin, balance) VALUES (?, ?, ?)
+		ON CONFLICT(account, coin) DO UPDATE SET balance = balance + excluded.balance
+	`, account, coin, amount)
+	return err
+}
+
+// exchangeAccountBalances returns the balance of an exchange account in each coin
+func exchangeAccountBalances(db *sql.DB, account string) (map[string]float64, error) {
+	rows, err := db.Query(`SELECT coin, balance FROM exchange_accounts WHERE account = ?`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := map[string]float64{"kernelcoin": 0, "litecoin": 0}
+	for rows.Next() {
+		var coin string
+		var balance float64
+		if err := rows.Scan(&coin, &balance); err != nil {
+			return nil, err
+		}
+		balances[coin] = balance
+	}
+	return balances, rows.Err()
+}
+
+// handleGetFees returns the fee tiers and what the logged in user pays
+func (s *Server) handleGetFees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.RLock()
+	rates, err := s.fees.Rates(marketKCNLTC, session.UserID, time.Now())
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[FEES] Failed to look up rates for user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load fees"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"market": marketKCNLTC,
+		"tiers":  s.fees.Tiers(marketKCNLTC),
+		"rates":  rates,
+	})
+}
+
+// handleAdminFees shows the tiers, overrides and fee revenue (GET), or sets or
+// removes a user's override (POST {"username", "maker", "taker", "note"} or
+// {"username", "remove": true})
+func (s *Server) handleAdminFees(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.fees == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Trading fees are disabled"})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Username string  `json:"username"`
+			Maker    float64 `json:"maker"`
+			Taker    float64 `json:"taker"`
+			Note     string  `json:"note"`
+			Remove   bool    `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		user, err := s.getUserByUsername(req.Username)
+		if err == nil {
+			if req.Remove {
+				err = s.fees.RemoveOverride(user.ID, marketKCNLTC)
+			} else {
+				err = s.fees.SetOverride(user.ID, marketKCNLTC, req.Maker, req.Taker, req.Note)
+			}
+		} else if err == sql.ErrNoRows {
+			err = fmt.Errorf("unknown user %q", req.Username)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if req.Remove {
+			log.Printf("[FEES] Admin %s removed the fee override of %s", session.Username, req.Username)
+		} else {
+			log.Printf("[FEES] Admin %s set %s's fees to maker %g, taker %g", session.Username, req.Username, req.Maker, req.Taker)
+		}
+	}
+
+	s.mu.RLock()
+	overrides, err := s.fees.Overrides()
+	var revenue map[string]float64
+	if err == nil {
+		revenue, err = exchangeAccountBalances(s.db, feeAccount)
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[FEES] Failed to load fee settings: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load fees"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tiers":     map[string][]FeeTier{marketKCNLTC: s.fees.Tiers(marketKCNLTC)},
+		"overrides": overrides,
+		"revenue":   revenue,
+	})
+}
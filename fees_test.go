@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFeeTiers(t *testing.T) {
+	tiers, err := ParseFeeTiers("100:0.0005:0.001, 0:0.001:0.002")
+	if err != nil || len(tiers) != 2 {
+		t.Fatalf("tiers = %v, %v", tiers, err)
+	}
+	fees := NewFeeSchedule(nil)
+	if err := fees.SetTiers(marketKCNLTC, tiers); err != nil {
+		t.Fatalf("set tiers: %v", err)
+	}
+	if got := fees.Tiers(marketKCNLTC); got[0].MinVolume != 0 || got[1].Taker != 0.001 {
+		t.Errorf("tiers are not sorted by volume: %v", got)
+	}
+
+	for _, spec := range []string{"0:0.001", "0:x:0.002", "10:0.001:0.002", "0:0.5:0.002", "0:-0.001:0.002"} {
+		tiers, err := ParseFeeTiers(spec)
+		if err == nil {
+			err = fees.SetTiers(marketKCNLTC, tiers)
+		}
+		if err == nil {
+			t.Errorf("fee tiers %q were accepted", spec)
+		}
+	}
+}
+
+func TestFeesByVolumeTierAndOverride(t *testing.T) {
+	db := newTestDB(t)
+	assets := newSimAssets(t, db)
+	ex := startTestExchange(t, db, assets)
+	ex.server.fees = NewFeeSchedule(db)
+	tiers, _ := ParseFeeTiers("0:0.001:0.002,10:0.0005:0.001")
+	ex.server.fees.SetTiers(marketKCNLTC, tiers)
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	admin := ex.newUser(t, "admin")
+	db.Exec(`UPDATE balances SET kernelcoin = 200, litecoin = 20`)
+
+	// Alice asks 150 KCN at 0.1 LTC; Bob takes it in three fills of 50
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 150, "coin_buying": "litecoin", "amount_buying": 15,
+	})
+	execute := func() {
+		t.Helper()
+		if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 50}); resp["success"] != true {
+			t.Fatalf("execute: %v", resp)
+		}
+	}
+
+	// First fill on the base tier: Alice pays 0.1% of 5 LTC, Bob 0.2% of 50 KCN
+	execute()
+	assertAmount(t, "alice LTC", alice.balance()["litecoin"], 24.995)
+	assertAmount(t, "bob KCN", bob.balance()["kernelcoin"], 249.9)
+	assertAmount(t, "bob LTC", bob.balance()["litecoin"], 15)
+
+	// The second fill, at 5 LTC of volume, is still on the base tier
+	execute()
+	var fees struct {
+		Rates FeeRates `json:"rates"`
+	}
+	bob.get("/api/fees", &fees)
+	if fees.Rates.Tier != 1 || fees.Rates.Taker != 0.001 || fees.Rates.Volume != 10 {
+		t.Fatalf("bob's rates after 10 LTC = %+v", fees.Rates)
+	}
+
+	// Bob trades free from now on
+	var settings struct {
+		Overrides []FeeOverride `json:"overrides"`
+		Error     string        `json:"error"`
+	}
+	admin.post("/api/admin/fees", map[string]interface{}{"username": "bob", "maker": 0, "taker": 0, "note": "market maker"}, &settings)
+	if len(settings.Overrides) != 1 || settings.Overrides[0].Username != "bob" {
+		t.Fatalf("overrides = %+v (%s)", settings, settings.Error)
+	}
+
+	// Third fill: Alice on the 10 LTC tier pays 0.05%, Bob nothing
+	execute()
+	assertAmount(t, "alice LTC", alice.balance()["litecoin"], 20+15-0.005-0.005-0.0025)
+	assertAmount(t, "bob KCN", bob.balance()["kernelcoin"], 200+150-0.1-0.1)
+
+	revenue, err := exchangeAccountBalances(db, feeAccount)
+	if err != nil {
+		t.Fatalf("fee account: %v", err)
+	}
+	assertAmount(t, "KCN fees", revenue["kernelcoin"], 0.2)
+	assertAmount(t, "LTC fees", revenue["litecoin"], 0.0125)
+
+	// Fees are counted with what users hold, so the books still balance
+	rc := NewReconciler(db, assets, nil, 0)
+	report := &ReconciliationReport{Coin: "litecoin"}
+	if err := rc.liabilities(report); err != nil {
+		t.Fatalf("liabilities: %v", err)
+	}
+	assertAmount(t, "LTC liabilities", report.Liabilities, 60)
+	assertAmount(t, "LTC exchange funds", report.ExchangeFunds, 0.0125)
+
+	// Every fill shows its fee
+	var bobTrades struct {
+		Trades []map[string]interface{} `json:"trades"`
+	}
+	bob.get("/api/trade/my-trades", &bobTrades)
+	if len(bobTrades.Trades) != 3 {
+		t.Fatalf("bob's trades = %v", bobTrades.Trades)
+	}
+	var bobFees float64
+	for _, trade := range bobTrades.Trades {
+		if trade["liquidity"] != "taker" || trade["fee_coin"] != "kernelcoin" || trade["fill_id"] == nil {
+			t.Errorf("bob's fill = %v", trade)
+		}
+		bobFees += trade["fee"].(float64)
+	}
+	assertAmount(t, "bob's fees", bobFees, 0.2)
+
+	var aliceTrades struct {
+		Trades []struct {
+			Liquidity string      `json:"liquidity"`
+			Fee       float64     `json:"fee"`
+			FeeCoin   string      `json:"fee_coin"`
+			Fills     []*UserFill `json:"fills"`
+		} `json:"trades"`
+	}
+	alice.get("/api/trade/my-trades", &aliceTrades)
+	if len(aliceTrades.Trades) != 1 || len(aliceTrades.Trades[0].Fills) != 3 {
+		t.Fatalf("alice's trades = %+v", aliceTrades.Trades)
+	}
+	order := aliceTrades.Trades[0]
+	if order.Liquidity != "maker" || order.FeeCoin != "litecoin" || order.Fills[2].Fee.Rate != 0.0005 {
+		t.Errorf("alice's order = %+v", order)
+	}
+	assertAmount(t, "alice's fees", order.Fee, 0.0125)
+}
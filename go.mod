@@ -7,6 +7,7 @@ toolchain go1.24.10
 require (
 	github.com/btcsuite/btcd v0.25.0
 	github.com/btcsuite/btcd/btcutil v1.1.6
+	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.19
 	github.com/tyler-smith/go-bip39 v1.1.0
 	github.com/wenlng/go-captcha-assets v1.0.7
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testExchange is a real Server wired to a fake kernelcoind and a fake Electrum
+// daemon, or to simulated chains, in which case kcn and ltc are nil
+type testExchange struct {
+	server *Server
+	ts     *httptest.Server
+	kcn    *fakeChain
+	ltc    *fakeChain
+}
+
+// newTestDB opens an initialised database in a temporary directory
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initDB(db); err != nil {
+		t.Fatalf("init db: %v", err)
+	}
+	return db
+}
+
+// newTestExchange starts the exchange against fresh fake chains. The RPC timeout is
+// short so tests can script timeouts with SetLatency.
+func newTestExchange(t *testing.T) *testExchange {
+	t.Helper()
+
+	kcn := newFakeChain("kcrt1q", 100)
+	ltc := newFakeChain("rltc1q", 2000)
+	kernelcoind := newFakeKernelcoind(t, kcn)
+	electrum := newFakeElectrum(t, ltc)
+
+	rpc := NewKernelcoinRPCClient(kernelcoind.URL, "rpcuser", "rpcpass")
+	rpc.timeout = 200 * time.Millisecond
+	electrumClient := NewElectrumClient(ElectrumConfig{
+		URL:         electrum.URL,
+		User:        "user",
+		Password:    "electrumpass",
+		Timeout:     200 * time.Millisecond,
+		WithdrawFee: 0.001,
+	})
+
+	ex := startTestExchange(t, newTestDB(t), newAssets(NewRPCWallet(rpc, "bech32"), NewElectrumWallet(electrumClient)))
+	ex.kcn, ex.ltc = kcn, ltc
+	return ex
+}
+
+// startTestExchange serves a Server using the given wallets
+func startTestExchange(t *testing.T, db *sql.DB, assets map[string]*Asset) *testExchange {
+	t.Helper()
+
+	server := &Server{
+		db:       db,
+		sessions: make(map[string]*Session),
+		captchaService: NewCaptchaService(NewProofOfWorkChallenge(0), CaptchaConfig{
+			TTL:           5 * time.Minute,
+			MaxPerIP:      100,
+			MaxFailures:   100,
+			FailureWindow: time.Minute,
+		}),
+		assets:  assets,
+		cookies: CookieConfig{SameSite: http.SameSiteStrictMode},
+		events:  NewEventHub(),
+		candles: NewCandles(db),
+	}
+	if err := server.loadOrderBook(); err != nil {
+		t.Fatalf("load order book: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	server.RegisterRoutes(mux)
+	ts := httptest.NewTLSServer(mux)
+	t.Cleanup(ts.Close)
+
+	return &testExchange{server: server, ts: ts}
+}
+
+// testUser is a browser session against a testExchange
+type testUser struct {
+	t      *testing.T
+	ex     *testExchange
+	client *http.Client
+	token  string
+}
+
+// newUser registers and logs in a user
+func (ex *testExchange) newUser(t *testing.T, username string) *testUser {
+	t.Helper()
+	return ex.newUserWith(t, username, nil)
+}
+
+// newUserWith registers a user with extra registration fields and logs them in
+func (ex *testExchange) newUserWith(t *testing.T, username string, fields map[string]interface{}) *testUser {
+	t.Helper()
+
+	// ts.Client is shared, so each user gets its own copy with its own cookies
+	client := *ex.ts.Client()
+	client.Jar, _ = cookiejar.New(nil)
+	u := &testUser{t: t, ex: ex, client: &client}
+	u.token = fetchCSRFToken(t, ex.ts, u.client)
+
+	var captcha struct {
+		CaptchaID string `json:"captcha_id"`
+	}
+	u.get("/api/captcha/generate", &captcha)
+
+	register := map[string]interface{}{
+		"username":       username,
+		"password":       "password123",
+		"captcha_id":     captcha.CaptchaID,
+		"captcha_answer": map[string]string{"nonce": "1"},
+	}
+	for k, v := range fields {
+		register[k] = v
+	}
+	var resp map[string]interface{}
+	u.post("/api/register", register, &resp)
+	if resp["success"] != true {
+		t.Fatalf("register %s: %v", username, resp)
+	}
+
+	u.post("/api/login", map[string]string{"username": username, "password": "password123"}, &resp)
+	if resp["success"] != true {
+		t.Fatalf("login %s: %v", username, resp)
+	}
+	return u
+}
+
+// do sends a request and decodes the JSON response into out, picking up rotated CSRF tokens
+func (u *testUser) do(method, path string, body interface{}, out interface{}) {
+	u.t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u.ex.ts.URL+path, reader)
+	if err != nil {
+		u.t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, u.token)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		u.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if token := resp.Header.Get(csrfHeader); token != "" {
+		u.token = token
+	}
+	if resp.StatusCode != http.StatusOK {
+		u.t.Fatalf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			u.t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+}
+
+func (u *testUser) get(path string, out interface{}) {
+	u.t.Helper()
+	u.do(http.MethodGet, path, nil, out)
+}
+
+func (u *testUser) post(path string, body, out interface{}) {
+	u.t.Helper()
+	u.do(http.MethodPost, path, body, out)
+}
+
+// call posts and returns the response as a map
+func (u *testUser) call(path string, body interface{}) map[string]interface{} {
+	u.t.Helper()
+	var resp map[string]interface{}
+	u.post(path, body, &resp)
+	return resp
+}
+
+// receiveAddress generates a deposit address for coin
+func (u *testUser) receiveAddress(coin string) string {
+	u.t.Helper()
+
+	if resp := u.call("/api/generate-receive-address", map[string]string{"coin": coin}); resp["success"] != true {
+		u.t.Fatalf("generate %s address: %v", coin, resp)
+	}
+	var user map[string]interface{}
+	u.get("/api/user", &user)
+	address, _ := user[coin+"_receive_address"].(string)
+	if address == "" {
+		u.t.Fatalf("no %s receive address in %v", coin, user)
+	}
+	return address
+}
+
+// checkDeposit asks the exchange to look for deposits to the user's receive address
+func (u *testUser) checkDeposit(coin string) map[string]interface{} {
+	u.t.Helper()
+	return u.call("/api/check-confirmations", map[string]string{"coin": coin})
+}
+
+func (u *testUser) balance() map[string]float64 {
+	u.t.Helper()
+	var balance map[string]float64
+	u.get("/api/balance", &balance)
+	return balance
+}
+
+// deposit pays a new receive address on chain, mines enough blocks and credits the user
+func (u *testUser) deposit(coin string, chain *fakeChain, amount float64) {
+	u.t.Helper()
+
+	chain.Pay(u.receiveAddress(coin), amount)
+	chain.Mine(u.ex.server.assets[coin].Confirmations)
+	if resp := u.checkDeposit(coin); resp["status"] != "confirmed" {
+		u.t.Fatalf("deposit %.8f %s: %v", amount, coin, resp)
+	}
+}
+
+func assertAmount(t *testing.T, what string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-8 {
+		t.Errorf("%s = %.8f, want %.8f", what, got, want)
+	}
+}
+
+func TestRegisterDepositTradeWithdraw(t *testing.T) {
+	ex := newTestExchange(t)
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+
+	// Alice's KCN deposit is pending until it has 2 confirmations
+	address := alice.receiveAddress("kernelcoin")
+	ex.kcn.Pay(address, 50)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "pending" {
+		t.Fatalf("unconfirmed deposit: %v", resp)
+	}
+	ex.kcn.Mine(1)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "pending" {
+		t.Fatalf("deposit with 1 confirmation: %v", resp)
+	}
+	ex.kcn.Mine(1)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "confirmed" {
+		t.Fatalf("deposit with 2 confirmations: %v", resp)
+	}
+	assertAmount(t, "alice KCN after deposit", alice.balance()["kernelcoin"], 50)
+
+	// Bob deposits LTC through Electrum
+	bob.deposit("litecoin", ex.ltc, 2)
+	assertAmount(t, "bob LTC after deposit", bob.balance()["litecoin"], 2)
+
+	// Alice sells 10 KCN for 1 LTC and Bob takes it
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling":   "kernelcoin",
+		"amount_selling": 10,
+		"coin_buying":    "litecoin",
+		"amount_buying":  1,
+	})
+	if created["success"] != true {
+		t.Fatalf("create trade: %v", created)
+	}
+	assertAmount(t, "alice KCN while order is open", alice.balance()["kernelcoin"], 40)
+
+	executed := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 10})
+	if executed["success"] != true {
+		t.Fatalf("execute trade: %v", executed)
+	}
+
+	aliceBalance, bobBalance := alice.balance(), bob.balance()
+	assertAmount(t, "alice KCN", aliceBalance["kernelcoin"], 40)
+	assertAmount(t, "alice LTC", aliceBalance["litecoin"], 1)
+	assertAmount(t, "bob KCN", bobBalance["kernelcoin"], 10)
+	assertAmount(t, "bob LTC", bobBalance["litecoin"], 1)
+
+	// Both withdraw what they bought
+	if resp := alice.call("/api/update-addresses", map[string]string{"litecoin_address": "rltc1qalice"}); resp["success"] != true {
+		t.Fatalf("alice update addresses: %v", resp)
+	}
+	if resp := bob.call("/api/update-addresses", map[string]string{"kernelcoin_address": "kcrt1qbob"}); resp["success"] != true {
+		t.Fatalf("bob update addresses: %v", resp)
+	}
+
+	if resp := alice.call("/api/withdraw", map[string]interface{}{"coin": "litecoin", "amount": 1}); resp["success"] != true {
+		t.Fatalf("alice withdraw: %v", resp)
+	}
+	if resp := bob.call("/api/withdraw", map[string]interface{}{"coin": "kernelcoin", "amount": 10}); resp["success"] != true {
+		t.Fatalf("bob withdraw: %v", resp)
+	}
+
+	assertAmount(t, "alice LTC after withdrawal", alice.balance()["litecoin"], 0)
+	assertAmount(t, "bob KCN after withdrawal", bob.balance()["kernelcoin"], 0)
+
+	ltcSent := ex.ltc.Sent()
+	if len(ltcSent) != 1 || ltcSent[0].Address != "rltc1qalice" {
+		t.Fatalf("LTC payments = %+v, want one to rltc1qalice", ltcSent)
+	}
+	assertAmount(t, "LTC paid after Electrum fee", ltcSent[0].Amount, 0.999)
+
+	kcnSent := ex.kcn.Sent()
+	if len(kcnSent) != 1 || kcnSent[0].Address != "kcrt1qbob" {
+		t.Fatalf("KCN payments = %+v, want one to kcrt1qbob", kcnSent)
+	}
+	assertAmount(t, "KCN paid", kcnSent[0].Amount, 10)
+}
+
+func TestDepositReorgIsNotCredited(t *testing.T) {
+	ex := newTestExchange(t)
+	alice := ex.newUser(t, "alice")
+
+	address := alice.receiveAddress("kernelcoin")
+	txid := ex.kcn.Pay(address, 5)
+	ex.kcn.Mine(1)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "pending" {
+		t.Fatalf("deposit with 1 confirmation: %v", resp)
+	}
+
+	// The block is reorganised away and the payment is double spent
+	ex.kcn.Reorg(1)
+	ex.kcn.Drop(txid)
+	ex.kcn.Mine(2)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] == "confirmed" {
+		t.Fatalf("dropped deposit was credited: %v", resp)
+	}
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 0)
+}
+
+func TestDepositSurvivesReorg(t *testing.T) {
+	ex := newTestExchange(t)
+	alice := ex.newUser(t, "alice")
+
+	address := alice.receiveAddress("kernelcoin")
+	ex.kcn.Pay(address, 5)
+	ex.kcn.Mine(1)
+
+	// The payment goes back to the mempool and is mined again on the new chain
+	ex.kcn.Reorg(1)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "pending" {
+		t.Fatalf("deposit back in mempool: %v", resp)
+	}
+	ex.kcn.Mine(2)
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "confirmed" {
+		t.Fatalf("deposit after reorg: %v", resp)
+	}
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 5)
+}
+
+func TestWithdrawTimeoutIsRecordedPending(t *testing.T) {
+	ex := newTestExchange(t)
+	alice := ex.newUser(t, "alice")
+	alice.deposit("kernelcoin", ex.kcn, 5)
+	alice.call("/api/update-addresses", map[string]string{"kernelcoin_address": "kcrt1qalice"})
+
+	bob := ex.newUser(t, "bob")
+
+	// The node takes longer to answer than the client waits
+	ex.kcn.SetLatency("sendtoaddress", 500*time.Millisecond)
+	done := make(chan map[string]interface{})
+	go func() {
+		done <- alice.call("/api/withdraw", map[string]interface{}{"coin": "kernelcoin", "amount": 2})
+	}()
+
+	// Other users are served while the wallet is sending
+	time.Sleep(50 * time.Millisecond)
+	bob.balance()
+	select {
+	case <-done:
+		t.Fatalf("withdrawal finished before the wallet answered")
+	default:
+	}
+
+	resp := <-done
+	if resp["success"] != true || !strings.Contains(resp["message"].(string), "checked manually") {
+		t.Fatalf("withdraw with unknown outcome: %v", resp)
+	}
+	if n := ex.kcn.Calls("sendtoaddress"); n != 1 {
+		t.Errorf("sendtoaddress called %d times, want exactly 1", n)
+	}
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 3)
+
+	var txs struct {
+		Transactions []map[string]interface{} `json:"transactions"`
+	}
+	alice.get("/api/transactions", &txs)
+	found := false
+	for _, tx := range txs.Transactions {
+		if tx["type"] == "withdraw" && tx["status"] == "pending" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no pending withdrawal in %v", txs.Transactions)
+	}
+}
+
+func TestWithdrawWalletErrors(t *testing.T) {
+	ex := newTestExchange(t)
+	alice := ex.newUser(t, "alice")
+	alice.deposit("litecoin", ex.ltc, 1)
+	alice.call("/api/update-addresses", map[string]string{"litecoin_address": "rltc1qalice"})
+
+	// Electrum refuses to pay for lack of funds
+	ex.ltc.FailNext("payto", 1, 1, "Insufficient funds")
+	resp := alice.call("/api/withdraw", map[string]interface{}{"coin": "litecoin", "amount": 0.5})
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "cannot cover this withdrawal") {
+		t.Fatalf("withdraw with insufficient wallet funds: %v", resp)
+	}
+	assertAmount(t, "alice LTC after refused withdrawal", alice.balance()["litecoin"], 1)
+
+	// The daemon is down
+	ex.ltc.SetDown(true)
+	resp = alice.call("/api/withdraw", map[string]interface{}{"coin": "litecoin", "amount": 0.5})
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "unavailable") {
+		t.Fatalf("withdraw with daemon down: %v", resp)
+	}
+	assertAmount(t, "alice LTC after failed withdrawal", alice.balance()["litecoin"], 1)
+	if len(ex.ltc.Sent()) != 0 {
+		t.Errorf("LTC payments = %+v, want none", ex.ltc.Sent())
+	}
+}
+
+func TestChainMonitorPausesDeposits(t *testing.T) {
+	ex := newTestExchange(t)
+	ex.server.chainMonitor = NewChainMonitor(ex.server.assets, HealthConfig{MinPeers: 1, MaxLag: 2, MinProgress: 0.99})
+	ex.server.chainMonitor.Check()
+	alice := ex.newUser(t, "alice")
+
+	if resp := alice.call("/api/generate-receive-address", map[string]string{"coin": "kernelcoin"}); resp["success"] != true {
+		t.Fatalf("generate address with healthy node: %v", resp)
+	}
+
+	ex.kcn.SetDown(true)
+	ex.server.chainMonitor.Check()
+	resp := alice.checkDeposit("kernelcoin")
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "paused") {
+		t.Fatalf("check deposit with node down: %v", resp)
+	}
+
+	// Litecoin is unaffected
+	if resp := alice.call("/api/generate-receive-address", map[string]string{"coin": "litecoin"}); resp["success"] != true {
+		t.Fatalf("generate LTC address: %v", resp)
+	}
+
+	ex.kcn.SetDown(false)
+	ex.server.chainMonitor.Check()
+	if resp := alice.checkDeposit("kernelcoin"); resp["error"] != "No transactions found for this address" {
+		t.Fatalf("check deposit after recovery: %v", resp)
+	}
+}
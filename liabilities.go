@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"exchange/proof"
+)
+
+// coinUnits is the number of base units in one coin; tree amounts are integers
+const coinUnits = 1e8
+
+// LiabilitySnapshot is a published proof-of-liabilities root
+type LiabilitySnapshot struct {
+	ID        int64     `json:"id"`
+	Root      string    `json:"root"`
+	Assets    []string  `json:"assets"`
+	Totals    []int64   `json:"totals"` // base units, one per asset
+	LeafCount int       `json:"leaf_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Liabilities builds Merkle sum tree snapshots of user balances and serves
+// inclusion proofs from the latest one
+type Liabilities struct {
+	mu       sync.Mutex
+	db       *sql.DB
+	assets   []string // balances columns, in tree order
+	snapshot *LiabilitySnapshot
+	tree     *proof.Tree
+	leaves   map[int64]int // user ID to leaf index
+	entries  []proof.Leaf
+}
+
+// NewLiabilities creates a proof-of-liabilities generator over the given assets
+func NewLiabilities(db *sql.DB, assets map[string]*Asset) *Liabilities {
+	names := make([]string, 0, len(assets))
+	for name := range assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Liabilities{db: db, assets: names}
+}
+
+// toUnits converts a coin amount to base units
+func toUnits(amount float64) int64 {
+	return int64(math.Round(amount * coinUnits))
+}
+
+// Generate snapshots every user's balances, stores the leaves and publishes a new root
+func (l *Liabilities) Generate() (*LiabilitySnapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Coins escrowed in open orders are taken out of balances but still owed
+	columns := make([]string, len(l.assets))
+	for i, name := range l.assets {
+		columns[i] = fmt.Sprintf(`b.%s + COALESCE((SELECT SUM(%s) FROM trades t WHERE t.seller_id = b.user_id AND t.coin_selling = '%s' AND t.status = 'open'), 0)`, name, orderEscrowSQL, name)
+	}
+	rows, err := l.db.Query(fmt.Sprintf(`SELECT b.user_id, %s FROM balances b ORDER BY b.user_id`, strings.Join(columns, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	var leaves []proof.Leaf
+	for rows.Next() {
+		var userID int64
+		amounts := make([]float64, len(l.assets))
+		dest := []interface{}{&userID}
+		for i := range amounts {
+			dest = append(dest, &amounts[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		nonce := make([]byte, 16)
+		if _, err := randRead(nonce); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		balances := make([]int64, len(amounts))
+		for i, amount := range amounts {
+			balances[i] = toUnits(amount)
+		}
+		leaves = append(leaves, proof.Leaf{UserID: userID, Nonce: hex.EncodeToString(nonce), Balances: balances})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A proof reveals the sums of its siblings, so hide which user sits next to whom
+	rand.Shuffle(len(leaves), func(i, j int) { leaves[i], leaves[j] = leaves[j], leaves[i] })
+
+	tree, err := proof.Build(l.assets, leaves)
+	if err != nil {
+		return nil, err
+	}
+	root := tree.Root()
+	snapshot := &LiabilitySnapshot{
+		Root:      hex.EncodeToString(root.Hash),
+		Assets:    l.assets,
+		Totals:    root.Sums,
+		LeafCount: len(leaves),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	assetsJSON, _ := json.Marshal(snapshot.Assets)
+	totalsJSON, _ := json.Marshal(snapshot.Totals)
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO liability_snapshots (root, assets, totals, leaf_count, created_at) VALUES (?, ?, ?, ?, ?)`,
+		snapshot.Root, string(assetsJSON), string(totalsJSON), snapshot.LeafCount, snapshot.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.ID, _ = result.LastInsertId()
+
+	stmt, err := tx.Prepare(`INSERT INTO liability_leaves (snapshot_id, position, user_id, nonce, balances) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	for i, leaf := range leaves {
+		balancesJSON, _ := json.Marshal(leaf.Balances)
+		if _, err := stmt.Exec(snapshot.ID, i, leaf.UserID, leaf.Nonce, string(balancesJSON)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.cache(snapshot, tree, leaves)
+	log.Printf("[LIABILITIES] Published snapshot %d | Root: %s | Users: %d", snapshot.ID, snapshot.Root, snapshot.LeafCount)
+	return snapshot, nil
+}
+
+// cache keeps a snapshot's tree in memory for proofs. Caller must hold l.mu.
+func (l *Liabilities) cache(snapshot *LiabilitySnapshot, tree *proof.Tree, leaves []proof.Leaf) {
+	l.snapshot = snapshot
+	l.tree = tree
+	l.entries = leaves
+	l.leaves = make(map[int64]int, len(leaves))
+	for i, leaf := range leaves {
+		l.leaves[leaf.UserID] = i
+	}
+}
+
+// load rebuilds the latest stored snapshot's tree. Caller must hold l.mu.
+func (l *Liabilities) load() error {
+	var snapshot LiabilitySnapshot
+	var assetsJSON, totalsJSON string
+	err := l.db.QueryRow(`SELECT id, root, assets, totals, leaf_count, created_at FROM liability_snapshots ORDER BY id DESC LIMIT 1`).
+		Scan(&snapshot.ID, &snapshot.Root, &assetsJSON, &totalsJSON, &snapshot.LeafCount, &snapshot.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(assetsJSON), &snapshot.Assets); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(totalsJSON), &snapshot.Totals); err != nil {
+		return err
+	}
+
+	rows, err := l.db.Query(`SELECT user_id, nonce, balances FROM liability_leaves WHERE snapshot_id = ? ORDER BY position`, snapshot.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var leaves []proof.Leaf
+	for rows.Next() {
+		var leaf proof.Leaf
+		var balancesJSON string
+		if err := rows.Scan(&leaf.UserID, &leaf.Nonce, &balancesJSON); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(balancesJSON), &leaf.Balances); err != nil {
+			return err
+		}
+		leaves = append(leaves, leaf)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tree, err := proof.Build(snapshot.Assets, leaves)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(tree.Root().Hash) != snapshot.Root {
+		return fmt.Errorf("stored leaves of snapshot %d do not match its root", snapshot.ID)
+	}
+	l.cache(&snapshot, tree, leaves)
+	return nil
+}
+
+// Latest returns the most recent snapshot, or nil if none has been published
+func (l *Liabilities) Latest() (*LiabilitySnapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.snapshot == nil {
+		if err := l.load(); err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return l.snapshot, nil
+}
+
+// Proof returns a user's inclusion proof in the latest snapshot
+func (l *Liabilities) Proof(userID int64) (*proof.Proof, *LiabilitySnapshot, error) {
+	snapshot, err := l.Latest()
+	if err != nil || snapshot == nil {
+		return nil, nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	index, ok := l.leaves[userID]
+	if !ok {
+		return nil, l.snapshot, nil
+	}
+	p, err := l.tree.Prove(index, l.entries[index])
+	return p, l.snapshot, err
+}
+
+// Run publishes a new snapshot every interval, and one straight away if none exists
+func (l *Liabilities) Run(interval time.Duration) {
+	if snapshot, err := l.Latest(); err == nil && snapshot == nil {
+		if _, err := l.Generate(); err != nil {
+			log.Printf("[LIABILITIES] Failed to publish snapshot: %v", err)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := l.Generate(); err != nil {
+			log.Printf("[LIABILITIES] Failed to publish snapshot: %v", err)
+		}
+	}
+}
+
+// snapshotJSON adds coin-denominated totals to a snapshot for the API
+func snapshotJSON(snapshot *LiabilitySnapshot) map[string]interface{} {
+	totals := make(map[string]float64, len(snapshot.Assets))
+	for i, asset := range snapshot.Assets {
+		totals[asset] = float64(snapshot.Totals[i]) / coinUnits
+	}
+	return map[string]interface{}{
+		"id":           snapshot.ID,
+		"root":         snapshot.Root,
+		"assets":       snapshot.Assets,
+		"totals":       snapshot.Totals,
+		"total_coins":  totals,
+		"leaf_count":   snapshot.LeafCount,
+		"created_at":   snapshot.CreatedAt,
+		"unit_divisor": coinUnits,
+	}
+}
+
+// handleGetLiabilities publishes the latest proof-of-liabilities root and totals
+func (s *Server) handleGetLiabilities(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := s.liabilities.Latest()
+	if err != nil {
+		log.Printf("[LIABILITIES] Failed to load snapshot: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load proof of liabilities"})
+		return
+	}
+	if snapshot == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "No proof of liabilities has been published yet"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshotJSON(snapshot))
+}
+
+// handleGetLiabilityProof returns the logged in user's inclusion proof, which can
+// be checked offline with cmd/verify-liabilities
+func (s *Server) handleGetLiabilityProof(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p, snapshot, err := s.liabilities.Proof(int64(session.UserID))
+	if err != nil {
+		log.Printf("[LIABILITIES] Failed to build proof for user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to build proof"})
+		return
+	}
+	if snapshot == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "No proof of liabilities has been published yet"})
+		return
+	}
+	if p == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Your account is not in the latest snapshot; it will be in the next one"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"snapshot": snapshotJSON(snapshot),
+		"proof":    p,
+	})
+}
+
+// handleAdminLiabilities publishes a new proof-of-liabilities snapshot
+func (s *Server) handleAdminLiabilities(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshot, err := s.liabilities.Generate()
+	if err != nil {
+		log.Printf("[LIABILITIES] Failed to publish snapshot: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to publish snapshot: " + err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshotJSON(snapshot))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MailSender delivers plain-text email
+type MailSender interface {
+	Send(to, subject, body string) error
+}
+
+// formatMessage builds a minimal RFC 5322 message
+func formatMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// FileMailSender writes each message to a .eml file instead of sending it.
+// It stands in for a real mail server in development and tests.
+type FileMailSender struct {
+	dir  string
+	from string
+}
+
+// NewFileMailSender creates a mail sender that writes messages into dir
+func NewFileMailSender(dir, from string) (*FileMailSender, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileMailSender{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file in the mail directory
+func (f *FileMailSender) Send(to, subject, body string) error {
+	token, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+	suffix := strings.NewReplacer("/", "", "+", "", "=", "").Replace(token)[:8]
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), suffix)
+	path := filepath.Join(f.dir, name)
+
+	if err := os.WriteFile(path, formatMessage(f.from, to, subject, body), 0600); err != nil {
+		return err
+	}
+	log.Printf("[MAIL] Wrote message for %s to %s", to, path)
+	return nil
+}
+
+// SMTPMailSender delivers mail through an SMTP server using PLAIN auth
+type SMTPMailSender struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailSender creates a mail sender for the given SMTP server
+func NewSMTPMailSender(host, port, user, password, from string) *SMTPMailSender {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &SMTPMailSender{
+		addr: host + ":" + port,
+		auth: auth,
+		from: from,
+	}
+}
+
+// Send delivers the message via SMTP
+func (m *SMTPMailSender) Send(to, subject, body string) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, formatMessage(m.from, to, subject, body)); err != nil {
+		log.Printf("[MAIL] Failed to send message to %s: %v", to, err)
+		return err
+	}
+	log.Printf("[MAIL] Sent message to %s", to)
+	return nil
+}
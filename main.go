@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,21 +24,37 @@ type Session struct {
 
 // Server is the main application server
 type Server struct {
-	db                  *sql.DB
-	mu                  sync.RWMutex
-	sessions            map[string]*Session
-	captchaService      *CaptchaService
-	kernelcoinRPCUser   string
-	kernelcoinRPCPass   string
-	kernelcoinRPCHost   string
-	kernelcoinRPCPort   string
-	kernelcoinRPCClient *KernelcoinRPCClient
-	electrumClient      *ElectrumClient
-	electrumBinary      string
-	ltcWithdrawFee      float64
-	noWallets           bool
-	ltcPriceCache       float64
-	ltcPriceCacheExpiry time.Time
+	db                *sql.DB
+	mu                sync.RWMutex
+	sessions          map[string]*Session
+	captchaService    *CaptchaService
+	kernelcoinRPCUser string
+	kernelcoinRPCPass string
+	kernelcoinRPCHost string
+	kernelcoinRPCPort string
+	assets            map[string]*Asset
+	chainMonitor      *ChainMonitor
+	sweeper           *Sweeper
+	reconciler        *Reconciler
+	liabilities       *Liabilities
+	events            *EventHub
+	book              *OrderBook
+	candles           *Candles
+	ltcWithdrawFee    float64
+	prices            *PriceOracle
+	fees              *FeeSchedule
+	referrals         *Referrals
+	rules             *MarketRules
+	orderLimits       map[string]int
+	deadman           *DeadManSwitch
+	rateLimiter       *RateLimiter
+	cookies           CookieConfig
+	mailSender        MailSender
+	baseURL           string
+	resetSecret       []byte
+	trustProxy        bool
+	captchaOnLogin    bool
+	captchaOnWithdraw bool
 }
 
 // User represents a user account
@@ -87,18 +104,94 @@ func main() {
 	var (
 		port              = flag.String("port", "8080", "Server port")
 		dbPath            = flag.String("db", "exchange.db", "Database path")
-		electrumBinary    = flag.String("electrum-binary", "/Applications/Electrum-LTC.app/Contents/MacOS/run_electrum", "Path to Electrum binary")
+		ltcBackend        = flag.String("ltc-backend", "electrum", "Litecoin wallet backend: electrum or rpc (litecoind)")
+		ltcRPCUser        = flag.String("ltc-rpc-user", "", "Litecoin Core RPC user (with -ltc-backend=rpc)")
+		ltcRPCPass        = flag.String("ltc-rpc-pass", "", "Litecoin Core RPC password (with -ltc-backend=rpc)")
+		ltcRPCHost        = flag.String("ltc-rpc-host", "127.0.0.1", "Litecoin Core RPC host (with -ltc-backend=rpc)")
+		ltcRPCPort        = flag.String("ltc-rpc-port", "9332", "Litecoin Core RPC port (with -ltc-backend=rpc)")
+		electrumRPCURL    = flag.String("electrum-rpc-url", "http://127.0.0.1:7777", "Electrum daemon JSON-RPC URL")
+		electrumRPCUser   = flag.String("electrum-rpc-user", "user", "Electrum daemon rpcuser")
+		electrumRPCPass   = flag.String("electrum-rpc-pass", "", "Electrum daemon rpcpassword")
+		electrumWallet    = flag.String("electrum-wallet", "", "Wallet file for the Electrum daemon to load (default wallet if empty)")
+		healthInterval    = flag.Duration("health-interval", 30*time.Second, "How often to check wallet node health")
+		healthMaxLag      = flag.Int64("health-max-lag", 2, "Pause a coin when its node trails the network by more blocks than this")
+		healthMinPeers    = flag.Int("health-min-peers", 1, "Pause a coin when its node has fewer peers than this")
+		healthStaleAfter  = flag.Duration("health-stale-after", time.Hour, "Pause a coin when no new block arrives for this long (0 disables)")
+		hotTargetKCN      = flag.Float64("hot-target-kcn", 0, "KCN kept in the hot wallet; the excess is swept to -cold-address-kcn (0 disables)")
+		hotMinKCN         = flag.Float64("hot-min-kcn", 0, "KCN reserve on top of pending withdrawals below which a refill is requested")
+		coldAddressKCN    = flag.String("cold-address-kcn", "", "Cold storage address that excess KCN is swept to")
+		hotTargetLTC      = flag.Float64("hot-target-ltc", 0, "LTC kept in the hot wallet; the excess is swept to -cold-address-ltc (0 disables)")
+		hotMinLTC         = flag.Float64("hot-min-ltc", 0, "LTC reserve on top of pending withdrawals below which a refill is requested")
+		coldAddressLTC    = flag.String("cold-address-ltc", "", "Cold storage address that excess LTC is swept to")
+		sweepInterval     = flag.Duration("sweep-interval", 10*time.Minute, "How often to check hot wallet balances")
+		reconcileInterval = flag.Duration("reconcile-interval", time.Hour, "How often to reconcile user balances against wallet holdings")
+		reconcileTol      = flag.Float64("reconcile-tolerance", 0.001, "Difference in coins between liabilities and holdings tolerated before alerting")
+		liabilitiesEvery  = flag.Duration("liabilities-interval", 24*time.Hour, "How often to publish a new proof-of-liabilities snapshot")
+		priceSources      = flag.String("price-sources", "coingecko,kraken,binance", "LTC price sources: coingecko, kraken, binance, static, file")
+		priceCurrencies   = flag.String("price-currencies", "usd,eur,gbp", "Fiat currencies to quote LTC and KCN in")
+		priceInterval     = flag.Duration("price-interval", 5*time.Minute, "How often to refresh LTC prices")
+		priceDeviation    = flag.Float64("price-max-deviation", 0.05, "Drop price quotes further than this fraction from the median")
+		priceMaxAge       = flag.Duration("price-max-age", 30*time.Minute, "Stop serving an LTC price not refreshed for this long (0 disables)")
+		priceStatic       = flag.String("price-static", "", "Prices for the static source as currency=price,... (LTC in each currency)")
+		priceFile         = flag.String("price-file", "", "JSON file of prices for the file source, e.g. {\"usd\": 80}")
+		feeTiers          = flag.String("fee-tiers", "0:0.001:0.002", "Trading fee tiers as volume:maker:taker,... (30-day LTC volume, fee rates as fractions)")
+		referralShare     = flag.Float64("referral-share", 0.2, "Share of a referred user's trading fees paid to their referrer (0 disables)")
+		referralPeriod    = flag.Duration("referral-period", 180*24*time.Hour, "How long after registering a referred user's fees are shared")
+		marketTick        = flag.Float64("market-tick", 0.00000001, "Price increment in LTC for KCN-LTC orders")
+		marketStep        = flag.Float64("market-step", 0.00000001, "Quantity increment in KCN for KCN-LTC orders")
+		marketMinSize     = flag.Float64("market-min-size", 0.001, "Minimum order size in KCN")
+		marketMaxSize     = flag.Float64("market-max-size", 0, "Maximum order size in KCN (0 for no limit)")
+		marketMinNotional = flag.Float64("market-min-notional", 0.0001, "Minimum order value in LTC")
+		marketDeviation   = flag.Float64("market-max-deviation", 0, "Reject prices further than this fraction from the last trade (0 disables)")
+		orderLimits       = flag.String("order-limits", "user=10,market_maker=200", "Open orders allowed per account role as role=limit,...")
+		deadmanInterval   = flag.Duration("deadman-interval", time.Second, "How often to cancel the orders of users whose heartbeats stopped")
+		rpcTimeout        = flag.Duration("rpc-timeout", defaultRPCTimeout, "Timeout for each kernelcoind/litecoind RPC attempt")
+		electrumTimeout   = flag.Duration("electrum-timeout", 30*time.Second, "Timeout for Electrum daemon requests")
 		ltcWithdrawFee    = flag.Float64("ltc-withdraw-fee", 0.0003, "Litecoin withdrawal fee")
 		kernelcoinRPCUser = flag.String("kcn-rpc-user", "mike", "Kernelcoin RPC user")
 		kernelcoinRPCPass = flag.String("kcn-rpc-pass", "x", "Kernelcoin RPC password")
 		kernelcoinRPCHost = flag.String("kcn-rpc-host", "127.0.0.1", "Kernelcoin RPC host")
 		kernelcoinRPCPort = flag.String("kcn-rpc-port", "9332", "Kernelcoin RPC port")
-		noWallets         = flag.Bool("no-wallets", false, "Disable wallet integration and use fallback behavior")
+		simulate          = flag.Bool("simulate", false, "Run on simulated chains instead of real wallets (for staging)")
+		noWallets         = flag.Bool("no-wallets", false, "Deprecated: same as -simulate")
+		simBlockInterval  = flag.Duration("sim-block-interval", 30*time.Second, "How often simulated chains mine a block")
+		simSeed           = flag.String("sim-seed", "kernelcoin-exchange", "Seed for simulated addresses and transaction IDs")
 		preseed           = flag.Bool("preseed", false, "Preseed database with test users")
+		rateLimits        = flag.String("rate-limits", "", "Per-route rate limits as route=rate:burst,... (rate in requests/second)")
+		rateLimitDefault  = flag.String("rate-limit-default", "5:20", "Default rate limit for API routes as rate:burst")
+		trustProxy        = flag.Bool("trust-proxy", false, "Use X-Forwarded-For for client IPs (set when behind a reverse proxy)")
+		secureCookies     = flag.Bool("secure-cookies", false, "Mark cookies Secure (requires HTTPS)")
+		cookieHostPrefix  = flag.Bool("cookie-host-prefix", true, "Use the __Host- cookie name prefix when -secure-cookies is set")
+		cookieSameSite    = flag.String("cookie-samesite", "strict", "SameSite mode for cookies: strict, lax or none")
+		captchaKind       = flag.String("captcha-kind", "slide", "Captcha challenge type: slide, click, rotate or pow")
+		captchaTolerance  = flag.Int("captcha-tolerance", 10, "Allowed error in pixels (slide, click) or degrees (rotate)")
+		captchaPowBits    = flag.Int("captcha-pow-difficulty", 18, "Leading zero bits required by the pow captcha")
+		captchaMaxPerIP   = flag.Int("captcha-max-per-ip", 10, "Maximum unsolved captchas per client IP")
+		captchaLogin      = flag.Bool("captcha-login", false, "Require a captcha to log in")
+		captchaWithdraw   = flag.Bool("captcha-withdraw", false, "Require a captcha to withdraw")
+		argon2Memory      = flag.Uint("argon2-memory", uint(passwordParams.Memory), "Argon2id memory cost in KiB for password hashes")
+		argon2Iterations  = flag.Uint("argon2-iterations", uint(passwordParams.Iterations), "Argon2id iteration count for password hashes")
+		baseURL           = flag.String("base-url", "http://127.0.0.1:8080", "Public URL of the exchange, used in emailed links")
+		mailMode          = flag.String("mail-mode", "file", "How to deliver email: file (write .eml files) or smtp")
+		mailDir           = flag.String("mail-dir", "mail", "Directory for .eml files when -mail-mode=file")
+		mailFrom          = flag.String("mail-from", "noreply@localhost", "From address for outgoing email")
+		smtpHost          = flag.String("smtp-host", "127.0.0.1", "SMTP server host")
+		smtpPort          = flag.String("smtp-port", "587", "SMTP server port")
+		smtpUser          = flag.String("smtp-user", "", "SMTP username")
+		smtpPass          = flag.String("smtp-pass", "", "SMTP password")
+		resetSecret       = flag.String("reset-secret", "", "Secret for signing password reset tokens (random per start if empty)")
+		argon2Parallelism = flag.Uint("argon2-parallelism", uint(passwordParams.Parallelism), "Argon2id parallelism for password hashes")
 	)
 
 	flag.Parse()
 
+	// Existing hashes weaker than these parameters are upgraded at next login
+	params, err := NewArgon2Params(*argon2Memory, *argon2Iterations, *argon2Parallelism)
+	if err != nil {
+		log.Fatalf("Invalid password hashing parameters: %v", err)
+	}
+	passwordParams = params
+
 	// Create database directory
 	dbDir := filepath.Dir(*dbPath)
 	if dbDir != "." && dbDir != "" {
@@ -124,31 +217,227 @@ func main() {
 		}
 	}
 
-	// Create kernelcoin RPC client
-	kernelcoinRPCURL := fmt.Sprintf("http://%s:%s", *kernelcoinRPCHost, *kernelcoinRPCPort)
-	kernelcoinRPCClient := NewKernelcoinRPCClient(kernelcoinRPCURL, *kernelcoinRPCUser, *kernelcoinRPCPass)
+	// Create wallet backends for each coin
+	defaultRPCTimeout = *rpcTimeout
+	var assets map[string]*Asset
+	if *simulate || *noWallets {
+		// Deposits come from the admin faucet and confirm as simulated blocks are mined
+		simKCN, err := NewSimWallet(db, "kernelcoin", "KCN", *simSeed, 0.0001)
+		if err != nil {
+			log.Fatalf("Failed to open simulated KCN chain: %v", err)
+		}
+		simLTC, err := NewSimWallet(db, "litecoin", "LTC", *simSeed, *ltcWithdrawFee)
+		if err != nil {
+			log.Fatalf("Failed to open simulated LTC chain: %v", err)
+		}
+		go simKCN.Run(*simBlockInterval)
+		go simLTC.Run(*simBlockInterval)
+		log.Printf("Simulation mode: no real coins, a block every %v", *simBlockInterval)
+		assets = newAssets(simKCN, simLTC)
+	} else {
+		kernelcoinRPCURL := fmt.Sprintf("http://%s:%s", *kernelcoinRPCHost, *kernelcoinRPCPort)
+		kernelcoinRPCClient := NewKernelcoinRPCClient(kernelcoinRPCURL, *kernelcoinRPCUser, *kernelcoinRPCPass)
+
+		var litecoinWallet WalletBackend
+		switch *ltcBackend {
+		case "rpc":
+			litecoinRPCURL := fmt.Sprintf("http://%s:%s", *ltcRPCHost, *ltcRPCPort)
+			litecoinWallet = NewRPCWallet(NewLitecoinRPCClient(litecoinRPCURL, *ltcRPCUser, *ltcRPCPass), "bech32")
+		case "electrum":
+			electrumClient := NewElectrumClient(ElectrumConfig{
+				URL:         *electrumRPCURL,
+				User:        *electrumRPCUser,
+				Password:    *electrumRPCPass,
+				WalletPath:  *electrumWallet,
+				Timeout:     *electrumTimeout,
+				WithdrawFee: *ltcWithdrawFee,
+			})
+			if err := electrumClient.LoadWallet(); err != nil {
+				log.Printf("Electrum wallet not loaded yet, will retry on first use: %v", err)
+			}
+			litecoinWallet = NewElectrumWallet(electrumClient)
+		default:
+			log.Fatalf("Invalid -ltc-backend %q, expected electrum or rpc", *ltcBackend)
+		}
+		assets = newAssets(NewRPCWallet(kernelcoinRPCClient, "legacy"), litecoinWallet)
+	}
+
+	// Watch node health and pause coins whose node is unhealthy
+	healthConfig := HealthConfig{
+		Interval:    *healthInterval,
+		MaxLag:      *healthMaxLag,
+		MinPeers:    *healthMinPeers,
+		MinProgress: 0.9999,
+		StaleAfter:  *healthStaleAfter,
+	}
+	chainMonitor := NewChainMonitor(assets, healthConfig)
+	go chainMonitor.Run()
+
+	// Sweep hot wallet balances above target to cold storage
+	hotKCN, err := parseHotWalletConfig("KCN", *hotTargetKCN, *hotMinKCN, *coldAddressKCN)
+	if err != nil {
+		log.Fatalf("Invalid hot wallet settings: %v", err)
+	}
+	hotLTC, err := parseHotWalletConfig("LTC", *hotTargetLTC, *hotMinLTC, *coldAddressLTC)
+	if err != nil {
+		log.Fatalf("Invalid hot wallet settings: %v", err)
+	}
+	sweeper := NewSweeper(db, assets, map[string]HotWalletConfig{"kernelcoin": hotKCN, "litecoin": hotLTC}, chainMonitor)
+	go sweeper.Run(*sweepInterval)
+
+	// Check the wallets cover every user balance
+	reconciler := NewReconciler(db, assets, sweeper, *reconcileTol)
+	go reconciler.Run(*reconcileInterval)
+
+	// Poll LTC prices from several sources and keep the median
+	sources, err := NewPriceSources(*priceSources, *priceStatic, *priceFile, 10*time.Second)
+	if err != nil {
+		log.Fatalf("Invalid -price-sources: %v", err)
+	}
+	var currencies []string
+	for _, currency := range strings.Split(*priceCurrencies, ",") {
+		if currency = strings.ToLower(strings.TrimSpace(currency)); currency != "" {
+			currencies = append(currencies, currency)
+		}
+	}
+	prices, err := NewPriceOracle(db, sources, currencies, *priceDeviation, *priceMaxAge)
+	if err != nil {
+		log.Fatalf("Failed to load price history: %v", err)
+	}
+	go prices.Run(*priceInterval)
 
-	// Create Electrum client
-	electrumClient := NewElectrumClient(*electrumBinary, *ltcWithdrawFee)
+	// Charge maker and taker fees by 30-day volume
+	tiers, err := ParseFeeTiers(*feeTiers)
+	if err != nil {
+		log.Fatalf("Invalid -fee-tiers: %v", err)
+	}
+	fees := NewFeeSchedule(db)
+	if err := fees.SetTiers(marketKCNLTC, tiers); err != nil {
+		log.Fatalf("Invalid -fee-tiers: %v", err)
+	}
+
+	// Limits on order prices and sizes
+	rules, err := NewMarketRules(*marketTick, *marketStep, *marketMinSize, *marketMaxSize, *marketMinNotional, *marketDeviation)
+	if err != nil {
+		log.Fatalf("Invalid market rules: %v", err)
+	}
+
+	// Open order caps per account role
+	limits, err := ParseOrderLimits(*orderLimits)
+	if err != nil {
+		log.Fatalf("Invalid -order-limits: %v", err)
+	}
+
+	// Share fees with the users who referred the traders paying them
+	referrals, err := NewReferrals(db, *referralShare, *referralPeriod)
+	if err != nil {
+		log.Fatalf("Invalid referral settings: %v", err)
+	}
+
+	// Bring the price history up to date with any trades made while it was not kept
+	candles := NewCandles(db)
+	if err := candles.Rollup(); err != nil {
+		log.Printf("[CANDLES] Rollup failed: %v", err)
+	}
+
+	// Publish Merkle sum tree roots users can check their balances against
+	liabilities := NewLiabilities(db, assets)
+	go liabilities.Run(*liabilitiesEvery)
+
+	cookies := CookieConfig{
+		Secure:     *secureCookies,
+		HostPrefix: *cookieHostPrefix,
+		SameSite:   parseSameSite(*cookieSameSite),
+	}
+
+	// Create rate limiter
+	routeLimits, err := parseRouteLimits(*rateLimits)
+	if err != nil {
+		log.Fatalf("Invalid -rate-limits: %v", err)
+	}
+	defaultLimit, err := parseRateLimit(*rateLimitDefault)
+	if err != nil {
+		log.Fatalf("Invalid -rate-limit-default: %v", err)
+	}
+	rateLimiter := NewRateLimiter(routeLimits, defaultLimit, *trustProxy)
+	go rateLimiter.RunCleanup(time.Minute)
+
+	// Create mail sender for account recovery
+	var mailSender MailSender
+	switch *mailMode {
+	case "smtp":
+		mailSender = NewSMTPMailSender(*smtpHost, *smtpPort, *smtpUser, *smtpPass, *mailFrom)
+	case "file":
+		fileSender, err := NewFileMailSender(*mailDir, *mailFrom)
+		if err != nil {
+			log.Fatalf("Failed to create mail directory: %v", err)
+		}
+		mailSender = fileSender
+	default:
+		log.Fatalf("Invalid -mail-mode %q, expected file or smtp", *mailMode)
+	}
+
+	secret := []byte(*resetSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := randRead(secret); err != nil {
+			log.Fatalf("Failed to generate reset secret: %v", err)
+		}
+		log.Printf("No -reset-secret set; password reset links will not survive a restart")
+	}
+
+	// Create captcha service
+	challenge, err := NewChallenge(*captchaKind, *captchaTolerance, *captchaPowBits)
+	if err != nil {
+		log.Fatalf("Invalid -captcha-kind: %v", err)
+	}
+	captchaService := NewCaptchaService(challenge, CaptchaConfig{
+		TTL:           5 * time.Minute,
+		MaxPerIP:      *captchaMaxPerIP,
+		MaxFailures:   10,
+		FailureWindow: 15 * time.Minute,
+	})
+	go captchaService.RunSweeper(time.Minute)
 
 	// Create server instance
 	server := &Server{
-		db:                  db,
-		sessions:            make(map[string]*Session),
-		captchaService:      NewCaptchaService(),
-		kernelcoinRPCUser:   *kernelcoinRPCUser,
-		kernelcoinRPCPass:   *kernelcoinRPCPass,
-		kernelcoinRPCHost:   *kernelcoinRPCHost,
-		kernelcoinRPCPort:   *kernelcoinRPCPort,
-		kernelcoinRPCClient: kernelcoinRPCClient,
-		electrumClient:      electrumClient,
-		electrumBinary:      *electrumBinary,
-		ltcWithdrawFee:      *ltcWithdrawFee,
-		noWallets:           *noWallets,
+		db:                db,
+		sessions:          make(map[string]*Session),
+		captchaService:    captchaService,
+		kernelcoinRPCUser: *kernelcoinRPCUser,
+		kernelcoinRPCPass: *kernelcoinRPCPass,
+		kernelcoinRPCHost: *kernelcoinRPCHost,
+		kernelcoinRPCPort: *kernelcoinRPCPort,
+		assets:            assets,
+		chainMonitor:      chainMonitor,
+		sweeper:           sweeper,
+		reconciler:        reconciler,
+		liabilities:       liabilities,
+		events:            NewEventHub(),
+		candles:           candles,
+		prices:            prices,
+		fees:              fees,
+		referrals:         referrals,
+		rules:             rules,
+		orderLimits:       limits,
+		deadman:           NewDeadManSwitch(),
+		ltcWithdrawFee:    *ltcWithdrawFee,
+		rateLimiter:       rateLimiter,
+		cookies:           cookies,
+		mailSender:        mailSender,
+		baseURL:           *baseURL,
+		resetSecret:       secret,
+		trustProxy:        *trustProxy,
+		captchaOnLogin:    *captchaLogin,
+		captchaOnWithdraw: *captchaWithdraw,
+	}
+	if err := server.loadOrderBook(); err != nil {
+		log.Fatalf("Failed to load order book: %v", err)
 	}
+	go server.RunDeadManSwitch(*deadmanInterval)
 
 	// Register all routes
-	server.RegisterRoutes()
+	server.RegisterRoutes(http.DefaultServeMux)
 
 	// Start server
 	log.Printf("Exchange server starting on http://127.0.0.1:%s", *port)
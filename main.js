@@ -51,6 +51,7 @@ function showTab(tabName) {
         }
         if (tabName === 'exchange') {
             loadTrades();
+            loadMarketChart();
             setupExchangeEventListeners();
         }
         if (tabName === 'trades') {
@@ -136,11 +137,22 @@ function setupFormEventListeners() {
             }
         });
         
+        // Referral links are /?ref=CODE
+        const referralParam = new URLSearchParams(window.location.search).get('ref');
+        const referralField = document.getElementById('regReferral');
+        if (referralParam && referralField) {
+            referralField.value = referralParam;
+        }
+
         registerForm.addEventListener('submit', async (e) => {
             e.preventDefault();
             const username = document.getElementById('regUsername').value;
             const password = document.getElementById('regPassword').value;
             const confirmPassword = document.getElementById('regConfirmPassword').value;
+            const emailInput = document.getElementById('regEmail');
+            const email = emailInput ? emailInput.value.trim() : '';
+            const referralInput = document.getElementById('regReferral');
+            const referral_code = referralInput ? referralInput.value.trim() : '';
 
             if (password !== confirmPassword) {
                 alert('Passwords do not match');
@@ -164,9 +176,10 @@ function setupFormEventListeners() {
                     body: JSON.stringify({ 
                         username, 
                         password,
+                        email,
+                        referral_code,
                         captcha_id: captchaData.captcha_id,
-                        captcha_x: captchaData.captcha_x,
-                        captcha_y: captchaData.captcha_y
+                        captcha_answer: captchaData.captcha_answer
                     })
                 });
                 const data = await response.json();
@@ -204,22 +217,35 @@ function setupFormEventListeners() {
             e.preventDefault();
             const username = document.getElementById('loginUsername').value;
             const password = document.getElementById('loginPassword').value;
+
+            // Captcha is only shown when the server requires it for login
+            const loginBody = { username, password };
+            const captchaInstance = window.captchaInstances['loginCaptchaContainer'];
+            if (captchaInstance) {
+                if (!captchaInstance.isValid()) {
+                    alert('Please complete the captcha');
+                    return;
+                }
+                Object.assign(loginBody, captchaInstance.getCaptchaData());
+            }
             
             try {
                 const response = await fetch('/api/login', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
                     credentials: 'include',
-                    body: JSON.stringify({ 
-                        username, 
-                        password
-                    })
+                    body: JSON.stringify(loginBody)
                 });
                 const data = await response.json();
 
+                if (!data.success && captchaInstance) {
+                    captchaInstance.refresh();
+                }
+
                 if (data.success) {
                     currentUser = data.username;
                     currentUserId = data.user_id;
+                    reconnectFeed();
                     document.getElementById('currentUser').textContent = data.username;
                     const logoutBtn = document.getElementById('logoutBtn');
                     if (logoutBtn) {
@@ -245,6 +271,85 @@ function setupFormEventListeners() {
             }
         });
     }
+
+    setupPasswordResetEventListeners();
+}
+
+// Setup forgot-password and reset-link forms
+function setupPasswordResetEventListeners() {
+    const forgotLink = document.getElementById('forgotPasswordLink');
+    const forgotForm = document.getElementById('forgotPasswordForm');
+    if (forgotLink && forgotForm && !forgotForm.hasAttribute('data-listener-added')) {
+        forgotForm.setAttribute('data-listener-added', 'true');
+        forgotLink.addEventListener('click', (e) => {
+            e.preventDefault();
+            forgotForm.style.display = forgotForm.style.display === 'none' ? 'block' : 'none';
+        });
+        forgotForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const username = document.getElementById('resetUsername').value;
+
+            try {
+                const response = await fetch('/api/password-reset/request', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    credentials: 'include',
+                    body: JSON.stringify({ username })
+                });
+                const data = await response.json();
+
+                if (data.success) {
+                    alert(data.message);
+                    forgotForm.reset();
+                    forgotForm.style.display = 'none';
+                } else {
+                    alert('Error: ' + data.error);
+                }
+            } catch (error) {
+                alert('Error: ' + error.message);
+            }
+        });
+    }
+
+    const resetToken = new URLSearchParams(window.location.search).get('reset_token');
+    const resetCard = document.getElementById('resetPasswordCard');
+    const resetForm = document.getElementById('resetPasswordForm');
+    if (!resetToken || !resetCard || !resetForm || resetForm.hasAttribute('data-listener-added')) {
+        return;
+    }
+
+    resetForm.setAttribute('data-listener-added', 'true');
+    resetCard.style.display = 'block';
+    resetForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const newPassword = document.getElementById('resetNewPassword').value;
+        const confirmPassword = document.getElementById('resetConfirmPassword').value;
+
+        if (newPassword !== confirmPassword) {
+            alert('New passwords do not match');
+            return;
+        }
+
+        try {
+            const response = await fetch('/api/password-reset/confirm', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                credentials: 'include',
+                body: JSON.stringify({ token: resetToken, new_password: newPassword })
+            });
+            const data = await response.json();
+
+            if (data.success) {
+                alert(data.message + ' You can now login.');
+                resetCard.style.display = 'none';
+                window.history.replaceState({}, '', window.location.pathname);
+            } else {
+                alert('Error: ' + data.error);
+            }
+        } catch (error) {
+            alert('Error: ' + error.message);
+        }
+    });
 }
 
 async function loadTrades() {
@@ -329,6 +434,90 @@ async function loadTrades() {
     }
 }
 
+// Price chart and 24h ticker from /api/candles and /api/ticker
+let chartInterval = '1h';
+
+async function loadMarketChart() {
+    const canvas = document.getElementById('marketChart');
+    if (!canvas) return;
+    try {
+        const [tickerResp, candlesResp] = await Promise.all([
+            fetch('/api/ticker', { credentials: 'include' }),
+            fetch('/api/candles?interval=' + chartInterval, { credentials: 'include' })
+        ]);
+        const ticker = await tickerResp.json();
+        const data = await candlesResp.json();
+
+        if (!ticker.error) {
+            document.getElementById('tickerLast').textContent = ticker.last.toFixed(8) + ' LTC';
+            const change = document.getElementById('tickerChange');
+            change.textContent = (ticker.change >= 0 ? '+' : '') + ticker.change_percent.toFixed(2) + '%';
+            change.style.color = ticker.change >= 0 ? 'var(--success)' : 'var(--error)';
+            document.getElementById('tickerHigh').textContent = ticker.high.toFixed(8);
+            document.getElementById('tickerLow').textContent = ticker.low.toFixed(8);
+            document.getElementById('tickerVolume').textContent = ticker.volume.toFixed(2);
+        }
+        drawCandles(canvas, data.candles || []);
+    } catch (error) {
+        console.error('Error loading chart:', error);
+    }
+}
+
+function drawCandles(canvas, candles) {
+    const width = canvas.width = canvas.clientWidth;
+    const height = canvas.height;
+    const ctx = canvas.getContext('2d');
+    ctx.clearRect(0, 0, width, height);
+    ctx.font = '12px sans-serif';
+
+    if (candles.length === 0) {
+        ctx.fillStyle = '#b0b0b0';
+        ctx.fillText('No trades yet', width / 2 - 40, height / 2);
+        return;
+    }
+
+    const axis = 90;
+    const volumeHeight = 40;
+    const priceHeight = height - volumeHeight - 20;
+    const high = Math.max(...candles.map(c => c.high));
+    const low = Math.min(...candles.map(c => c.low));
+    const range = (high - low) || high || 1;
+    const maxVolume = Math.max(...candles.map(c => c.volume)) || 1;
+    const step = (width - axis) / Math.max(candles.length, 20);
+    const y = price => 10 + (high - price) / range * (priceHeight - 10);
+
+    ctx.fillStyle = '#b0b0b0';
+    ctx.fillText(high.toFixed(8), width - axis + 5, y(high) + 4);
+    ctx.fillText(low.toFixed(8), width - axis + 5, y(low));
+
+    candles.forEach((c, i) => {
+        const x = i * step + step / 2;
+        const color = c.close >= c.open ? '#00d966' : '#ff4444';
+        ctx.strokeStyle = color;
+        ctx.fillStyle = color;
+        ctx.beginPath();
+        ctx.moveTo(x, y(c.high));
+        ctx.lineTo(x, y(c.low));
+        ctx.stroke();
+        const top = y(Math.max(c.open, c.close));
+        const body = Math.max(y(Math.min(c.open, c.close)) - top, 1);
+        ctx.fillRect(x - step * 0.35, top, step * 0.7, body);
+
+        const bar = c.volume / maxVolume * volumeHeight;
+        ctx.globalAlpha = 0.4;
+        ctx.fillRect(x - step * 0.35, height - bar, step * 0.7, bar);
+        ctx.globalAlpha = 1;
+    });
+}
+
+document.addEventListener('click', (e) => {
+    if (e.target.classList.contains('chart-interval')) {
+        chartInterval = e.target.dataset.interval;
+        document.querySelectorAll('.chart-interval').forEach(btn => btn.classList.toggle('active', btn === e.target));
+        loadMarketChart();
+    }
+});
+
 let currentBalances = { litecoin: 0, kernelcoin: 0, ltc_reserved: 0, kcn_reserved: 0 };
 
 async function loadMyBalances() {
@@ -429,6 +618,11 @@ async function loadAdminData() {
         document.getElementById('activeTrades').textContent = activeTrades;
         document.getElementById('completedTrades').textContent = statsData.completed_trades || 0;
 
+        loadNodeHealth();
+        loadFaucet();
+        loadHotWallets();
+        loadReconciliation();
+
         if (adminTable) {
             adminTable.destroy();
         }
@@ -464,6 +658,295 @@ async function loadAdminData() {
     }
 }
 
+// Fill the admin node health table, with a pause/resume toggle per coin
+async function loadNodeHealth() {
+    const tbody = document.getElementById('healthTableBody');
+    if (!tbody) return;
+
+    try {
+        const response = await fetch('/api/admin/health', { credentials: 'include' });
+        const data = await response.json();
+        tbody.innerHTML = '';
+
+        if (data.error) {
+            tbody.innerHTML = `<tr><td colspan="7" class="text-center">${data.error}</td></tr>`;
+            return;
+        }
+
+        (data.coins || []).forEach(coin => {
+            const row = tbody.insertRow();
+            const status = coin.healthy ? 'Healthy' : `Unhealthy: ${coin.reason}`;
+            const paused = coin.manual_pause || !coin.healthy;
+            row.innerHTML = `
+                <td>${coin.symbol}</td>
+                <td style="color: ${coin.healthy ? '#28a745' : '#dc3545'};">${status}</td>
+                <td>${coin.height}</td>
+                <td>${coin.headers}</td>
+                <td>${coin.peers}</td>
+                <td>${coin.last_tip_change ? new Date(coin.last_tip_change).toLocaleString() : ''}</td>
+                <td>
+                    ${paused ? 'Paused' : 'Enabled'}
+                    <button class="btn btn-secondary" style="font-size: 0.75rem; padding: 0.2rem 0.6rem; margin-left: 0.5rem;"
+                        onclick="setCoinPaused('${coin.coin}', ${!coin.manual_pause})">${coin.manual_pause ? 'Resume' : 'Pause'}</button>
+                </td>
+            `;
+        });
+    } catch (error) {
+        console.error('Error loading node health:', error);
+    }
+}
+
+async function setCoinPaused(coin, paused) {
+    const reason = paused ? prompt('Reason shown to users:', 'Scheduled maintenance') : '';
+    if (paused && reason === null) return;
+
+    const response = await fetch('/api/admin/health', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        credentials: 'include',
+        body: JSON.stringify({ coin, paused, reason })
+    });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+    }
+    loadNodeHealth();
+}
+
+// Fill the admin hot wallet table and sweep ledger
+function renderHotWallets(data) {
+    const tbody = document.getElementById('hotWalletTableBody');
+    const ledgerBody = document.getElementById('sweepLedgerTableBody');
+    if (!tbody || !ledgerBody) return;
+    tbody.innerHTML = '';
+    ledgerBody.innerHTML = '';
+
+    if (data.error) {
+        tbody.innerHTML = `<tr><td colspan="8" class="text-center">${data.error}</td></tr>`;
+        return;
+    }
+
+    (data.wallets || []).forEach(wallet => {
+        const row = tbody.insertRow();
+        row.innerHTML = `
+            <td>${wallet.symbol}</td>
+            <td>${wallet.error ? wallet.error : wallet.balance.toFixed(8)}</td>
+            <td>${wallet.pending_withdrawals.toFixed(8)}</td>
+            <td>${wallet.target > 0 ? wallet.target.toFixed(8) : 'Disabled'}</td>
+            <td>${wallet.min.toFixed(8)}</td>
+            <td>${wallet.cold_address || '-'}</td>
+            <td style="color: ${wallet.refill > 0 ? '#dc3545' : 'inherit'};">${wallet.refill > 0 ? wallet.refill.toFixed(8) : '-'}</td>
+            <td>
+                <button class="btn btn-secondary" style="font-size: 0.75rem; padding: 0.2rem 0.6rem;"
+                    onclick="recordRefill('${wallet.coin}', '${wallet.symbol}')">Record Refill</button>
+            </td>
+        `;
+    });
+
+    const ledger = data.ledger || [];
+    if (ledger.length === 0) {
+        ledgerBody.innerHTML = '<tr><td colspan="7" class="text-center">No sweeps yet</td></tr>';
+        return;
+    }
+    ledger.forEach(entry => {
+        const row = ledgerBody.insertRow();
+        const details = entry.kind === 'sweep' ? `${entry.address} ${entry.tx_hash || entry.note}` : entry.note;
+        row.innerHTML = `
+            <td>${new Date(entry.created_at).toLocaleString()}</td>
+            <td>${entry.coin}</td>
+            <td>${entry.kind}</td>
+            <td>${entry.amount.toFixed(8)}</td>
+            <td>${entry.status}</td>
+            <td>${entry.hot_balance.toFixed(8)}</td>
+            <td style="word-break: break-all;">${details}</td>
+        `;
+    });
+}
+
+function renderFaucet(data) {
+    const card = document.getElementById('faucetCard');
+    const tbody = document.getElementById('simChainTableBody');
+    const txBody = document.getElementById('simTxTableBody');
+    if (!card || !tbody || !txBody) return;
+    if (data.error || !data.chains) {
+        card.style.display = 'none';
+        return;
+    }
+    card.style.display = '';
+    tbody.innerHTML = '';
+    txBody.innerHTML = '';
+
+    const txs = [];
+    Object.entries(data.chains).forEach(([coin, chain]) => {
+        const row = tbody.insertRow();
+        row.innerHTML = `
+            <td>${chain.symbol}</td>
+            <td>${chain.height}</td>
+            <td>${new Date(chain.tip_time).toLocaleString()}</td>
+            <td>${chain.balance.toFixed(8)}</td>
+            <td>${chain.unconfirmed.toFixed(8)}</td>
+            <td>
+                <button class="btn btn-secondary" style="font-size: 0.75rem; padding: 0.2rem 0.6rem;"
+                    onclick="faucetPay('${coin}', '${chain.symbol}')">Pay User</button>
+                <button class="btn btn-secondary" style="font-size: 0.75rem; padding: 0.2rem 0.6rem;"
+                    onclick="faucetMine('${coin}')">Mine Block</button>
+            </td>
+        `;
+        (chain.transactions || []).forEach(tx => txs.push({ ...tx, symbol: chain.symbol }));
+    });
+
+    if (txs.length === 0) {
+        txBody.innerHTML = '<tr><td colspan="5" class="text-center">No simulated transactions yet</td></tr>';
+        return;
+    }
+    txs.sort((a, b) => new Date(b.created_at) - new Date(a.created_at));
+    txs.forEach(tx => {
+        const row = txBody.insertRow();
+        row.innerHTML = `
+            <td>${tx.symbol}</td>
+            <td>${tx.kind} (${tx.direction})</td>
+            <td>${tx.address}</td>
+            <td>${tx.amount.toFixed(8)}</td>
+            <td>${tx.height > 0 ? tx.height : 'mempool'}</td>
+        `;
+    });
+}
+
+async function loadFaucet() {
+    try {
+        const response = await fetch('/api/admin/faucet', { credentials: 'include' });
+        renderFaucet(await response.json());
+    } catch (error) {
+        console.error('Error loading faucet:', error);
+    }
+}
+
+async function faucetPay(coin, symbol) {
+    const username = prompt(`Pay ${symbol} to which user's deposit address?`);
+    if (!username) return;
+    const amount = parseFloat(prompt(`${symbol} to send to ${username}:`));
+    if (!(amount > 0)) return;
+
+    const response = await fetch('/api/admin/faucet', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        credentials: 'include',
+        body: JSON.stringify({ coin, username, amount })
+    });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+    }
+    loadFaucet();
+}
+
+async function faucetMine(coin) {
+    const response = await fetch('/api/admin/faucet', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        credentials: 'include',
+        body: JSON.stringify({ coin, blocks: 1 })
+    });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+    }
+    loadFaucet();
+}
+
+async function loadHotWallets() {
+    try {
+        const response = await fetch('/api/admin/hot-wallet', { credentials: 'include' });
+        renderHotWallets(await response.json());
+    } catch (error) {
+        console.error('Error loading hot wallets:', error);
+    }
+}
+
+async function sweepNow() {
+    if (!confirm('Sweep every hot wallet above its target to cold storage now?')) return;
+
+    const response = await fetch('/api/admin/hot-wallet', {
+        method: 'POST',
+        credentials: 'include'
+    });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+    }
+    renderHotWallets(data);
+}
+
+async function recordRefill(coin, symbol) {
+    const amount = parseFloat(prompt(`${symbol} moved from cold storage to the hot wallet:`));
+    if (!(amount > 0)) return;
+    const txHash = prompt('Transaction hash (optional):') || '';
+
+    const response = await fetch('/api/admin/hot-wallet', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        credentials: 'include',
+        body: JSON.stringify({ coin, amount, tx_hash: txHash })
+    });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+    }
+    renderHotWallets(data);
+}
+
+// Fill the admin reconciliation table, newest reports first
+function renderReconciliation(data) {
+    const tbody = document.getElementById('reconciliationTableBody');
+    if (!tbody) return;
+    tbody.innerHTML = '';
+
+    if (data.error) {
+        tbody.innerHTML = `<tr><td colspan="7" class="text-center">${data.error}</td></tr>`;
+        return;
+    }
+
+    const history = data.history || [];
+    if (history.length === 0) {
+        tbody.innerHTML = '<tr><td colspan="7" class="text-center">No reports yet</td></tr>';
+        return;
+    }
+    const colors = { ok: '#28a745', surplus: '#ffc107', shortfall: '#dc3545', error: '#dc3545' };
+    history.slice(0, 20).forEach(report => {
+        const row = tbody.insertRow();
+        row.innerHTML = `
+            <td>${new Date(report.created_at).toLocaleString()}</td>
+            <td>${report.symbol}</td>
+            <td>${report.liabilities.toFixed(8)}</td>
+            <td>${(report.wallet_confirmed + report.wallet_unconfirmed).toFixed(8)}</td>
+            <td>${report.cold_storage.toFixed(8)}</td>
+            <td>${report.difference.toFixed(8)}</td>
+            <td style="color: ${colors[report.status]};">${report.error ? report.error : report.status}</td>
+        `;
+    });
+}
+
+async function loadReconciliation() {
+    try {
+        const response = await fetch('/api/admin/reconciliation', { credentials: 'include' });
+        renderReconciliation(await response.json());
+    } catch (error) {
+        console.error('Error loading reconciliation:', error);
+    }
+}
+
+async function reconcileNow() {
+    const response = await fetch('/api/admin/reconciliation', {
+        method: 'POST',
+        credentials: 'include'
+    });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+    }
+    renderReconciliation(data);
+}
+
 async function loadMyTrades() {
     if (!currentUserId) return;
     try {
@@ -505,6 +988,8 @@ async function loadMyTrades() {
                 const pricePerCoinUsd = (actualPricePerCoin * ltcUsdPrice).toFixed(8);
                 const dateCreated = new Date(trade.created_at).toLocaleString();
                 const counterparty = trade.counterparty || 'You';
+                const feeSymbol = trade.fee_coin === 'kernelcoin' ? 'KCN' : 'LTC';
+                const fee = trade.fee ? `${trade.fee.toFixed(8)} ${feeSymbol}` : '-';
                 
                 row.innerHTML = `
                     <td>${tradeType}</td>
@@ -513,6 +998,7 @@ async function loadMyTrades() {
                     <td>${ltcAmount.toFixed(8)}</td>
                     <td>$${priceUsd}</td>
                     <td>$${pricePerCoinUsd}</td>
+                    <td title="${trade.liquidity || ''}">${fee}</td>
                     <td>${dateCreated}</td>
                     <td>-</td>
                     <td>${statusBadge}</td>
@@ -527,7 +1013,7 @@ async function loadMyTrades() {
                 });
             }
         } else {
-            tbody.innerHTML = '<tr><td colspan="10" class="text-center">No trades yet</td></tr>';
+            tbody.innerHTML = '<tr><td colspan="11" class="text-center">No trades yet</td></tr>';
         }
     } catch (error) {
         console.error('Error loading trades:', error);
@@ -560,6 +1046,12 @@ function updateLtcPriceDisplay() {
 
 // Check session on page load
 async function checkSessionOnLoad() {
+    // A password reset link always opens the auth tab where the reset form lives
+    if (new URLSearchParams(window.location.search).has('reset_token')) {
+        showTab('auth');
+        return;
+    }
+
     try {
         const response = await fetch('/api/session', {
             credentials: 'include'
@@ -569,6 +1061,7 @@ async function checkSessionOnLoad() {
         if (data.success) {
             currentUser = data.username;
             currentUserId = data.user_id;
+            feedSubscribe('user');
             document.getElementById('currentUser').textContent = data.username;
             const logoutBtn = document.getElementById('logoutBtn');
             if (logoutBtn) {
@@ -609,11 +1102,123 @@ setTimeout(() => {
     setupFormEventListeners();
 }, 100);
 
-// Initial fetch and periodic updates
+// Live updates over /ws. Each channel's events carry a sequence number; after a gap
+// or a reconnect we resubscribe from the last one seen and the server replays what
+// we missed, or sends a fresh snapshot if it no longer has it or has restarted
+// since (the epoch differs).
+let feedSocket = null;
+let feedConnected = false;
+let feedRetryDelay = 1000;
+const feedSeq = {};
+const feedEpoch = {};
+const feedRefresh = {};
+
+// Run fn at most once per short burst of events
+function debounceFeed(key, fn) {
+    clearTimeout(feedRefresh[key]);
+    feedRefresh[key] = setTimeout(fn, 250);
+}
+
+function feedSubscribe(channel) {
+    if (!feedSocket || feedSocket.readyState !== WebSocket.OPEN) return;
+    const req = { op: 'subscribe', channel: channel };
+    if (feedSeq[channel] !== undefined) {
+        req.since = feedSeq[channel];
+        req.epoch = feedEpoch[channel];
+    }
+    feedSocket.send(JSON.stringify(req));
+}
+
+function handleFeedMessage(msg) {
+    if (msg.type === 'error') {
+        console.error('Feed error:', msg.error);
+        return;
+    }
+    if (msg.type === 'subscribed') {
+        feedSeq[msg.channel] = msg.seq;
+        feedEpoch[msg.channel] = msg.epoch;
+        return;
+    }
+    if (!msg.channel || msg.seq === undefined) return;
+
+    if (msg.type !== 'snapshot' && feedSeq[msg.channel] !== undefined && msg.seq !== feedSeq[msg.channel] + 1) {
+        if (msg.seq > feedSeq[msg.channel] + 1) {
+            feedSubscribe(msg.channel); // missed some, catch up
+        }
+        return;
+    }
+    feedSeq[msg.channel] = msg.seq;
+    if (msg.type === 'snapshot') {
+        feedEpoch[msg.channel] = msg.epoch;
+    }
+
+    if (msg.channel === 'book' || msg.channel === 'trades') {
+        debounceFeed('trades', loadTrades);
+        if (msg.channel === 'trades') {
+            debounceFeed('chart', loadMarketChart);
+        }
+        return;
+    }
+    if (msg.type === 'snapshot' || msg.type === 'balance' || msg.type === 'deposit' || msg.type === 'withdrawal') {
+        debounceFeed('balances', loadMyBalances);
+    }
+    if (msg.type === 'snapshot' || msg.type === 'order' || msg.type === 'fill') {
+        debounceFeed('myTrades', loadMyTrades);
+    }
+}
+
+function connectFeed() {
+    if (!window.WebSocket) return;
+    const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+    const socket = new WebSocket(scheme + window.location.host + '/ws');
+    feedSocket = socket;
+
+    socket.onopen = () => {
+        feedConnected = true;
+        feedRetryDelay = 1000;
+        feedSubscribe('book');
+        feedSubscribe('trades');
+        if (currentUser) {
+            feedSubscribe('user');
+        }
+    };
+    socket.onmessage = (event) => {
+        try {
+            handleFeedMessage(JSON.parse(event.data));
+        } catch (e) {
+            console.error('Bad feed message:', e);
+        }
+    };
+    socket.onclose = () => {
+        feedConnected = false;
+        if (feedSocket !== socket) return;
+        setTimeout(connectFeed, feedRetryDelay);
+        feedRetryDelay = Math.min(feedRetryDelay * 2, 30000);
+    };
+}
+
+// The user channel belongs to the session the socket was opened with, so start over
+// after logging in or out
+function reconnectFeed() {
+    delete feedSeq.user;
+    if (feedSocket) {
+        const old = feedSocket;
+        feedSocket = null;
+        old.close();
+    }
+    connectFeed();
+}
+
+connectFeed();
+
+// Initial fetch and periodic updates; trades are only polled while the feed is down
 updateLtcPriceDisplay();
 setInterval(() => {
     updateLtcPriceDisplay();
-    loadTrades();
+    if (!feedConnected) {
+        loadTrades();
+        loadMarketChart();
+    }
 }, 30000); // Update every 30 seconds
 
 // Setup exchange event listeners
@@ -732,7 +1337,7 @@ function clearWalletData() {
     const elements = [
         'walletLtcBalance', 'walletKcnBalance', 'walletLtcReserved', 'walletKcnReserved',
         'ltcAddress', 'kcnAddress', 'ltcReceiveAddress', 'kcnReceiveAddress',
-        'newLtcAddress', 'newKcnAddress'
+        'newLtcAddress', 'newKcnAddress', 'recoveryEmail'
     ];
     
     elements.forEach(id => {
@@ -784,6 +1389,19 @@ async function loadWalletData() {
             const newKcnAddr = document.getElementById('newKcnAddress');
             if (newLtcAddr) newLtcAddr.value = userData.litecoin_address || '';
             if (newKcnAddr) newKcnAddr.value = userData.kernelcoin_address || '';
+
+            const recoveryEmail = document.getElementById('recoveryEmail');
+            if (recoveryEmail) recoveryEmail.value = userData.email || '';
+
+            const frozenNotice = document.getElementById('withdrawalsFrozenNotice');
+            if (frozenNotice) {
+                if (userData.withdrawals_frozen_until) {
+                    frozenNotice.textContent = `Withdrawals are disabled until ${new Date(userData.withdrawals_frozen_until).toLocaleString()} after a password reset.`;
+                    frozenNotice.style.display = 'block';
+                } else {
+                    frozenNotice.style.display = 'none';
+                }
+            }
         }
         
         // Load withdrawal fee
@@ -799,6 +1417,9 @@ async function loadWalletData() {
             }
         }
         
+        loadWalletStatus();
+        loadLiabilities();
+
         // Load transaction history
         loadTransactionHistory();
     } catch (error) {
@@ -866,6 +1487,65 @@ function showTxHashModal(txHash) {
     });
 }
 
+// Show which coins have deposits and withdrawals paused because of node problems
+async function loadWalletStatus() {
+    const notice = document.getElementById('walletStatusNotice');
+    if (!notice) return;
+
+    try {
+        const response = await fetch('/api/wallet-status', { credentials: 'include' });
+        const data = await response.json();
+        const paused = Object.values(data.coins || {}).filter(c => !c.deposits_enabled || !c.withdrawals_enabled);
+
+        if (paused.length > 0) {
+            notice.innerHTML = paused
+                .map(c => `<i class="fas fa-exclamation-triangle"></i> ${c.symbol} deposits and withdrawals are temporarily paused: ${c.reason}`)
+                .join('<br>');
+            notice.style.display = 'block';
+        } else {
+            notice.style.display = 'none';
+        }
+    } catch (error) {
+        console.error('Error loading wallet status:', error);
+    }
+}
+
+// Show the latest proof-of-liabilities root and let the user download their proof
+async function loadLiabilities() {
+    const rootEl = document.getElementById('liabilitiesRoot');
+    if (!rootEl) return;
+
+    try {
+        const response = await fetch('/api/liabilities', { credentials: 'include' });
+        const data = await response.json();
+        if (data.error) {
+            rootEl.textContent = data.error;
+            return;
+        }
+        rootEl.textContent = data.root;
+        document.getElementById('liabilitiesDate').textContent = new Date(data.created_at).toLocaleString();
+        document.getElementById('liabilitiesUsers').textContent = data.leaf_count;
+    } catch (error) {
+        console.error('Error loading proof of liabilities:', error);
+    }
+}
+
+async function downloadLiabilityProof() {
+    const response = await fetch('/api/liabilities/proof', { credentials: 'include' });
+    const data = await response.json();
+    if (data.error) {
+        alert('Error: ' + data.error);
+        return;
+    }
+
+    const blob = new Blob([JSON.stringify(data.proof, null, 2)], { type: 'application/json' });
+    const link = document.createElement('a');
+    link.href = URL.createObjectURL(blob);
+    link.download = `liabilities-proof-${data.snapshot.id}.json`;
+    link.click();
+    URL.revokeObjectURL(link.href);
+}
+
 // Check confirmations function
 async function checkConfirmations(coin) {
     try {
@@ -957,6 +1637,30 @@ async function updateSingleAddress(coin) {
     }
 }
 
+// Update the recovery email used for password resets
+async function updateRecoveryEmail() {
+    const email = document.getElementById('recoveryEmail').value.trim();
+
+    try {
+        const response = await fetch('/api/update-email', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            credentials: 'include',
+            body: JSON.stringify({ email })
+        });
+        const data = await response.json();
+
+        if (data.success) {
+            alert('Recovery email updated!');
+            loadWalletData();
+        } else {
+            alert('Error: ' + data.error);
+        }
+    } catch (error) {
+        alert('Error: ' + error.message);
+    }
+}
+
 // Setup wallet event listeners
 function setupWalletEventListeners() {
     // Add real-time validation for address inputs
@@ -1028,6 +1732,15 @@ function requestWithdraw(coin) {
     document.getElementById('withdrawAmountLabel').textContent = `Amount (${coin.toUpperCase()})`;
     document.getElementById('withdrawAmount').value = '';
     document.getElementById('withdrawModal').classList.add('active');
+
+    if (window.getCaptchaConfig) {
+        window.getCaptchaConfig().then(config => {
+            if (config.withdraw) {
+                document.getElementById('withdrawCaptchaGroup').style.display = 'block';
+                window.initCaptcha('withdrawCaptchaContainer');
+            }
+        });
+    }
 }
 
 function closeWithdrawModal() {
@@ -1137,12 +1850,23 @@ function confirmWithdraw() {
         alert('Please enter a valid amount');
         return;
     }
+
+    const withdrawBody = { coin: withdrawCoin, amount: amount };
+    const captchaGroup = document.getElementById('withdrawCaptchaGroup');
+    const captchaInstance = window.captchaInstances && window.captchaInstances['withdrawCaptchaContainer'];
+    if (captchaGroup && captchaGroup.style.display !== 'none' && captchaInstance) {
+        if (!captchaInstance.isValid()) {
+            alert('Please complete the captcha');
+            return;
+        }
+        Object.assign(withdrawBody, captchaInstance.getCaptchaData());
+    }
     
     fetch('/api/withdraw', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         credentials: 'include',
-        body: JSON.stringify({ coin: withdrawCoin, amount: amount })
+        body: JSON.stringify(withdrawBody)
     })
     .then(response => response.json())
     .then(data => {
@@ -1522,6 +2246,7 @@ function setupLogoutButton() {
                 });
                 currentUser = null;
                 currentUserId = null;
+                reconnectFeed();
                 document.getElementById('currentUser').textContent = 'Not logged in';
                 logoutBtn.style.display = 'none';
                 const adminBtn = document.getElementById('adminTabBtn');
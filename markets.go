@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Error codes returned with rejected orders and executions
+const (
+	errInvalidCoin    = "invalid_coin"
+	errInvalidAmount  = "invalid_amount"
+	errTickSize       = "tick_size"
+	errStepSize       = "step_size"
+	errMinSize        = "min_size"
+	errMaxSize        = "max_size"
+	errMinNotional    = "min_notional"
+	errPriceDeviation = "price_deviation"
+)
+
+// RuleError is an order or execution that breaks a market rule. Code is one of
+// the err* codes above, for clients to act on; Message is for people.
+type RuleError struct {
+	Code    string
+	Message string
+}
+
+func (e *RuleError) Error() string { return e.Message }
+
+// ruleError creates a RuleError
+func ruleError(code, format string, args ...interface{}) *RuleError {
+	return &RuleError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorCode is the code of a RuleError, or "" for other errors
+func errorCode(err error) string {
+	var ruleErr *RuleError
+	if errors.As(err, &ruleErr) {
+		return ruleErr.Code
+	}
+	return ""
+}
+
+// balanceColumns maps each coin to its column in balances. Coin names only reach
+// SQL through this map.
+var balanceColumns = map[string]string{
+	"kernelcoin": "kernelcoin",
+	"litecoin":   "litecoin",
+}
+
+// execer is a *sql.DB or a *sql.Tx, so balance changes can be part of a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// adjustBalance adds delta, which may be negative, to a user's balance of a coin
+func adjustBalance(db execer, userID int, coin string, delta float64) error {
+	column, ok := balanceColumns[coin]
+	if !ok {
+		return ruleError(errInvalidCoin, "unknown coin %q", coin)
+	}
+	_, err := db.Exec(`UPDATE balances SET `+column+` = `+column+` + ? WHERE user_id = ?`, delta, userID)
+	return err
+}
+
+// MarketRules are the limits on orders in a market. Prices are in the quote coin per
+// base coin and sizes in the base coin. A zero MaxSize or MaxDeviation is no limit.
+type MarketRules struct {
+	Market       string  `json:"market"`
+	Base         string  `json:"base"`
+	Quote        string  `json:"quote"`
+	TickSize     float64 `json:"tick_size"`
+	StepSize     float64 `json:"step_size"`
+	MinSize      float64 `json:"min_size"`
+	MaxSize      float64 `json:"max_size"`
+	MinNotional  float64 `json:"min_notional"`
+	MaxDeviation float64 `json:"max_price_deviation"` // fraction of the last trade price
+	BaseCoin     string  `json:"-"`
+	QuoteCoin    string  `json:"-"`
+}
+
+// NewMarketRules creates the rules for the KCN-LTC market
+func NewMarketRules(tick, step, minSize, maxSize, minNotional, maxDeviation float64) (*MarketRules, error) {
+	if tick <= 0 || step <= 0 {
+		return nil, fmt.Errorf("tick and step sizes must be positive")
+	}
+	if minSize < 0 || maxSize < 0 || minNotional < 0 || maxDeviation < 0 {
+		return nil, fmt.Errorf("order limits must not be negative")
+	}
+	if maxSize > 0 && maxSize < minSize {
+		return nil, fmt.Errorf("maximum order size is below the minimum")
+	}
+	return &MarketRules{
+		Market:       marketKCNLTC,
+		Base:         "KCN",
+		Quote:        "LTC",
+		TickSize:     tick,
+		StepSize:     step,
+		MinSize:      minSize,
+		MaxSize:      maxSize,
+		MinNotional:  minNotional,
+		MaxDeviation: maxDeviation,
+		BaseCoin:     "kernelcoin",
+		QuoteCoin:    "litecoin",
+	}, nil
+}
+
+// validAmount reports whether an amount is a usable positive number
+func validAmount(v float64) bool {
+	return v > 0 && !math.IsInf(v, 0) && !math.IsNaN(v)
+}
+
+// onGrid reports whether v is a whole number of increments, give or take float error
+func onGrid(v, increment float64) bool {
+	n := v / increment
+	return math.Abs(n-math.Round(n)) <= 1e-6
+}
+
+// orderTerms works out an order's price and size in KCN from what it sells and
+// buys, rejecting coins other than KCN and LTC and amounts that are not positive
+func orderTerms(coinSelling string, amountSelling float64, coinBuying string, amountBuying float64) (price, size float64, err error) {
+	if _, ok := balanceColumns[coinSelling]; !ok {
+		return 0, 0, ruleError(errInvalidCoin, "Unknown coin: %s", coinSelling)
+	}
+	if _, ok := balanceColumns[coinBuying]; !ok || coinBuying == coinSelling {
+		return 0, 0, ruleError(errInvalidCoin, "An order must trade kernelcoin for litecoin or litecoin for kernelcoin")
+	}
+	if !validAmount(amountSelling) || !validAmount(amountBuying) {
+		return 0, 0, ruleError(errInvalidAmount, "Amounts must be positive numbers")
+	}
+	if coinSelling == "kernelcoin" {
+		return amountBuying / amountSelling, amountSelling, nil
+	}
+	return amountSelling / amountBuying, amountBuying, nil
+}
+
+// checkPrice applies the tick size and the deviation from the last trade price
+func (m *MarketRules) checkPrice(price, last float64) error {
+	if !onGrid(price, m.TickSize) {
+		return ruleError(errTickSize, "Price %g %s must be a multiple of %g", price, m.Quote, m.TickSize)
+	}
+	if m.MaxDeviation > 0 && last > 0 && math.Abs(price-last)/last > m.MaxDeviation {
+		return ruleError(errPriceDeviation, "Price %g %s is more than %g%% from the last trade at %g",
+			price, m.Quote, m.MaxDeviation*100, last)
+	}
+	return nil
+}
+
+// checkSize applies the step size, the size limits and the minimum notional. A
+// fill that takes the rest of an order may be smaller than the minimums, so no
+// order is left that cannot be filled.
+func (m *MarketRules) checkSize(size, price float64, rest bool) error {
+	if !onGrid(size, m.StepSize) {
+		return ruleError(errStepSize, "Quantity %g %s must be a multiple of %g", size, m.Base, m.StepSize)
+	}
+	if m.MaxSize > 0 && size > m.MaxSize {
+		return ruleError(errMaxSize, "Quantity %g %s is above the maximum of %g", size, m.Base, m.MaxSize)
+	}
+	if rest {
+		return nil
+	}
+	if size < m.MinSize {
+		return ruleError(errMinSize, "Quantity %g %s is below the minimum of %g", size, m.Base, m.MinSize)
+	}
+	if size*price < m.MinNotional {
+		return ruleError(errMinNotional, "Order value %g %s is below the minimum of %g", size*price, m.Quote, m.MinNotional)
+	}
+	return nil
+}
+
+// CheckOrder applies the rules to a new order. last is the last trade price, 0 if none.
+func (m *MarketRules) CheckOrder(price, size, last float64) error {
+	if m == nil {
+		return nil
+	}
+	if err := m.checkPrice(price, last); err != nil {
+		return err
+	}
+	return m.checkSize(size, price, false)
+}
+
+// CheckFill applies the size rules to executing quantity of an order. The order's
+// price was checked when it was placed or amended; checking it again against a last
+// price that has since moved would leave it resting with no way to fill.
+func (m *MarketRules) CheckFill(order *BookOrder, quantity float64) error {
+	if m == nil {
+		return nil
+	}
+	return m.checkSize(quantity, order.Price, math.Abs(quantity-order.Remaining) <= 1e-9)
+}
+
+// CheckAmend applies the rules to an order's new price and remaining size. Only
+// what changes is checked, so a remainder that fills left below the minimums can
+// still be repriced.
+func (m *MarketRules) CheckAmend(order *BookOrder, price, remaining, last float64) error {
+	if m == nil {
+		return nil
+	}
+	if price != order.Price {
+		if err := m.checkPrice(price, last); err != nil {
+			return err
+		}
+	}
+	if remaining != order.Remaining {
+		return m.checkSize(remaining, price, false)
+	}
+	return nil
+}
+
+// lastPrice is the market's last trade price, 0 before the first. Caller must hold s.mu.
+func (s *Server) lastPrice() (float64, error) {
+	if s.candles == nil {
+		return 0, nil
+	}
+	return s.candles.LastPrice()
+}
+
+// checkOrder validates a new order against the market rules. Caller must hold s.mu.
+func (s *Server) checkOrder(coinSelling string, amountSelling float64, coinBuying string, amountBuying float64) error {
+	price, size, err := orderTerms(coinSelling, amountSelling, coinBuying, amountBuying)
+	if err != nil {
+		return err
+	}
+	last, err := s.lastPrice()
+	if err != nil {
+		return err
+	}
+	return s.rules.CheckOrder(price, size, last)
+}
+
+// handleGetMarkets publishes each market's trading rules and fees
+func (s *Server) handleGetMarkets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Without configured rules only the coin and amount checks apply
+	rules := s.rules
+	if rules == nil {
+		rules, _ = NewMarketRules(1e-8, 1e-8, 0, 0, 0, 0)
+	}
+	s.mu.RLock()
+	last, err := s.lastPrice()
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[MARKETS] Failed to load last price: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load markets"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"markets": []interface{}{
+			struct {
+				*MarketRules
+				LastPrice float64   `json:"last_price"`
+				FeeTiers  []FeeTier `json:"fee_tiers"`
+			}{rules, last, s.fees.Tiers(rules.Market)},
+		},
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMarketRulesOnCreateAndExecute(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	ex.server.rules, _ = NewMarketRules(0.001, 0.1, 1, 100, 0.05, 0.2)
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 500, litecoin = 50`)
+
+	ask := func(kcn, ltc float64) map[string]interface{} {
+		return alice.call("/api/trade/create", map[string]interface{}{
+			"coin_selling": "kernelcoin", "amount_selling": kcn, "coin_buying": "litecoin", "amount_buying": ltc,
+		})
+	}
+	for _, tc := range []struct {
+		order map[string]interface{}
+		code  string
+	}{
+		{map[string]interface{}{"coin_selling": "kernelcoin = 1000, litecoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1}, errInvalidCoin},
+		{map[string]interface{}{"coin_selling": "litecoin", "amount_selling": 1, "coin_buying": "litecoin", "amount_buying": 1}, errInvalidCoin},
+		{map[string]interface{}{"coin_selling": "kernelcoin", "amount_selling": 0, "coin_buying": "litecoin", "amount_buying": 1}, errInvalidAmount},
+		{map[string]interface{}{"coin_selling": "litecoin", "amount_selling": 1, "coin_buying": "kernelcoin", "amount_buying": -10}, errInvalidAmount},
+		{map[string]interface{}{"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1.0005}, errTickSize},
+		{map[string]interface{}{"coin_selling": "kernelcoin", "amount_selling": 10.05, "coin_buying": "litecoin", "amount_buying": 1.005}, errStepSize},
+		{map[string]interface{}{"coin_selling": "kernelcoin", "amount_selling": 0.5, "coin_buying": "litecoin", "amount_buying": 0.05}, errMinSize},
+		{map[string]interface{}{"coin_selling": "kernelcoin", "amount_selling": 150, "coin_buying": "litecoin", "amount_buying": 15}, errMaxSize},
+		{map[string]interface{}{"coin_selling": "litecoin", "amount_selling": 0.02, "coin_buying": "kernelcoin", "amount_buying": 2}, errMinNotional},
+	} {
+		resp := alice.call("/api/trade/create", tc.order)
+		if resp["code"] != tc.code || resp["success"] == true {
+			t.Errorf("%v: %v, want code %s", tc.order, resp, tc.code)
+		}
+	}
+	assertAmount(t, "alice KCN after rejected orders", alice.balance()["kernelcoin"], 500)
+
+	created := ask(10, 1)
+	if created["success"] != true {
+		t.Fatalf("create: %v", created)
+	}
+	execute := func(quantity float64) map[string]interface{} {
+		return bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": quantity})
+	}
+	if resp := execute(0.05); resp["code"] != errStepSize {
+		t.Errorf("execute 0.05: %v", resp)
+	}
+	if resp := execute(0.5); resp["code"] != errMinSize {
+		t.Errorf("execute 0.5: %v", resp)
+	}
+	// What is left may be taken even below the minimums
+	if resp := execute(9.5); resp["success"] != true {
+		t.Fatalf("execute 9.5: %v", resp)
+	}
+	if resp := execute(0.5); resp["success"] != true {
+		t.Fatalf("execute the last 0.5: %v", resp)
+	}
+
+	// Prices are held within 20% of the last trade at 0.1
+	if resp := ask(10, 1.3); resp["code"] != errPriceDeviation {
+		t.Errorf("ask at 0.13: %v", resp)
+	}
+	high := ask(10, 1.2)
+	if high["success"] != true {
+		t.Errorf("ask at 0.12: %v", high)
+	}
+	low := ask(10, 0.9)
+	if low["success"] != true {
+		t.Errorf("ask at 0.09: %v", low)
+	}
+
+	var markets struct {
+		Markets []struct {
+			Market      string  `json:"market"`
+			TickSize    float64 `json:"tick_size"`
+			MinNotional float64 `json:"min_notional"`
+			LastPrice   float64 `json:"last_price"`
+		} `json:"markets"`
+	}
+	bob.get("/api/markets", &markets)
+	if len(markets.Markets) != 1 || markets.Markets[0].Market != marketKCNLTC || markets.Markets[0].TickSize != 0.001 ||
+		markets.Markets[0].MinNotional != 0.05 || markets.Markets[0].LastPrice != 0.1 {
+		t.Errorf("markets = %+v", markets)
+	}
+
+	// A resting order stays fillable after the last price moves away from it
+	for _, order := range []map[string]interface{}{high, low} {
+		if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": order["trade_id"], "quantity": 10}); resp["success"] != true {
+			t.Errorf("execute after the price moved to 0.12: %v", resp)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Limits for /api/orderbook
+const (
+	defaultBookDepth = 50
+	maxBookDepth     = 500
+	maxBookPrecision = 8
+)
+
+// OrderBook is a market's open orders aggregated by price. It is updated as each
+// order changes, so reading it never touches the database.
+type OrderBook struct {
+	mu     sync.RWMutex
+	market string
+	seq    uint64 // the book stream's sequence number as of the last change
+	orders map[int]*BookOrder
+	bids   []*bookLevel // highest price first
+	asks   []*bookLevel // lowest price first
+}
+
+// bookLevel is the open size at one exact price
+type bookLevel struct {
+	price  float64
+	size   float64
+	orders int
+}
+
+// PriceLevel is one row of an aggregated book. Size is in KCN at this level and
+// Total is the size at this and every better level.
+type PriceLevel struct {
+	Price  float64 `json:"price"`
+	Size   float64 `json:"size"`
+	Total  float64 `json:"total"`
+	Orders int     `json:"orders"`
+}
+
+// BookDepth is the top of a book. Seq matches the book channel on /ws, so a feed
+// client can apply the diffs that follow it.
+type BookDepth struct {
+	Market string       `json:"market"`
+	Seq    uint64       `json:"seq"`
+	Bids   []PriceLevel `json:"bids"`
+	Asks   []PriceLevel `json:"asks"`
+}
+
+// NewOrderBook creates an empty book for market
+func NewOrderBook(market string) *OrderBook {
+	return &OrderBook{market: market, orders: make(map[int]*BookOrder)}
+}
+
+// Load replaces the book's contents with orders
+func (b *OrderBook) Load(orders []*BookOrder, seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.orders = make(map[int]*BookOrder)
+	b.bids, b.asks = nil, nil
+	for _, order := range orders {
+		b.apply(order)
+	}
+	b.seq = seq
+}
+
+// Apply records the new state of an order: it is added, resized or, once it is no
+// longer open, removed
+func (b *OrderBook) Apply(order *BookOrder, seq uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.apply(order)
+	b.seq = seq
+}
+
+func (b *OrderBook) apply(order *BookOrder) {
+	if old, ok := b.orders[order.ID]; ok {
+		b.adjust(old.Side, old.Price, -old.Remaining, -1)
+		delete(b.orders, order.ID)
+	}
+	if order.Status != "open" || order.Remaining <= 0 {
+		return
+	}
+	copied := *order
+	b.orders[order.ID] = &copied
+	b.adjust(order.Side, order.Price, order.Remaining, 1)
+}
+
+// adjust changes the size and order count at a price, inserting or dropping the level
+func (b *OrderBook) adjust(side string, price, size float64, orders int) {
+	levels := &b.asks
+	better := func(i int) bool { return (*levels)[i].price >= price }
+	if side == "buy" {
+		levels = &b.bids
+		better = func(i int) bool { return (*levels)[i].price <= price }
+	}
+
+	i := sort.Search(len(*levels), better)
+	if i < len(*levels) && (*levels)[i].price == price {
+		level := (*levels)[i]
+		level.size += size
+		level.orders += orders
+		if level.orders <= 0 {
+			*levels = append((*levels)[:i], (*levels)[i+1:]...)
+		}
+		return
+	}
+	if orders <= 0 {
+		return
+	}
+	*levels = append(*levels, nil)
+	copy((*levels)[i+1:], (*levels)[i:])
+	(*levels)[i] = &bookLevel{price: price, size: size, orders: orders}
+}
+
+// Depth returns up to depth levels a side. With precision >= 0 prices are grouped
+// to that many decimals, rounding bids down and asks up.
+func (b *OrderBook) Depth(depth, precision int) BookDepth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return BookDepth{
+		Market: b.market,
+		Seq:    b.seq,
+		Bids:   aggregateLevels(b.bids, depth, precision, false),
+		Asks:   aggregateLevels(b.asks, depth, precision, true),
+	}
+}
+
+// Orders returns a copy of every open order in time priority
+func (b *OrderBook) Orders() ([]*BookOrder, uint64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	orders := make([]*BookOrder, 0, len(b.orders))
+	for _, order := range b.orders {
+		copied := *order
+		orders = append(orders, &copied)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].Queue != orders[j].Queue {
+			return orders[i].Queue < orders[j].Queue
+		}
+		return orders[i].ID < orders[j].ID
+	})
+	return orders, b.seq
+}
+
+// aggregateLevels groups sorted levels into price buckets with a running total.
+// Bids round down and asks round up, so a bucket never looks better than its orders.
+func aggregateLevels(levels []*bookLevel, depth, precision int, roundUp bool) []PriceLevel {
+	scale := math.Pow(10, float64(precision))
+	result := []PriceLevel{}
+	var total float64
+	for _, level := range levels {
+		price := level.price
+		if precision >= 0 {
+			// The 1e-9 keeps a price already on the grid from moving a step
+			if roundUp {
+				price = math.Ceil(price*scale-1e-9) / scale
+			} else {
+				price = math.Floor(price*scale+1e-9) / scale
+			}
+		}
+		n := len(result)
+		if n == 0 || result[n-1].Price != price {
+			if n == depth {
+				break
+			}
+			result = append(result, PriceLevel{Price: price})
+			n++
+		}
+		total += level.size
+		result[n-1].Size += level.size
+		result[n-1].Total = total
+		result[n-1].Orders += level.orders
+	}
+	return result
+}
+
+// loadOrderBook fills the in-memory book from the database at startup
+func (s *Server) loadOrderBook() error {
+	orders, err := s.getOpenOrders()
+	if err != nil {
+		return err
+	}
+	s.book = NewOrderBook(marketKCNLTC)
+	s.book.Load(orders, s.events.Seq(streamBook))
+	return nil
+}
+
+// handleGetOrderBook returns the aggregated order book:
+// /api/orderbook?market=KCN-LTC&depth=50&precision=4
+func (s *Server) handleGetOrderBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	market := query.Get("market")
+	if market == "" {
+		market = marketKCNLTC
+	}
+	if market != marketKCNLTC || s.book == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown market: " + market})
+		return
+	}
+
+	depth := defaultBookDepth
+	if v := query.Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxBookDepth {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "depth must be between 1 and " + strconv.Itoa(maxBookDepth)})
+			return
+		}
+		depth = n
+	}
+
+	precision := -1
+	if v := query.Get("precision"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxBookPrecision {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "precision must be between 0 and " + strconv.Itoa(maxBookPrecision)})
+			return
+		}
+		precision = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.book.Depth(depth, precision))
+}
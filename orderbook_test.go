@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOrderBookAggregatesIncrementally(t *testing.T) {
+	book := NewOrderBook(marketKCNLTC)
+	book.Load([]*BookOrder{
+		{ID: 1, Side: "sell", Price: 0.0125, Remaining: 10, Status: "open"},
+		{ID: 2, Side: "sell", Price: 0.012, Remaining: 5, Status: "open"},
+		{ID: 3, Side: "buy", Price: 0.011, Remaining: 4, Status: "open"},
+	}, 7)
+
+	book.Apply(&BookOrder{ID: 4, Side: "sell", Price: 0.012, Remaining: 3, Status: "open"}, 8)
+	book.Apply(&BookOrder{ID: 5, Side: "buy", Price: 0.0115, Remaining: 2, Status: "open"}, 9)
+	book.Apply(&BookOrder{ID: 3, Side: "buy", Price: 0.011, Remaining: 1, Status: "open"}, 10) // partly filled
+	book.Apply(&BookOrder{ID: 1, Side: "sell", Price: 0.0125, Status: "cancelled"}, 11)
+
+	depth := book.Depth(50, -1)
+	if depth.Seq != 11 {
+		t.Errorf("seq = %d, want 11", depth.Seq)
+	}
+	if len(depth.Asks) != 1 || depth.Asks[0].Price != 0.012 || depth.Asks[0].Orders != 2 {
+		t.Fatalf("asks = %+v, want one level at 0.012 with 2 orders", depth.Asks)
+	}
+	assertAmount(t, "ask size", depth.Asks[0].Size, 8)
+	if len(depth.Bids) != 2 || depth.Bids[0].Price != 0.0115 || depth.Bids[1].Price != 0.011 {
+		t.Fatalf("bids = %+v, want 0.0115 then 0.011", depth.Bids)
+	}
+	assertAmount(t, "best bid total", depth.Bids[0].Total, 2)
+	assertAmount(t, "second bid total", depth.Bids[1].Total, 3)
+
+	// Grouped to 2 decimals bids round down and asks up
+	grouped := book.Depth(50, 2)
+	if len(grouped.Bids) != 1 || grouped.Bids[0].Price != 0.01 || grouped.Bids[0].Orders != 2 {
+		t.Errorf("grouped bids = %+v, want one level at 0.01", grouped.Bids)
+	}
+	if len(grouped.Asks) != 1 || grouped.Asks[0].Price != 0.02 {
+		t.Errorf("grouped asks = %+v, want one level at 0.02", grouped.Asks)
+	}
+
+	if top := book.Depth(1, -1); len(top.Bids) != 1 || top.Bids[0].Price != 0.0115 {
+		t.Errorf("depth 1 bids = %+v, want only the best bid", top.Bids)
+	}
+
+	// Removing the last order at a price removes the level
+	book.Apply(&BookOrder{ID: 5, Side: "buy", Price: 0.0115, Status: "completed"}, 12)
+	if bids := book.Depth(50, -1).Bids; len(bids) != 1 || bids[0].Price != 0.011 {
+		t.Errorf("bids after fill = %+v, want only 0.011", bids)
+	}
+}
+
+func TestOrderBookEndpointFollowsTrades(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 50, litecoin = 5`)
+
+	// Alice asks 10 KCN at 0.1 and 5 KCN at 0.2; Bob bids for 20 KCN at 0.05
+	for _, order := range []map[string]interface{}{
+		{"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1},
+		{"coin_selling": "kernelcoin", "amount_selling": 5, "coin_buying": "litecoin", "amount_buying": 1},
+	} {
+		if resp := alice.call("/api/trade/create", order); resp["success"] != true {
+			t.Fatalf("create ask: %v", resp)
+		}
+	}
+	bid := bob.call("/api/trade/create", map[string]interface{}{"coin_selling": "litecoin", "amount_selling": 1, "coin_buying": "kernelcoin", "amount_buying": 20})
+	if bid["success"] != true {
+		t.Fatalf("create bid: %v", bid)
+	}
+	if resp := alice.call("/api/trade/execute", map[string]interface{}{"trade_id": bid["trade_id"], "quantity": 8}); resp["success"] != true {
+		t.Fatalf("execute bid: %v", resp)
+	}
+
+	var depth BookDepth
+	bob.get("/api/orderbook?market=KCN-LTC&depth=50", &depth)
+	if len(depth.Asks) != 2 || depth.Asks[0].Price != 0.1 || depth.Asks[1].Price != 0.2 {
+		t.Fatalf("asks = %+v, want 0.1 then 0.2", depth.Asks)
+	}
+	assertAmount(t, "cumulative ask size", depth.Asks[1].Total, 15)
+	if len(depth.Bids) != 1 {
+		t.Fatalf("bids = %+v, want one level", depth.Bids)
+	}
+	assertAmount(t, "bid left after fill", depth.Bids[0].Size, 12)
+
+	// A restarted server rebuilds the same book from the database
+	if err := ex.server.loadOrderBook(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	var reloaded BookDepth
+	bob.get("/api/orderbook", &reloaded)
+	if len(reloaded.Asks) != 2 || len(reloaded.Bids) != 1 || reloaded.Bids[0].Size != depth.Bids[0].Size {
+		t.Errorf("reloaded book = %+v, want %+v", reloaded, depth)
+	}
+
+	var resp map[string]interface{}
+	bob.get("/api/orderbook?market=BTC-LTC", &resp)
+	if resp["error"] == nil {
+		t.Errorf("unknown market: %v", resp)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params holds the Argon2id cost parameters used for password hashing
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// legacyArgon2Params are the parameters used by the original "salt:hash" format
+var legacyArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  1,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// passwordParams are the parameters used for new hashes. Raising them causes
+// existing hashes to be upgraded the next time their owner logs in.
+var passwordParams = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  1,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// NewArgon2Params creates the parameters for new hashes from the command line
+// values, rejecting those Argon2id cannot use rather than truncating them
+func NewArgon2Params(memory, iterations, parallelism uint) (Argon2Params, error) {
+	p := passwordParams
+	if parallelism < 1 || parallelism > math.MaxUint8 {
+		return p, fmt.Errorf("argon2 parallelism must be between 1 and %d", math.MaxUint8)
+	}
+	if iterations < 1 || iterations > math.MaxUint32 {
+		return p, fmt.Errorf("argon2 iterations must be between 1 and %d", uint32(math.MaxUint32))
+	}
+	if memory < 8*parallelism || memory > math.MaxUint32 {
+		return p, fmt.Errorf("argon2 memory must be between 8 KiB per lane (%d) and %d KiB", 8*parallelism, uint32(math.MaxUint32))
+	}
+	p.Memory = uint32(memory)
+	p.Iterations = uint32(iterations)
+	p.Parallelism = uint8(parallelism)
+	return p, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash returns a hash to verify against when a login names an unknown
+// user, so the response takes as long as a real password check
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("dummy-password")
+	})
+	return dummyHash
+}
+
+// hashPassword hashes a password using Argon2id and encodes it in PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	return hashPasswordWithParams(password, passwordParams)
+}
+
+// hashPasswordWithParams hashes a password with explicit Argon2id parameters
+func hashPasswordWithParams(password string, p Argon2Params) (string, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := randRead(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// decodePasswordHash parses a stored hash in either PHC or legacy "salt:hash" format
+func decodePasswordHash(storedHash string) (params Argon2Params, salt, hash []byte, err error) {
+	if !strings.HasPrefix(storedHash, "$") {
+		// Legacy format: base64(salt):base64(hash) with fixed parameters
+		parts := strings.Split(storedHash, ":")
+		if len(parts) != 2 {
+			return params, nil, nil, fmt.Errorf("invalid legacy hash format")
+		}
+		if salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+			return params, nil, nil, err
+		}
+		if hash, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return params, nil, nil, err
+		}
+		params = legacyArgon2Params
+		params.SaltLength = uint32(len(salt))
+		params.KeyLength = uint32(len(hash))
+		return params, salt, hash, nil
+	}
+
+	parts := strings.Split(storedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("unsupported hash format")
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	// A stored hash is not trusted input: out-of-range parameters would make argon2 panic
+	var memory, iterations, parallelism uint
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return params, nil, nil, err
+	}
+	if params, err = NewArgon2Params(memory, iterations, parallelism); err != nil {
+		return params, nil, nil, err
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, err
+	}
+	if hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, err
+	}
+	if len(hash) == 0 {
+		return params, nil, nil, fmt.Errorf("empty password hash")
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(hash))
+
+	return params, salt, hash, nil
+}
+
+// verifyPassword compares a password with a stored hash in constant time.
+// needsRehash is true when the password matched but the hash uses an older format
+// or weaker parameters than passwordParams.
+func verifyPassword(password, storedHash string) (match bool, needsRehash bool) {
+	params, salt, hash, err := decodePasswordHash(storedHash)
+	if err != nil {
+		return false, false
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(hash, candidate) != 1 {
+		return false, false
+	}
+
+	needsRehash = !strings.HasPrefix(storedHash, "$") ||
+		params.Memory < passwordParams.Memory ||
+		params.Iterations < passwordParams.Iterations ||
+		params.Parallelism != passwordParams.Parallelism ||
+		params.SaltLength < passwordParams.SaltLength ||
+		params.KeyLength < passwordParams.KeyLength
+
+	return true, needsRehash
+}
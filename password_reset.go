@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// resetTokenTTL is how long a password reset link stays valid
+	resetTokenTTL = time.Hour
+	// resetWithdrawalFreeze is how long withdrawals are blocked after a password reset
+	resetWithdrawalFreeze = 24 * time.Hour
+	// resetCooldown is how long after one reset email an account gets no other
+	resetCooldown = 15 * time.Minute
+)
+
+// signResetToken creates a reset token of the form base64(payload).base64(hmac)
+// where the payload binds the user, a single-use token ID and the expiry.
+func (s *Server) signResetToken(userID int, tokenID string, expiry time.Time) string {
+	payload := fmt.Sprintf("%d.%s.%d", userID, tokenID, expiry.Unix())
+	mac := hmac.New(sha256.New, s.resetSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseResetToken verifies a reset token's signature and expiry
+func (s *Server) parseResetToken(token string) (userID int, tokenID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+
+	mac := hmac.New(sha256.New, s.resetSecret)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return 0, "", fmt.Errorf("invalid token signature")
+	}
+
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 3 {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	userID, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	expiry, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	if time.Now().After(time.Unix(expiry, 0)) {
+		return 0, "", fmt.Errorf("token expired")
+	}
+
+	return userID, fields[1], nil
+}
+
+// isValidEmail checks that an address parses and is safe to place in a mail header
+func isValidEmail(email string) bool {
+	if len(email) > 254 || strings.ContainsAny(email, "\r\n") {
+		return false
+	}
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// revokeUserSessions removes every session belonging to a user. Caller must hold s.mu.
+func (s *Server) revokeUserSessions(userID int) int {
+	revoked := 0
+	for token, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, token)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// withdrawalsFrozenUntil returns the time until which a user's withdrawals are blocked
+func (s *Server) withdrawalsFrozenUntil(userID int) (time.Time, bool) {
+	var until sql.NullTime
+	err := s.db.QueryRow(`SELECT withdrawals_frozen_until FROM users WHERE id = ?`, userID).Scan(&until)
+	if err != nil || !until.Valid || until.Time.Before(time.Now()) {
+		return time.Time{}, false
+	}
+	return until.Time, true
+}
+
+// handleRequestPasswordReset emails a single-use reset link to the account's address.
+// The response never reveals whether the account or email exists.
+func (s *Server) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	genericResponse := map[string]interface{}{
+		"success": true,
+		"message": "If the account has a recovery email, a reset link has been sent",
+	}
+
+	// The lock covers only the token; the email is sent after it is released so a
+	// slow mail server does not stall the exchange
+	s.mu.Lock()
+	var userID int
+	var email sql.NullString
+	err := s.db.QueryRow(`SELECT id, email FROM users WHERE username = ?`, req.Username).Scan(&userID, &email)
+	if err != nil || !email.Valid || email.String == "" || s.mailSender == nil {
+		s.mu.Unlock()
+		log.Printf("[RESET] Reset requested for %q but no recovery email is available", req.Username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(genericResponse)
+		return
+	}
+
+	// The last reset row is when the account was last mailed; asking again within
+	// the cooldown sends nothing, so nobody can flood an inbox
+	var recent int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND created_at > ?`,
+		userID, time.Now().Add(-resetCooldown).UTC().Format("2006-01-02 15:04:05")).Scan(&recent)
+	if err != nil {
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create reset token"})
+		return
+	}
+	if recent > 0 {
+		s.mu.Unlock()
+		log.Printf("[RESET] Reset requested for user %d within the cooldown, no email sent", userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(genericResponse)
+		return
+	}
+
+	tokenID, err := generateSessionToken()
+	if err != nil {
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create reset token"})
+		return
+	}
+	tokenID = strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(tokenID)
+	expiry := time.Now().Add(resetTokenTTL)
+
+	_, err = s.db.Exec(`INSERT INTO password_resets (id, user_id, expires_at) VALUES (?, ?, ?)`, tokenID, userID, expiry)
+	s.mu.Unlock()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create reset token"})
+		return
+	}
+
+	link := fmt.Sprintf("%s/?reset_token=%s", strings.TrimRight(s.baseURL, "/"), s.signResetToken(userID, tokenID, expiry))
+	body := fmt.Sprintf("A password reset was requested for your Kernelcoin Exchange account %q.\n\n"+
+		"Open this link within %d minutes to choose a new password:\n\n%s\n\n"+
+		"Withdrawals will be disabled for 24 hours after the reset.\n"+
+		"If you did not request this, you can ignore this email.\n",
+		req.Username, int(resetTokenTTL.Minutes()), link)
+
+	if err := s.mailSender.Send(email.String, "Kernelcoin Exchange password reset", body); err != nil {
+		log.Printf("[RESET] Failed to send reset email for user %d: %v", userID, err)
+	} else {
+		log.Printf("[RESET] Sent reset link to user %d", userID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(genericResponse)
+}
+
+// handleConfirmPasswordReset sets a new password using a reset token, revokes all
+// sessions for the account and freezes withdrawals for 24 hours
+func (s *Server) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	if len(req.NewPassword) == 0 || len(req.NewPassword) > 64 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password must be between 1 and 64 characters"})
+		return
+	}
+
+	userID, tokenID, err := s.parseResetToken(req.Token)
+	if err != nil {
+		log.Printf("[RESET] Rejected reset token: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or expired reset link"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Consume the token; a second use finds used_at already set
+	result, err := s.db.Exec(`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND used_at IS NULL`, tokenID, userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reset password"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or expired reset link"})
+		return
+	}
+
+	passwordHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password hashing failed"})
+		return
+	}
+
+	frozenUntil := time.Now().Add(resetWithdrawalFreeze)
+	_, err = s.db.Exec(`UPDATE users SET password_hash = ?, withdrawals_frozen_until = ? WHERE id = ?`,
+		passwordHash, frozenUntil, userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reset password"})
+		return
+	}
+
+	// Any other outstanding links for this account are no longer valid
+	s.db.Exec(`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL`, userID)
+
+	revoked := s.revokeUserSessions(userID)
+	log.Printf("[RESET] User %d reset their password | Sessions revoked: %d | Withdrawals frozen until %s",
+		userID, revoked, frozenUntil.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Password reset. Withdrawals are disabled for 24 hours.",
+	})
+}
+
+// handleUpdateEmail sets or clears the account's recovery email
+func (s *Server) handleUpdateEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	email := strings.TrimSpace(req.Email)
+	if email != "" && !isValidEmail(email) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid email address"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var value interface{}
+	if email != "" {
+		value = email
+	}
+	_, err := s.db.Exec(`UPDATE users SET email = ? WHERE id = ?`, value, session.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			json.NewEncoder(w).Encode(map[string]string{"error": "Email is already in use by another user"})
+		} else {
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update email"})
+		}
+		return
+	}
+
+	log.Printf("[ACCOUNT] User: %s (ID:%d) | Updated recovery email", session.Username, session.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMailSender keeps sent messages and whether s.mu was free at the time
+type recordingMailSender struct {
+	server *Server
+
+	mu       sync.Mutex
+	bodies   []string
+	unlocked []bool
+}
+
+func (m *recordingMailSender) Send(to, subject, body string) error {
+	free := m.server.mu.TryLock()
+	if free {
+		m.server.mu.Unlock()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bodies = append(m.bodies, body)
+	m.unlocked = append(m.unlocked, free)
+	return nil
+}
+
+func TestResetTokenSignAndParse(t *testing.T) {
+	s := &Server{resetSecret: []byte("secret")}
+	token := s.signResetToken(7, "abc", time.Now().Add(time.Minute))
+
+	userID, tokenID, err := s.parseResetToken(token)
+	if err != nil || userID != 7 || tokenID != "abc" {
+		t.Fatalf("parse = %d, %q, %v", userID, tokenID, err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := (&Server{resetSecret: []byte("secret")}).signResetToken(8, "abc", time.Now().Add(time.Minute))
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for name, bad := range map[string]string{
+		"empty":          "",
+		"no signature":   payload,
+		"extra part":     token + ".x",
+		"bad base64":     payload + ".!!",
+		"other user":     forgedPayload + "." + signature,
+		"other secret":   (&Server{resetSecret: []byte("other")}).signResetToken(7, "abc", time.Now().Add(time.Minute)),
+		"expired":        s.signResetToken(7, "abc", time.Now().Add(-time.Second)),
+		"truncated sig":  payload + "." + signature[:len(signature)-2],
+		"unsigned field": s.signResetToken(7, "a.b", time.Now().Add(time.Minute)),
+	} {
+		if _, _, err := s.parseResetToken(bad); err == nil {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
+
+func TestPasswordResetIsSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	mail := &recordingMailSender{server: ex.server}
+	ex.server.mailSender = mail
+	ex.server.resetSecret = []byte("secret")
+	ex.server.baseURL = "https://exchange.example"
+
+	alice := ex.newUserWith(t, "alice", map[string]interface{}{"email": "alice@example.com"})
+
+	// A taken recovery email fails registration instead of being dropped
+	var captcha struct {
+		CaptchaID string `json:"captcha_id"`
+	}
+	alice.get("/api/captcha/generate", &captcha)
+	resp := alice.call("/api/register", map[string]interface{}{
+		"username": "bob", "password": "password123", "email": "alice@example.com",
+		"captcha_id": captcha.CaptchaID, "captcha_answer": map[string]string{"nonce": "1"},
+	})
+	if resp["success"] == true || resp["error"] == nil {
+		t.Errorf("register with a taken email = %v", resp)
+	}
+	var users int
+	db.QueryRow(`SELECT COUNT(*) FROM users WHERE username = 'bob'`).Scan(&users)
+	if users != 0 {
+		t.Errorf("bob was created with a taken email")
+	}
+
+	if resp := alice.call("/api/password-reset/request", map[string]string{"username": "alice"}); resp["success"] != true {
+		t.Fatalf("request reset: %v", resp)
+	}
+	if len(mail.bodies) != 1 || !mail.unlocked[0] {
+		t.Fatalf("reset emails = %d, sent without the server lock = %v", len(mail.bodies), mail.unlocked)
+	}
+	// Within the cooldown another request answers the same but mails nothing
+	if resp := alice.call("/api/password-reset/request", map[string]string{"username": "alice"}); resp["success"] != true {
+		t.Fatalf("second reset request: %v", resp)
+	}
+	if len(mail.bodies) != 1 {
+		t.Fatalf("%d reset emails within the cooldown", len(mail.bodies))
+	}
+
+	i := strings.Index(mail.bodies[0], "reset_token=")
+	if i < 0 {
+		t.Fatalf("no link in %q", mail.bodies[0])
+	}
+	token, _ := url.QueryUnescape(strings.Fields(mail.bodies[0][i+len("reset_token="):])[0])
+
+	reset := map[string]string{"token": token, "new_password": "new-password"}
+	if resp := alice.call("/api/password-reset/confirm", reset); resp["success"] != true {
+		t.Fatalf("confirm reset: %v", resp)
+	}
+	if resp := alice.call("/api/password-reset/confirm", map[string]string{"token": token, "new_password": "again"}); resp["success"] == true {
+		t.Errorf("reset token used twice: %v", resp)
+	}
+
+	// Once the cooldown is over the account can be mailed again
+	db.Exec(`UPDATE password_resets SET created_at = datetime(created_at, '-1 hour')`)
+	if alice.call("/api/password-reset/request", map[string]string{"username": "alice"}); len(mail.bodies) != 2 {
+		t.Errorf("%d reset emails after the cooldown", len(mail.bodies))
+	}
+
+	var hash string
+	db.QueryRow(`SELECT password_hash FROM users WHERE username = 'alice'`).Scan(&hash)
+	if match, _ := verifyPassword("new-password", hash); !match {
+		t.Errorf("password not changed")
+	}
+	if _, frozen := ex.server.withdrawalsFrozenUntil(1); !frozen {
+		t.Errorf("withdrawals not frozen after reset")
+	}
+}
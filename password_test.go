@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// legacyHash creates a hash in the original "salt:hash" format
+func legacyHash(password string) string {
+	p := legacyArgon2Params
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(hash)
+}
+
+func TestPasswordHashFormats(t *testing.T) {
+	weak := Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16}
+	phc, err := hashPasswordWithParams("hunter22", weak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(phc, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("PHC hash = %s", phc)
+	}
+	params, salt, hash, err := decodePasswordHash(phc)
+	if err != nil || params != weak || len(salt) != 8 || len(hash) != 16 {
+		t.Errorf("decode PHC = %+v, %d-byte salt, %d-byte hash, %v", params, len(salt), len(hash), err)
+	}
+
+	legacy := legacyHash("hunter22")
+	params, salt, hash, err = decodePasswordHash(legacy)
+	if err != nil || params != legacyArgon2Params || string(salt) != "0123456789abcdef" || len(hash) != 32 {
+		t.Errorf("decode legacy = %+v, %q, %d-byte hash, %v", params, salt, len(hash), err)
+	}
+
+	current, _ := hashPassword("hunter22")
+	for _, tc := range []struct {
+		name, password, hash string
+		match, rehash        bool
+	}{
+		{"current", "hunter22", current, true, false},
+		{"weaker parameters", "hunter22", phc, true, true},
+		{"legacy", "hunter22", legacy, true, true},
+		{"wrong password", "hunter23", current, false, false},
+		{"wrong legacy password", "hunter23", legacy, false, false},
+	} {
+		match, rehash := verifyPassword(tc.password, tc.hash)
+		if match != tc.match || rehash != tc.rehash {
+			t.Errorf("%s: match %v rehash %v, want %v %v", tc.name, match, rehash, tc.match, tc.rehash)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"no-colon",
+		"!!:!!",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+		// Parameters outside NewArgon2Params' bounds would make argon2 panic
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=4,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=256$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=4294967296,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=-1,p=1$c2FsdA$aGFzaA",
+	} {
+		if _, _, _, err := decodePasswordHash(bad); err == nil {
+			t.Errorf("decoded %q", bad)
+		}
+		if match, _ := verifyPassword("hunter22", bad); match {
+			t.Errorf("%q matched", bad)
+		}
+	}
+}
+
+func TestNewArgon2Params(t *testing.T) {
+	p, err := NewArgon2Params(128*1024, 3, 2)
+	if err != nil || p.Memory != 128*1024 || p.Iterations != 3 || p.Parallelism != 2 || p.KeyLength != passwordParams.KeyLength {
+		t.Errorf("NewArgon2Params = %+v, %v", p, err)
+	}
+	for _, tc := range []struct{ memory, iterations, parallelism uint }{
+		{64 * 1024, 1, 0},
+		{64 * 1024, 1, 256},
+		{64 * 1024, 1, 260}, // would truncate to 4
+		{64 * 1024, 0, 4},
+		{16, 1, 4},
+		{1 << 32, 1, 4},
+	} {
+		if _, err := NewArgon2Params(tc.memory, tc.iterations, tc.parallelism); err == nil {
+			t.Errorf("NewArgon2Params(%d, %d, %d) accepted", tc.memory, tc.iterations, tc.parallelism)
+		}
+	}
+}
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	alice := ex.newUser(t, "alice")
+
+	db.Exec(`UPDATE users SET password_hash = ? WHERE username = 'alice'`, legacyHash("password123"))
+	if resp := alice.call("/api/login", map[string]string{"username": "alice", "password": "wrong"}); resp["success"] == true {
+		t.Fatalf("login with the wrong password: %v", resp)
+	}
+	var stored string
+	db.QueryRow(`SELECT password_hash FROM users WHERE username = 'alice'`).Scan(&stored)
+	if strings.HasPrefix(stored, "$") {
+		t.Errorf("hash upgraded after a failed login: %s", stored)
+	}
+
+	if resp := alice.call("/api/login", map[string]string{"username": "alice", "password": "password123"}); resp["success"] != true {
+		t.Fatalf("login with a legacy hash: %v", resp)
+	}
+	db.QueryRow(`SELECT password_hash FROM users WHERE username = 'alice'`).Scan(&stored)
+	if match, rehash := verifyPassword("password123", stored); !match || rehash || !strings.HasPrefix(stored, "$argon2id$") {
+		t.Errorf("hash after login = %s", stored)
+	}
+	if resp := alice.call("/api/login", map[string]string{"username": "alice", "password": "password123"}); resp["success"] != true {
+		t.Errorf("login with the upgraded hash: %v", resp)
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PriceSource quotes the price of one LTC in fiat currencies. Currencies are lower
+// case ISO codes ("usd", "eur"); a source leaves out any it does not quote.
+type PriceSource interface {
+	Name() string
+	Prices(ctx context.Context, currencies []string) (map[string]float64, error)
+}
+
+// Public API endpoints of the built-in sources
+const (
+	coinGeckoURL = "https://api.coingecko.com"
+	krakenURL    = "https://api.kraken.com"
+	binanceURL   = "https://api.binance.com"
+)
+
+// getJSON fetches url and decodes the JSON response into out
+func getJSON(ctx context.Context, client *http.Client, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// CoinGeckoSource reads CoinGecko's simple price API
+type CoinGeckoSource struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewCoinGeckoSource creates a CoinGecko source; baseURL is coinGeckoURL outside tests
+func NewCoinGeckoSource(client *http.Client, baseURL string) *CoinGeckoSource {
+	return &CoinGeckoSource{client: client, baseURL: baseURL}
+}
+
+func (c *CoinGeckoSource) Name() string { return "coingecko" }
+
+func (c *CoinGeckoSource) Prices(ctx context.Context, currencies []string) (map[string]float64, error) {
+	var data map[string]map[string]float64
+	url := c.baseURL + "/api/v3/simple/price?ids=litecoin&vs_currencies=" + strings.Join(currencies, ",")
+	if err := getJSON(ctx, c.client, url, &data); err != nil {
+		return nil, err
+	}
+	prices, ok := data["litecoin"]
+	if !ok {
+		return nil, fmt.Errorf("litecoin missing from response")
+	}
+	return prices, nil
+}
+
+// KrakenSource reads Kraken's public ticker, using the last trade price
+type KrakenSource struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewKrakenSource creates a Kraken source; baseURL is krakenURL outside tests
+func NewKrakenSource(client *http.Client, baseURL string) *KrakenSource {
+	return &KrakenSource{client: client, baseURL: baseURL}
+}
+
+func (k *KrakenSource) Name() string { return "kraken" }
+
+func (k *KrakenSource) Prices(ctx context.Context, currencies []string) (map[string]float64, error) {
+	prices := make(map[string]float64)
+	var lastErr error
+	// One pair per request: Kraken rejects the whole request if any pair is unknown
+	for _, currency := range currencies {
+		var data struct {
+			Error  []string `json:"error"`
+			Result map[string]struct {
+				Last []string `json:"c"`
+			} `json:"result"`
+		}
+		if err := getJSON(ctx, k.client, k.baseURL+"/0/public/Ticker?pair=LTC"+strings.ToUpper(currency), &data); err != nil {
+			lastErr = err
+			continue
+		}
+		if len(data.Error) > 0 {
+			lastErr = fmt.Errorf("%s", strings.Join(data.Error, "; "))
+			continue
+		}
+		// Result keys are Kraken's own pair names, e.g. XLTCZUSD
+		for _, ticker := range data.Result {
+			if len(ticker.Last) == 0 {
+				continue
+			}
+			if price, err := strconv.ParseFloat(ticker.Last[0], 64); err == nil {
+				prices[currency] = price
+			}
+		}
+	}
+	if len(prices) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return prices, nil
+}
+
+// BinanceSource reads Binance's ticker price. USD is quoted against USDT.
+type BinanceSource struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewBinanceSource creates a Binance source; baseURL is binanceURL outside tests
+func NewBinanceSource(client *http.Client, baseURL string) *BinanceSource {
+	return &BinanceSource{client: client, baseURL: baseURL}
+}
+
+func (b *BinanceSource) Name() string { return "binance" }
+
+func (b *BinanceSource) Prices(ctx context.Context, currencies []string) (map[string]float64, error) {
+	prices := make(map[string]float64)
+	var lastErr error
+	for _, currency := range currencies {
+		quote := strings.ToUpper(currency)
+		if quote == "USD" {
+			quote = "USDT"
+		}
+		var data struct {
+			Price string `json:"price"`
+		}
+		if err := getJSON(ctx, b.client, b.baseURL+"/api/v3/ticker/price?symbol=LTC"+quote, &data); err != nil {
+			lastErr = err
+			continue
+		}
+		if price, err := strconv.ParseFloat(data.Price, 64); err == nil {
+			prices[currency] = price
+		}
+	}
+	if len(prices) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return prices, nil
+}
+
+// StaticSource always quotes the same prices, for offline and staging setups
+type StaticSource struct {
+	prices map[string]float64
+}
+
+// NewStaticSource parses prices given as usd=80,eur=74
+func NewStaticSource(spec string) (*StaticSource, error) {
+	prices := make(map[string]float64)
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid price %q, expected currency=price", entry)
+		}
+		price, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || price <= 0 {
+			return nil, fmt.Errorf("invalid price %q", entry)
+		}
+		prices[strings.ToLower(strings.TrimSpace(kv[0]))] = price
+	}
+	return &StaticSource{prices: prices}, nil
+}
+
+func (s *StaticSource) Name() string { return "static" }
+
+func (s *StaticSource) Prices(ctx context.Context, currencies []string) (map[string]float64, error) {
+	return s.prices, nil
+}
+
+// FileSource reads prices from a JSON file such as {"usd": 80, "eur": 74} on every
+// refresh, so they can be changed without a restart
+type FileSource struct {
+	path string
+}
+
+// NewFileSource creates a source that reads path
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (f *FileSource) Name() string { return "file" }
+
+func (f *FileSource) Prices(ctx context.Context, currencies []string) (map[string]float64, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var prices map[string]float64
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", f.path, err)
+	}
+	lower := make(map[string]float64, len(prices))
+	for currency, price := range prices {
+		lower[strings.ToLower(currency)] = price
+	}
+	return lower, nil
+}
+
+// NewPriceSources builds the sources named in a comma separated list: coingecko,
+// kraken, binance, static (with staticPrices) and file (with path)
+func NewPriceSources(names, staticPrices, path string, timeout time.Duration) ([]PriceSource, error) {
+	client := &http.Client{Timeout: timeout}
+	var sources []PriceSource
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "coingecko":
+			sources = append(sources, NewCoinGeckoSource(client, coinGeckoURL))
+		case "kraken":
+			sources = append(sources, NewKrakenSource(client, krakenURL))
+		case "binance":
+			sources = append(sources, NewBinanceSource(client, binanceURL))
+		case "static":
+			source, err := NewStaticSource(staticPrices)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		case "file":
+			if path == "" {
+				return nil, fmt.Errorf("the file price source needs a path")
+			}
+			sources = append(sources, NewFileSource(path))
+		default:
+			return nil, fmt.Errorf("unknown price source %q", name)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no price sources")
+	}
+	return sources, nil
+}
+
+// PriceOracle polls its sources for LTC prices and keeps, per currency, the median
+// of the quotes that agree with each other. Prices are stored so a restart, or a
+// spell when every source is down, still has the last known price.
+type PriceOracle struct {
+	mu           sync.RWMutex
+	db           *sql.DB
+	sources      []PriceSource
+	currencies   []string
+	maxDeviation float64       // quotes further than this fraction from the median are dropped
+	maxAge       time.Duration // prices older than this are stale; 0 never expires them
+	timeout      time.Duration
+	prices       map[string]float64
+	updated      map[string]time.Time
+}
+
+// NewPriceOracle creates an oracle for currencies and loads the last stored prices
+func NewPriceOracle(db *sql.DB, sources []PriceSource, currencies []string, maxDeviation float64, maxAge time.Duration) (*PriceOracle, error) {
+	o := &PriceOracle{
+		db:           db,
+		sources:      sources,
+		currencies:   currencies,
+		maxDeviation: maxDeviation,
+		maxAge:       maxAge,
+		timeout:      15 * time.Second,
+		prices:       make(map[string]float64),
+		updated:      make(map[string]time.Time),
+	}
+	for _, currency := range currencies {
+		var price float64
+		var at time.Time
+		err := db.QueryRow(`SELECT price, created_at FROM price_history WHERE currency = ? ORDER BY id DESC LIMIT 1`, currency).Scan(&price, &at)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		o.prices[currency], o.updated[currency] = price, at
+	}
+	return o, nil
+}
+
+// Currencies returns the fiat currencies the oracle tracks
+func (o *PriceOracle) Currencies() []string {
+	return o.currencies
+}
+
+// LTC returns the price of one LTC in currency, if one is known
+func (o *PriceOracle) LTC(currency string) (float64, bool) {
+	if o == nil {
+		return 0, false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	price, ok := o.prices[currency]
+	return price, ok
+}
+
+// FreshLTC returns the price of one LTC in currency and when it was set, or an
+// error if none is known or it is older than the oracle's maximum age
+func (o *PriceOracle) FreshLTC(currency string, now time.Time) (float64, time.Time, error) {
+	if o == nil {
+		return 0, time.Time{}, fmt.Errorf("no %s price", currency)
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	price, ok := o.prices[currency]
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("no %s price", currency)
+	}
+	updated := o.updated[currency]
+	if o.maxAge > 0 && now.Sub(updated) > o.maxAge {
+		return 0, updated, fmt.Errorf("%s price is stale, last updated %s", currency, updated.Format(time.RFC3339))
+	}
+	return price, updated, nil
+}
+
+// Snapshot returns every known LTC price and when the oldest was last updated
+func (o *PriceOracle) Snapshot() (map[string]float64, time.Time) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	prices := make(map[string]float64, len(o.prices))
+	var oldest time.Time
+	for currency, price := range o.prices {
+		prices[currency] = price
+		if at := o.updated[currency]; oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+	return prices, oldest
+}
+
+// Run refreshes prices every interval
+func (o *PriceOracle) Run(interval time.Duration) {
+	for {
+		if err := o.Refresh(); err != nil {
+			log.Printf("[PRICE] Refresh failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Refresh asks every source for quotes and stores the new prices
+func (o *PriceOracle) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	type result struct {
+		source string
+		prices map[string]float64
+	}
+	results := make(chan result, len(o.sources))
+	for _, source := range o.sources {
+		go func(source PriceSource) {
+			prices, err := source.Prices(ctx, o.currencies)
+			if err != nil {
+				log.Printf("[PRICE] %s: %v", source.Name(), err)
+			}
+			results <- result{source.Name(), prices}
+		}(source)
+	}
+
+	quotes := make(map[string][]float64)
+	for range o.sources {
+		r := <-results
+		for _, currency := range o.currencies {
+			if price, ok := r.prices[currency]; ok && price > 0 && !math.IsInf(price, 0) {
+				quotes[currency] = append(quotes[currency], price)
+			}
+		}
+	}
+
+	var failed []string
+	for _, currency := range o.currencies {
+		price, used, err := consensusPrice(quotes[currency], o.maxDeviation)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", currency, err))
+			continue
+		}
+		if used < len(quotes[currency]) {
+			log.Printf("[PRICE] %s: dropped %d of %d quotes as outliers (%v)", currency, len(quotes[currency])-used, len(quotes[currency]), quotes[currency])
+		}
+		if _, err := o.db.Exec(`INSERT INTO price_history (currency, price, sources) VALUES (?, ?, ?)`, currency, price, used); err != nil {
+			return err
+		}
+		o.mu.Lock()
+		o.prices[currency], o.updated[currency] = price, time.Now().UTC()
+		o.mu.Unlock()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// consensusPrice is the median of the quotes within maxDeviation of their overall
+// median, and how many quotes that was
+func consensusPrice(quotes []float64, maxDeviation float64) (float64, int, error) {
+	if len(quotes) == 0 {
+		return 0, 0, fmt.Errorf("no quotes")
+	}
+	mid := median(quotes)
+	var agreed []float64
+	for _, quote := range quotes {
+		if math.Abs(quote-mid)/mid <= maxDeviation {
+			agreed = append(agreed, quote)
+		}
+	}
+	if len(agreed) == 0 {
+		return 0, 0, fmt.Errorf("quotes %v disagree by more than %.0f%%", quotes, maxDeviation*100)
+	}
+	return median(agreed), len(agreed), nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// maxPricePoints is the most points a price history response holds
+const maxPricePoints = 1000
+
+// PricePoint is a stored price
+type PricePoint struct {
+	Price   float64   `json:"price"`
+	Sources int       `json:"sources"`
+	Time    time.Time `json:"time"`
+}
+
+// History returns the stored LTC prices in currency since a time, oldest first.
+// Longer spans are downsampled to at most maxPoints by keeping the last price in
+// each bucket of equal time; the bucket size in seconds is returned, 1 when every
+// point is kept.
+func (o *PriceOracle) History(currency string, since, now time.Time, maxPoints int) ([]PricePoint, int64, error) {
+	// Buckets count from since, so [since, now] spans at most maxPoints of them
+	bucket := int64(1)
+	if span := int64(now.Sub(since).Seconds()); span >= int64(maxPoints) {
+		bucket = span/int64(maxPoints) + 1
+	}
+	rows, err := o.db.Query(`
+		SELECT price, sources, created_at FROM price_history
+		WHERE id IN (
+			SELECT MAX(id) FROM price_history
+			WHERE currency = ? AND created_at >= ?
+			GROUP BY (CAST(strftime('%s', created_at) AS INTEGER) - ?) / ?
+		)
+		ORDER BY id
+	`, currency, since.UTC().Format("2006-01-02 15:04:05"), since.Unix(), bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	points := []PricePoint{}
+	for rows.Next() {
+		var point PricePoint
+		if err := rows.Scan(&point.Price, &point.Sources, &point.Time); err != nil {
+			return nil, 0, err
+		}
+		points = append(points, point)
+	}
+	return points, bucket, rows.Err()
+}
+
+// ltcPrice returns the price of one LTC in currency, or 0 if none is known yet
+func (s *Server) ltcPrice(currency string) float64 {
+	price, _ := s.prices.LTC(currency)
+	return price
+}
+
+// handleGetLtcPrice returns the LTC price in USD, or an error once it is stale
+func (s *Server) handleGetLtcPrice(w http.ResponseWriter, r *http.Request) {
+	price, updated, err := s.prices.FreshLTC("usd", time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		resp := map[string]interface{}{"error": "LTC price is not available: " + err.Error()}
+		if !updated.IsZero() {
+			resp["updated_at"] = updated.Format(time.RFC3339)
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ltc_usd":    price,
+		"updated_at": updated.Format(time.RFC3339),
+	})
+}
+
+// handleGetPrices returns LTC and implied KCN prices in every tracked currency.
+// KCN's price is its last trade price in LTC times LTC's price.
+func (s *Server) handleGetPrices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.prices == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Prices are not available"})
+		return
+	}
+
+	ltc, updated := s.prices.Snapshot()
+
+	s.mu.RLock()
+	kcnLTC, err := s.candles.LastPrice()
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[PRICE] Failed to load last KCN price: %v", err)
+	}
+
+	kcn := make(map[string]float64, len(ltc))
+	for currency, price := range ltc {
+		kcn[currency] = price * kcnLTC
+	}
+
+	resp := map[string]interface{}{
+		"ltc":     ltc,
+		"kcn":     kcn,
+		"kcn_ltc": kcnLTC,
+	}
+	if !updated.IsZero() {
+		resp["updated_at"] = updated.Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetPriceHistory returns stored LTC prices:
+// /api/prices/history?currency=usd&hours=24
+func (s *Server) handleGetPriceHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.prices == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Prices are not available"})
+		return
+	}
+
+	query := r.URL.Query()
+	currency := strings.ToLower(query.Get("currency"))
+	if currency == "" {
+		currency = "usd"
+	}
+	if _, ok := s.prices.LTC(currency); !ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown currency: " + currency})
+		return
+	}
+	hours := 24
+	if v := query.Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 24*365 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "hours must be between 1 and 8760"})
+			return
+		}
+		hours = n
+	}
+
+	now := time.Now()
+	points, resolution, err := s.prices.History(currency, now.Add(-time.Duration(hours)*time.Hour), now, maxPricePoints)
+	if err != nil {
+		log.Printf("[PRICE] Failed to load %s history: %v", currency, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load price history"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"currency":           currency,
+		"prices":             points,
+		"resolution_seconds": resolution,
+	})
+}
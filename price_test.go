@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFakePriceAPI serves the CoinGecko, Kraken and Binance endpoints the sources use,
+// quoting LTC at usd and eur
+func newFakePriceAPI(t *testing.T, usd, eur float64) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/simple/price", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"litecoin":{"usd":%g,"eur":%g}}`, usd, eur)
+	})
+	mux.HandleFunc("/0/public/Ticker", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("pair") {
+		case "LTCUSD":
+			fmt.Fprintf(w, `{"error":[],"result":{"XLTCZUSD":{"a":["1","1","1"],"c":["%g","0.5"]}}}`, usd)
+		case "LTCEUR":
+			fmt.Fprintf(w, `{"error":[],"result":{"XLTCZEUR":{"c":["%g","0.5"]}}}`, eur)
+		default:
+			fmt.Fprint(w, `{"error":["EQuery:Unknown asset pair"]}`)
+		}
+	})
+	mux.HandleFunc("/api/v3/ticker/price", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("symbol") {
+		case "LTCUSDT":
+			fmt.Fprintf(w, `{"symbol":"LTCUSDT","price":"%g"}`, usd)
+		case "LTCEUR":
+			fmt.Fprintf(w, `{"symbol":"LTCEUR","price":"%g"}`, eur)
+		default:
+			http.Error(w, `{"code":-1121,"msg":"Invalid symbol."}`, http.StatusBadRequest)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestPriceSourcesParseProviderFormats(t *testing.T) {
+	api := newFakePriceAPI(t, 81.5, 75.25)
+	client := api.Client()
+
+	for _, source := range []PriceSource{
+		NewCoinGeckoSource(client, api.URL),
+		NewKrakenSource(client, api.URL),
+		NewBinanceSource(client, api.URL),
+	} {
+		prices, err := source.Prices(context.Background(), []string{"usd", "eur", "jpy"})
+		if err != nil {
+			t.Fatalf("%s: %v", source.Name(), err)
+		}
+		if prices["usd"] != 81.5 || prices["eur"] != 75.25 {
+			t.Errorf("%s prices = %v", source.Name(), prices)
+		}
+		if _, ok := prices["jpy"]; ok {
+			t.Errorf("%s quoted a currency it does not have: %v", source.Name(), prices)
+		}
+	}
+}
+
+func TestConsensusPriceRejectsOutliers(t *testing.T) {
+	price, used, err := consensusPrice([]float64{80, 81, 250}, 0.05)
+	if err != nil || used != 2 || price != 80.5 {
+		t.Errorf("consensus of 80, 81, 250 = %v from %d quotes (%v), want 80.5 from 2", price, used, err)
+	}
+	if price, used, _ := consensusPrice([]float64{80}, 0.05); price != 80 || used != 1 {
+		t.Errorf("single quote = %v from %d", price, used)
+	}
+	// Two sources that disagree give no price rather than a guess
+	if _, _, err := consensusPrice([]float64{80, 100}, 0.05); err == nil {
+		t.Error("disagreeing quotes were accepted")
+	}
+	if _, _, err := consensusPrice(nil, 0.05); err == nil {
+		t.Error("no quotes were accepted")
+	}
+}
+
+func TestPriceOracleRefreshAndHistory(t *testing.T) {
+	db := newTestDB(t)
+	good := newFakePriceAPI(t, 80, 74)
+	bad := newFakePriceAPI(t, 800, 740) // a broken feed, off by 10x
+	path := filepath.Join(t.TempDir(), "prices.json")
+	os.WriteFile(path, []byte(`{"USD": 82, "EUR": 76}`), 0644)
+
+	sources := []PriceSource{
+		NewCoinGeckoSource(good.Client(), good.URL),
+		NewKrakenSource(good.Client(), good.URL),
+		NewBinanceSource(bad.Client(), bad.URL),
+		NewFileSource(path),
+	}
+	oracle, err := NewPriceOracle(db, sources, []string{"usd", "eur"}, 0.05, 0)
+	if err != nil {
+		t.Fatalf("new oracle: %v", err)
+	}
+	if _, ok := oracle.LTC("usd"); ok {
+		t.Fatal("price known before the first refresh")
+	}
+	if err := oracle.Refresh(); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if usd, _ := oracle.LTC("usd"); usd != 80 {
+		t.Errorf("usd = %v, want 80 (median of 80, 80, 82 without the outlier)", usd)
+	}
+
+	// Every source down: the last price is kept and survives a restart
+	os.Remove(path)
+	good.Close()
+	bad.Close()
+	if err := oracle.Refresh(); err == nil {
+		t.Error("refresh with every source down succeeded")
+	}
+	restarted, err := NewPriceOracle(db, nil, []string{"usd", "eur"}, 0.05, time.Hour)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if eur, ok := restarted.LTC("eur"); !ok || eur != 74 {
+		t.Errorf("eur after restart = %v, %v, want 74", eur, ok)
+	}
+
+	history, _, err := restarted.History("usd", time.Now().Add(-time.Hour), time.Now(), 10)
+	if err != nil || len(history) != 1 || history[0].Price != 80 || history[0].Sources != 3 {
+		t.Errorf("usd history = %+v, %v", history, err)
+	}
+
+	// The restarted oracle's prices are served until they are older than an hour
+	if _, _, err := restarted.FreshLTC("usd", time.Now()); err != nil {
+		t.Errorf("fresh price: %v", err)
+	}
+	if _, updated, err := restarted.FreshLTC("usd", time.Now().Add(2*time.Hour)); err == nil || updated.IsZero() {
+		t.Errorf("stale price served: %v", err)
+	}
+	if _, _, err := restarted.FreshLTC("gbp", time.Now()); err == nil {
+		t.Errorf("price served for an untracked currency")
+	}
+}
+
+func TestPriceHistoryIsDownsampled(t *testing.T) {
+	db := newTestDB(t)
+	oracle, _ := NewPriceOracle(db, nil, []string{"usd"}, 0.05, 0)
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+
+	// A price every five minutes for ten days
+	tx, _ := db.Begin()
+	for i := 10*24*12 - 1; i >= 0; i-- {
+		at := now.Add(-time.Duration(i) * 5 * time.Minute)
+		tx.Exec(`INSERT INTO price_history (currency, price, sources, created_at) VALUES ('usd', ?, 1, ?)`, float64(i), at.Format("2006-01-02 15:04:05"))
+	}
+	tx.Commit()
+
+	points, resolution, err := oracle.History("usd", now.Add(-24*time.Hour), now, 1000)
+	if err != nil || resolution != 87 || len(points) != 24*12+1 {
+		t.Errorf("a day: %d points at %ds, %v", len(points), resolution, err)
+	}
+
+	points, resolution, err = oracle.History("usd", now.Add(-10*24*time.Hour), now, 1000)
+	if err != nil || resolution != 865 || len(points) > 1000 || len(points) < 900 {
+		t.Fatalf("ten days: %d points at %ds, %v", len(points), resolution, err)
+	}
+	// The whole span is covered, not only its newest points
+	if first, last := points[0].Time, points[len(points)-1].Time; now.Sub(first) < 239*time.Hour || !last.Equal(now) {
+		t.Errorf("ten days span %s to %s", first, last)
+	}
+}
+
+func TestPricesEndpointImpliesKCN(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	static, _ := NewStaticSource("usd=80,eur=70")
+	ex.server.prices, _ = NewPriceOracle(db, []PriceSource{static}, []string{"usd", "eur"}, 0.05, time.Hour)
+	ex.server.prices.Refresh()
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 50, litecoin = 5`)
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 0.5,
+	})
+	bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 10})
+
+	var prices struct {
+		LTC    map[string]float64 `json:"ltc"`
+		KCN    map[string]float64 `json:"kcn"`
+		KCNLTC float64            `json:"kcn_ltc"`
+	}
+	bob.get("/api/prices", &prices)
+	if prices.LTC["eur"] != 70 || prices.KCNLTC != 0.05 {
+		t.Fatalf("prices = %+v", prices)
+	}
+	assertAmount(t, "KCN in USD", prices.KCN["usd"], 4)
+	assertAmount(t, "KCN in EUR", prices.KCN["eur"], 3.5)
+
+	var ltc map[string]interface{}
+	bob.get("/api/ltc-price", &ltc)
+	if ltc["ltc_usd"] != 80.0 || ltc["updated_at"] == nil {
+		t.Errorf("ltc-price = %v", ltc)
+	}
+}
@@ -0,0 +1,203 @@
+// Package proof builds Merkle sum trees over user balances so each user can check
+// that their balance is counted in the exchange's published liabilities.
+//
+// Every node carries a hash and the total of each asset beneath it. A parent's
+// totals are the sum of its children's, and its hash commits to both children's
+// hashes and totals, so no balance can be left out or shrunk without changing
+// the root. Amounts are integers in the coin's smallest unit.
+package proof
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Leaf is one user's entry in the tree
+type Leaf struct {
+	UserID   int64
+	Nonce    string  // random per snapshot, so leaf hashes reveal nothing about other snapshots
+	Balances []int64 // one per asset, in the tree's asset order
+}
+
+// Node is a tree node: a hash and the per-asset totals beneath it
+type Node struct {
+	Hash []byte
+	Sums []int64
+}
+
+// Step is one sibling on the path from a leaf to the root
+type Step struct {
+	Hash  string  `json:"hash"`
+	Sums  []int64 `json:"sums"`
+	Right bool    `json:"right"` // the sibling is on the right
+}
+
+// Proof shows a leaf is included under a root
+type Proof struct {
+	Assets   []string `json:"assets"`
+	UserID   int64    `json:"user_id"`
+	Nonce    string   `json:"nonce"`
+	Balances []int64  `json:"balances"`
+	Path     []Step   `json:"path"`
+	Root     string   `json:"root"`
+	Totals   []int64  `json:"totals"`
+}
+
+// Tree is a Merkle sum tree. Levels[0] are the leaves and the last level is the root.
+type Tree struct {
+	Assets []string
+	Levels [][]Node
+}
+
+// LeafHash commits to a user's ID, nonce and balances
+func LeafHash(userID int64, nonce string, balances []int64) []byte {
+	h := sha256.New()
+	h.Write([]byte("leaf"))
+	binary.Write(h, binary.BigEndian, userID)
+	binary.Write(h, binary.BigEndian, uint32(len(nonce)))
+	h.Write([]byte(nonce))
+	for _, b := range balances {
+		binary.Write(h, binary.BigEndian, b)
+	}
+	return h.Sum(nil)
+}
+
+// parent combines two nodes, summing their totals. Sums that would overflow an
+// int64 are an error rather than wrapping.
+func parent(left, right Node) (Node, error) {
+	sums := make([]int64, len(left.Sums))
+	for i := range sums {
+		if left.Sums[i] < 0 || right.Sums[i] < 0 || left.Sums[i] > math.MaxInt64-right.Sums[i] {
+			return Node{}, errors.New("sum out of range")
+		}
+		sums[i] = left.Sums[i] + right.Sums[i]
+	}
+	h := sha256.New()
+	h.Write([]byte("node"))
+	for _, n := range []Node{left, right} {
+		h.Write(n.Hash)
+		for _, s := range n.Sums {
+			binary.Write(h, binary.BigEndian, s)
+		}
+	}
+	return Node{Hash: h.Sum(nil), Sums: sums}, nil
+}
+
+// Build creates a tree over the leaves. A node without a sibling is carried up
+// to the next level unchanged.
+func Build(assets []string, leaves []Leaf) (*Tree, error) {
+	if len(leaves) == 0 {
+		return nil, errors.New("no leaves")
+	}
+
+	level := make([]Node, len(leaves))
+	for i, leaf := range leaves {
+		if len(leaf.Balances) != len(assets) {
+			return nil, fmt.Errorf("user %d has %d balances, expected %d", leaf.UserID, len(leaf.Balances), len(assets))
+		}
+		for _, b := range leaf.Balances {
+			if b < 0 {
+				return nil, fmt.Errorf("user %d has a negative balance", leaf.UserID)
+			}
+		}
+		level[i] = Node{Hash: LeafHash(leaf.UserID, leaf.Nonce, leaf.Balances), Sums: leaf.Balances}
+	}
+
+	tree := &Tree{Assets: assets, Levels: [][]Node{level}}
+	for len(level) > 1 {
+		next := make([]Node, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				node, err := parent(level[i], level[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("level %d: %w", len(tree.Levels), err)
+				}
+				next = append(next, node)
+			}
+		}
+		tree.Levels = append(tree.Levels, next)
+		level = next
+	}
+	return tree, nil
+}
+
+// Root returns the root node
+func (t *Tree) Root() Node {
+	return t.Levels[len(t.Levels)-1][0]
+}
+
+// Prove returns the inclusion proof for the leaf at index
+func (t *Tree) Prove(index int, leaf Leaf) (*Proof, error) {
+	if index < 0 || index >= len(t.Levels[0]) {
+		return nil, fmt.Errorf("leaf %d out of range", index)
+	}
+
+	root := t.Root()
+	proof := &Proof{
+		Assets:   t.Assets,
+		UserID:   leaf.UserID,
+		Nonce:    leaf.Nonce,
+		Balances: leaf.Balances,
+		Path:     []Step{},
+		Root:     hex.EncodeToString(root.Hash),
+		Totals:   root.Sums,
+	}
+	for _, level := range t.Levels[:len(t.Levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			node := level[sibling]
+			proof.Path = append(proof.Path, Step{Hash: hex.EncodeToString(node.Hash), Sums: node.Sums, Right: sibling > index})
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// Verify recomputes the root from the proof's leaf and path and checks it
+// matches the proof's root and totals
+func Verify(p *Proof) error {
+	if len(p.Balances) != len(p.Assets) || len(p.Totals) != len(p.Assets) {
+		return errors.New("balances and totals must have one entry per asset")
+	}
+	for _, b := range p.Balances {
+		if b < 0 {
+			return errors.New("negative balance")
+		}
+	}
+
+	node := Node{Hash: LeafHash(p.UserID, p.Nonce, p.Balances), Sums: p.Balances}
+	for i, step := range p.Path {
+		hash, err := hex.DecodeString(step.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("step %d: invalid hash", i)
+		}
+		if len(step.Sums) != len(p.Assets) {
+			return fmt.Errorf("step %d: expected %d sums", i, len(p.Assets))
+		}
+		sibling := Node{Hash: hash, Sums: step.Sums}
+		if step.Right {
+			node, err = parent(node, sibling)
+		} else {
+			node, err = parent(sibling, node)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+
+	if hex.EncodeToString(node.Hash) != p.Root {
+		return errors.New("computed root does not match")
+	}
+	for i, total := range p.Totals {
+		if node.Sums[i] != total {
+			return fmt.Errorf("computed %s total %d does not match %d", p.Assets[i], node.Sums[i], total)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package proof
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"testing"
+)
+
+var assets = []string{"kernelcoin", "litecoin"}
+
+func leaves(n int) []Leaf {
+	out := make([]Leaf, n)
+	for i := range out {
+		out[i] = Leaf{UserID: int64(i + 1), Nonce: fmt.Sprintf("nonce-%d", i), Balances: []int64{int64(100 * (i + 1)), int64(i)}}
+	}
+	return out
+}
+
+func TestProveVerifyEveryLeaf(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		ls := leaves(n)
+		tree, err := Build(assets, ls)
+		if err != nil {
+			t.Fatalf("%d leaves: %v", n, err)
+		}
+
+		var want [2]int64
+		for _, l := range ls {
+			want[0] += l.Balances[0]
+			want[1] += l.Balances[1]
+		}
+		if root := tree.Root(); root.Sums[0] != want[0] || root.Sums[1] != want[1] {
+			t.Errorf("%d leaves: root sums %v, want %v", n, root.Sums, want)
+		}
+
+		for i, l := range ls {
+			p, err := tree.Prove(i, l)
+			if err != nil {
+				t.Fatalf("%d leaves: prove %d: %v", n, i, err)
+			}
+			if err := Verify(p); err != nil {
+				t.Errorf("%d leaves: verify %d: %v", n, i, err)
+			}
+		}
+		if _, err := tree.Prove(n, ls[0]); err == nil {
+			t.Errorf("%d leaves: proved an index out of range", n)
+		}
+	}
+}
+
+func TestOddLeafIsCarried(t *testing.T) {
+	ls := leaves(3)
+	tree, err := Build(assets, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The third leaf has no sibling, so it moves up unchanged and its proof skips a level
+	if len(tree.Levels) != 3 || len(tree.Levels[1]) != 2 {
+		t.Fatalf("levels = %d, level 1 has %d nodes", len(tree.Levels), len(tree.Levels[1]))
+	}
+	if hex.EncodeToString(tree.Levels[1][1].Hash) != hex.EncodeToString(tree.Levels[0][2].Hash) {
+		t.Errorf("odd leaf was not carried up unchanged")
+	}
+	p, _ := tree.Prove(2, ls[2])
+	if len(p.Path) != 1 || p.Path[0].Right {
+		t.Errorf("path of the carried leaf = %+v", p.Path)
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	ls := leaves(5)
+	tree, err := Build(assets, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tamper := range map[string]func(p *Proof){
+		"balance":      func(p *Proof) { p.Balances[1]++ },
+		"nonce":        func(p *Proof) { p.Nonce += "x" },
+		"user":         func(p *Proof) { p.UserID++ },
+		"sibling hash": func(p *Proof) { p.Path[0].Hash = hex.EncodeToString(make([]byte, 32)) },
+		"short hash":   func(p *Proof) { p.Path[0].Hash = p.Path[0].Hash[:10] },
+		"sibling sums": func(p *Proof) { p.Path[1].Sums[0]-- },
+		"negative sum": func(p *Proof) { p.Path[0].Sums[0] = -1 },
+		"right flag":   func(p *Proof) { p.Path[0].Right = !p.Path[0].Right },
+		"dropped step": func(p *Proof) { p.Path = p.Path[:len(p.Path)-1] },
+		"root":         func(p *Proof) { p.Root = p.Path[0].Hash },
+		"total":        func(p *Proof) { p.Totals[0]++ },
+		"asset count":  func(p *Proof) { p.Totals = p.Totals[:1] },
+		"overflow":     func(p *Proof) { p.Path[0].Sums[0] = math.MaxInt64 },
+	} {
+		p, err := tree.Prove(1, ls[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Copy the slices the tree shares so tampering does not leak between cases
+		p.Balances = append([]int64(nil), p.Balances...)
+		p.Totals = append([]int64(nil), p.Totals...)
+		for i := range p.Path {
+			p.Path[i].Sums = append([]int64(nil), p.Path[i].Sums...)
+		}
+		tamper(p)
+		if err := Verify(p); err == nil {
+			t.Errorf("%s: tampered proof verified", name)
+		}
+	}
+}
+
+func TestBuildRejectsBadLeaves(t *testing.T) {
+	if _, err := Build(assets, nil); err == nil {
+		t.Errorf("built a tree without leaves")
+	}
+	if _, err := Build(assets, []Leaf{{UserID: 1, Balances: []int64{1}}}); err == nil {
+		t.Errorf("built a tree with a missing balance")
+	}
+	if _, err := Build(assets, []Leaf{{UserID: 1, Balances: []int64{1, -1}}}); err == nil {
+		t.Errorf("built a tree with a negative balance")
+	}
+	big := []Leaf{
+		{UserID: 1, Balances: []int64{math.MaxInt64, 0}},
+		{UserID: 2, Balances: []int64{1, 0}},
+	}
+	if _, err := Build(assets, big); err == nil {
+		t.Errorf("built a tree whose totals overflow")
+	}
+}
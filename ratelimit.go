@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token-bucket budget: Rate tokens are added per second up to Burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// tokenBucket tracks the remaining tokens for a single key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter enforces per-route token-bucket limits keyed by IP and logged in user.
+// Buckets are only created for requests that are let through, so requests that are
+// refused cannot grow the bucket map.
+type RateLimiter struct {
+	mu           sync.Mutex
+	buckets      map[string]*tokenBucket
+	routes       map[string]RateLimit
+	defaultLimit RateLimit
+	trustProxy   bool
+	idleTTL      time.Duration
+}
+
+// defaultRouteLimits are the built-in per-route budgets, overridable with -rate-limits
+var defaultRouteLimits = map[string]RateLimit{
+	"/api/captcha/generate":       {Rate: 0.2, Burst: 5},
+	"/api/register":               {Rate: 0.1, Burst: 3},
+	"/api/login":                  {Rate: 0.2, Burst: 5},
+	"/api/change-password":        {Rate: 0.1, Burst: 3},
+	"/api/trade/create":           {Rate: 1, Burst: 10},
+	"/api/trade/execute":          {Rate: 1, Burst: 10},
+	"/api/trade/cancel":           {Rate: 2, Burst: 20},
+	"/api/withdraw":               {Rate: 0.1, Burst: 3},
+	"/api/ltc-price":              {Rate: 1, Burst: 10},
+	"/api/password-reset/request": {Rate: 0.01, Burst: 3},
+	"/api/update-email":           {Rate: 0.1, Burst: 3},
+	"/api/trade/batch/create":     {Rate: 0.5, Burst: 5},
+	"/api/trade/batch/cancel":     {Rate: 0.5, Burst: 5},
+	"/api/trade/batch/replace":    {Rate: 0.5, Burst: 5},
+	"/api/admin/faucet":           {Rate: 1, Burst: 10},
+}
+
+// NewRateLimiter creates a rate limiter with the given per-route budgets
+func NewRateLimiter(routes map[string]RateLimit, defaultLimit RateLimit, trustProxy bool) *RateLimiter {
+	return &RateLimiter{
+		buckets:      make(map[string]*tokenBucket),
+		routes:       routes,
+		defaultLimit: defaultLimit,
+		trustProxy:   trustProxy,
+		idleTTL:      10 * time.Minute,
+	}
+}
+
+// parseRateLimit parses a "rate:burst" budget such as "0.5:10"
+func parseRateLimit(s string) (RateLimit, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected rate:burst", s)
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate in %q", s)
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid burst in %q", s)
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// parseRouteLimits merges a "route=rate:burst,route=rate:burst" list over the default budgets
+func parseRouteLimits(spec string) (map[string]RateLimit, error) {
+	routes := make(map[string]RateLimit, len(defaultRouteLimits))
+	for route, limit := range defaultRouteLimits {
+		routes[route] = limit
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		return routes, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid route limit %q, expected route=rate:burst", entry)
+		}
+		limit, err := parseRateLimit(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		routes[kv[0]] = limit
+	}
+
+	return routes, nil
+}
+
+// limitFor returns the budget that applies to a route
+func (rl *RateLimiter) limitFor(route string) RateLimit {
+	if limit, ok := rl.routes[route]; ok {
+		return limit
+	}
+	return rl.defaultLimit
+}
+
+// available returns the tokens key has at now, without creating its bucket. Caller must hold rl.mu.
+func (rl *RateLimiter) available(key string, limit RateLimit, now time.Time) float64 {
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		return float64(limit.Burst)
+	}
+	elapsed := now.Sub(bucket.last).Seconds()
+	return math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+}
+
+// clientIP returns the caller's IP, honouring X-Forwarded-For only when behind a trusted proxy.
+// Clients can send their own X-Forwarded-For, which the proxy appends to, so only the
+// rightmost entry, added by the proxy itself, can be trusted.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// keysFor returns every bucket key a request is charged against. user identifies
+// the request's valid session, or is empty without one.
+func (rl *RateLimiter) keysFor(route string, r *http.Request, user string) []string {
+	keys := []string{route + "|ip|" + clientIP(r, rl.trustProxy)}
+	if user != "" {
+		keys = append(keys, route+"|user|"+user)
+	}
+	return keys
+}
+
+// Allow charges a request at now against all of its buckets, returning the longest
+// required wait on rejection. A rejected request takes no tokens and creates no bucket.
+func (rl *RateLimiter) Allow(route string, r *http.Request, user string, now time.Time) (bool, time.Duration) {
+	limit := rl.limitFor(route)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	keys := rl.keysFor(route, r, user)
+	tokens := make([]float64, len(keys))
+	allowed := true
+	var retryAfter time.Duration
+	for i, key := range keys {
+		tokens[i] = rl.available(key, limit, now)
+		if tokens[i] < 1 {
+			allowed = false
+			wait := time.Duration((1 - tokens[i]) / limit.Rate * float64(time.Second))
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if !allowed {
+		return false, retryAfter
+	}
+	for i, key := range keys {
+		rl.buckets[key] = &tokenBucket{tokens: tokens[i] - 1, last: now}
+	}
+	return true, 0
+}
+
+// Middleware wraps a handler so that requests over budget receive 429 Too Many Requests.
+// userOf names the user of a request's valid session, or returns "" without one.
+func (rl *RateLimiter) Middleware(route string, userOf func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := rl.Allow(route, r, userOf(r), time.Now())
+		if !allowed {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			log.Printf("[RATELIMIT] Rejected %s %s from %s (retry after %ds)", r.Method, route, clientIP(r, rl.trustProxy), seconds)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       "Too many requests",
+				"retry_after": seconds,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Cleanup removes buckets that have not been used within the idle TTL of now
+func (rl *RateLimiter) Cleanup(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := now.Add(-rl.idleTTL)
+	for key, bucket := range rl.buckets {
+		if bucket.last.Before(cutoff) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RunCleanup periodically removes idle buckets
+func (rl *RateLimiter) RunCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		rl.Cleanup(now)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIPTakesProxyEntry(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/login", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+
+	if ip := clientIP(r, true); ip != "203.0.113.7" {
+		t.Errorf("behind a proxy: %s, want the entry the proxy added", ip)
+	}
+	if ip := clientIP(r, false); ip != "10.0.0.2" {
+		t.Errorf("without a proxy: %s", ip)
+	}
+}
+
+// request builds a request from addr for the rate limiter
+func request(addr string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/x", nil)
+	r.RemoteAddr = addr + ":1234"
+	return r
+}
+
+func TestRejectedRequestTakesNoTokens(t *testing.T) {
+	rl := NewRateLimiter(map[string]RateLimit{}, RateLimit{Rate: 0.001, Burst: 2}, false)
+	now := time.Now()
+	allow := func(user string) bool {
+		allowed, _ := rl.Allow("/api/x", request("192.0.2.1"), user, now)
+		return allowed
+	}
+
+	// The IP's two tokens go to user a; b is refused on the IP bucket alone
+	for i := 0; i < 2; i++ {
+		if !allow("a") {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	if allow("b") {
+		t.Fatal("request over the IP budget allowed")
+	}
+	rl.mu.Lock()
+	_, created := rl.buckets["/api/x|user|b"]
+	buckets := len(rl.buckets)
+	rl.mu.Unlock()
+	if created || buckets != 2 {
+		t.Errorf("a rejected request created a bucket: %d buckets", buckets)
+	}
+}
+
+func TestRouteLimitsAndRefill(t *testing.T) {
+	routes, err := parseRouteLimits("/api/login=1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes["/api/withdraw"] != defaultRouteLimits["/api/withdraw"] || routes["/api/login"] != (RateLimit{Rate: 1, Burst: 2}) {
+		t.Fatalf("routes = %v", routes)
+	}
+	rl := NewRateLimiter(routes, RateLimit{Rate: 100, Burst: 100}, false)
+	now := time.Now()
+
+	// Each route has its own budget: the login burst of 2 does not touch other routes
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.Allow("/api/login", request("192.0.2.1"), "", now); !ok {
+			t.Fatalf("login %d refused", i)
+		}
+	}
+	ok, wait := rl.Allow("/api/login", request("192.0.2.1"), "", now)
+	if ok || wait != time.Second {
+		t.Errorf("third login = %v, retry after %v", ok, wait)
+	}
+	if ok, _ := rl.Allow("/api/balance", request("192.0.2.1"), "", now); !ok {
+		t.Errorf("another route refused")
+	}
+	if ok, _ := rl.Allow("/api/login", request("192.0.2.2"), "", now); !ok {
+		t.Errorf("another IP refused")
+	}
+
+	// One token comes back per second, up to the burst
+	if ok, _ := rl.Allow("/api/login", request("192.0.2.1"), "", now.Add(500*time.Millisecond)); ok {
+		t.Errorf("login allowed before a token came back")
+	}
+	if ok, _ := rl.Allow("/api/login", request("192.0.2.1"), "", now.Add(time.Second)); !ok {
+		t.Errorf("login refused after a second")
+	}
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.Allow("/api/login", request("192.0.2.1"), "", later); !ok {
+			t.Fatalf("login %d after an hour refused", i)
+		}
+	}
+	if ok, _ := rl.Allow("/api/login", request("192.0.2.1"), "", later); ok {
+		t.Errorf("more than the burst after an hour")
+	}
+
+	// A user is limited across IPs
+	for i := 0; i < 2; i++ {
+		rl.Allow("/api/login", request(fmt.Sprintf("198.51.100.%d", i)), "7", later)
+	}
+	if ok, _ := rl.Allow("/api/login", request("198.51.100.9"), "7", later); ok {
+		t.Errorf("user over the budget allowed from a new IP")
+	}
+}
+
+func TestIdleBucketsAreEvicted(t *testing.T) {
+	rl := NewRateLimiter(map[string]RateLimit{}, RateLimit{Rate: 1, Burst: 1}, false)
+	now := time.Now()
+	rl.Allow("/api/x", request("192.0.2.1"), "", now)
+	rl.Allow("/api/x", request("192.0.2.2"), "", now.Add(rl.idleTTL))
+
+	rl.Cleanup(now.Add(rl.idleTTL + time.Second))
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.buckets["/api/x|ip|192.0.2.1"]; ok {
+		t.Errorf("idle bucket kept")
+	}
+	if _, ok := rl.buckets["/api/x|ip|192.0.2.2"]; !ok {
+		t.Errorf("recent bucket evicted")
+	}
+}
+
+func TestForgedSessionIsNotAUser(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	ex.newUser(t, "alice")
+
+	r := httptest.NewRequest("GET", "/api/balance", nil)
+	r.AddCookie(&http.Cookie{Name: ex.server.cookies.SessionName(), Value: "made-up"})
+	if user := ex.server.sessionUser(r); user != "" {
+		t.Errorf("forged session is user %q", user)
+	}
+	var token string
+	ex.server.mu.RLock()
+	for id, session := range ex.server.sessions {
+		if session.Username == "alice" {
+			token = id
+		}
+	}
+	ex.server.mu.RUnlock()
+	r = httptest.NewRequest("GET", "/api/balance", nil)
+	r.AddCookie(&http.Cookie{Name: ex.server.cookies.SessionName(), Value: token})
+	if user := ex.server.sessionUser(r); user != "1" {
+		t.Errorf("alice's session is user %q", user)
+	}
+}
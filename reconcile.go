@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReconciliationReport compares what the exchange owes users in one coin with what it holds
+type ReconciliationReport struct {
+	ID                 int64     `json:"id"`
+	Coin               string    `json:"coin"`
+	Symbol             string    `json:"symbol"`
+	UserBalances       float64   `json:"user_balances"` // available balances
+	Locked             float64   `json:"locked"`        // escrowed in open orders, already taken out of balances
+	PendingWithdrawals float64   `json:"pending_withdrawals"`
+	ExchangeFunds      float64   `json:"exchange_funds"` // the exchange's own funds such as fee revenue, held in the same wallets
+	Liabilities        float64   `json:"liabilities"`
+	WalletConfirmed    float64   `json:"wallet_confirmed"`
+	WalletUnconfirmed  float64   `json:"wallet_unconfirmed"`
+	ColdStorage        float64   `json:"cold_storage"`
+	Holdings           float64   `json:"holdings"`
+	Difference         float64   `json:"difference"` // holdings less liabilities; negative is a shortfall
+	Status             string    `json:"status"`     // "ok", "shortfall", "surplus" or "error"
+	Error              string    `json:"error,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+// Reconciler periodically checks that the wallets cover every user balance
+type Reconciler struct {
+	mu        sync.Mutex
+	db        *sql.DB
+	assets    map[string]*Asset
+	sweeper   *Sweeper // may be nil; supplies cold storage holdings
+	tolerance float64  // absolute difference in coins tolerated before alerting
+}
+
+// NewReconciler creates a reconciler for every asset
+func NewReconciler(db *sql.DB, assets map[string]*Asset, sweeper *Sweeper, tolerance float64) *Reconciler {
+	return &Reconciler{db: db, assets: assets, sweeper: sweeper, tolerance: tolerance}
+}
+
+// liabilities sums what users are owed in a coin
+func (rc *Reconciler) liabilities(report *ReconciliationReport) error {
+	asset := rc.assets[report.Coin]
+
+	err := rc.db.QueryRow(fmt.Sprintf(`SELECT COALESCE(SUM(%s), 0) FROM balances`, asset.Name)).Scan(&report.UserBalances)
+	if err != nil {
+		return fmt.Errorf("sum balances: %w", err)
+	}
+	err = rc.db.QueryRow(`SELECT COALESCE(SUM(`+orderEscrowSQL+`), 0) FROM trades t WHERE t.coin_selling = ? AND t.status = 'open'`, asset.Name).Scan(&report.Locked)
+	if err != nil {
+		return fmt.Errorf("sum open orders: %w", err)
+	}
+	// Withdrawals with an unknown outcome were debited but may still be in the wallet
+	err = rc.db.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE coin = ? AND type = 'withdraw' AND status = 'pending'`, asset.Name).Scan(&report.PendingWithdrawals)
+	if err != nil {
+		return fmt.Errorf("sum pending withdrawals: %w", err)
+	}
+	err = rc.db.QueryRow(`SELECT COALESCE(SUM(balance), 0) FROM exchange_accounts WHERE coin = ?`, asset.Name).Scan(&report.ExchangeFunds)
+	if err != nil {
+		return fmt.Errorf("sum exchange accounts: %w", err)
+	}
+	report.Liabilities = report.UserBalances + report.Locked + report.PendingWithdrawals + report.ExchangeFunds
+	return nil
+}
+
+// reconcile builds the report for one coin
+func (rc *Reconciler) reconcile(name string) *ReconciliationReport {
+	asset := rc.assets[name]
+	report := &ReconciliationReport{Coin: name, Symbol: asset.Symbol, Status: "error", CreatedAt: time.Now().UTC()}
+
+	if err := rc.liabilities(report); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	confirmed, unconfirmed, err := asset.Wallet.Balance()
+	if err != nil {
+		report.Error = asset.userError(err, "failed to read wallet balance")
+		return report
+	}
+	report.WalletConfirmed = confirmed
+	report.WalletUnconfirmed = unconfirmed
+
+	if rc.sweeper != nil {
+		if report.ColdStorage, err = rc.sweeper.ColdStorage(name); err != nil {
+			report.Error = fmt.Sprintf("sum cold storage: %v", err)
+			return report
+		}
+	}
+
+	// Unconfirmed coins count: they include change from our own withdrawals.
+	// Deposits not yet credited to users show up as a surplus.
+	report.Holdings = confirmed + unconfirmed + report.ColdStorage
+	report.Difference = report.Holdings - report.Liabilities
+	switch {
+	case report.Difference < -rc.tolerance:
+		report.Status = "shortfall"
+	case report.Difference > rc.tolerance:
+		report.Status = "surplus"
+	default:
+		report.Status = "ok"
+	}
+	return report
+}
+
+// Check reconciles every coin, stores the reports and alerts on discrepancies
+func (rc *Reconciler) Check() []*ReconciliationReport {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	names := make([]string, 0, len(rc.assets))
+	for name := range rc.assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := make([]*ReconciliationReport, 0, len(names))
+	for _, name := range names {
+		report := rc.reconcile(name)
+
+		switch report.Status {
+		case "shortfall", "surplus":
+			log.Printf("[RECONCILE] DISCREPANCY: %s %s of %.8f | liabilities %.8f | holdings %.8f (wallet %.8f + %.8f unconfirmed, cold %.8f)",
+				report.Symbol, report.Status, math.Abs(report.Difference), report.Liabilities, report.Holdings,
+				report.WalletConfirmed, report.WalletUnconfirmed, report.ColdStorage)
+		case "error":
+			log.Printf("[RECONCILE] %s reconciliation failed: %s", report.Symbol, report.Error)
+		}
+
+		result, err := rc.db.Exec(`
+			INSERT INTO reconciliation_reports (coin, user_balances, locked, pending_withdrawals, exchange_funds, liabilities,
+				wallet_confirmed, wallet_unconfirmed, cold_storage, holdings, difference, status, error, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			report.Coin, report.UserBalances, report.Locked, report.PendingWithdrawals, report.ExchangeFunds, report.Liabilities,
+			report.WalletConfirmed, report.WalletUnconfirmed, report.ColdStorage, report.Holdings, report.Difference,
+			report.Status, report.Error, report.CreatedAt)
+		if err != nil {
+			log.Printf("[RECONCILE] Failed to store %s report: %v", report.Symbol, err)
+		} else {
+			report.ID, _ = result.LastInsertId()
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// Run reconciles every interval
+func (rc *Reconciler) Run(interval time.Duration) {
+	rc.Check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rc.Check()
+	}
+}
+
+// History returns stored reports, newest first
+func (rc *Reconciler) History(limit int) ([]*ReconciliationReport, error) {
+	rows, err := rc.db.Query(`
+		SELECT id, coin, user_balances, locked, pending_withdrawals, exchange_funds, liabilities, wallet_confirmed,
+			wallet_unconfirmed, cold_storage, holdings, difference, status, COALESCE(error, ''), created_at
+		FROM reconciliation_reports ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*ReconciliationReport{}
+	for rows.Next() {
+		var report ReconciliationReport
+		err := rows.Scan(&report.ID, &report.Coin, &report.UserBalances, &report.Locked, &report.PendingWithdrawals,
+			&report.ExchangeFunds, &report.Liabilities, &report.WalletConfirmed, &report.WalletUnconfirmed, &report.ColdStorage,
+			&report.Holdings, &report.Difference, &report.Status, &report.Error, &report.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if asset, ok := rc.assets[report.Coin]; ok {
+			report.Symbol = asset.Symbol
+		}
+		reports = append(reports, &report)
+	}
+	return reports, rows.Err()
+}
+
+// handleAdminReconciliation shows the latest reconciliation history (GET, ?limit=)
+// or reconciles immediately (POST)
+func (s *Server) handleAdminReconciliation(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if s.reconciler == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Reconciliation is disabled"})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		log.Printf("[RECONCILE] Admin %s triggered a reconciliation", session.Username)
+		s.reconciler.Check()
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	history, err := s.reconciler.History(limit)
+	if err != nil {
+		log.Printf("[RECONCILE] Failed to load history: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load reconciliation history"})
+		return
+	}
+
+	// The newest report for each coin
+	latest := map[string]*ReconciliationReport{}
+	for _, report := range history {
+		if _, ok := latest[report.Coin]; !ok {
+			latest[report.Coin] = report
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tolerance": s.reconciler.tolerance,
+		"latest":    latest,
+		"history":   history,
+	})
+}
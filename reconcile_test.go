@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// brokenWallet is a wallet backend whose node is down
+type brokenWallet struct {
+	WalletBackend
+}
+
+func (brokenWallet) Balance() (float64, float64, error) {
+	return 0, 0, ErrWalletUnavailable
+}
+
+// fundSim pays amount into a sim wallet and confirms it
+func fundSim(t *testing.T, wallet *SimWallet, amount float64) {
+	t.Helper()
+	if amount == 0 {
+		return
+	}
+	address, err := wallet.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wallet.Faucet(address, amount); err != nil {
+		t.Fatal(err)
+	}
+	wallet.Mine(1)
+}
+
+// seedLiabilities owes users 60 KCN in balances, 20 in an open ask, 15 in a
+// pending withdrawal and keeps 5 of fee revenue: 100 in all
+func seedLiabilities(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for _, query := range []string{
+		`INSERT INTO balances (user_id, kernelcoin) VALUES (1, 40), (2, 20)`,
+		`INSERT INTO trades (seller_id, coin_selling, amount_selling, coin_buying, amount_buying, price_per_unit, status)
+			VALUES (1, 'kernelcoin', 20, 'litecoin', 2, 0.1, 'open'), (1, 'kernelcoin', 50, 'litecoin', 5, 0.1, 'cancelled')`,
+		`INSERT INTO transactions (user_id, coin, amount, type, status) VALUES
+			(2, 'kernelcoin', 15, 'withdraw', 'pending'), (2, 'kernelcoin', 30, 'withdraw', 'completed')`,
+		`INSERT INTO exchange_accounts (account, coin, balance) VALUES ('fees', 'kernelcoin', 5)`,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestReconcilerCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		wallet    float64
+		cold      float64 // swept to cold storage
+		filled    float64 // KCN of the open ask already filled
+		tolerance float64
+		broken    bool
+		status    string
+		diff      float64
+	}{
+		{name: "matched", wallet: 100, status: "ok"},
+		{name: "shortfall", wallet: 90, status: "shortfall", diff: -10},
+		{name: "surplus", wallet: 110, status: "surplus", diff: 10},
+		{name: "within tolerance", wallet: 100.5, tolerance: 1, status: "ok", diff: 0.5},
+		{name: "cold storage", wallet: 70, cold: 30, status: "ok"},
+		{name: "partly filled order", wallet: 95, filled: 5, status: "ok"},
+		{name: "wallet down", broken: true, status: "error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			assets := newSimAssets(t, db)
+			fundSim(t, assets["kernelcoin"].Wallet.(*SimWallet), tc.wallet)
+			seedLiabilities(t, db)
+			if tc.filled > 0 {
+				db.Exec(`INSERT INTO trade_completions (trade_id, buyer_id, quantity, price) VALUES (1, 2, ?, 0.1)`, tc.filled)
+			}
+			if tc.cold > 0 {
+				db.Exec(`INSERT INTO hot_wallet_ledger (coin, kind, amount, status, hot_balance, pending_withdrawals) VALUES ('kernelcoin', 'sweep', ?, 'sent', 0, 0)`, tc.cold)
+			}
+			if tc.broken {
+				assets["kernelcoin"].Wallet = brokenWallet{assets["kernelcoin"].Wallet}
+			}
+
+			rc := NewReconciler(db, assets, NewSweeper(db, assets, map[string]HotWalletConfig{}, nil), tc.tolerance)
+			reports := rc.Check()
+			if len(reports) != 2 || reports[0].Coin != "kernelcoin" || reports[1].Coin != "litecoin" {
+				t.Fatalf("reports = %+v", reports)
+			}
+			report := reports[0]
+			if report.Status != tc.status {
+				t.Fatalf("status = %s (%s), want %s", report.Status, report.Error, tc.status)
+			}
+			if tc.broken {
+				if !strings.Contains(report.Error, "unavailable") {
+					t.Errorf("error = %q", report.Error)
+				}
+				return
+			}
+
+			assertAmount(t, "balances", report.UserBalances, 60)
+			assertAmount(t, "locked", report.Locked, 20-tc.filled)
+			assertAmount(t, "pending withdrawals", report.PendingWithdrawals, 15)
+			assertAmount(t, "exchange funds", report.ExchangeFunds, 5)
+			assertAmount(t, "liabilities", report.Liabilities, 100-tc.filled)
+			assertAmount(t, "cold storage", report.ColdStorage, tc.cold)
+			assertAmount(t, "holdings", report.Holdings, tc.wallet+tc.cold)
+			assertAmount(t, "difference", report.Difference, tc.diff)
+			if reports[1].Status != "ok" || reports[1].Liabilities != 0 {
+				t.Errorf("LTC report = %+v", reports[1])
+			}
+		})
+	}
+}
+
+func TestReconciliationHistoryAndAdmin(t *testing.T) {
+	db := newTestDB(t)
+	assets := newSimAssets(t, db)
+	ex := startTestExchange(t, db, assets)
+	admin := ex.newUser(t, "admin")
+	alice := ex.newUser(t, "alice")
+	ex.server.reconciler = NewReconciler(db, assets, nil, 0)
+
+	// Alice is owed 3 KCN that the wallet does not hold
+	db.Exec(`UPDATE balances SET kernelcoin = 3 WHERE user_id = 2`)
+	fundSim(t, assets["litecoin"].Wallet.(*SimWallet), 1)
+	ex.server.reconciler.Check()
+	db.Exec(`UPDATE balances SET kernelcoin = 0 WHERE user_id = 2`)
+
+	var resp struct {
+		Latest  map[string]*ReconciliationReport `json:"latest"`
+		History []*ReconciliationReport          `json:"history"`
+		Error   string                           `json:"error"`
+	}
+	admin.post("/api/admin/reconciliation", nil, &resp)
+	if len(resp.History) != 4 || resp.Error != "" {
+		t.Fatalf("history = %+v (%s)", resp.History, resp.Error)
+	}
+	// Newest first; each coin's latest report is from the admin's run
+	if kcn := resp.Latest["kernelcoin"]; kcn == nil || kcn.ID != resp.History[1].ID || kcn.Status != "ok" {
+		t.Errorf("latest KCN = %+v", kcn)
+	}
+	if ltc := resp.Latest["litecoin"]; ltc == nil || ltc.ID != resp.History[0].ID || ltc.Status != "surplus" || ltc.Symbol != "LTC" {
+		t.Errorf("latest LTC = %+v", ltc)
+	}
+	first := resp.History[3]
+	if first.Coin != "kernelcoin" || first.Status != "shortfall" || first.Difference != -3 || first.CreatedAt.IsZero() {
+		t.Errorf("first report = %+v", first)
+	}
+
+	history, err := ex.server.reconciler.History(1)
+	if err != nil || len(history) != 1 || history[0].ID != resp.History[0].ID {
+		t.Errorf("history(1) = %+v, %v", history, err)
+	}
+
+	if r := postJSON(t, alice.client, ex.ts.URL+"/api/admin/reconciliation", `{}`, alice.token, ""); r.StatusCode != 401 {
+		t.Errorf("reconciliation as alice: status %d", r.StatusCode)
+	}
+}
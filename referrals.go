@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// referralCodeBytes is the randomness in a referral code, 8 base32 characters
+const referralCodeBytes = 5
+
+// ReferralStats is how a referrer is doing
+type ReferralStats struct {
+	UserID         int                `json:"-"`
+	Username       string             `json:"username,omitempty"`
+	Code           string             `json:"code"`
+	Referees       int                `json:"referees"`
+	ActiveReferees int                `json:"active_referees"` // still within the payout period
+	Earned         map[string]float64 `json:"earned"`
+}
+
+// ReferralPayout is one share of a referee's fee paid to their referrer
+type ReferralPayout struct {
+	ID        int64     `json:"id"`
+	Referrer  string    `json:"referrer,omitempty"`
+	Referee   string    `json:"referee"`
+	FillID    int64     `json:"fill_id"`
+	Coin      string    `json:"coin"`
+	Fee       float64   `json:"fee"`
+	Amount    float64   `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Referrals pays referrers a share of the trading fees of the users they brought
+// in, for a period after each referee registers
+type Referrals struct {
+	db     *sql.DB
+	share  float64
+	period time.Duration
+}
+
+// NewReferrals creates a referral program paying share (0 to 1) of each referee's
+// fees for period after they register
+func NewReferrals(db *sql.DB, share float64, period time.Duration) (*Referrals, error) {
+	if share < 0 || share > 1 {
+		return nil, fmt.Errorf("referral share must be between 0 and 1")
+	}
+	if period < 0 {
+		return nil, fmt.Errorf("referral period must not be negative")
+	}
+	return &Referrals{db: db, share: share, period: period}, nil
+}
+
+// normalizeReferralCode accepts codes in any case and with surrounding spaces
+func normalizeReferralCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Code returns a user's referral code, or "" if they have none yet
+func (rf *Referrals) Code(userID int) (string, error) {
+	var code string
+	err := rf.db.QueryRow(`SELECT code FROM referral_codes WHERE user_id = ?`, userID).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return code, err
+}
+
+// CreateCode returns a user's referral code, generating one the first time
+func (rf *Referrals) CreateCode(userID int) (string, error) {
+	if code, err := rf.Code(userID); err != nil || code != "" {
+		return code, err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		b := make([]byte, referralCodeBytes)
+		if _, err := randRead(b); err != nil {
+			return "", err
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+		_, err := rf.db.Exec(`INSERT INTO referral_codes (code, user_id) VALUES (?, ?)`, code, userID)
+		if err == nil {
+			return code, nil
+		}
+		if !strings.Contains(err.Error(), "UNIQUE constraint failed: referral_codes.code") {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("failed to generate a unique referral code")
+}
+
+// Lookup returns the user a referral code belongs to
+func (rf *Referrals) Lookup(code string) (int, bool, error) {
+	var userID int
+	err := rf.db.QueryRow(`SELECT user_id FROM referral_codes WHERE code = ?`, normalizeReferralCode(code)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return userID, err == nil, err
+}
+
+// Refer records that a new user registered with another's code
+func (rf *Referrals) Refer(refereeID, referrerID int) error {
+	_, err := rf.db.Exec(`UPDATE users SET referred_by = ?, referred_at = CURRENT_TIMESTAMP WHERE id = ? AND referred_by IS NULL`,
+		referrerID, refereeID)
+	return err
+}
+
+// Pay gives a referee's referrer their share of a fee, taken from the fee account,
+// as part of the fill's transaction. It returns the referrer and the amount, or 0
+// and 0 if nothing is due.
+func (rf *Referrals) Pay(tx *sql.Tx, fillID int64, refereeID int, fee *FeeCharge, now time.Time) (int, float64, error) {
+	if rf == nil || rf.share == 0 || fee.Amount == 0 {
+		return 0, 0, nil
+	}
+
+	var referrerID int
+	var referredAt time.Time
+	err := tx.QueryRow(`SELECT referred_by, referred_at FROM users WHERE id = ? AND referred_by IS NOT NULL`, refereeID).
+		Scan(&referrerID, &referredAt)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if now.Sub(referredAt) > rf.period {
+		return 0, 0, nil
+	}
+
+	amount := math.Round(fee.Amount*rf.share*1e8) / 1e8
+	if amount == 0 {
+		return 0, 0, nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO referral_payouts (referrer_id, referee_id, completion_id, coin, fee, amount) VALUES (?, ?, ?, ?, ?, ?)
+	`, referrerID, refereeID, fillID, fee.Coin, fee.Amount, amount)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := creditExchangeAccount(tx, feeAccount, fee.Coin, -amount); err != nil {
+		return 0, 0, err
+	}
+	if err := adjustBalance(tx, referrerID, fee.Coin, amount); err != nil {
+		return 0, 0, err
+	}
+	return referrerID, amount, nil
+}
+
+// Stats summarises every referrer, or one if userID is not 0. Referrers without a
+// code are only listed when asked for by userID.
+func (rf *Referrals) Stats(userID int, now time.Time) ([]*ReferralStats, error) {
+	activeSince := now.Add(-rf.period).UTC().Format("2006-01-02 15:04:05")
+	query := `
+		SELECT u.id, u.username, COALESCE(c.code, ''),
+			(SELECT COUNT(*) FROM users r WHERE r.referred_by = u.id),
+			(SELECT COUNT(*) FROM users r WHERE r.referred_by = u.id AND r.referred_at >= ?),
+			(SELECT COALESCE(SUM(amount), 0) FROM referral_payouts p WHERE p.referrer_id = u.id AND p.coin = 'kernelcoin'),
+			(SELECT COALESCE(SUM(amount), 0) FROM referral_payouts p WHERE p.referrer_id = u.id AND p.coin = 'litecoin')
+		FROM users u
+		LEFT JOIN referral_codes c ON c.user_id = u.id`
+	args := []interface{}{activeSince}
+	if userID != 0 {
+		query += ` WHERE u.id = ?`
+		args = append(args, userID)
+	} else {
+		query += ` WHERE c.code IS NOT NULL ORDER BY u.username`
+	}
+
+	rows, err := rf.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []*ReferralStats{}
+	for rows.Next() {
+		st := &ReferralStats{}
+		var kcn, ltc float64
+		if err := rows.Scan(&st.UserID, &st.Username, &st.Code, &st.Referees, &st.ActiveReferees, &kcn, &ltc); err != nil {
+			return nil, err
+		}
+		st.Earned = map[string]float64{"kernelcoin": kcn, "litecoin": ltc}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// Payouts returns referral payouts newest first, to one referrer if userID is not 0
+func (rf *Referrals) Payouts(userID int, limit int) ([]*ReferralPayout, error) {
+	query := `
+		SELECT p.id, a.username, b.username, p.completion_id, p.coin, p.fee, p.amount, p.created_at
+		FROM referral_payouts p
+		JOIN users a ON a.id = p.referrer_id
+		JOIN users b ON b.id = p.referee_id`
+	args := []interface{}{}
+	if userID != 0 {
+		query += ` WHERE p.referrer_id = ?`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY p.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := rf.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := []*ReferralPayout{}
+	for rows.Next() {
+		p := &ReferralPayout{}
+		if err := rows.Scan(&p.ID, &p.Referrer, &p.Referee, &p.FillID, &p.Coin, &p.Fee, &p.Amount, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		if userID != 0 {
+			p.Referrer = ""
+		}
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+// referralLimit reads ?limit= for payout histories
+func referralLimit(r *http.Request) int {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	return limit
+}
+
+// handleReferral returns the logged in user's referral code and stats (GET), or
+// generates their code (POST)
+func (s *Server) handleReferral(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.referrals == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "The referral program is disabled"})
+		return
+	}
+
+	var stats []*ReferralStats
+	var err error
+	if r.Method == http.MethodPost {
+		s.mu.Lock()
+		_, err = s.referrals.CreateCode(session.UserID)
+		if err == nil {
+			stats, err = s.referrals.Stats(session.UserID, time.Now())
+		}
+		s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		stats, err = s.referrals.Stats(session.UserID, time.Now())
+		s.mu.RUnlock()
+	}
+	if err != nil || len(stats) != 1 {
+		log.Printf("[REFERRAL] Failed to load referral stats for user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load referral program"})
+		return
+	}
+
+	st := stats[0]
+	link := ""
+	if st.Code != "" {
+		link = strings.TrimRight(s.baseURL, "/") + "/?ref=" + st.Code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":            st.Code,
+		"link":            link,
+		"share":           s.referrals.share,
+		"period_days":     s.referrals.period.Hours() / 24,
+		"referees":        st.Referees,
+		"active_referees": st.ActiveReferees,
+		"earned":          st.Earned,
+	})
+}
+
+// handleReferralPayouts returns the logged in user's referral payouts, newest first (?limit=)
+func (s *Server) handleReferralPayouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.referrals == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "The referral program is disabled"})
+		return
+	}
+
+	s.mu.RLock()
+	payouts, err := s.referrals.Payouts(session.UserID, referralLimit(r))
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[REFERRAL] Failed to load payouts for user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load payouts"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"payouts": payouts})
+}
+
+// handleAdminReferrals lists every referrer and the latest payouts (?limit=)
+func (s *Server) handleAdminReferrals(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.referrals == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "The referral program is disabled"})
+		return
+	}
+
+	s.mu.RLock()
+	referrers, err := s.referrals.Stats(0, time.Now())
+	var payouts []*ReferralPayout
+	if err == nil {
+		payouts, err = s.referrals.Payouts(0, referralLimit(r))
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("[REFERRAL] Failed to load referral report: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load referrals"})
+		return
+	}
+
+	totals := map[string]float64{"kernelcoin": 0, "litecoin": 0}
+	for _, st := range referrers {
+		for coin, amount := range st.Earned {
+			totals[coin] += amount
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"share":       s.referrals.share,
+		"period_days": s.referrals.period.Hours() / 24,
+		"referrers":   referrers,
+		"payouts":     payouts,
+		"totals":      totals,
+	})
+}
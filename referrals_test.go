@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReferralsShareFees(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	ex.server.fees = NewFeeSchedule(db)
+	tiers, _ := ParseFeeTiers("0:0.001:0.002")
+	ex.server.fees.SetTiers(marketKCNLTC, tiers)
+	ex.server.referrals, _ = NewReferrals(db, 0.5, time.Hour)
+	ex.server.baseURL = "https://kcn.example"
+
+	alice := ex.newUser(t, "alice")
+	var referral struct {
+		Code     string             `json:"code"`
+		Link     string             `json:"link"`
+		Referees int                `json:"referees"`
+		Active   int                `json:"active_referees"`
+		Earned   map[string]float64 `json:"earned"`
+	}
+	alice.post("/api/referral", nil, &referral)
+	if len(referral.Code) != 8 || referral.Link != "https://kcn.example/?ref="+referral.Code {
+		t.Fatalf("referral = %+v", referral)
+	}
+	code := referral.Code
+	if alice.post("/api/referral", nil, &referral); referral.Code != code {
+		t.Errorf("code changed from %s to %s", code, referral.Code)
+	}
+
+	// Codes are not case sensitive; unknown ones are refused
+	carol := ex.newUserWith(t, "carol", map[string]interface{}{"referral_code": strings.ToLower(code)})
+	dave := ex.newUser(t, "dave")
+	var captcha struct {
+		CaptchaID string `json:"captcha_id"`
+	}
+	dave.get("/api/captcha/generate", &captcha)
+	resp := dave.call("/api/register", map[string]interface{}{
+		"username": "eve", "password": "password123", "referral_code": "NOPE2345",
+		"captcha_id": captcha.CaptchaID, "captcha_answer": map[string]string{"nonce": "1"},
+	})
+	if resp["error"] != "Unknown referral code" {
+		t.Errorf("register with an unknown code: %v", resp)
+	}
+
+	db.Exec(`UPDATE balances SET kernelcoin = 200, litecoin = 20`)
+	trade := func(maker, taker *testUser, kcn float64) {
+		t.Helper()
+		created := maker.call("/api/trade/create", map[string]interface{}{
+			"coin_selling": "kernelcoin", "amount_selling": kcn, "coin_buying": "litecoin", "amount_buying": kcn / 10,
+		})
+		if resp := taker.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": kcn}); resp["success"] != true {
+			t.Fatalf("execute: %v", resp)
+		}
+	}
+
+	// Carol pays 0.2 KCN taking 100 KCN and 0.001 LTC making 1 LTC; Alice gets half
+	trade(dave, carol, 100)
+	trade(carol, dave, 10)
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 200.1)
+	assertAmount(t, "alice LTC", alice.balance()["litecoin"], 20.0005)
+	revenue, _ := exchangeAccountBalances(db, feeAccount)
+	// Dave's fees, 0.01 LTC as maker and 0.02 KCN as taker, are not shared
+	assertAmount(t, "KCN fee revenue", revenue["kernelcoin"], 0.1+0.02)
+	assertAmount(t, "LTC fee revenue", revenue["litecoin"], 0.01+0.0005)
+
+	alice.get("/api/referral", &referral)
+	if referral.Referees != 1 || referral.Active != 1 {
+		t.Errorf("referral stats = %+v", referral)
+	}
+	assertAmount(t, "earned KCN", referral.Earned["kernelcoin"], 0.1)
+	assertAmount(t, "earned LTC", referral.Earned["litecoin"], 0.0005)
+
+	var payouts struct {
+		Payouts []ReferralPayout `json:"payouts"`
+	}
+	alice.get("/api/referral/payouts", &payouts)
+	if len(payouts.Payouts) != 2 || payouts.Payouts[0].Coin != "litecoin" || payouts.Payouts[1].Referee != "carol" ||
+		payouts.Payouts[1].Fee != 0.2 || payouts.Payouts[1].Referrer != "" {
+		t.Errorf("payouts = %+v", payouts.Payouts)
+	}
+
+	// After the period Carol's fees are the exchange's alone
+	db.Exec(`UPDATE users SET referred_at = datetime('now', '-2 hours') WHERE username = 'carol'`)
+	trade(dave, carol, 10)
+	alice.get("/api/referral", &referral)
+	if referral.Active != 0 {
+		t.Errorf("active referees after the period = %d", referral.Active)
+	}
+	assertAmount(t, "earned KCN after the period", referral.Earned["kernelcoin"], 0.1)
+
+	admin := ex.newUser(t, "admin")
+	var report struct {
+		Referrers []ReferralStats    `json:"referrers"`
+		Payouts   []ReferralPayout   `json:"payouts"`
+		Totals    map[string]float64 `json:"totals"`
+	}
+	admin.get("/api/admin/referrals", &report)
+	if len(report.Referrers) != 1 || report.Referrers[0].Username != "alice" || len(report.Payouts) != 2 || report.Payouts[0].Referrer != "alice" {
+		t.Errorf("admin report = %+v", report)
+	}
+	assertAmount(t, "total KCN paid", report.Totals["kernelcoin"], 0.1)
+}
@@ -6,10 +6,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -31,7 +31,7 @@ func isValidAlphanumeric(s string) bool {
 
 // getSession retrieves a session from a request
 func (s *Server) getSession(r *http.Request) *Session {
-	cookie, err := r.Cookie("session")
+	cookie, err := r.Cookie(s.cookies.SessionName())
 	if err != nil {
 		return nil
 	}
@@ -47,33 +47,87 @@ func (s *Server) getSession(r *http.Request) *Session {
 	return session
 }
 
-// RegisterRoutes sets up all HTTP routes
-func (s *Server) RegisterRoutes() {
-	http.HandleFunc("/", s.serveHTML)
-	http.HandleFunc("/api/captcha/generate", s.handleGenerateCaptcha)
-	http.HandleFunc("/api/register", s.handleRegister)
-	http.HandleFunc("/api/login", s.handleLogin)
-	http.HandleFunc("/api/logout", s.handleLogout)
-	http.HandleFunc("/api/session", s.handleCheckSession)
-	http.HandleFunc("/api/balance", s.handleGetBalance)
-	http.HandleFunc("/api/escrow", s.handleGetEscrow)
-	http.HandleFunc("/api/admin", s.handleGetAdminData)
-	http.HandleFunc("/api/trade/create", s.handleCreateTrade)
-	http.HandleFunc("/api/trade/list", s.handleListTrades)
-	http.HandleFunc("/api/trade/my-trades", s.handleGetUserTrades)
-	http.HandleFunc("/api/trade/execute", s.handleExecuteTrade)
-	http.HandleFunc("/api/trade/cancel", s.handleCancelTrade)
-	http.HandleFunc("/api/price-stats", s.handleGetPriceStats)
-	http.HandleFunc("/api/ltc-price", s.handleGetLtcPrice)
-	http.HandleFunc("/api/user", s.handleGetUser)
-	http.HandleFunc("/api/withdraw", s.handleWithdraw)
-	http.HandleFunc("/api/transactions", s.handleGetTransactions)
-	http.HandleFunc("/api/admin/stats", s.handleGetAdminStats)
-	http.HandleFunc("/api/change-password", s.handleChangePassword)
-	http.HandleFunc("/api/update-addresses", s.handleUpdateAddresses)
-	http.HandleFunc("/api/generate-receive-address", s.handleGenerateReceiveAddress)
-	http.HandleFunc("/api/check-confirmations", s.handleCheckConfirmations)
-	http.HandleFunc("/api/withdraw-fee", s.handleGetWithdrawFee)
+// handle registers an API route behind the rate limiter and CSRF check
+func (s *Server) handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	handler = s.csrfMiddleware(handler)
+	if s.rateLimiter != nil {
+		handler = s.rateLimiter.Middleware(pattern, s.sessionUser, handler)
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+// sessionUser identifies the user of a request's valid session to the rate limiter
+func (s *Server) sessionUser(r *http.Request) string {
+	if session := s.getSession(r); session != nil {
+		return strconv.Itoa(session.UserID)
+	}
+	return ""
+}
+
+// RegisterRoutes sets up all HTTP routes on mux
+func (s *Server) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/", s.serveHTML)
+	s.handle(mux, "/api/csrf", s.handleGetCSRFToken)
+	s.handle(mux, "/api/captcha/generate", s.handleGenerateCaptcha)
+	s.handle(mux, "/api/captcha/config", s.handleCaptchaConfig)
+	s.handle(mux, "/api/register", s.handleRegister)
+	s.handle(mux, "/api/login", s.handleLogin)
+	s.handle(mux, "/api/logout", s.handleLogout)
+	s.handle(mux, "/api/session", s.handleCheckSession)
+	s.handle(mux, "/api/balance", s.handleGetBalance)
+	s.handle(mux, "/api/escrow", s.handleGetEscrow)
+	s.handle(mux, "/api/admin", s.handleGetAdminData)
+	s.handle(mux, "/api/trade/create", s.handleCreateTrade)
+	s.handle(mux, "/api/trade/list", s.handleListTrades)
+	s.handle(mux, "/api/trade/my-trades", s.handleGetUserTrades)
+	s.handle(mux, "/api/trade/execute", s.handleExecuteTrade)
+	s.handle(mux, "/api/trade/cancel", s.handleCancelTrade)
+	s.handle(mux, "/api/trade/cancel-all", s.handleCancelAll)
+	s.handle(mux, "/api/trade/amend", s.handleAmendTrade)
+	s.handle(mux, "/api/trade/amendments", s.handleGetAmendments)
+	s.handle(mux, "/api/trade/batch/create", s.handleBatch("create"))
+	s.handle(mux, "/api/trade/batch/cancel", s.handleBatch("cancel"))
+	s.handle(mux, "/api/trade/batch/replace", s.handleBatch("replace"))
+	s.handle(mux, "/api/trade/heartbeat", s.handleHeartbeat)
+	s.handle(mux, "/api/price-stats", s.handleGetPriceStats)
+	s.handle(mux, "/api/ltc-price", s.handleGetLtcPrice)
+	s.handle(mux, "/api/user", s.handleGetUser)
+	s.handle(mux, "/api/withdraw", s.handleWithdraw)
+	s.handle(mux, "/api/transactions", s.handleGetTransactions)
+	s.handle(mux, "/api/admin/stats", s.handleGetAdminStats)
+	s.handle(mux, "/api/change-password", s.handleChangePassword)
+	s.handle(mux, "/api/password-reset/request", s.handleRequestPasswordReset)
+	s.handle(mux, "/api/password-reset/confirm", s.handleConfirmPasswordReset)
+	s.handle(mux, "/api/update-email", s.handleUpdateEmail)
+	s.handle(mux, "/api/update-addresses", s.handleUpdateAddresses)
+	s.handle(mux, "/api/generate-receive-address", s.handleGenerateReceiveAddress)
+	s.handle(mux, "/api/check-confirmations", s.handleCheckConfirmations)
+	s.handle(mux, "/api/withdraw-fee", s.handleGetWithdrawFee)
+	s.handle(mux, "/api/wallet-status", s.handleWalletStatus)
+	s.handle(mux, "/api/admin/health", s.handleAdminHealth)
+	s.handle(mux, "/api/admin/hot-wallet", s.handleAdminHotWallet)
+	s.handle(mux, "/api/admin/reconciliation", s.handleAdminReconciliation)
+	s.handle(mux, "/api/liabilities", s.handleGetLiabilities)
+	s.handle(mux, "/api/liabilities/proof", s.handleGetLiabilityProof)
+	s.handle(mux, "/api/admin/liabilities", s.handleAdminLiabilities)
+	s.handle(mux, "/api/admin/faucet", s.handleAdminFaucet)
+	s.handle(mux, "/ws", s.handleFeed)
+	s.handle(mux, "/api/orderbook", s.handleGetOrderBook)
+	s.handle(mux, "/api/candles", s.handleGetCandles)
+	s.handle(mux, "/api/ticker", s.handleGetTicker)
+	s.handle(mux, "/api/prices", s.handleGetPrices)
+	s.handle(mux, "/api/prices/history", s.handleGetPriceHistory)
+	s.handle(mux, "/api/fees", s.handleGetFees)
+	s.handle(mux, "/api/admin/fees", s.handleAdminFees)
+	s.handle(mux, "/api/referral", s.handleReferral)
+	s.handle(mux, "/api/referral/payouts", s.handleReferralPayouts)
+	s.handle(mux, "/api/admin/referrals", s.handleAdminReferrals)
+	s.handle(mux, "/api/admin/user-role", s.handleAdminUserRole)
+	s.handle(mux, "/api/markets", s.handleGetMarkets)
+	s.handle(mux, "/api/v1/summary", publicAPI(summaryMaxAge, s.handleAggregatorSummary))
+	s.handle(mux, "/api/v1/ticker", publicAPI(summaryMaxAge, s.handleAggregatorTicker))
+	s.handle(mux, "/api/v1/orderbook/{pair}", publicAPI(orderbookMaxAge, s.handleAggregatorOrderBook))
+	s.handle(mux, "/api/v1/trades/{pair}", publicAPI(tradesMaxAge, s.handleAggregatorTrades))
 }
 
 // handleGenerateCaptcha generates a new captcha
@@ -83,7 +137,13 @@ func (s *Server) handleGenerateCaptcha(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	captchaResp, err := s.captchaService.GenerateCaptcha()
+	captchaResp, err := s.captchaService.GenerateCaptcha(clientIP(r, s.trustProxy))
+	if err == errCaptchaLimit || err == errCaptchaLocked {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many captcha requests, try again later"})
+		return
+	}
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate captcha"})
@@ -94,6 +154,22 @@ func (s *Server) handleGenerateCaptcha(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(captchaResp)
 }
 
+// handleCaptchaConfig tells the client which captcha is in use and where it is required
+func (s *Server) handleCaptchaConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":     s.captchaService.Kind(),
+		"register": true,
+		"login":    s.captchaOnLogin,
+		"withdraw": s.captchaOnWithdraw,
+	})
+}
+
+// checkCaptcha validates the captcha fields of a request
+func (s *Server) checkCaptcha(r *http.Request, fields CaptchaFields) bool {
+	return s.captchaService.ValidateCaptcha(fields.CaptchaID, clientIP(r, s.trustProxy), fields.answer())
+}
+
 // handleRegister handles user registration
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -102,11 +178,11 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Username  string `json:"username"`
-		Password  string `json:"password"`
-		CaptchaID string `json:"captcha_id"`
-		CaptchaX  int    `json:"captcha_x"`
-		CaptchaY  int    `json:"captcha_y"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+		Referral string `json:"referral_code"`
+		CaptchaFields
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -116,8 +192,8 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate captcha first
-	log.Printf("[REGISTER] Received captcha validation request - ID: %s, Position: (%d, %d)", req.CaptchaID, req.CaptchaX, req.CaptchaY)
-	if !s.captchaService.ValidateCaptcha(req.CaptchaID, req.CaptchaX, req.CaptchaY) {
+	log.Printf("[REGISTER] Received captcha validation request - ID: %s", req.CaptchaID)
+	if !s.checkCaptcha(r, req.CaptchaFields) {
 		log.Printf("[REGISTER] Captcha validation failed for ID: %s", req.CaptchaID)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid captcha"})
@@ -145,9 +221,51 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	email := strings.TrimSpace(req.Email)
+	if email != "" && !isValidEmail(email) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid email address"})
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// An unknown code is more likely a typo than something to ignore
+	referrerID := 0
+	if code := strings.TrimSpace(req.Referral); code != "" && s.referrals != nil {
+		id, ok, err := s.referrals.Lookup(code)
+		if err != nil {
+			log.Printf("[REGISTER] Failed to look up referral code: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Registration failed"})
+			return
+		}
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unknown referral code"})
+			return
+		}
+		referrerID = id
+	}
+
+	// Checked before the account exists, so a clash fails the whole registration
+	if email != "" {
+		var taken int
+		err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ?`, email).Scan(&taken)
+		if err != nil {
+			log.Printf("[REGISTER] Failed to check recovery email: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Registration failed"})
+			return
+		}
+		if taken > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Email is already in use by another user"})
+			return
+		}
+	}
+
 	passwordHash, err := hashPassword(req.Password)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -155,7 +273,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = s.createUser(req.Username, passwordHash)
+	userID, err := s.createUser(req.Username, passwordHash)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
 			w.Header().Set("Content-Type", "application/json")
@@ -167,6 +285,20 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if email != "" {
+		if _, err := s.db.Exec(`UPDATE users SET email = ? WHERE id = ?`, email, userID); err != nil {
+			log.Printf("[REGISTER] Failed to store recovery email for user %d: %v", userID, err)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Account created, but the recovery email could not be saved; set it again after logging in"})
+			return
+		}
+	}
+	if referrerID != 0 {
+		if err := s.referrals.Refer(userID, referrerID); err != nil {
+			log.Printf("[REGISTER] Failed to record referral of user %d: %v", userID, err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -184,6 +316,7 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		CaptchaFields
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -192,18 +325,43 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// No captcha validation for login
+	if s.captchaOnLogin && !s.checkCaptcha(r, req.CaptchaFields) {
+		log.Printf("[LOGIN] Captcha validation failed for ID: %s", req.CaptchaID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid captcha"})
+		return
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	user, err := s.getUserByUsername(req.Username)
-	if err != nil || !verifyPassword(req.Password, user.PasswordHash) {
+	if err != nil {
+		// Spend the same time hashing as a real check so unknown usernames are not revealed
+		verifyPassword(req.Password, dummyPasswordHash())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+		return
+	}
+
+	match, needsRehash := verifyPassword(req.Password, user.PasswordHash)
+	if !match {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
 		return
 	}
 
+	// Transparently upgrade hashes created with an older format or weaker parameters
+	if needsRehash {
+		if newHash, err := hashPassword(req.Password); err == nil {
+			if _, err := s.db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, newHash, user.ID); err != nil {
+				log.Printf("[LOGIN] Failed to upgrade password hash for user %d: %v", user.ID, err)
+			} else {
+				log.Printf("[LOGIN] Upgraded password hash for user %d", user.ID)
+			}
+		}
+	}
+
 	// Create session
 	token, _ := generateSessionToken()
 	s.sessions[token] = &Session{
@@ -212,13 +370,12 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Expiry:   time.Now().Add(24 * time.Hour),
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		Expires:  time.Now().Add(24 * time.Hour),
-	})
+	s.setSessionCookie(w, token, time.Now().Add(24*time.Hour))
+
+	// Rotate the CSRF token so a token planted before login cannot be reused
+	if _, err := s.issueCSRFToken(w); err != nil {
+		log.Printf("[CSRF] Failed to rotate token at login: %v", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -235,19 +392,14 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, _ := r.Cookie("session")
+	cookie, _ := r.Cookie(s.cookies.SessionName())
 	if cookie != nil {
 		s.mu.Lock()
 		delete(s.sessions, cookie.Value)
 		s.mu.Unlock()
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
+	s.clearSessionCookie(w)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
@@ -295,33 +447,21 @@ func (s *Server) handleGetBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate reserved amounts from open trades
-	var ltcReserved, kcnReserved float64
-	rows, err := s.db.Query(`
-		SELECT coin_selling, amount_selling FROM trades 
-		WHERE seller_id = ? AND status = 'open'
-	`, session.UserID)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var coin string
-			var amount float64
-			if rows.Scan(&coin, &amount) == nil {
-				if coin == "litecoin" {
-					ltcReserved += amount
-				} else {
-					kcnReserved += amount
-				}
-			}
-		}
+	// Reserved amounts are what open orders still hold in escrow
+	reserved, err := s.getReserved(session.UserID)
+	if err != nil {
+		log.Printf("[API] Failed to sum open orders of user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load balance"})
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]float64{
 		"litecoin":     balance.Litecoin,
 		"kernelcoin":   balance.Kernelcoin,
-		"ltc_reserved":  ltcReserved,
-		"kcn_reserved":  kcnReserved,
+		"ltc_reserved": reserved["litecoin"],
+		"kcn_reserved": reserved["kernelcoin"],
 	})
 }
 
@@ -391,12 +531,31 @@ func (s *Server) handleCreateTrade(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Check active trades limit
+	if err := s.checkOrder(req.CoinSelling, req.AmountSelling, req.CoinBuying, req.AmountBuying); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	// Check active trades limit for the user's role
 	var activeTradesCount int
 	err := s.db.QueryRow(`SELECT COUNT(*) FROM trades WHERE seller_id = ? AND status = 'open'`, session.UserID).Scan(&activeTradesCount)
-	if err == nil && activeTradesCount >= 10 {
+	var limit int
+	if err == nil {
+		limit, err = s.openOrderLimit(session.UserID)
+	}
+	if err != nil {
+		log.Printf("[TRADE] Failed to check the open order limit for user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create trade"})
+		return
+	}
+	if activeTradesCount >= limit {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"error": "Maximum of 10 active trades allowed per account"})
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Maximum of %d active trades allowed per account", limit),
+			"code":  errOrderLimit,
+		})
 		return
 	}
 
@@ -502,6 +661,7 @@ func (s *Server) handleExecuteTrade(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
 			"error":   err.Error(),
+			"code":    errorCode(err),
 		})
 		return
 	}
@@ -567,128 +727,6 @@ func (s *Server) handleGetPriceStats(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleGetLtcPrice gets the current LTC price
-func (s *Server) handleGetLtcPrice(w http.ResponseWriter, r *http.Request) {
-	s.mu.RLock()
-	// Check if cache is still valid
-	if time.Now().Before(s.ltcPriceCacheExpiry) && s.ltcPriceCache > 0 {
-		cachedPrice := s.ltcPriceCache
-		s.mu.RUnlock()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"ltc_usd": cachedPrice,
-		})
-		return
-	}
-	lastPrice := s.ltcPriceCache
-	s.mu.RUnlock()
-
-	// Fetch LTC price from CoinGecko API
-	resp, err := http.Get("https://api.coingecko.com/api/v3/simple/price?ids=litecoin&vs_currencies=usd")
-	if err != nil {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to fetch price"})
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("API returned status %d", resp.StatusCode)})
-		return
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to read response"})
-		return
-	}
-
-	var data map[string]interface{}
-	if err := json.Unmarshal(body, &data); err != nil {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to parse response"})
-		return
-	}
-
-	litecoinData, ok := data["litecoin"]
-	if !ok {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Litecoin data not found"})
-		return
-	}
-
-	litecoinMap, ok := litecoinData.(map[string]interface{})
-	if !ok {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid response format"})
-		return
-	}
-
-	usdPrice, ok := litecoinMap["usd"]
-	if !ok {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "USD price not found"})
-		return
-	}
-
-	ltcPrice, ok := usdPrice.(float64)
-	if !ok {
-		if lastPrice > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": lastPrice})
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid price format"})
-		return
-	}
-
-	s.mu.Lock()
-	s.ltcPriceCache = ltcPrice
-	s.ltcPriceCacheExpiry = time.Now().Add(5 * time.Minute)
-	s.mu.Unlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"ltc_usd": ltcPrice})
-}
-
 // handleGetUser gets user information including addresses
 func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	session := s.getSession(r)
@@ -702,23 +740,30 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
 
 	var ltcAddr, kcnAddr sql.NullString
 	var ltcReceiveAddr, kcnReceiveAddr sql.NullString
-	err := s.db.QueryRow(`SELECT litecoin_address, kernelcoin_address, litecoin_receive_address, kernelcoin_receive_address FROM users WHERE id = ?`, session.UserID).
-		Scan(&ltcAddr, &kcnAddr, &ltcReceiveAddr, &kcnReceiveAddr)
+	var email sql.NullString
+	err := s.db.QueryRow(`SELECT litecoin_address, kernelcoin_address, litecoin_receive_address, kernelcoin_receive_address, email FROM users WHERE id = ?`, session.UserID).
+		Scan(&ltcAddr, &kcnAddr, &ltcReceiveAddr, &kcnReceiveAddr, &email)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
 		return
 	}
 
+	resp := map[string]interface{}{
+		"user_id":                    session.UserID,
+		"username":                   session.Username,
+		"litecoin_address":           ltcAddr.String,
+		"kernelcoin_address":         kcnAddr.String,
+		"litecoin_receive_address":   ltcReceiveAddr.String,
+		"kernelcoin_receive_address": kcnReceiveAddr.String,
+		"email":                      email.String,
+	}
+	if until, frozen := s.withdrawalsFrozenUntil(session.UserID); frozen {
+		resp["withdrawals_frozen_until"] = until.Format(time.RFC3339)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"user_id":                     session.UserID,
-		"username":                    session.Username,
-		"litecoin_address":            ltcAddr.String,
-		"kernelcoin_address":          kcnAddr.String,
-		"litecoin_receive_address":    ltcReceiveAddr.String,
-		"kernelcoin_receive_address":  kcnReceiveAddr.String,
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 // handleWithdraw handles withdrawal requests
@@ -732,6 +777,7 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Coin   string  `json:"coin"`
 		Amount float64 `json:"amount"`
+		CaptchaFields
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -740,6 +786,26 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.captchaOnWithdraw && !s.checkCaptcha(r, req.CaptchaFields) {
+		log.Printf("[WITHDRAW] Captcha validation failed for ID: %s", req.CaptchaID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid captcha"})
+		return
+	}
+
+	asset, ok := s.assets[req.Coin]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported coin: " + req.Coin})
+		return
+	}
+
+	if reason, paused := s.coinPaused(asset.Name); paused {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": asset.Symbol + " withdrawals are temporarily paused: " + reason})
+		return
+	}
+
 	// Check minimum withdrawal amount
 	if req.Amount < 0.001 {
 		w.Header().Set("Content-Type", "application/json")
@@ -747,9 +813,20 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The sweeper cannot work out the hot wallet's excess until this withdrawal is
+	// recorded and sent
+	asset.sendMu.Lock()
+	defer asset.sendMu.Unlock()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if until, frozen := s.withdrawalsFrozenUntil(session.UserID); frozen {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Withdrawals are disabled until " + until.Format("2006-01-02 15:04 MST") + " after a password reset"})
+		return
+	}
+
 	balance, err := s.getUserBalance(session.UserID)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -757,20 +834,6 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate reserved amounts
-	var reserved float64
-	rows, err := s.db.Query(`SELECT coin_selling, amount_selling FROM trades WHERE seller_id = ? AND status = 'open'`, session.UserID)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var coin string
-			var amount float64
-			if rows.Scan(&coin, &amount) == nil && coin == req.Coin {
-				reserved += amount
-			}
-		}
-	}
-
 	var userBalance float64
 	if req.Coin == "litecoin" {
 		userBalance = balance.Litecoin
@@ -778,14 +841,7 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 		userBalance = balance.Kernelcoin
 	}
 
-	availableBalance := userBalance - reserved
-	if availableBalance < req.Amount {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient available balance"})
-		return
-	}
-
-	// Check if user has enough total balance (including reserved)
+	// Open orders' escrow was taken out of the balance when they were placed
 	if userBalance < req.Amount {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient balance"})
@@ -804,77 +860,75 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 
 	address := withdrawalAddr.String
 
-	// Handle withdrawals via RPC/Electrum for supported coins
-	if !s.noWallets && (req.Coin == "kernelcoin" || req.Coin == "litecoin") {
-		var txid string
-		if req.Coin == "kernelcoin" {
-			// Send via RPC
-			txid, err = s.kernelcoinRPCClient.SendToAddress(address, req.Amount)
-			if err != nil {
-				log.Printf("[API] Failed to send %s via RPC: %v", req.Coin, err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to send transaction"})
-				return
-			}
-		} else {
-			// Send via Electrum
-			txid, err = s.electrumClient.PayTo(address, req.Amount)
-			if err != nil {
-				log.Printf("[API] Failed to send %s via Electrum: %v", req.Coin, err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to send transaction"})
-				return
-			}
-		}
-
-		// Subtract from balance
-		_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s - ? WHERE user_id = ?`, req.Coin, req.Coin), req.Amount, session.UserID)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update balance"})
-			return
+	// Reserve the amount: debit it and record the withdrawal as pending, so the
+	// balance cannot be spent twice while the wallet is sending without the lock
+	if err := adjustBalance(s.db, session.UserID, asset.Name, -req.Amount); err != nil {
+		log.Printf("[WITHDRAW] Failed to debit user %d: %v", session.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update balance"})
+		return
+	}
+	result, err := s.db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status) VALUES (?, ?, ?, 'withdraw', 'pending')`, session.UserID, req.Coin, req.Amount)
+	var withdrawalID int64
+	if err == nil {
+		withdrawalID, err = result.LastInsertId()
+	}
+	if err != nil {
+		log.Printf("[WITHDRAW] Failed to record withdrawal for user %d: %v", session.UserID, err)
+		if err := adjustBalance(s.db, session.UserID, asset.Name, req.Amount); err != nil {
+			log.Printf("[WITHDRAW] Failed to refund %.8f %s to user %d: %v", req.Amount, asset.Symbol, session.UserID, err)
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to record withdrawal"})
+		return
+	}
+	s.mu.Unlock()
 
-		// Log transaction with txid
-		_, err = s.db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status, tx_hash) VALUES (?, ?, ?, 'withdraw', 'completed', ?)`, session.UserID, req.Coin, req.Amount, txid)
-		if err != nil {
-			log.Printf("Failed to log withdrawal transaction: %v", err)
-		}
+	txid, sendErr := asset.Wallet.Send(address, req.Amount)
 
-		log.Printf("[WITHDRAW] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | TxHash: %s | Status: SENT", session.Username, session.UserID, strings.ToUpper(req.Coin), req.Amount, address, txid)
+	s.mu.Lock()
+	if sendErr != nil && sendOutcomeUnknown(sendErr) {
+		// The wallet may have broadcast the payment, so the user stays debited and the
+		// withdrawal stays pending for an operator to check rather than letting them withdraw twice
+		log.Printf("[WITHDRAW] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | Status: UNKNOWN (%v) - check the wallet before retrying", session.Username, session.UserID, asset.Symbol, req.Amount, address, sendErr)
+		s.publishTransfer(session.UserID, "withdrawal", asset.Name, req.Amount, "pending", "")
+		s.publishBalance(session.UserID)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": true,
-			"message": "Withdrawal sent",
-			"txid":    txid,
+			"message": "Withdrawal submitted, but the wallet did not confirm it. It will be checked manually.",
 		})
-	} else if s.noWallets {
-		// Fallback behavior when --no-wallets is used
-		_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s - ? WHERE user_id = ?`, req.Coin, req.Coin), req.Amount, session.UserID)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update balance"})
-			return
+		return
+	}
+	if sendErr != nil {
+		log.Printf("[API] Failed to send %s: %v", req.Coin, sendErr)
+		if err := adjustBalance(s.db, session.UserID, asset.Name, req.Amount); err != nil {
+			// Left pending so the operator sees the user is owed the amount
+			log.Printf("[WITHDRAW] Failed to refund %.8f %s to user %d after a failed send: %v", req.Amount, asset.Symbol, session.UserID, err)
+		} else if _, err := s.db.Exec(`UPDATE transactions SET status = 'failed' WHERE id = ?`, withdrawalID); err != nil {
+			log.Printf("[WITHDRAW] Failed to mark withdrawal %d as failed: %v", withdrawalID, err)
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": asset.userError(sendErr, "Failed to send transaction")})
+		return
+	}
 
-		_, err = s.db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status) VALUES (?, ?, ?, 'withdraw', 'completed')`, session.UserID, req.Coin, req.Amount)
-		if err != nil {
-			log.Printf("Failed to log withdrawal transaction: %v", err)
-		}
+	if _, err := s.db.Exec(`UPDATE transactions SET status = 'completed', tx_hash = ? WHERE id = ?`, txid, withdrawalID); err != nil {
+		// The coins were sent; the withdrawal stays pending until an operator records the txid
+		log.Printf("[WITHDRAW] Failed to record txid %s for withdrawal %d: %v", txid, withdrawalID, err)
+	}
 
-		log.Printf("[WITHDRAW] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | Status: FALLBACK_SENT", session.Username, session.UserID, strings.ToUpper(req.Coin), req.Amount, address)
+	log.Printf("[WITHDRAW] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | TxHash: %s | Status: SENT", session.Username, session.UserID, asset.Symbol, req.Amount, address, txid)
+	s.publishTransfer(session.UserID, "withdrawal", asset.Name, req.Amount, "completed", txid)
+	s.publishBalance(session.UserID)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"message": "Withdrawal request submitted",
-		})
-	} else {
-		// Wallet integration required but not available
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"error": "Wallet integration required for " + req.Coin})
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Withdrawal sent",
+		"txid":    txid,
+	})
 }
 
 // handleGetTransactions gets user transaction history
@@ -994,7 +1048,7 @@ func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify current password
-	if !verifyPassword(req.CurrentPassword, user.PasswordHash) {
+	if match, _ := verifyPassword(req.CurrentPassword, user.PasswordHash); !match {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Current password is incorrect"})
 		return
@@ -1016,6 +1070,9 @@ func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Outstanding reset links were issued for the old password
+	s.db.Exec(`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL`, session.UserID)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 }
@@ -1054,6 +1111,11 @@ func (s *Server) handleUpdateAddresses(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "Litecoin address must be alphanumeric and less than 64 characters"})
 			return
 		}
+		if msg := s.checkAddressNetwork("litecoin", req.LitecoinAddress); msg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
 		// Check if address is already in use
 		var existingUserID int
 		err := s.db.QueryRow(`SELECT id FROM users WHERE litecoin_address = ? AND id != ?`, req.LitecoinAddress, session.UserID).Scan(&existingUserID)
@@ -1077,6 +1139,11 @@ func (s *Server) handleUpdateAddresses(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "Kernelcoin address must be alphanumeric and less than 64 characters"})
 			return
 		}
+		if msg := s.checkAddressNetwork("kernelcoin", req.KernelcoinAddress); msg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
 		// Check if address is already in use
 		var existingUserID int
 		err := s.db.QueryRow(`SELECT id FROM users WHERE kernelcoin_address = ? AND id != ?`, req.KernelcoinAddress, session.UserID).Scan(&existingUserID)
@@ -1098,6 +1165,24 @@ func (s *Server) handleUpdateAddresses(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 }
 
+// checkAddressNetwork asks the coin's wallet backend whether an address is valid,
+// returning an error message for the user or "" if it is
+func (s *Server) checkAddressNetwork(coin, address string) string {
+	asset, ok := s.assets[coin]
+	if !ok {
+		return ""
+	}
+	valid, err := asset.Wallet.ValidateAddress(address)
+	if err != nil {
+		log.Printf("[ADDRESS] Failed to validate %s address %s: %v", asset.Symbol, address, err)
+		return asset.userError(err, "Could not validate "+coin+" address, please try again later")
+	}
+	if !valid {
+		return "Not a valid " + coin + " address"
+	}
+	return ""
+}
+
 // handleGenerateReceiveAddress generates a receive address for a coin
 func (s *Server) handleGenerateReceiveAddress(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -1121,13 +1206,25 @@ func (s *Server) handleGenerateReceiveAddress(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	asset, ok := s.assets[req.Coin]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported coin: " + req.Coin})
+		return
+	}
+
+	if reason, paused := s.coinPaused(asset.Name); paused {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": asset.Symbol + " deposits are temporarily paused: " + reason})
+		return
+	}
 
-	// Check if address already exists
+	// The wallet is asked for an address without holding s.mu
+	s.mu.RLock()
 	var existingAddr sql.NullString
 	column := req.Coin + "_receive_address"
 	err := s.db.QueryRow(fmt.Sprintf(`SELECT %s FROM users WHERE id = ?`, column), session.UserID).Scan(&existingAddr)
+	s.mu.RUnlock()
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to check existing address"})
@@ -1140,52 +1237,31 @@ func (s *Server) handleGenerateReceiveAddress(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// Generate address using RPC wallet for supported coins, or random for fallback
-	var address string
-	if !s.noWallets {
-		if req.Coin == "kernelcoin" {
-			// Use RPC wallet to generate real kernelcoin address
-			address, err = s.kernelcoinRPCClient.GetNewAddress("", "legacy")
-			if err != nil {
-				log.Printf("[API] Failed to generate kernelcoin address via RPC: %v", err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate kernelcoin address"})
-				return
-			}
-		} else if req.Coin == "litecoin" {
-			// Use Electrum to generate real litecoin address
-			address, err = s.electrumClient.CreateNewAddress()
-			if err != nil {
-				log.Printf("[API] Failed to generate litecoin address via Electrum: %v", err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate litecoin address"})
-				return
-			}
-		} else {
-			// Unsupported coin
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported coin: " + req.Coin})
-			return
-		}
-	} else {
-		// Generate random address (fallback when --no-wallets is used)
-		address, err = generateSessionToken()
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate address"})
-			return
-		}
+	// Generate address from the coin's wallet backend
+	address, err := asset.Wallet.NewAddress()
+	if err != nil {
+		log.Printf("[API] Failed to generate %s address: %v", req.Coin, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": asset.userError(err, "Failed to generate "+req.Coin+" address")})
+		return
 	}
 
-	// Store in database
-	_, err = s.db.Exec(fmt.Sprintf(`UPDATE users SET %s = ? WHERE id = ?`, column), address, session.UserID)
+	// Store in database, unless a concurrent request stored one first
+	s.mu.Lock()
+	result, err := s.db.Exec(fmt.Sprintf(`UPDATE users SET %s = ? WHERE id = ? AND (%s IS NULL OR %s = '')`, column, column, column), address, session.UserID)
+	s.mu.Unlock()
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
 		return
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Receive address already exists"})
+		return
+	}
 
-	log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Generated receive address: %s", session.Username, session.UserID, strings.ToUpper(req.Coin), address)
+	log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Generated receive address: %s", session.Username, session.UserID, asset.Symbol, address)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
@@ -1214,13 +1290,25 @@ func (s *Server) handleCheckConfirmations(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	asset, ok := s.assets[req.Coin]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported coin: " + req.Coin})
+		return
+	}
 
-	// Check if receive address exists
+	if reason, paused := s.coinPaused(asset.Name); paused {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": asset.Symbol + " deposits are temporarily paused: " + reason})
+		return
+	}
+
+	// The wallet is asked about the address without holding s.mu
+	s.mu.RLock()
 	var receiveAddr sql.NullString
 	column := req.Coin + "_receive_address"
 	err := s.db.QueryRow(fmt.Sprintf(`SELECT %s FROM users WHERE id = ?`, column), session.UserID).Scan(&receiveAddr)
+	s.mu.RUnlock()
 	if err != nil || !receiveAddr.Valid || receiveAddr.String == "" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"error": "No receive address found"})
@@ -1229,152 +1317,85 @@ func (s *Server) handleCheckConfirmations(w http.ResponseWriter, r *http.Request
 
 	address := receiveAddr.String
 
-	// Check for transactions using RPC for supported coins (unless --no-wallets is used)
-	if !s.noWallets && (req.Coin == "kernelcoin" || req.Coin == "litecoin") {
-		var rpcClient *CoinRPCClient
-		var coinSymbol string
-		var confirmedAmount, unconfirmedAmount, pendingAmount float64
-		var txHash string
-
-		if req.Coin == "kernelcoin" {
-			rpcClient = s.kernelcoinRPCClient
-			coinSymbol = "KCN"
-			// Check confirmed transactions (2+ confirmations)
-			confirmedAmount, err = rpcClient.GetReceivedByAddress(address, 2)
-			if err != nil {
-				log.Printf("[API] Failed to check confirmed transactions: %v", err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to check transactions"})
-				return
-			}
-			// Check unconfirmed transactions (0+ confirmations)
-			unconfirmedAmount, err = rpcClient.GetReceivedByAddress(address, 0)
-			if err != nil {
-				log.Printf("[API] Failed to check unconfirmed transactions: %v", err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to check transactions"})
-				return
+	transfers, err := asset.Wallet.IncomingTransfers(address)
+	if err != nil {
+		log.Printf("[API] Failed to check %s transactions: %v", req.Coin, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": asset.userError(err, "Failed to check transactions")})
+		return
+	}
+
+	var confirmedAmount, pendingAmount float64
+	var txHash string
+	for _, transfer := range transfers {
+		if transfer.Confirmations >= asset.Confirmations {
+			confirmedAmount += transfer.Amount
+			if txHash == "" {
+				txHash = transfer.TxID
 			}
-			pendingAmount = unconfirmedAmount - confirmedAmount
 		} else {
-			coinSymbol = "LTC"
-			// Use Electrum for Litecoin
-			confirmedAmount, unconfirmedAmount, err = s.electrumClient.GetAddressBalance(address)
-			if err != nil {
-				log.Printf("[API] Failed to check Litecoin balance: %v", err)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to check transactions"})
-				return
-			}
-			pendingAmount = unconfirmedAmount
+			pendingAmount += transfer.Amount
 		}
+	}
 
-		if confirmedAmount > 0 {
-			// Get transaction details to find txid
-			if req.Coin == "kernelcoin" {
-				txList, err := rpcClient.ListReceivedByAddress(2, false, false)
-				if err == nil {
-					for _, tx := range txList {
-						if txMap, ok := tx.(map[string]interface{}); ok {
-							if addr, ok := txMap["address"].(string); ok && addr == address {
-								if txids, ok := txMap["txids"].([]interface{}); ok && len(txids) > 0 {
-									if txid, ok := txids[0].(string); ok {
-										txHash = txid
-										break
-									}
-								}
-							}
-						}
-					}
-				}
-			} else {
-				// Get transaction hash from Electrum history
-				history, err := s.electrumClient.GetAddressHistory(address)
-				if err == nil && len(history) > 0 {
-					if txHashVal, ok := history[0]["tx_hash"]; ok {
-						if hash, ok := txHashVal.(string); ok {
-							txHash = hash
-						}
-					}
-				}
-			}
-
-			// Add confirmed amount to balance
-			_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s + ? WHERE user_id = ?`, req.Coin, req.Coin), confirmedAmount, session.UserID)
-			if err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update balance"})
-				return
-			}
-
-			// Log transaction with hash
-			_, err = s.db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status, tx_hash) VALUES (?, ?, ?, 'deposit', 'confirmed', ?)`, session.UserID, req.Coin, confirmedAmount, txHash)
-			if err != nil {
-				log.Printf("Failed to log deposit transaction: %v", err)
-			}
-
-			log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | TxHash: %s | Status: CONFIRMED", session.Username, session.UserID, strings.ToUpper(req.Coin), confirmedAmount, address, txHash)
-
-			// Clear receive address
-			_, err = s.db.Exec(fmt.Sprintf(`UPDATE users SET %s = NULL WHERE id = ?`, column), session.UserID)
-			if err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to clear receive address"})
-				return
-			}
+	if confirmedAmount > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
 
+		// Clear the receive address first; if a concurrent check already cleared it,
+		// that check credited these coins
+		result, err := s.db.Exec(fmt.Sprintf(`UPDATE users SET %s = NULL WHERE id = ? AND %s = ?`, column, column), session.UserID, address)
+		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": true,
-				"message": fmt.Sprintf("Received %.8f %s (confirmed)", confirmedAmount, coinSymbol),
-				"amount":  confirmedAmount,
-				"status":  "confirmed",
-			})
-			return
-		} else if pendingAmount > 0 {
-			log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | Status: PENDING", session.Username, session.UserID, strings.ToUpper(req.Coin), pendingAmount, address)
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"message": fmt.Sprintf("%.8f %s pending confirmation", pendingAmount, coinSymbol),
-				"amount":  pendingAmount,
-				"status":  "pending",
-			})
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to clear receive address"})
 			return
-		} else {
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"error": "No transactions found for this address"})
+			json.NewEncoder(w).Encode(map[string]string{"error": "No receive address found"})
 			return
 		}
-	} else if s.noWallets {
-		// Fallback behavior when --no-wallets is used (add 50 coins)
-		_, err = s.db.Exec(fmt.Sprintf(`UPDATE balances SET %s = %s + 50 WHERE user_id = ?`, req.Coin, req.Coin), session.UserID)
-		if err != nil {
+
+		// Add confirmed amount to balance
+		if err := adjustBalance(s.db, session.UserID, asset.Name, confirmedAmount); err != nil {
+			log.Printf("[DEPOSIT] Failed to credit %.8f %s to user %d from %s: %v", confirmedAmount, asset.Symbol, session.UserID, address, err)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update balance"})
 			return
 		}
 
-		_, err = s.db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status) VALUES (?, ?, 50, 'deposit', 'confirmed')`, session.UserID, req.Coin)
+		// Log transaction with hash
+		_, err = s.db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status, tx_hash) VALUES (?, ?, ?, 'deposit', 'confirmed', ?)`, session.UserID, req.Coin, confirmedAmount, txHash)
 		if err != nil {
 			log.Printf("Failed to log deposit transaction: %v", err)
 		}
 
-		log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Amount: 50.00000000 | Address: %s | Status: FALLBACK_CONFIRMED", session.Username, session.UserID, strings.ToUpper(req.Coin), address)
-
-		_, err = s.db.Exec(fmt.Sprintf(`UPDATE users SET %s = NULL WHERE id = ?`, column), session.UserID)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to clear receive address"})
-			return
-		}
+		log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | TxHash: %s | Status: CONFIRMED", session.Username, session.UserID, asset.Symbol, confirmedAmount, address, txHash)
+		s.publishTransfer(session.UserID, "deposit", asset.Name, confirmedAmount, "confirmed", txHash)
+		s.publishBalance(session.UserID)
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Received %.8f %s (confirmed)", confirmedAmount, asset.Symbol),
+			"amount":  confirmedAmount,
+			"status":  "confirmed",
+		})
+	} else if pendingAmount > 0 {
+		log.Printf("[DEPOSIT] User: %s (ID:%d) | Coin: %s | Amount: %.8f | Address: %s | Status: PENDING", session.Username, session.UserID, asset.Symbol, pendingAmount, address)
+		s.mu.Lock()
+		s.publishTransfer(session.UserID, "deposit", asset.Name, pendingAmount, "pending", "")
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("%.8f %s pending confirmation", pendingAmount, asset.Symbol),
+			"amount":  pendingAmount,
+			"status":  "pending",
+		})
 	} else {
-		// Wallet integration required but not available
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"error": "Wallet integration required for " + req.Coin})
+		json.NewEncoder(w).Encode(map[string]string{"error": "No transactions found for this address"})
 	}
 }
 
@@ -1411,15 +1432,20 @@ func (s *Server) serveHTML(w http.ResponseWriter, r *http.Request) {
 
 // handleGetWithdrawFee returns the current withdrawal fee in LTC and USD
 func (s *Server) handleGetWithdrawFee(w http.ResponseWriter, r *http.Request) {
-	s.mu.RLock()
-	ltcPrice := s.ltcPriceCache
-	s.mu.RUnlock()
-	
-	feeUSD := s.ltcWithdrawFee * ltcPrice
-	
+	ltcPrice := s.ltcPrice("usd")
+
+	fee := s.ltcWithdrawFee
+	if asset, ok := s.assets["litecoin"]; ok {
+		if estimate, err := asset.Wallet.EstimateFee(); err == nil {
+			fee = estimate
+		}
+	}
+
+	feeUSD := fee * ltcPrice
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"ltc_withdraw_fee": s.ltcWithdrawFee,
+		"ltc_withdraw_fee":     fee,
 		"ltc_withdraw_fee_usd": feeUSD,
 	})
 }
@@ -2,22 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os/exec"
-	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // CoinRPCClient communicates with cryptocurrency daemons (kernelcoind, litecoind, etc.)
 type CoinRPCClient struct {
-	url      string
-	user     string
-	password string
-	coinName string
+	url        string
+	user       string
+	password   string
+	coinName   string
+	httpClient *http.Client
+	timeout    time.Duration
+	retry      rpcRetryPolicy
+	breaker    *circuitBreaker
+	nextID     atomic.Int64
 }
 
 // KernelcoinRPCClient is an alias for backward compatibility
@@ -28,90 +35,240 @@ type JSONRPCRequest struct {
 	JSONRPC string        `json:"jsonrpc"`
 	Method  string        `json:"method"`
 	Params  []interface{} `json:"params"`
-	ID      int           `json:"id"`
+	ID      int64         `json:"id"`
 }
 
 // JSONRPCResponse represents JSON-RPC 2.0 response
 type JSONRPCResponse struct {
-	JSONRPC string      `json:"jsonrpc"`
-	Result  interface{} `json:"result"`
-	Error   interface{} `json:"error"`
-	ID      int         `json:"id"`
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	ID int64 `json:"id"`
 }
 
-// NewKernelcoinRPCClient creates an authenticated RPC client for Kernelcoin
-func NewKernelcoinRPCClient(url, user, password string) *KernelcoinRPCClient {
+// RPCCall is one call in a batch. Result is decoded into when the call succeeds.
+type RPCCall struct {
+	Method string
+	Params []interface{}
+	Result interface{}
+	Err    error
+}
+
+// newCoinRPCClient creates an RPC client sharing the common transport
+func newCoinRPCClient(url, user, password, coinName string) *CoinRPCClient {
 	return &CoinRPCClient{
-		url:      url,
-		user:     user,
-		password: password,
-		coinName: "kernelcoin",
+		url:        url,
+		user:       user,
+		password:   password,
+		coinName:   coinName,
+		httpClient: &http.Client{Transport: rpcTransport},
+		timeout:    defaultRPCTimeout,
+		retry:      defaultRetryPolicy,
+		breaker:    newCircuitBreaker(strings.ToUpper(coinName)),
 	}
 }
 
+// NewKernelcoinRPCClient creates an authenticated RPC client for Kernelcoin
+func NewKernelcoinRPCClient(url, user, password string) *KernelcoinRPCClient {
+	return newCoinRPCClient(url, user, password, "kernelcoin")
+}
+
 // NewLitecoinRPCClient creates an authenticated RPC client for Litecoin
 func NewLitecoinRPCClient(url, user, password string) *CoinRPCClient {
-	return &CoinRPCClient{
-		url:      url,
-		user:     user,
-		password: password,
-		coinName: "litecoin",
-	}
+	return newCoinRPCClient(url, user, password, "litecoin")
 }
 
-// call makes an authenticated RPC call
-func (c *CoinRPCClient) call(method string, params []interface{}) (interface{}, error) {
-	log.Printf("[RPC-%s] Calling method: %s with params: %v", strings.ToUpper(c.coinName), method, params)
-
-	request := JSONRPCRequest{
-		JSONRPC: "2.0",
-		Method:  method,
-		Params:  params,
-		ID:      1,
+// post sends one payload (a request or a batch) with a per-attempt deadline.
+// Any failure to obtain a JSON body is returned as a TransportError.
+func (c *CoinRPCClient) post(ctx context.Context, method string, payload interface{}) ([]byte, error) {
+	if !c.breaker.allow() {
+		return nil, &TransportError{Method: method, Err: ErrWalletUnavailable}
 	}
 
-	requestBody, err := json.Marshal(request)
+	requestBody, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("[RPC-%s] ERROR: Failed to marshal request: %v", strings.ToUpper(c.coinName), err)
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", c.url, bytes.NewBuffer(requestBody))
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(requestBody))
 	if err != nil {
-		log.Printf("[RPC-%s] ERROR: Failed to create HTTP request: %v", strings.ToUpper(c.coinName), err)
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-
 	req.SetBasicAuth(c.user, c.password)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		log.Printf("[RPC-%s] ERROR: RPC POST failed: %v", strings.ToUpper(c.coinName), err)
-		return nil, fmt.Errorf("RPC POST failed: %w", err)
+		transportErr := newTransportError(method, err)
+		c.breaker.failure(transportErr)
+		return nil, transportErr
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("[RPC-%s] ERROR: Failed to read response body: %v", strings.ToUpper(c.coinName), err)
-		return nil, fmt.Errorf("RPC read error: %w", err)
+		transportErr := &TransportError{Method: method, Sent: true, Err: err}
+		c.breaker.failure(transportErr)
+		return nil, transportErr
+	}
+
+	// RPC errors come back as HTTP 500 with a JSON body; anything else without one
+	// (401 bad credentials, 404 wrong wallet path, 503 work queue full) is a transport problem
+	if resp.StatusCode != http.StatusOK && !json.Valid(body) {
+		transportErr := &TransportError{Method: method, Sent: true, Err: fmt.Errorf("HTTP %s", resp.Status)}
+		c.breaker.failure(transportErr)
+		return nil, transportErr
+	}
+
+	c.breaker.success()
+	return body, nil
+}
+
+// decodeRPCResponse turns a response into either a decoded result or an RPCError
+func decodeRPCResponse(method string, response JSONRPCResponse, result interface{}) error {
+	if response.Error != nil {
+		return &RPCError{Method: method, Code: response.Error.Code, Message: response.Error.Message}
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("unexpected %s response: %w", method, err)
+	}
+	return nil
+}
+
+// callContext makes an authenticated RPC call, retrying as the retry policy allows
+func (c *CoinRPCClient) callContext(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	log.Printf("[RPC-%s] Calling method: %s with params: %v", strings.ToUpper(c.coinName), method, params)
+
+	idempotent := idempotentRPCMethods[method]
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, params, result)
+		if err == nil {
+			return nil
+		}
+		if !c.retry.shouldRetry(idempotent, attempt, err) || errors.Is(err, context.Canceled) {
+			log.Printf("[RPC-%s] ERROR: %v", strings.ToUpper(c.coinName), err)
+			return err
+		}
+
+		delay := c.retry.backoff(attempt)
+		log.Printf("[RPC-%s] %s failed (%v), retrying in %s", strings.ToUpper(c.coinName), method, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// attempt performs a single request for callContext
+func (c *CoinRPCClient) attempt(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	request := JSONRPCRequest{JSONRPC: "2.0", Method: method, Params: params, ID: c.nextID.Add(1)}
+
+	body, err := c.post(ctx, method, request)
+	if err != nil {
+		return err
 	}
 
 	var response JSONRPCResponse
 	if err := json.Unmarshal(body, &response); err != nil {
-		log.Printf("[RPC-%s] ERROR: Failed to unmarshal response: %v", strings.ToUpper(c.coinName), err)
-		return nil, fmt.Errorf("unmarshal error: %w", err)
+		return fmt.Errorf("unmarshal error: %w", err)
+	}
+	if response.ID != request.ID {
+		return fmt.Errorf("%s: response ID %d does not match request ID %d", method, response.ID, request.ID)
 	}
+	return decodeRPCResponse(method, response, result)
+}
 
-	if response.Error != nil {
-		log.Printf("[RPC-%s] ERROR: RPC returned error: %v", strings.ToUpper(c.coinName), response.Error)
-		return nil, fmt.Errorf("RPC error: %v", response.Error)
+// call makes an RPC call with no caller deadline beyond the per-attempt timeout
+func (c *CoinRPCClient) call(method string, params []interface{}) (interface{}, error) {
+	var result interface{}
+	if err := c.callContext(context.Background(), method, params, &result); err != nil {
+		return nil, err
+	}
+	log.Printf("[RPC-%s] SUCCESS: Result type: %T", strings.ToUpper(c.coinName), result)
+	return result, nil
+}
+
+// Batch sends several calls in one request. Each call's Err is set individually;
+// the returned error is only for failures affecting the whole batch. A batch is
+// retried only if every call in it is idempotent.
+func (c *CoinRPCClient) Batch(ctx context.Context, calls ...*RPCCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	idempotent := true
+	for _, call := range calls {
+		idempotent = idempotent && idempotentRPCMethods[call.Method]
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.batchAttempt(ctx, calls)
+		if err == nil {
+			return nil
+		}
+		if !c.retry.shouldRetry(idempotent, attempt, err) {
+			log.Printf("[RPC-%s] batch ERROR: %v", strings.ToUpper(c.coinName), err)
+			return err
+		}
+		select {
+		case <-time.After(c.retry.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
+
+// batchAttempt performs a single batch request
+func (c *CoinRPCClient) batchAttempt(ctx context.Context, calls []*RPCCall) error {
+	requests := make([]JSONRPCRequest, len(calls))
+	byID := make(map[int64]*RPCCall, len(calls))
+	for i, call := range calls {
+		params := call.Params
+		if params == nil {
+			params = []interface{}{}
+		}
+		requests[i] = JSONRPCRequest{JSONRPC: "2.0", Method: call.Method, Params: params, ID: c.nextID.Add(1)}
+		byID[requests[i].ID] = call
+	}
+
+	body, err := c.post(ctx, "batch", requests)
+	if err != nil {
+		return err
+	}
+
+	var responses []JSONRPCResponse
+	if err := json.Unmarshal(body, &responses); err != nil {
+		return fmt.Errorf("batch unmarshal error: %w", err)
+	}
+
+	for _, response := range responses {
+		if call, ok := byID[response.ID]; ok {
+			call.Err = decodeRPCResponse(call.Method, response, call.Result)
+			delete(byID, response.ID)
+		}
+	}
+	for _, call := range byID {
+		call.Err = fmt.Errorf("%s: no response in batch", call.Method)
+	}
+	return nil
+}
 
-	log.Printf("[RPC-%s] SUCCESS: Result type: %T", strings.ToUpper(c.coinName), response.Result)
-	return response.Result, nil
+// callResult makes an RPC call and decodes the result into v
+func (c *CoinRPCClient) callResult(method string, params []interface{}, v interface{}) error {
+	return c.callContext(context.Background(), method, params, v)
 }
 
 // GetNewAddress generates a new address from the RPC wallet
@@ -190,113 +347,108 @@ func (c *CoinRPCClient) SendToAddress(address string, amount float64) (string, e
 	return txid, nil
 }
 
-// ElectrumClient handles Electrum binary calls
-type ElectrumClient struct {
-	binaryPath string
-	withdrawFee float64
-}
+// ListReceivedTxIDs returns the IDs of wallet transactions paying to an address
+func (c *CoinRPCClient) ListReceivedTxIDs(address string, minconf int) ([]string, error) {
+	var entries []struct {
+		Address string   `json:"address"`
+		TxIDs   []string `json:"txids"`
+	}
+	if err := c.callResult("listreceivedbyaddress", []interface{}{minconf, false, false, address}, &entries); err != nil {
+		return nil, err
+	}
 
-// NewElectrumClient creates a new Electrum client
-func NewElectrumClient(binaryPath string, withdrawFee float64) *ElectrumClient {
-	return &ElectrumClient{binaryPath: binaryPath, withdrawFee: withdrawFee}
+	var txids []string
+	for _, entry := range entries {
+		if entry.Address == address {
+			txids = append(txids, entry.TxIDs...)
+		}
+	}
+	return txids, nil
 }
 
-// CreateNewAddress creates a new address using Electrum
-func (e *ElectrumClient) CreateNewAddress() (string, error) {
-	log.Printf("[ELECTRUM] CreateNewAddress: Generating new address")
-	cmd := exec.Command(e.binaryPath, "createnewaddress")
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("[ELECTRUM] CreateNewAddress ERROR: %v", err)
-		return "", err
-	}
-	address := strings.TrimSpace(string(output))
-	log.Printf("[ELECTRUM] CreateNewAddress SUCCESS: %s", address)
-	return address, nil
+// WalletTransaction is the subset of gettransaction output the exchange uses
+type WalletTransaction struct {
+	TxID          string  `json:"txid"`
+	Confirmations int     `json:"confirmations"`
+	Amount        float64 `json:"amount"`
+	Details       []struct {
+		Address  string  `json:"address"`
+		Category string  `json:"category"`
+		Amount   float64 `json:"amount"`
+	} `json:"details"`
 }
 
-// GetAddressBalance gets the balance for an address using Electrum
-func (e *ElectrumClient) GetAddressBalance(address string) (float64, float64, error) {
-	log.Printf("[ELECTRUM] GetAddressBalance: Checking address %s", address)
-	cmd := exec.Command(e.binaryPath, "getaddressbalance", address)
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("[ELECTRUM] GetAddressBalance ERROR: %v", err)
-		return 0, 0, err
+// GetTransaction looks up a wallet transaction by ID
+func (c *CoinRPCClient) GetTransaction(txid string) (*WalletTransaction, error) {
+	var tx WalletTransaction
+	if err := c.callResult("gettransaction", []interface{}{txid}, &tx); err != nil {
+		return nil, err
 	}
+	return &tx, nil
+}
 
+// GetBalances returns the wallet's trusted (confirmed) and pending balances
+func (c *CoinRPCClient) GetBalances() (trusted, pending float64, err error) {
 	var result struct {
-		Confirmed   string `json:"confirmed"`
-		Unconfirmed string `json:"unconfirmed"`
+		Mine struct {
+			Trusted          float64 `json:"trusted"`
+			UntrustedPending float64 `json:"untrusted_pending"`
+		} `json:"mine"`
 	}
-
-	if err := json.Unmarshal(output, &result); err != nil {
-		log.Printf("[ELECTRUM] GetAddressBalance ERROR: Failed to parse JSON: %v", err)
+	if err := c.callResult("getbalances", []interface{}{}, &result); err != nil {
 		return 0, 0, err
 	}
-
-	confirmed, _ := strconv.ParseFloat(result.Confirmed, 64)
-	unconfirmed, _ := strconv.ParseFloat(result.Unconfirmed, 64)
-
-	log.Printf("[ELECTRUM] GetAddressBalance SUCCESS: confirmed=%.8f, unconfirmed=%.8f", confirmed, unconfirmed)
-	return confirmed, unconfirmed, nil
+	return result.Mine.Trusted, result.Mine.UntrustedPending, nil
 }
 
-// GetAddressHistory gets transaction history for an address using Electrum
-func (e *ElectrumClient) GetAddressHistory(address string) ([]map[string]interface{}, error) {
-	log.Printf("[ELECTRUM] GetAddressHistory: Checking address %s", address)
-	cmd := exec.Command(e.binaryPath, "getaddresshistory", address)
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("[ELECTRUM] GetAddressHistory ERROR: %v", err)
-		return nil, err
+// EstimateSmartFee returns the estimated fee rate in coins per kvB for confirmation within target blocks
+func (c *CoinRPCClient) EstimateSmartFee(target int) (float64, error) {
+	var result struct {
+		FeeRate float64  `json:"feerate"`
+		Errors  []string `json:"errors"`
 	}
+	if err := c.callResult("estimatesmartfee", []interface{}{target}, &result); err != nil {
+		return 0, err
+	}
+	if result.FeeRate <= 0 {
+		return 0, fmt.Errorf("no fee estimate available: %v", result.Errors)
+	}
+	return result.FeeRate, nil
+}
 
+// ValidateAddress asks the node whether an address is valid for its network
+func (c *CoinRPCClient) ValidateAddress(address string) (bool, error) {
 	var result struct {
-		Result []map[string]interface{} `json:"result"`
+		IsValid bool `json:"isvalid"`
 	}
-
-	if err := json.Unmarshal(output, &result); err != nil {
-		log.Printf("[ELECTRUM] GetAddressHistory ERROR: Failed to parse JSON: %v", err)
-		return nil, err
+	if err := c.callResult("validateaddress", []interface{}{address}, &result); err != nil {
+		return false, err
 	}
+	return result.IsValid, nil
+}
 
-	log.Printf("[ELECTRUM] GetAddressHistory SUCCESS: %d transactions", len(result.Result))
-	return result.Result, nil
+// BlockchainInfo is the subset of getblockchaininfo output the exchange uses
+type BlockchainInfo struct {
+	Chain                string  `json:"chain"`
+	Blocks               int64   `json:"blocks"`
+	Headers              int64   `json:"headers"`
+	BestBlockHash        string  `json:"bestblockhash"`
+	MedianTime           int64   `json:"mediantime"`
+	VerificationProgress float64 `json:"verificationprogress"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
 }
 
-// PayTo sends Litecoin to an address using Electrum with configurable fee
-func (e *ElectrumClient) PayTo(address string, amount float64) (string, error) {
-	fee := e.withdrawFee
-	netAmount := amount - fee
-	
-	log.Printf("[ELECTRUM] PayTo: sending %.8f to %s (fee: %.8f, net: %.8f)", amount, address, fee, netAmount)
-	
-	if netAmount <= 0 {
-		return "", fmt.Errorf("amount too small after fee deduction")
-	}
-	
-	// Step 1: Create transaction hex
-	amountStr := fmt.Sprintf("%.8f", netAmount)
-	cmd := exec.Command(e.binaryPath, "payto", address, amountStr)
-	log.Printf("[ELECTRUM] Step 1 - Creating transaction: %s %s %s %s", e.binaryPath, "payto", address, amountStr)
-	hexOutput, err := cmd.Output()
-	if err != nil {
-		log.Printf("[ELECTRUM] PayTo Step 1 ERROR: %v", err)
-		return "", err
-	}
-	hex := strings.TrimSpace(string(hexOutput))
-	log.Printf("[ELECTRUM] Generated hex: %s", hex)
-	
-	// Step 2: Broadcast transaction
-	cmd = exec.Command(e.binaryPath, "broadcast", hex)
-	log.Printf("[ELECTRUM] Step 2 - Broadcasting: %s %s %s", e.binaryPath, "broadcast", hex)
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("[ELECTRUM] PayTo Step 2 ERROR: %v", err)
-		return "", err
+// GetBlockchainInfo returns the node's view of the chain
+func (c *CoinRPCClient) GetBlockchainInfo() (*BlockchainInfo, error) {
+	var info BlockchainInfo
+	if err := c.callResult("getblockchaininfo", []interface{}{}, &info); err != nil {
+		return nil, err
 	}
-	txid := strings.TrimSpace(string(output))
-	log.Printf("[ELECTRUM] PayTo SUCCESS: %s (kept %.8f LTC as fee)", txid, fee)
-	return txid, nil
-}
\ No newline at end of file
+	return &info, nil
+}
+
+// NetworkInfo is the subset of getnetworkinfo output the exchange uses
+type NetworkInfo struct {
+	Connections   int  `json:"connections"`
+	NetworkActive bool `json:"networkactive"`
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcTransport is shared by every wallet client so connections to the daemons are reused
+var rpcTransport = &http.Transport{
+	DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	MaxIdleConns:        16,
+	MaxIdleConnsPerHost: 4,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// defaultRPCTimeout bounds each RPC attempt. Set from -rpc-timeout before clients are created.
+var defaultRPCTimeout = 15 * time.Second
+
+// ErrWalletUnavailable is returned when a wallet daemon cannot be reached or its
+// circuit breaker is open
+var ErrWalletUnavailable = errors.New("wallet unavailable")
+
+// Bitcoin Core RPC error codes the exchange reacts to
+const (
+	rpcErrInvalidAddress    = -5
+	rpcErrInsufficientFunds = -6
+	rpcErrInWarmup          = -28
+)
+
+// RPCError is an error returned by a bitcoind-style daemon for a call
+type RPCError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC %s error %d: %s", e.Method, e.Code, e.Message)
+}
+
+// TransportError is a failure to get a response from a daemon at all. Sent is
+// false only when the request certainly never reached the daemon.
+type TransportError struct {
+	Method string
+	Sent   bool
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Method, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every transport failure match ErrWalletUnavailable
+func (e *TransportError) Is(target error) bool {
+	return target == ErrWalletUnavailable
+}
+
+// newTransportError wraps an HTTP client error, noting whether the request may have been delivered
+func newTransportError(method string, err error) *TransportError {
+	var opErr *net.OpError
+	sent := !(errors.As(err, &opErr) && opErr.Op == "dial")
+	return &TransportError{Method: method, Sent: sent, Err: err}
+}
+
+// isInsufficientFunds reports whether a wallet refused a payment for lack of funds
+func isInsufficientFunds(err error) bool {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code == rpcErrInsufficientFunds
+	}
+	var electrumErr *ElectrumError
+	if errors.As(err, &electrumErr) {
+		return strings.Contains(strings.ToLower(electrumErr.Message), "insufficient funds")
+	}
+	return false
+}
+
+// sendOutcomeUnknown reports whether a payment request failed in a way that leaves
+// open whether the daemon broadcast it
+func sendOutcomeUnknown(err error) bool {
+	var transportErr *TransportError
+	return errors.As(err, &transportErr) && transportErr.Sent
+}
+
+// idempotentRPCMethods are safe to repeat after a failure that may have reached the daemon
+var idempotentRPCMethods = map[string]bool{
+	"getblockchaininfo":     true,
+	"getnetworkinfo":        true,
+	"getbalances":           true,
+	"getbalance":            true,
+	"gettransaction":        true,
+	"getreceivedbyaddress":  true,
+	"listreceivedbyaddress": true,
+	"validateaddress":       true,
+	"estimatesmartfee":      true,
+	"getbestblockhash":      true,
+	"getblockcount":         true,
+}
+
+// rpcRetryPolicy decides how failed calls are repeated
+type rpcRetryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+var defaultRetryPolicy = rpcRetryPolicy{maxRetries: 2, baseDelay: 250 * time.Millisecond, maxDelay: 2 * time.Second}
+
+// shouldRetry reports whether a call may be repeated after err. Idempotent calls
+// are retried on transport failures and while the node warms up; others only
+// when the request never left this process.
+func (p rpcRetryPolicy) shouldRetry(idempotent bool, attempt int, err error) bool {
+	if attempt >= p.maxRetries {
+		return false
+	}
+
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		if transportErr.Err == ErrWalletUnavailable {
+			return false // breaker is open
+		}
+		return idempotent || !transportErr.Sent
+	}
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return idempotent && rpcErr.Code == rpcErrInWarmup
+	}
+	return false
+}
+
+// backoff returns the delay before retry number attempt (0-based), with jitter
+func (p rpcRetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.baseDelay << attempt
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// circuitBreaker stops calling a daemon after repeated failures so requests fail
+// fast with ErrWalletUnavailable instead of each waiting for a timeout
+type circuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	lastError error
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: 5, cooldown: 30 * time.Second}
+}
+
+// allow reports whether a call may proceed. Once the cooldown passes a single
+// trial call is let through; the breaker closes again if it succeeds.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	return true
+}
+
+// success records a call that reached the daemon
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures >= b.threshold {
+		log.Printf("[RPC-%s] Circuit closed, wallet reachable again", b.name)
+	}
+	b.failures = 0
+	b.lastError = nil
+}
+
+// failure records a call that could not reach the daemon
+func (b *circuitBreaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastError = err
+	if b.failures == b.threshold {
+		log.Printf("[RPC-%s] Circuit opened after %d failures: %v", b.name, b.failures, err)
+	}
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// open reports whether calls are currently being rejected, and the last failure
+func (b *circuitBreaker) open() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && time.Now().Before(b.openUntil), b.lastError
+}
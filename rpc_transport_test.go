@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRPCClient points a client at handler with fast retries and a short timeout
+func newTestRPCClient(t *testing.T, handler http.HandlerFunc) *CoinRPCClient {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	c := newCoinRPCClient(ts.URL, "user", "pass", "kernelcoin")
+	c.timeout = 100 * time.Millisecond
+	c.retry = rpcRetryPolicy{maxRetries: 2, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	return c
+}
+
+// writeRPC answers one JSON-RPC request with a result, or an error when code is non-zero
+func writeRPC(w http.ResponseWriter, r *http.Request, result interface{}, code int) {
+	var req JSONRPCRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	resp := map[string]interface{}{"id": req.ID, "result": result, "error": nil}
+	if code != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp["result"] = nil
+		resp["error"] = map[string]interface{}{"code": code, "message": "failed"}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestShouldRetry(t *testing.T) {
+	policy := rpcRetryPolicy{maxRetries: 2}
+	sent := &TransportError{Method: "m", Sent: true, Err: errors.New("EOF")}
+	unsent := &TransportError{Method: "m", Err: errors.New("connection refused")}
+	for _, tc := range []struct {
+		name       string
+		idempotent bool
+		attempt    int
+		err        error
+		want       bool
+	}{
+		{"sent, idempotent", true, 0, sent, true},
+		{"sent, not idempotent", false, 0, sent, false},
+		{"never sent", false, 0, unsent, true},
+		{"wrapped transport error", true, 1, fmt.Errorf("getbalance: %w", sent), true},
+		{"out of retries", true, 2, sent, false},
+		{"breaker open", true, 0, &TransportError{Method: "m", Err: ErrWalletUnavailable}, false},
+		{"warming up, idempotent", true, 0, &RPCError{Code: rpcErrInWarmup}, true},
+		{"warming up, not idempotent", false, 0, &RPCError{Code: rpcErrInWarmup}, false},
+		{"rpc error", true, 0, &RPCError{Code: rpcErrInsufficientFunds}, false},
+		{"other error", true, 0, errors.New("unmarshal error"), false},
+	} {
+		if got := policy.shouldRetry(tc.idempotent, tc.attempt, tc.err); got != tc.want {
+			t.Errorf("%s: shouldRetry = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRPCRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		fail   func(w http.ResponseWriter, r *http.Request) // the first request's failure
+		calls  int64
+		ok     bool
+		rpcErr bool // fails with the daemon's error rather than as unreachable
+	}{
+		{
+			name:   "5xx, idempotent",
+			method: "getbalance",
+			fail:   func(w http.ResponseWriter, r *http.Request) { http.Error(w, "work queue depth exceeded", 503) },
+			calls:  2, ok: true,
+		},
+		{
+			name:   "5xx, not idempotent",
+			method: "sendtoaddress",
+			fail:   func(w http.ResponseWriter, r *http.Request) { http.Error(w, "work queue depth exceeded", 503) },
+			calls:  1,
+		},
+		{
+			name:   "timeout, idempotent",
+			method: "getbalance",
+			fail:   func(w http.ResponseWriter, r *http.Request) { time.Sleep(200 * time.Millisecond) },
+			calls:  2, ok: true,
+		},
+		{
+			name:   "warming up",
+			method: "getbalance",
+			fail:   func(w http.ResponseWriter, r *http.Request) { writeRPC(w, r, nil, rpcErrInWarmup) },
+			calls:  2, ok: true,
+		},
+		{
+			name:   "rpc error",
+			method: "getbalance",
+			fail:   func(w http.ResponseWriter, r *http.Request) { writeRPC(w, r, nil, rpcErrInsufficientFunds) },
+			calls:  1, rpcErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int64
+			c := newTestRPCClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					tc.fail(w, r)
+					return
+				}
+				writeRPC(w, r, 1.5, 0)
+			})
+
+			var result float64
+			err := c.callResult(tc.method, nil, &result)
+			if got := calls.Load(); got != tc.calls {
+				t.Errorf("daemon saw %d requests, want %d", got, tc.calls)
+			}
+			if tc.ok {
+				if err != nil || result != 1.5 {
+					t.Errorf("result = %v, %v", result, err)
+				}
+				return
+			}
+			var rpcErr *RPCError
+			if err == nil || errors.As(err, &rpcErr) != tc.rpcErr || errors.Is(err, ErrWalletUnavailable) == tc.rpcErr {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls atomic.Int64
+	var down atomic.Bool
+	down.Store(true)
+	c := newTestRPCClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			http.Error(w, "down", 503)
+			return
+		}
+		writeRPC(w, r, 1.5, 0)
+	})
+	c.retry.maxRetries = 0
+	c.breaker.threshold = 2
+	c.breaker.cooldown = 50 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		c.callResult("getbalance", nil, nil)
+	}
+	if open, lastErr := c.breaker.open(); !open || lastErr == nil {
+		t.Fatalf("breaker open = %v, %v after 2 failures", open, lastErr)
+	}
+	// An open breaker fails fast without asking the daemon
+	if err := c.callResult("getbalance", nil, nil); !errors.Is(err, ErrWalletUnavailable) || calls.Load() != 2 {
+		t.Errorf("call while open = %v, daemon saw %d requests", err, calls.Load())
+	}
+
+	// Half-open: after the cooldown one trial call goes through. It fails, so
+	// the breaker stays open for another cooldown.
+	time.Sleep(60 * time.Millisecond)
+	if err := c.callResult("getbalance", nil, nil); err == nil || calls.Load() != 3 {
+		t.Errorf("trial call = %v, daemon saw %d requests", err, calls.Load())
+	}
+	if open, _ := c.breaker.open(); !open {
+		t.Error("breaker closed after a failed trial")
+	}
+
+	// Only one trial is let through per cooldown; a successful one closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	down.Store(false)
+	if !c.breaker.allow() || c.breaker.allow() {
+		t.Error("half-open breaker should allow exactly one trial")
+	}
+	time.Sleep(60 * time.Millisecond)
+	var result float64
+	if err := c.callResult("getbalance", nil, &result); err != nil || result != 1.5 {
+		t.Fatalf("trial call = %v, %v", result, err)
+	}
+	if open, lastErr := c.breaker.open(); open || lastErr != nil {
+		t.Errorf("breaker open = %v, %v after a successful trial", open, lastErr)
+	}
+	if err := c.callResult("getbalance", nil, nil); err != nil {
+		t.Errorf("call after closing: %v", err)
+	}
+}
+
+func TestBatchMatchesResponsesByID(t *testing.T) {
+	c := newTestRPCClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var reqs []JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&reqs)
+		// Answer in reverse order, fail getblockcount, skip gettransaction and
+		// add a response nobody asked for
+		var resps []map[string]interface{}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			switch reqs[i].Method {
+			case "getbalance":
+				resps = append(resps, map[string]interface{}{"id": reqs[i].ID, "result": 2.5})
+			case "getbestblockhash":
+				resps = append(resps, map[string]interface{}{"id": reqs[i].ID, "result": "00ff"})
+			case "getblockcount":
+				resps = append(resps, map[string]interface{}{"id": reqs[i].ID, "error": map[string]interface{}{"code": rpcErrInWarmup, "message": "Loading block index"}})
+			}
+		}
+		resps = append(resps, map[string]interface{}{"id": 999999, "result": 1})
+		json.NewEncoder(w).Encode(resps)
+	})
+
+	var balance float64
+	var hash string
+	var count int64
+	var tx map[string]interface{}
+	calls := []*RPCCall{
+		{Method: "getbalance", Result: &balance},
+		{Method: "getbestblockhash", Result: &hash},
+		{Method: "getblockcount", Result: &count},
+		{Method: "gettransaction", Params: []interface{}{"abc"}, Result: &tx},
+	}
+	if err := c.Batch(context.Background(), calls...); err != nil {
+		t.Fatal(err)
+	}
+	if calls[0].Err != nil || balance != 2.5 {
+		t.Errorf("getbalance = %v, %v", balance, calls[0].Err)
+	}
+	if calls[1].Err != nil || hash != "00ff" {
+		t.Errorf("getbestblockhash = %q, %v", hash, calls[1].Err)
+	}
+	var rpcErr *RPCError
+	if !errors.As(calls[2].Err, &rpcErr) || rpcErr.Code != rpcErrInWarmup || count != 0 {
+		t.Errorf("getblockcount = %d, %v", count, calls[2].Err)
+	}
+	if calls[3].Err == nil || tx != nil {
+		t.Errorf("gettransaction = %v, %v", tx, calls[3].Err)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimWallet is a WalletBackend on a simulated chain kept in the database, for staging
+// without real coins. Blocks are mined on a timer (or by hand from the admin faucet),
+// deposits and withdrawals wait in the mempool until the next block, and addresses are
+// derived from a seed so a given database always hands out the same ones.
+type SimWallet struct {
+	mu     sync.Mutex
+	db     *sql.DB
+	coin   string
+	symbol string
+	prefix string // every address on this chain starts with it
+	seed   string
+	fee    float64
+}
+
+// SimBlock is a block on a simulated chain
+type SimBlock struct {
+	Height    int64     `json:"height"`
+	Hash      string    `json:"hash"`
+	TxCount   int       `json:"tx_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SimTransaction is a payment on a simulated chain. A withdrawal to one of the
+// wallet's own addresses appears twice: once out and once in.
+type SimTransaction struct {
+	TxID      string    `json:"txid"`
+	Address   string    `json:"address"`
+	Amount    float64   `json:"amount"`
+	Fee       float64   `json:"fee"`
+	Direction string    `json:"direction"` // in or out
+	Kind      string    `json:"kind"`      // faucet, withdraw or transfer
+	Height    int64     `json:"height"`    // 0 while in the mempool
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewSimWallet opens the simulated chain for coin, creating its genesis block if needed
+func NewSimWallet(db *sql.DB, coin, symbol, seed string, fee float64) (*SimWallet, error) {
+	w := &SimWallet{
+		db:     db,
+		coin:   coin,
+		symbol: symbol,
+		prefix: "sim" + strings.ToLower(symbol),
+		seed:   seed,
+		fee:    fee,
+	}
+
+	var height int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(height), -1) FROM sim_blocks WHERE coin = ?`, coin).Scan(&height)
+	if err != nil {
+		return nil, err
+	}
+	if height < 0 {
+		if _, err := db.Exec(`INSERT INTO sim_blocks (coin, height, hash) VALUES (?, 0, ?)`, coin, w.blockHash(0, "")); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// blockHash chains a block to its parent
+func (w *SimWallet) blockHash(height int64, parent string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/block/%d/%s", w.seed, w.coin, height, parent)))
+	return hex.EncodeToString(sum[:])
+}
+
+// tip returns the best block. Caller must hold w.mu.
+func (w *SimWallet) tip() (*SimBlock, error) {
+	block := &SimBlock{}
+	err := w.db.QueryRow(`SELECT height, hash, created_at FROM sim_blocks WHERE coin = ? ORDER BY height DESC LIMIT 1`, w.coin).
+		Scan(&block.Height, &block.Hash, &block.CreatedAt)
+	return block, err
+}
+
+// NewAddress derives the next address from the seed and remembers it as the wallet's own
+func (w *SimWallet) NewAddress() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var index int64
+	if err := w.db.QueryRow(`SELECT COUNT(*) FROM sim_addresses WHERE coin = ?`, w.coin).Scan(&index); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/address/%d", w.seed, w.coin, index)))
+	address := w.prefix + hex.EncodeToString(sum[:])[:36]
+	if _, err := w.db.Exec(`INSERT INTO sim_addresses (coin, address, idx) VALUES (?, ?, ?)`, w.coin, address, index); err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+// isMine reports whether the wallet handed out address. Caller must hold w.mu.
+func (w *SimWallet) isMine(address string) (bool, error) {
+	var n int
+	err := w.db.QueryRow(`SELECT COUNT(*) FROM sim_addresses WHERE coin = ? AND address = ?`, w.coin, address).Scan(&n)
+	return n > 0, err
+}
+
+// newTxID returns a unique transaction ID. Caller must hold w.mu.
+func (w *SimWallet) newTxID() (string, error) {
+	var n int64
+	if err := w.db.QueryRow(`SELECT COUNT(DISTINCT txid) FROM sim_transactions WHERE coin = ?`, w.coin).Scan(&n); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/tx/%d", w.seed, w.coin, n)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Faucet pays amount to one of the wallet's addresses from outside the exchange,
+// as if a user had sent it. It confirms with the next block.
+func (w *SimWallet) Faucet(address string, amount float64) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if amount <= 0 {
+		return "", fmt.Errorf("amount must be positive")
+	}
+	mine, err := w.isMine(address)
+	if err != nil {
+		return "", err
+	}
+	if !mine {
+		return "", fmt.Errorf("%s is not a %s deposit address of this exchange", address, w.symbol)
+	}
+	txid, err := w.newTxID()
+	if err != nil {
+		return "", err
+	}
+	_, err = w.db.Exec(`INSERT INTO sim_transactions (coin, txid, address, amount, direction, kind) VALUES (?, ?, ?, ?, 'in', 'faucet')`,
+		w.coin, txid, address, amount)
+	return txid, err
+}
+
+// Mine adds blocks, confirming everything in the mempool in the first
+func (w *SimWallet) Mine(blocks int) (*SimBlock, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tip, err := w.tip()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < blocks; i++ {
+		height := tip.Height + 1
+		hash := w.blockHash(height, tip.Hash)
+
+		tx, err := w.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO sim_blocks (coin, height, hash) VALUES (?, ?, ?)`, w.coin, height, hash); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if _, err := tx.Exec(`UPDATE sim_transactions SET height = ? WHERE coin = ? AND height = 0`, height, w.coin); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		tip = &SimBlock{Height: height, Hash: hash, CreatedAt: time.Now()}
+	}
+	return tip, nil
+}
+
+// Run mines a block every interval, like a real chain's block clock
+func (w *SimWallet) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := w.Mine(1); err != nil {
+			log.Printf("[SIM] Failed to mine %s block: %v", w.symbol, err)
+		}
+	}
+}
+
+// IncomingTransfers returns the payments received by one of the wallet's addresses
+func (w *SimWallet) IncomingTransfers(address string) ([]IncomingTransfer, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tip, err := w.tip()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := w.db.Query(`SELECT txid, amount, height FROM sim_transactions WHERE coin = ? AND address = ? AND direction = 'in' ORDER BY id`, w.coin, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []IncomingTransfer
+	for rows.Next() {
+		var transfer IncomingTransfer
+		var height int64
+		if err := rows.Scan(&transfer.TxID, &transfer.Amount, &height); err != nil {
+			return nil, err
+		}
+		if height > 0 {
+			transfer.Confirmations = int(tip.Height - height + 1)
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+// balance returns the confirmed and unconfirmed funds. Coins sent are spent as soon
+// as the withdrawal enters the mempool. Caller must hold w.mu.
+func (w *SimWallet) balance() (confirmed, unconfirmed float64, err error) {
+	err = w.db.QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN direction = 'in' AND height > 0 THEN amount
+			                  WHEN direction = 'out' THEN -(amount + fee) ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN direction = 'in' AND height = 0 THEN amount ELSE 0 END), 0)
+		FROM sim_transactions WHERE coin = ?
+	`, w.coin).Scan(&confirmed, &unconfirmed)
+	return confirmed, unconfirmed, err
+}
+
+// Send pays amount less the fee to address. Paying one of the wallet's own addresses
+// shows up as a deposit there once mined, so users can withdraw to each other.
+func (w *SimWallet) Send(address string, amount float64) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.validAddress(address) {
+		return "", &RPCError{Method: "send", Code: rpcErrInvalidAddress, Message: "Invalid address"}
+	}
+	if amount <= w.fee {
+		return "", fmt.Errorf("amount too small after fee deduction")
+	}
+	confirmed, _, err := w.balance()
+	if err != nil {
+		return "", err
+	}
+	if amount > confirmed+1e-9 {
+		return "", &RPCError{Method: "send", Code: rpcErrInsufficientFunds, Message: "Insufficient funds"}
+	}
+	mine, err := w.isMine(address)
+	if err != nil {
+		return "", err
+	}
+	txid, err := w.newTxID()
+	if err != nil {
+		return "", err
+	}
+
+	net := amount - w.fee
+	tx, err := w.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`INSERT INTO sim_transactions (coin, txid, address, amount, fee, direction, kind) VALUES (?, ?, ?, ?, ?, 'out', 'withdraw')`,
+		w.coin, txid, address, net, w.fee); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if mine {
+		if _, err := tx.Exec(`INSERT INTO sim_transactions (coin, txid, address, amount, direction, kind) VALUES (?, ?, ?, ?, 'in', 'transfer')`,
+			w.coin, txid, address, net); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	log.Printf("[SIM] %s withdrawal of %.8f to %s in mempool as %s", w.symbol, net, address, txid)
+	return txid, nil
+}
+
+// Balance returns the wallet's confirmed and unconfirmed funds
+func (w *SimWallet) Balance() (float64, float64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.balance()
+}
+
+// EstimateFee returns the fixed simulated network fee
+func (w *SimWallet) EstimateFee() (float64, error) {
+	return w.fee, nil
+}
+
+// validAddress accepts any alphanumeric address with the chain's prefix
+func (w *SimWallet) validAddress(address string) bool {
+	return strings.HasPrefix(address, w.prefix) && len(address) > len(w.prefix) && len(address) <= 64 && isValidAlphanumeric(address)
+}
+
+// ValidateAddress accepts any alphanumeric address with the chain's prefix
+func (w *SimWallet) ValidateAddress(address string) (bool, error) {
+	return w.validAddress(address), nil
+}
+
+// ChainTip returns the best simulated block
+func (w *SimWallet) ChainTip() (*ChainTip, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tip, err := w.tip()
+	if err != nil {
+		return nil, err
+	}
+	return &ChainTip{Height: tip.Height, Hash: tip.Hash, Time: tip.CreatedAt}, nil
+}
+
+// Blocks returns the latest blocks, newest first
+func (w *SimWallet) Blocks(limit int) ([]SimBlock, error) {
+	rows, err := w.db.Query(`
+		SELECT b.height, b.hash, b.created_at,
+		       (SELECT COUNT(DISTINCT txid) FROM sim_transactions t WHERE t.coin = b.coin AND t.height = b.height)
+		FROM sim_blocks b WHERE b.coin = ? ORDER BY b.height DESC LIMIT ?
+	`, w.coin, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []SimBlock{}
+	for rows.Next() {
+		var block SimBlock
+		if err := rows.Scan(&block.Height, &block.Hash, &block.CreatedAt, &block.TxCount); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+// Transactions returns the latest transactions, mempool first
+func (w *SimWallet) Transactions(limit int) ([]SimTransaction, error) {
+	rows, err := w.db.Query(`
+		SELECT txid, address, amount, fee, direction, kind, height, created_at
+		FROM sim_transactions WHERE coin = ? ORDER BY height = 0 DESC, id DESC LIMIT ?
+	`, w.coin, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := []SimTransaction{}
+	for rows.Next() {
+		var tx SimTransaction
+		if err := rows.Scan(&tx.TxID, &tx.Address, &tx.Amount, &tx.Fee, &tx.Direction, &tx.Kind, &tx.Height, &tx.CreatedAt); err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, rows.Err()
+}
+
+// simWallets returns the simulated wallets by coin, empty unless running with -simulate
+func (s *Server) simWallets() map[string]*SimWallet {
+	wallets := make(map[string]*SimWallet)
+	for name, asset := range s.assets {
+		if w, ok := asset.Wallet.(*SimWallet); ok {
+			wallets[name] = w
+		}
+	}
+	return wallets
+}
+
+// handleAdminFaucet shows the simulated chains and lets the admin fund deposit
+// addresses and mine blocks. POST {coin, address or username, amount} pays a
+// deposit address; POST {coin, blocks} mines blocks.
+func (s *Server) handleAdminFaucet(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	wallets := s.simWallets()
+	if len(wallets) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "The faucet is only available with -simulate"})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Coin     string  `json:"coin"`
+			Address  string  `json:"address"`
+			Username string  `json:"username"`
+			Amount   float64 `json:"amount"`
+			Blocks   int     `json:"blocks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		wallet, ok := wallets[req.Coin]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported coin: " + req.Coin})
+			return
+		}
+
+		if req.Blocks > 0 {
+			if req.Blocks > 1000 {
+				req.Blocks = 1000
+			}
+			tip, err := wallet.Mine(req.Blocks)
+			if err != nil {
+				log.Printf("[SIM] Failed to mine %s blocks: %v", wallet.symbol, err)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to mine blocks"})
+				return
+			}
+			log.Printf("[SIM] Admin %s mined %d %s blocks, tip %d", session.Username, req.Blocks, wallet.symbol, tip.Height)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "height": tip.Height})
+			return
+		}
+
+		address := req.Address
+		if address == "" && req.Username != "" {
+			var receiveAddr sql.NullString
+			s.mu.RLock()
+			err := s.db.QueryRow(fmt.Sprintf(`SELECT %s_receive_address FROM users WHERE username = ?`, wallet.coin), req.Username).Scan(&receiveAddr)
+			s.mu.RUnlock()
+			if err != nil || !receiveAddr.Valid || receiveAddr.String == "" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{"error": req.Username + " has no " + wallet.symbol + " receive address"})
+				return
+			}
+			address = receiveAddr.String
+		}
+
+		txid, err := wallet.Faucet(address, req.Amount)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("[SIM] Admin %s sent %.8f %s from the faucet to %s (%s)", session.Username, req.Amount, wallet.symbol, address, txid)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "txid": txid, "address": address})
+		return
+	}
+
+	limit := 20
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	chains := make(map[string]interface{}, len(wallets))
+	for name, wallet := range wallets {
+		tip, err := wallet.ChainTip()
+		if err != nil {
+			log.Printf("[SIM] Failed to read %s chain: %v", wallet.symbol, err)
+			continue
+		}
+		confirmed, unconfirmed, _ := wallet.Balance()
+		blocks, _ := wallet.Blocks(limit)
+		txs, _ := wallet.Transactions(limit)
+		chains[name] = map[string]interface{}{
+			"symbol":       wallet.symbol,
+			"height":       tip.Height,
+			"tip_time":     tip.Time,
+			"fee":          wallet.fee,
+			"address_hint": wallet.prefix + "...",
+			"balance":      confirmed,
+			"unconfirmed":  unconfirmed,
+			"blocks":       blocks,
+			"transactions": txs,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"chains": chains})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// newSimAssets returns KCN and LTC backed by simulated chains in db
+func newSimAssets(t *testing.T, db *sql.DB) map[string]*Asset {
+	t.Helper()
+
+	kcn, err := NewSimWallet(db, "kernelcoin", "KCN", "test", 0.0001)
+	if err != nil {
+		t.Fatalf("open simulated KCN chain: %v", err)
+	}
+	ltc, err := NewSimWallet(db, "litecoin", "LTC", "test", 0.001)
+	if err != nil {
+		t.Fatalf("open simulated LTC chain: %v", err)
+	}
+	return newAssets(kcn, ltc)
+}
+
+func TestSimWalletAddressesAreDeterministic(t *testing.T) {
+	first, _ := NewSimWallet(newTestDB(t), "kernelcoin", "KCN", "seed", 0)
+	second, _ := NewSimWallet(newTestDB(t), "kernelcoin", "KCN", "seed", 0)
+
+	for i := 0; i < 3; i++ {
+		a, err := first.NewAddress()
+		if err != nil {
+			t.Fatalf("new address: %v", err)
+		}
+		b, _ := second.NewAddress()
+		if a != b {
+			t.Fatalf("address %d differs between chains with the same seed: %s != %s", i, a, b)
+		}
+		if valid, _ := first.ValidateAddress(a); !valid {
+			t.Fatalf("own address %s is not valid", a)
+		}
+	}
+}
+
+func TestSimulationFaucetDepositAndWithdraw(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	admin := ex.newUser(t, "admin")
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+
+	// The faucet pays Alice's deposit address; it is pending until mined
+	alice.receiveAddress("kernelcoin")
+	if resp := admin.call("/api/admin/faucet", map[string]interface{}{"coin": "kernelcoin", "username": "alice", "amount": 25}); resp["success"] != true {
+		t.Fatalf("faucet: %v", resp)
+	}
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "pending" {
+		t.Fatalf("deposit before mining: %v", resp)
+	}
+	if resp := admin.call("/api/admin/faucet", map[string]interface{}{"coin": "kernelcoin", "blocks": 2}); resp["success"] != true {
+		t.Fatalf("mine: %v", resp)
+	}
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "confirmed" {
+		t.Fatalf("deposit after mining: %v", resp)
+	}
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 25)
+
+	// Faucet requests from anyone but the admin are refused
+	if resp := postJSON(t, alice.client, ex.ts.URL+"/api/admin/faucet", `{"coin":"kernelcoin","blocks":1}`, alice.token, ""); resp.StatusCode != 401 {
+		t.Fatalf("faucet as alice: status %d", resp.StatusCode)
+	}
+
+	// Alice withdraws to Bob's deposit address; it lands in the next block and Bob is credited
+	bobAddress := bob.receiveAddress("kernelcoin")
+	alice.call("/api/update-addresses", map[string]string{"kernelcoin_address": bobAddress})
+	if resp := alice.call("/api/withdraw", map[string]interface{}{"coin": "kernelcoin", "amount": 10}); resp["success"] != true {
+		t.Fatalf("withdraw: %v", resp)
+	}
+	assertAmount(t, "alice KCN after withdrawal", alice.balance()["kernelcoin"], 15)
+	if resp := bob.checkDeposit("kernelcoin"); resp["status"] != "pending" {
+		t.Fatalf("withdrawal before mining: %v", resp)
+	}
+
+	wallet := ex.server.assets["kernelcoin"].Wallet.(*SimWallet)
+	wallet.Mine(2)
+	if resp := bob.checkDeposit("kernelcoin"); resp["status"] != "confirmed" {
+		t.Fatalf("withdrawal after mining: %v", resp)
+	}
+	assertAmount(t, "bob KCN", bob.balance()["kernelcoin"], 9.9999)
+
+	txs, err := wallet.Transactions(10)
+	if err != nil {
+		t.Fatalf("transactions: %v", err)
+	}
+	for _, tx := range txs {
+		if tx.Height == 0 {
+			t.Errorf("transaction %s still in the mempool after mining", tx.TxID)
+		}
+	}
+
+	// The wallet cannot pay out more than it holds
+	confirmed, _, _ := wallet.Balance()
+	assertAmount(t, "wallet balance", confirmed, 25-0.0001)
+	if _, err := wallet.Send(bobAddress, 100); !isInsufficientFunds(err) {
+		t.Fatalf("overspend error = %v, want insufficient funds", err)
+	}
+}
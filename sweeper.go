@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HotWalletConfig sets how much of a coin is kept in the exchange's hot wallet
+type HotWalletConfig struct {
+	Target      float64 // balance kept hot; anything above it is swept to ColdAddress. 0 disables sweeping.
+	Min         float64 // reserve kept on top of pending withdrawals before a refill is requested
+	ColdAddress string
+}
+
+// HotWalletStatus is the current position of one coin's hot wallet
+type HotWalletStatus struct {
+	Coin               string  `json:"coin"`
+	Symbol             string  `json:"symbol"`
+	Balance            float64 `json:"balance"`
+	Unconfirmed        float64 `json:"unconfirmed"`
+	Target             float64 `json:"target"`
+	Min                float64 `json:"min"`
+	ColdAddress        string  `json:"cold_address"`
+	PendingWithdrawals float64 `json:"pending_withdrawals"`
+	Refill             float64 `json:"refill"`
+	Error              string  `json:"error,omitempty"`
+}
+
+// Sweeper moves the hot wallet balance above each coin's target to cold storage and
+// raises a refill alert when the hot wallet cannot cover pending withdrawals
+type Sweeper struct {
+	mu      sync.Mutex // serialises passes so a balance is never swept twice
+	db      *sql.DB
+	assets  map[string]*Asset
+	configs map[string]HotWalletConfig
+	monitor *ChainMonitor
+}
+
+// NewSweeper creates a sweeper for the coins that have a hot wallet config.
+// monitor may be nil; otherwise paused coins are skipped.
+func NewSweeper(db *sql.DB, assets map[string]*Asset, configs map[string]HotWalletConfig, monitor *ChainMonitor) *Sweeper {
+	for name, config := range configs {
+		asset := assets[name]
+		if config.Target > 0 && config.ColdAddress == "" {
+			log.Printf("[SWEEP] %s has a hot wallet target but no cold address, sweeping disabled", asset.Symbol)
+		}
+		if config.ColdAddress != "" {
+			if valid, err := asset.Wallet.ValidateAddress(config.ColdAddress); err == nil && !valid {
+				log.Printf("[SWEEP] %s cold address %s is not valid, sweeping disabled", asset.Symbol, config.ColdAddress)
+				config.ColdAddress = ""
+				configs[name] = config
+			}
+		}
+	}
+	return &Sweeper{db: db, assets: assets, configs: configs, monitor: monitor}
+}
+
+// pendingWithdrawals sums withdrawals the hot wallet may still have to pay
+func (sw *Sweeper) pendingWithdrawals(coin string) (float64, error) {
+	var total float64
+	err := sw.db.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE coin = ? AND type = 'withdraw' AND status = 'pending'`, coin).Scan(&total)
+	return total, err
+}
+
+// status reads the hot wallet balance and works out how much it needs topping up
+func (sw *Sweeper) status(name string) HotWalletStatus {
+	asset := sw.assets[name]
+	config := sw.configs[name]
+	st := HotWalletStatus{Coin: name, Symbol: asset.Symbol, Target: config.Target, Min: config.Min, ColdAddress: config.ColdAddress}
+
+	pending, err := sw.pendingWithdrawals(name)
+	if err != nil {
+		st.Error = "failed to sum pending withdrawals"
+		return st
+	}
+	st.PendingWithdrawals = pending
+
+	confirmed, unconfirmed, err := asset.Wallet.Balance()
+	if err != nil {
+		st.Error = asset.userError(err, "failed to read wallet balance")
+		return st
+	}
+	st.Balance = confirmed
+	st.Unconfirmed = unconfirmed
+
+	// Top back up to the target once the wallet cannot cover what it owes plus the reserve
+	if confirmed < pending+config.Min {
+		st.Refill = pending + math.Max(config.Target, config.Min) - confirmed
+	}
+	return st
+}
+
+// coins returns the configured coins in name order
+func (sw *Sweeper) coins() []string {
+	names := make([]string, 0, len(sw.configs))
+	for name := range sw.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Status reports every hot wallet without sweeping
+func (sw *Sweeper) Status() []HotWalletStatus {
+	statuses := make([]HotWalletStatus, 0, len(sw.configs))
+	for _, name := range sw.coins() {
+		statuses = append(statuses, sw.status(name))
+	}
+	return statuses
+}
+
+// Check sweeps excess hot balances and opens or resolves refill alerts
+func (sw *Sweeper) Check() []HotWalletStatus {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	statuses := make([]HotWalletStatus, 0, len(sw.configs))
+	for _, name := range sw.coins() {
+		statuses = append(statuses, sw.check(name))
+	}
+	return statuses
+}
+
+// check sweeps and alerts for one coin. Withdrawals of the coin wait until the
+// sweep is sent, so the balance it is worked out from stays what the wallet holds.
+func (sw *Sweeper) check(name string) HotWalletStatus {
+	asset := sw.assets[name]
+	asset.sendMu.Lock()
+	defer asset.sendMu.Unlock()
+
+	st := sw.status(name)
+	if st.Error == "" {
+		sw.refillAlert(st)
+		sw.sweep(&st)
+	}
+	return st
+}
+
+// refillAlert records a refill alert when one is needed and none is open, and
+// resolves the open alert once the hot wallet is healthy again
+func (sw *Sweeper) refillAlert(st HotWalletStatus) {
+	var openID int64
+	err := sw.db.QueryRow(`SELECT id FROM hot_wallet_ledger WHERE coin = ? AND kind = 'refill' AND status = 'open'`, st.Coin).Scan(&openID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[SWEEP] Failed to look up refill alerts for %s: %v", st.Symbol, err)
+		return
+	}
+	err = nil
+
+	switch {
+	case st.Refill > 0 && openID == 0:
+		log.Printf("[SWEEP] REFILL NEEDED: %s hot wallet holds %.8f with %.8f pending withdrawal and a %.8f reserve; send %.8f from cold storage", st.Symbol, st.Balance, st.PendingWithdrawals, st.Min, st.Refill)
+		_, err = sw.db.Exec(`INSERT INTO hot_wallet_ledger (coin, kind, amount, status, hot_balance, pending_withdrawals, note) VALUES (?, 'refill', ?, 'open', ?, ?, ?)`,
+			st.Coin, st.Refill, st.Balance, st.PendingWithdrawals, "hot wallet below pending withdrawals plus reserve")
+	case st.Refill > 0:
+		_, err = sw.db.Exec(`UPDATE hot_wallet_ledger SET amount = ?, hot_balance = ?, pending_withdrawals = ? WHERE id = ?`, st.Refill, st.Balance, st.PendingWithdrawals, openID)
+	case openID != 0:
+		log.Printf("[SWEEP] %s hot wallet refilled to %.8f", st.Symbol, st.Balance)
+		_, err = sw.db.Exec(`UPDATE hot_wallet_ledger SET status = 'resolved', resolved_at = CURRENT_TIMESTAMP WHERE id = ?`, openID)
+	}
+	if err != nil {
+		log.Printf("[SWEEP] Failed to record refill alert for %s: %v", st.Symbol, err)
+	}
+}
+
+// sweep sends the balance above the target to the cold address
+func (sw *Sweeper) sweep(st *HotWalletStatus) {
+	asset := sw.assets[st.Coin]
+	if st.Target <= 0 || st.ColdAddress == "" {
+		return
+	}
+	if sw.monitor != nil {
+		if _, paused := sw.monitor.Paused(st.Coin); paused {
+			return
+		}
+	}
+
+	excess := st.Balance - st.PendingWithdrawals - st.Target
+	fee, err := asset.Wallet.EstimateFee()
+	if err != nil || excess <= fee {
+		return // not worth a transaction
+	}
+
+	hotBalance := st.Balance
+	status, note := "sent", ""
+	txid, err := asset.Wallet.Send(st.ColdAddress, excess)
+	if err != nil {
+		status, note = "failed", err.Error()
+		if sendOutcomeUnknown(err) {
+			status = "unknown"
+		}
+		log.Printf("[SWEEP] %s sweep of %.8f to %s %s: %v", st.Symbol, excess, st.ColdAddress, status, err)
+	} else {
+		log.Printf("[SWEEP] %s swept %.8f to %s | TxHash: %s", st.Symbol, excess, st.ColdAddress, txid)
+		st.Balance -= excess
+	}
+
+	_, err = sw.db.Exec(`INSERT INTO hot_wallet_ledger (coin, kind, amount, address, tx_hash, status, hot_balance, pending_withdrawals, note) VALUES (?, 'sweep', ?, ?, ?, ?, ?, ?, ?)`,
+		st.Coin, excess, st.ColdAddress, txid, status, hotBalance, st.PendingWithdrawals, note)
+	if err != nil {
+		log.Printf("[SWEEP] Failed to record %s sweep %s in ledger: %v", st.Symbol, txid, err)
+	}
+}
+
+// RecordRefill notes coins moved from cold storage back to the hot wallet
+func (sw *Sweeper) RecordRefill(coin string, amount float64, txHash string) error {
+	if _, ok := sw.configs[coin]; !ok {
+		return fmt.Errorf("unsupported coin: %s", coin)
+	}
+	if amount <= 0 {
+		return fmt.Errorf("refill amount must be positive")
+	}
+	st := sw.status(coin)
+	_, err := sw.db.Exec(`INSERT INTO hot_wallet_ledger (coin, kind, amount, tx_hash, status, hot_balance, pending_withdrawals, note) VALUES (?, 'cold_refill', ?, ?, 'received', ?, ?, 'moved from cold storage')`,
+		coin, amount, txHash, st.Balance, st.PendingWithdrawals)
+	return err
+}
+
+// ColdStorage estimates a coin's cold storage holdings from the ledger: sweeps
+// sent there less refills brought back
+func (sw *Sweeper) ColdStorage(coin string) (float64, error) {
+	var total float64
+	err := sw.db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN kind = 'sweep' THEN amount ELSE -amount END), 0)
+		FROM hot_wallet_ledger
+		WHERE coin = ? AND ((kind = 'sweep' AND status = 'sent') OR kind = 'cold_refill')`, coin).Scan(&total)
+	return total, err
+}
+
+// Run checks the hot wallets every interval
+func (sw *Sweeper) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sw.Check()
+	}
+}
+
+// ledger returns the most recent sweeps and refill alerts
+func (sw *Sweeper) ledger(limit int) ([]map[string]interface{}, error) {
+	rows, err := sw.db.Query(`
+		SELECT id, coin, kind, amount, COALESCE(address, ''), COALESCE(tx_hash, ''), status,
+			hot_balance, pending_withdrawals, COALESCE(note, ''), created_at, resolved_at
+		FROM hot_wallet_ledger ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var coin, kind, address, txHash, status, note string
+		var amount, hotBalance, pending float64
+		var createdAt time.Time
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&id, &coin, &kind, &amount, &address, &txHash, &status, &hotBalance, &pending, &note, &createdAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		entry := map[string]interface{}{
+			"id":                  id,
+			"coin":                coin,
+			"kind":                kind,
+			"amount":              amount,
+			"address":             address,
+			"tx_hash":             txHash,
+			"status":              status,
+			"hot_balance":         hotBalance,
+			"pending_withdrawals": pending,
+			"note":                note,
+			"created_at":          createdAt,
+		}
+		if resolvedAt.Valid {
+			entry["resolved_at"] = resolvedAt.Time
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// handleAdminHotWallet shows hot wallet positions and the sweep ledger (GET), runs
+// a sweep pass immediately (POST), or records a refill from cold storage (POST
+// {"coin", "amount", "tx_hash"})
+func (s *Server) handleAdminHotWallet(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil || session.Username != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if s.sweeper == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Hot wallet management is disabled"})
+		return
+	}
+
+	var wallets []HotWalletStatus
+	if r.Method == http.MethodPost {
+		var req struct {
+			Coin   string  `json:"coin"`
+			Amount float64 `json:"amount"`
+			TxHash string  `json:"tx_hash"`
+		}
+		// An empty body triggers a sweep; anything else must be a refill
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Coin != "" {
+			if err := s.sweeper.RecordRefill(req.Coin, req.Amount, req.TxHash); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			log.Printf("[SWEEP] Admin %s recorded a refill of %.8f %s from cold storage", session.Username, req.Amount, req.Coin)
+			wallets = s.sweeper.Status()
+		} else {
+			log.Printf("[SWEEP] Admin %s triggered a sweep", session.Username)
+			wallets = s.sweeper.Check()
+		}
+	} else {
+		wallets = s.sweeper.Status()
+	}
+
+	ledger, err := s.sweeper.ledger(100)
+	if err != nil {
+		log.Printf("[SWEEP] Failed to load ledger: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load ledger"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"wallets": wallets,
+		"ledger":  ledger,
+	})
+}
+
+// parseHotWalletConfig checks a coin's hot wallet flags
+func parseHotWalletConfig(symbol string, target, min float64, coldAddress string) (HotWalletConfig, error) {
+	if target < 0 || min < 0 {
+		return HotWalletConfig{}, fmt.Errorf("%s hot wallet target and minimum must not be negative", symbol)
+	}
+	if target > 0 && min > target {
+		return HotWalletConfig{}, fmt.Errorf("%s hot wallet minimum %.8f exceeds target %.8f", symbol, min, target)
+	}
+	return HotWalletConfig{Target: target, Min: min, ColdAddress: coldAddress}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminHotWalletRejectsBadJSON(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	ex.server.sweeper = NewSweeper(db, ex.server.assets, map[string]HotWalletConfig{}, nil)
+	admin := ex.newUser(t, "admin")
+
+	req, _ := http.NewRequest(http.MethodPost, ex.ts.URL+"/api/admin/hot-wallet", strings.NewReader(`{"coin": "litecoin", "amount": "1"`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, admin.token)
+	resp, err := admin.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad JSON: status %d, want 400", resp.StatusCode)
+	}
+
+	// An empty body is a sweep
+	if resp := admin.call("/api/admin/hot-wallet", nil); resp["error"] != nil {
+		t.Errorf("sweep: %v", resp)
+	}
+}
+
+func TestSweepAndRefillAlerts(t *testing.T) {
+	db := newTestDB(t)
+	assets := newSimAssets(t, db)
+	kcn := assets["kernelcoin"].Wallet.(*SimWallet)
+	hot, _ := kcn.NewAddress()
+	kcn.Faucet(hot, 100)
+	kcn.Mine(1)
+
+	sw := NewSweeper(db, assets, map[string]HotWalletConfig{
+		"kernelcoin": {Target: 30, Min: 10, ColdAddress: "simkcncold"},
+	}, nil)
+	withdraw := func(amount float64) {
+		t.Helper()
+		if _, err := db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status) VALUES (1, 'kernelcoin', ?, 'withdraw', 'pending')`, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ledger counts the entries of a kind and returns the latest
+	ledger := func(kind string) (count int, amount float64, status string) {
+		t.Helper()
+		db.QueryRow(`SELECT COUNT(*) FROM hot_wallet_ledger WHERE kind = ?`, kind).Scan(&count)
+		db.QueryRow(`SELECT amount, status FROM hot_wallet_ledger WHERE kind = ? ORDER BY id DESC LIMIT 1`, kind).Scan(&amount, &status)
+		return count, amount, status
+	}
+
+	// Everything above the target and what pending withdrawals need goes cold
+	withdraw(20)
+	st := sw.Check()[0]
+	assertAmount(t, "hot balance after the sweep", st.Balance, 50)
+	if n, amount, status := ledger("sweep"); n != 1 || amount != 50 || status != "sent" {
+		t.Fatalf("sweeps = %d of %v (%s)", n, amount, status)
+	}
+	confirmed, _, _ := kcn.Balance()
+	assertAmount(t, "wallet after the sweep", confirmed, 50)
+
+	// At the target there is nothing to sweep
+	sw.Check()
+	if n, _, _ := ledger("sweep"); n != 1 {
+		t.Errorf("%d sweeps at the target", n)
+	}
+
+	// Pending withdrawals above the balance less the reserve open one alert,
+	// for enough to pay them and get back to the target
+	withdraw(35)
+	st = sw.Check()[0]
+	assertAmount(t, "refill", st.Refill, 55+30-50)
+	sw.Check()
+	if n, amount, status := ledger("refill"); n != 1 || amount != 35 || status != "open" {
+		t.Fatalf("refill alerts = %d of %v (%s)", n, amount, status)
+	}
+
+	// Coins brought back from cold storage resolve the alert
+	if err := sw.RecordRefill("kernelcoin", 40, "coldtx"); err != nil {
+		t.Fatalf("record refill: %v", err)
+	}
+	cold, _ := sw.ColdStorage("kernelcoin")
+	assertAmount(t, "cold storage", cold, 10)
+	kcn.Faucet(hot, 40)
+	kcn.Mine(1)
+	sw.Check()
+	if _, _, status := ledger("refill"); status != "resolved" {
+		t.Errorf("refill alert after the refill is %s", status)
+	}
+	// The refill overshot the target by 5
+	if n, amount, _ := ledger("sweep"); n != 2 || math.Abs(amount-5) > 1e-9 {
+		t.Errorf("sweeps after the refill = %d, the last of %v", n, amount)
+	}
+
+	if err := sw.RecordRefill("dogecoin", 1, ""); err == nil {
+		t.Errorf("refill of an unknown coin recorded")
+	}
+	if err := sw.RecordRefill("kernelcoin", 0, ""); err == nil {
+		t.Errorf("empty refill recorded")
+	}
+}
+
+func TestSweepWaitsForWithdrawal(t *testing.T) {
+	db := newTestDB(t)
+	assets := newSimAssets(t, db)
+	kcn := assets["kernelcoin"].Wallet.(*SimWallet)
+	hot, _ := kcn.NewAddress()
+	kcn.Faucet(hot, 100)
+	kcn.Mine(1)
+	sw := NewSweeper(db, assets, map[string]HotWalletConfig{"kernelcoin": {Target: 30, ColdAddress: "simkcncold"}}, nil)
+
+	// A withdrawal holds the coin while it sends; the sweep works out the excess after it
+	assets["kernelcoin"].sendMu.Lock()
+	done := make(chan HotWalletStatus)
+	go func() { done <- sw.Check()[0] }()
+	select {
+	case <-done:
+		t.Fatal("sweep ran while a withdrawal was sending")
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.Exec(`INSERT INTO transactions (user_id, coin, amount, type, status) VALUES (1, 'kernelcoin', 60, 'withdraw', 'completed')`)
+	kcn.Send(hot, 60)
+	assets["kernelcoin"].sendMu.Unlock()
+
+	st := <-done
+	assertAmount(t, "hot balance after the withdrawal and sweep", st.Balance, 30)
+}
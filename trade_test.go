@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPartialFillsAndCancelRefundUnfilledEscrow(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 100, litecoin = 10`)
+
+	create := func(coinSelling string, amountSelling float64, coinBuying string, amountBuying float64) interface{} {
+		t.Helper()
+		resp := alice.call("/api/trade/create", map[string]interface{}{
+			"coin_selling": coinSelling, "amount_selling": amountSelling, "coin_buying": coinBuying, "amount_buying": amountBuying,
+		})
+		if resp["success"] != true {
+			t.Fatalf("create: %v", resp)
+		}
+		return resp["trade_id"]
+	}
+	execute := func(tradeID interface{}, quantity float64) map[string]interface{} {
+		return bob.call("/api/trade/execute", map[string]interface{}{"trade_id": tradeID, "quantity": quantity})
+	}
+	locked := func(coin string) float64 {
+		t.Helper()
+		report := &ReconciliationReport{Coin: coin}
+		if err := NewReconciler(db, ex.server.assets, nil, 0).liabilities(report); err != nil {
+			t.Fatalf("liabilities: %v", err)
+		}
+		return report.Locked
+	}
+
+	// An ask for 10 KCN at 0.1 LTC fills in parts; the seller keeps only the rest escrowed
+	ask := create("kernelcoin", 10, "litecoin", 1)
+	if resp := execute(ask, 4); resp["success"] != true {
+		t.Fatalf("execute 4: %v", resp)
+	}
+	assertAmount(t, "KCN locked after a partial fill", locked("kernelcoin"), 6)
+	assertAmount(t, "KCN reserved after a partial fill", alice.balance()["kcn_reserved"], 6)
+	if resp := execute(ask, 7); resp["success"] == true {
+		t.Errorf("executing more than the remaining 6: %v", resp)
+	}
+	if resp := alice.call("/api/trade/cancel", map[string]interface{}{"trade_id": ask}); resp["success"] != true {
+		t.Fatalf("cancel: %v", resp)
+	}
+	assertAmount(t, "alice KCN after cancelling", alice.balance()["kernelcoin"], 96)
+	assertAmount(t, "alice LTC from the fill", alice.balance()["litecoin"], 10.4)
+	if resp := alice.call("/api/trade/cancel", map[string]interface{}{"trade_id": ask}); resp["success"] == true {
+		t.Errorf("cancelling twice: %v", resp)
+	}
+	if resp := execute(ask, 1); resp["success"] == true {
+		t.Errorf("executing a cancelled order: %v", resp)
+	}
+
+	// A bid for 10 KCN at 0.1 LTC completes once all of it is taken
+	bid := create("litecoin", 1, "kernelcoin", 10)
+	if resp := execute(bid, 5); resp["success"] != true {
+		t.Fatalf("execute 5: %v", resp)
+	}
+	assertAmount(t, "LTC locked after half the bid", locked("litecoin"), 0.5)
+	assertAmount(t, "LTC reserved after half the bid", alice.balance()["ltc_reserved"], 0.5)
+	if resp := execute(bid, 5); resp["success"] != true {
+		t.Fatalf("execute the last 5: %v", resp)
+	}
+	assertAmount(t, "LTC locked after the bid completes", locked("litecoin"), 0)
+	if resp := execute(bid, 1); resp["success"] == true {
+		t.Errorf("executing a completed order: %v", resp)
+	}
+	assertAmount(t, "alice KCN after the bid", alice.balance()["kernelcoin"], 106)
+	assertAmount(t, "bob LTC", bob.balance()["litecoin"], 10-0.4+1)
+}
+
+func TestFailedFillChangesNothing(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	ex.server.fees = NewFeeSchedule(db)
+	tiers, _ := ParseFeeTiers("0:0.001:0.002")
+	ex.server.fees.SetTiers(marketKCNLTC, tiers)
+
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 100, litecoin = 10`)
+
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 10, "coin_buying": "litecoin", "amount_buying": 1,
+	})
+
+	// The taker's fee fails after the balances, the fill and the maker's fee are written
+	if _, err := db.Exec(`CREATE TRIGGER fail_taker_fee BEFORE INSERT ON trade_fees WHEN NEW.role = 'taker'
+		BEGIN SELECT RAISE(ABORT, 'taker fee failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 4}); resp["success"] == true {
+		t.Fatalf("execute with a failing fee: %v", resp)
+	}
+
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 90)
+	assertAmount(t, "alice LTC", alice.balance()["litecoin"], 10)
+	assertAmount(t, "bob KCN", bob.balance()["kernelcoin"], 100)
+	assertAmount(t, "bob LTC", bob.balance()["litecoin"], 10)
+	var fills, fees int
+	db.QueryRow(`SELECT (SELECT COUNT(*) FROM trade_completions), (SELECT COUNT(*) FROM trade_fees)`).Scan(&fills, &fees)
+	if fills != 0 || fees != 0 {
+		t.Errorf("%d fills and %d fees left by a failed fill", fills, fees)
+	}
+	revenue, _ := exchangeAccountBalances(db, feeAccount)
+	assertAmount(t, "LTC fees", revenue["litecoin"], 0)
+
+	// The whole order is still there to fill
+	db.Exec(`DROP TRIGGER fail_taker_fee`)
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 10}); resp["success"] != true {
+		t.Fatalf("execute: %v", resp)
+	}
+}
+
+func TestWithdrawAlongsideOpenOrders(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	admin := ex.newUser(t, "admin")
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+
+	alice.receiveAddress("kernelcoin")
+	admin.call("/api/admin/faucet", map[string]interface{}{"coin": "kernelcoin", "username": "alice", "amount": 10})
+	admin.call("/api/admin/faucet", map[string]interface{}{"coin": "kernelcoin", "blocks": 2})
+	if resp := alice.checkDeposit("kernelcoin"); resp["status"] != "confirmed" {
+		t.Fatalf("deposit: %v", resp)
+	}
+
+	// 4 KCN go into escrow, 6 stay spendable, and a fill of 1 leaves 3 reserved
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling": "kernelcoin", "amount_selling": 4, "coin_buying": "litecoin", "amount_buying": 0.4,
+	})
+	if created["success"] != true {
+		t.Fatalf("create: %v", created)
+	}
+	db.Exec(`UPDATE balances SET litecoin = 1 WHERE user_id = 3`)
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 1}); resp["success"] != true {
+		t.Fatalf("execute: %v", resp)
+	}
+	var data struct {
+		Users []map[string]interface{} `json:"users"`
+	}
+	admin.get("/api/admin", &data)
+	for _, user := range data.Users {
+		if user["username"] == "alice" {
+			assertAmount(t, "alice KCN reserved for the admin", user["kcn_reserved"].(float64), 3)
+		}
+	}
+
+	alice.call("/api/update-addresses", map[string]string{"kernelcoin_address": bob.receiveAddress("kernelcoin")})
+	if resp := alice.call("/api/withdraw", map[string]interface{}{"coin": "kernelcoin", "amount": 5}); resp["success"] != true {
+		t.Fatalf("withdrawing 5 of 6 spendable KCN: %v", resp)
+	}
+	if resp := alice.call("/api/withdraw", map[string]interface{}{"coin": "kernelcoin", "amount": 2}); resp["success"] == true {
+		t.Errorf("withdrawing more than the 1 KCN left: %v", resp)
+	}
+	assertAmount(t, "alice KCN", alice.balance()["kernelcoin"], 1)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WalletBackend is the wallet holding the exchange's funds for one coin
+type WalletBackend interface {
+	// NewAddress returns a fresh deposit address
+	NewAddress() (string, error)
+	// IncomingTransfers lists payments received by an address, confirmed or not
+	IncomingTransfers(address string) ([]IncomingTransfer, error)
+	// Send pays amount to address, with the network fee taken out of amount
+	Send(address string, amount float64) (txid string, err error)
+	// Balance returns the wallet's confirmed and unconfirmed funds
+	Balance() (confirmed, unconfirmed float64, err error)
+	// EstimateFee returns the expected fee deducted from a withdrawal
+	EstimateFee() (float64, error)
+	// ValidateAddress reports whether address is valid on the coin's network
+	ValidateAddress(address string) (bool, error)
+	// ChainTip returns the best block the backend knows about
+	ChainTip() (*ChainTip, error)
+}
+
+// IncomingTransfer is a payment to a deposit address
+type IncomingTransfer struct {
+	TxID          string
+	Amount        float64
+	Confirmations int
+}
+
+// ChainTip describes the best block seen by a wallet backend
+type ChainTip struct {
+	Height int64
+	Hash   string // empty when the backend does not report it
+	Time   time.Time
+}
+
+// Asset is a coin the exchange handles. Name doubles as the balances column.
+type Asset struct {
+	Name          string
+	Symbol        string
+	Confirmations int // confirmations before a deposit is credited
+	Wallet        WalletBackend
+
+	// sendMu is held from reading what the hot wallet can spend until the coins are
+	// sent, by withdrawals and sweeps alike, so both never spend the same funds.
+	// It is taken before s.mu, never while holding it.
+	sendMu sync.Mutex
+}
+
+// newAssets builds the asset table from the wallet backend for each coin
+func newAssets(kernelcoin, litecoin WalletBackend) map[string]*Asset {
+	return map[string]*Asset{
+		"kernelcoin": {Name: "kernelcoin", Symbol: "KCN", Confirmations: 2, Wallet: kernelcoin},
+		"litecoin":   {Name: "litecoin", Symbol: "LTC", Confirmations: 1, Wallet: litecoin},
+	}
+}
+
+// userError turns a wallet backend error into a message that is safe to show users
+func (a *Asset) userError(err error, fallback string) string {
+	var rpcErr *RPCError
+	switch {
+	case errors.Is(err, ErrWalletUnavailable):
+		return "The " + a.Symbol + " wallet is unavailable, please try again later"
+	case isInsufficientFunds(err):
+		return "The exchange's " + a.Symbol + " wallet cannot cover this withdrawal right now, please try again later"
+	case errors.As(err, &rpcErr) && rpcErr.Code == rpcErrInvalidAddress:
+		return "Your " + a.Symbol + " withdrawal address is not valid"
+	}
+	return fallback
+}
+
+// typicalWithdrawalSize is the approximate size in kvB of a one-input, two-output transaction
+const typicalWithdrawalSize = 0.226
+
+// RPCWallet is a WalletBackend for bitcoind-style nodes (kernelcoind, litecoind)
+type RPCWallet struct {
+	client      *CoinRPCClient
+	addressType string
+}
+
+// NewRPCWallet creates a wallet backend that generates addresses of the given type
+func NewRPCWallet(client *CoinRPCClient, addressType string) *RPCWallet {
+	return &RPCWallet{client: client, addressType: addressType}
+}
+
+// NewAddress generates an address from the node's wallet
+func (w *RPCWallet) NewAddress() (string, error) {
+	return w.client.GetNewAddress("", w.addressType)
+}
+
+// IncomingTransfers looks up each wallet transaction paying to the address in one batch
+func (w *RPCWallet) IncomingTransfers(address string) ([]IncomingTransfer, error) {
+	txids, err := w.client.ListReceivedTxIDs(address, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(txids) == 0 {
+		return nil, nil
+	}
+
+	txs := make([]WalletTransaction, len(txids))
+	calls := make([]*RPCCall, len(txids))
+	for i, txid := range txids {
+		calls[i] = &RPCCall{Method: "gettransaction", Params: []interface{}{txid}, Result: &txs[i]}
+	}
+	if err := w.client.Batch(context.Background(), calls...); err != nil {
+		return nil, err
+	}
+
+	var transfers []IncomingTransfer
+	for i, tx := range txs {
+		if calls[i].Err != nil {
+			return nil, calls[i].Err
+		}
+
+		var amount float64
+		for _, detail := range tx.Details {
+			if detail.Address == address && detail.Category == "receive" {
+				amount += detail.Amount
+			}
+		}
+		if amount > 0 {
+			transfers = append(transfers, IncomingTransfer{TxID: txids[i], Amount: amount, Confirmations: tx.Confirmations})
+		}
+	}
+	return transfers, nil
+}
+
+// Send pays out with the fee subtracted from the amount
+func (w *RPCWallet) Send(address string, amount float64) (string, error) {
+	return w.client.SendToAddress(address, amount)
+}
+
+// Balance returns the wallet's trusted and pending balances
+func (w *RPCWallet) Balance() (float64, float64, error) {
+	return w.client.GetBalances()
+}
+
+// EstimateFee prices a typical withdrawal at the node's 6-block fee rate
+func (w *RPCWallet) EstimateFee() (float64, error) {
+	rate, err := w.client.EstimateSmartFee(6)
+	if err != nil {
+		return 0, err
+	}
+	return rate * typicalWithdrawalSize, nil
+}
+
+// ValidateAddress asks the node to validate the address
+func (w *RPCWallet) ValidateAddress(address string) (bool, error) {
+	return w.client.ValidateAddress(address)
+}
+
+// ChainTip returns the node's best block
+func (w *RPCWallet) ChainTip() (*ChainTip, error) {
+	info, err := w.client.GetBlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &ChainTip{Height: info.Blocks, Hash: info.BestBlockHash, Time: time.Unix(info.MedianTime, 0)}, nil
+}
+
+// Health reads chain and peer status from the node in one batch
+func (w *RPCWallet) Health() (*NodeStatus, error) {
+	var chain BlockchainInfo
+	var network NetworkInfo
+	chainCall := &RPCCall{Method: "getblockchaininfo", Result: &chain}
+	networkCall := &RPCCall{Method: "getnetworkinfo", Result: &network}
+	if err := w.client.Batch(context.Background(), chainCall, networkCall); err != nil {
+		return nil, err
+	}
+	if chainCall.Err != nil {
+		return nil, chainCall.Err
+	}
+	if networkCall.Err != nil {
+		return nil, networkCall.Err
+	}
+
+	return &NodeStatus{
+		Height:    chain.Blocks,
+		Headers:   chain.Headers,
+		BestHash:  chain.BestBlockHash,
+		Progress:  chain.VerificationProgress,
+		Syncing:   chain.InitialBlockDownload,
+		Peers:     network.Connections,
+		Connected: network.NetworkActive && network.Connections > 0,
+	}, nil
+}
+
+// ElectrumWallet is a WalletBackend for an Electrum wallet
+type ElectrumWallet struct {
+	client *ElectrumClient
+
+	// received caches what each transaction paid to each address; outputs never change
+	mu       sync.Mutex
+	received map[string]float64
+}
+
+// NewElectrumWallet creates a wallet backend on top of an Electrum client
+func NewElectrumWallet(client *ElectrumClient) *ElectrumWallet {
+	return &ElectrumWallet{client: client, received: make(map[string]float64)}
+}
+
+// NewAddress creates an address in the Electrum wallet
+func (w *ElectrumWallet) NewAddress() (string, error) {
+	return w.client.CreateNewAddress()
+}
+
+// IncomingTransfers reports every transaction in the address's history that paid
+// to it, spent or not, with confirmations derived from its height and the current
+// chain height. The commands are sent one at a time, as not every daemon accepts
+// batches.
+func (w *ElectrumWallet) IncomingTransfers(address string) ([]IncomingTransfer, error) {
+	history, err := w.client.GetAddressHistory(address)
+	if err != nil {
+		return nil, err
+	}
+	info, err := w.client.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	transfers := make([]IncomingTransfer, 0, len(history))
+	for _, item := range history {
+		amount, err := w.receivedBy(item.TxHash, address)
+		if err != nil {
+			return nil, err
+		}
+		// Transactions that only spend from the address are not deposits
+		if amount <= 0 {
+			continue
+		}
+		confirmations := 0
+		if item.Height > 0 && info.BlockchainHeight >= item.Height {
+			confirmations = int(info.BlockchainHeight - item.Height + 1)
+		}
+		transfers = append(transfers, IncomingTransfer{
+			TxID:          item.TxHash,
+			Amount:        amount,
+			Confirmations: confirmations,
+		})
+	}
+	return transfers, nil
+}
+
+// receivedBy is the total a transaction paid to an address
+func (w *ElectrumWallet) receivedBy(txid, address string) (float64, error) {
+	key := txid + "/" + address
+	w.mu.Lock()
+	amount, ok := w.received[key]
+	w.mu.Unlock()
+	if ok {
+		return amount, nil
+	}
+
+	outputs, err := w.client.GetTransactionOutputs(txid)
+	if err != nil {
+		return 0, err
+	}
+	var sats int64
+	for _, output := range outputs {
+		if output.Address == address {
+			sats += output.ValueSats
+		}
+	}
+	amount = float64(sats) / 1e8
+
+	w.mu.Lock()
+	w.received[key] = amount
+	w.mu.Unlock()
+	return amount, nil
+}
+
+// Send pays out, keeping the configured withdrawal fee
+func (w *ElectrumWallet) Send(address string, amount float64) (string, error) {
+	return w.client.PayTo(address, amount)
+}
+
+// Balance returns the Electrum wallet balance
+func (w *ElectrumWallet) Balance() (float64, float64, error) {
+	return w.client.GetBalance()
+}
+
+// EstimateFee returns the fixed fee kept from each withdrawal
+func (w *ElectrumWallet) EstimateFee() (float64, error) {
+	return w.client.withdrawFee, nil
+}
+
+// ValidateAddress asks Electrum to validate the address
+func (w *ElectrumWallet) ValidateAddress(address string) (bool, error) {
+	return w.client.ValidateAddress(address)
+}
+
+// ChainTip returns the height of the chain Electrum is following
+func (w *ElectrumWallet) ChainTip() (*ChainTip, error) {
+	info, err := w.client.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Connected {
+		return nil, fmt.Errorf("electrum is not connected to a server")
+	}
+	return &ChainTip{Height: info.BlockchainHeight}, nil
+}
+
+// Health compares Electrum's local chain with its server's
+func (w *ElectrumWallet) Health() (*NodeStatus, error) {
+	info, err := w.client.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &NodeStatus{
+		Height:    info.BlockchainHeight,
+		Headers:   info.ServerHeight,
+		Progress:  1,
+		Peers:     info.SPVNodes,
+		Connected: info.Connected,
+	}, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Feed connection timing
+const (
+	feedWriteWait  = 10 * time.Second
+	feedPongWait   = 60 * time.Second
+	feedPingPeriod = 30 * time.Second
+	feedBuffer     = 1024
+	feedReadLimit  = 4096
+	feedTapeSize   = 50 // trades in a trade tape snapshot
+)
+
+var feedUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     sameOrigin,
+}
+
+// feedRequest is a message from a feed client. Since is the last sequence number
+// the client saw on the channel and Epoch the one its snapshot came with; without
+// them, or after a restart changed the epoch, the client gets a fresh snapshot.
+type feedRequest struct {
+	Op      string  `json:"op"`
+	Channel string  `json:"channel"`
+	Since   *uint64 `json:"since"`
+	Epoch   string  `json:"epoch"`
+}
+
+// feedClient is one websocket connection to /ws
+type feedClient struct {
+	conn    *websocket.Conn
+	out     chan interface{}
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	streams map[string]bool
+}
+
+func newFeedClient(conn *websocket.Conn) *feedClient {
+	return &feedClient{
+		conn:    conn,
+		out:     make(chan interface{}, feedBuffer),
+		done:    make(chan struct{}),
+		streams: make(map[string]bool),
+	}
+}
+
+// subscribed reports whether the client wants events from stream
+func (c *feedClient) subscribed(stream string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[stream]
+}
+
+func (c *feedClient) subscribe(stream string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams[stream] = true
+}
+
+func (c *feedClient) unsubscribe(stream string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, stream)
+}
+
+// send queues a message without blocking. A client too slow to keep up is
+// disconnected; it reconnects and resyncs from its last sequence number.
+func (c *feedClient) send(msg interface{}) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.out <- msg:
+	default:
+		log.Printf("[FEED] Dropping slow client %s", c.conn.RemoteAddr())
+		c.close()
+	}
+}
+
+func (c *feedClient) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// writeLoop sends queued messages and keepalive pings until the client is closed
+func (c *feedClient) writeLoop() {
+	ticker := time.NewTicker(feedPingPeriod)
+	defer ticker.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(feedWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(feedWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handleFeed serves the websocket feed. Clients send
+// {"op":"subscribe","channel":"book"|"trades"|"user","since":N,"epoch":E} and
+// receive a snapshot, or the events after N when they are still kept and E is the
+// current epoch, followed by live events. The user channel needs a logged-in session.
+func (s *Server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := feedUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied
+		return
+	}
+
+	client := newFeedClient(conn)
+	s.events.add(client)
+	defer s.events.remove(client)
+	defer client.close()
+	go client.writeLoop()
+
+	conn.SetReadLimit(feedReadLimit)
+	conn.SetReadDeadline(time.Now().Add(feedPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(feedPongWait))
+		return nil
+	})
+
+	for {
+		var req feedRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(feedPongWait))
+
+		switch req.Op {
+		case "subscribe":
+			s.feedSubscribe(client, r, req)
+		case "unsubscribe":
+			if stream, _, ok := s.feedStream(r, req.Channel); ok {
+				client.unsubscribe(stream)
+			}
+			client.send(map[string]string{"type": "unsubscribed", "channel": req.Channel})
+		case "ping":
+			client.send(map[string]string{"type": "pong"})
+		default:
+			client.send(map[string]string{"type": "error", "error": "Unknown op: " + req.Op})
+		}
+	}
+}
+
+// feedStream maps a channel to the stream the request may read, and for the user
+// channel whose stream it is
+func (s *Server) feedStream(r *http.Request, channel string) (string, int, bool) {
+	switch channel {
+	case streamBook, streamTrades:
+		return channel, 0, true
+	case "user":
+		session := s.getSession(r)
+		if session == nil {
+			return "", 0, false
+		}
+		return userStream(session.UserID), session.UserID, true
+	}
+	return "", 0, false
+}
+
+// feedSubscribe subscribes a client and catches it up. s.mu is held for reading so
+// no event can be published between the snapshot and the subscription.
+func (s *Server) feedSubscribe(client *feedClient, r *http.Request, req feedRequest) {
+	stream, userID, ok := s.feedStream(r, req.Channel)
+	if !ok {
+		if req.Channel == "user" {
+			client.send(map[string]string{"type": "error", "channel": req.Channel, "error": "Unauthorized"})
+		} else {
+			client.send(map[string]string{"type": "error", "channel": req.Channel, "error": "Unknown channel: " + req.Channel})
+		}
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if req.Since != nil {
+		if missed, ok := s.events.Since(stream, req.Epoch, *req.Since); ok {
+			client.subscribe(stream)
+			for _, event := range missed {
+				client.send(event)
+			}
+			client.send(map[string]interface{}{"type": "subscribed", "channel": req.Channel, "seq": s.events.Seq(stream), "epoch": s.events.Epoch()})
+			return
+		}
+	}
+
+	data, err := s.feedSnapshot(stream, userID)
+	if err != nil {
+		log.Printf("[FEED] Failed to build %s snapshot: %v", stream, err)
+		client.send(map[string]string{"type": "error", "channel": req.Channel, "error": "Failed to load snapshot"})
+		return
+	}
+	client.subscribe(stream)
+	client.send(Event{
+		Channel: req.Channel,
+		Type:    "snapshot",
+		Seq:     s.events.Seq(stream),
+		Epoch:   s.events.Epoch(),
+		Time:    time.Now().UTC(),
+		Data:    data,
+	})
+}
+
+// feedSnapshot is the current state of a stream; userID owns it if it is a user
+// stream. Caller must hold s.mu.
+func (s *Server) feedSnapshot(stream string, userID int) (interface{}, error) {
+	switch stream {
+	case streamBook:
+		if s.book == nil {
+			return nil, fmt.Errorf("order book not loaded")
+		}
+		orders, _ := s.book.Orders()
+		return map[string]interface{}{"market": marketKCNLTC, "orders": orders}, nil
+	case streamTrades:
+		fills, err := s.getRecentFills(feedTapeSize)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"market": marketKCNLTC, "trades": fills}, nil
+	}
+
+	balance, err := s.getUserBalance(userID)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := s.getOpenOrders()
+	if err != nil {
+		return nil, err
+	}
+	own := []*BookOrder{}
+	for _, order := range orders {
+		if order.SellerID == userID {
+			own = append(own, order)
+		}
+	}
+	return map[string]interface{}{
+		"balance": map[string]float64{
+			"kernelcoin": balance.Kernelcoin,
+			"litecoin":   balance.Litecoin,
+		},
+		"orders": own,
+	}, nil
+}
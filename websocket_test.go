@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// feedMessage is any message the feed sends
+type feedMessage struct {
+	Channel string          `json:"channel"`
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq"`
+	Epoch   string          `json:"epoch"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+// dialFeed opens /ws with the user's cookies
+func (u *testUser) dialFeed() *websocket.Conn {
+	u.t.Helper()
+
+	dialer := websocket.Dialer{
+		TLSClientConfig: u.client.Transport.(*http.Transport).TLSClientConfig,
+		Jar:             u.client.Jar,
+	}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(u.ex.ts.URL, "https")+"/ws", nil)
+	if err != nil {
+		u.t.Fatalf("dial feed: %v", err)
+	}
+	u.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func subscribeFeed(t *testing.T, conn *websocket.Conn, channel string, since *uint64, epoch string) {
+	t.Helper()
+	req := map[string]interface{}{"op": "subscribe", "channel": channel}
+	if since != nil {
+		req["since"] = *since
+		req["epoch"] = epoch
+	}
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatalf("subscribe %s: %v", channel, err)
+	}
+}
+
+// readFeed reads the next message on channel of the given type, skipping others
+func readFeed(t *testing.T, conn *websocket.Conn, channel, msgType string) feedMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg feedMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s %s: %v", channel, msgType, err)
+		}
+		if msg.Type == "error" {
+			t.Fatalf("waiting for %s %s: feed error %q", channel, msgType, msg.Error)
+		}
+		if msg.Channel == channel && msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestFeedBookTradesAndUserEvents(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+	alice := ex.newUser(t, "alice")
+	bob := ex.newUser(t, "bob")
+	db.Exec(`UPDATE balances SET kernelcoin = 50 WHERE user_id = (SELECT id FROM users WHERE username = 'alice')`)
+	db.Exec(`UPDATE balances SET litecoin = 5 WHERE user_id = (SELECT id FROM users WHERE username = 'bob')`)
+
+	public := bob.dialFeed()
+	subscribeFeed(t, public, "book", nil, "")
+	subscribeFeed(t, public, "trades", nil, "")
+	book := readFeed(t, public, "book", "snapshot")
+	readFeed(t, public, "trades", "snapshot")
+
+	private := alice.dialFeed()
+	subscribeFeed(t, private, "user", nil, "")
+	readFeed(t, private, "user", "snapshot")
+
+	// Alice sells 10 KCN at 0.1 LTC and Bob takes 4 of them
+	created := alice.call("/api/trade/create", map[string]interface{}{
+		"coin_selling":   "kernelcoin",
+		"amount_selling": 10,
+		"coin_buying":    "litecoin",
+		"amount_buying":  1,
+	})
+	if created["success"] != true {
+		t.Fatalf("create trade: %v", created)
+	}
+	added := readFeed(t, public, "book", "order_added")
+	if added.Seq != book.Seq+1 {
+		t.Errorf("order_added seq = %d, want %d", added.Seq, book.Seq+1)
+	}
+
+	if resp := bob.call("/api/trade/execute", map[string]interface{}{"trade_id": created["trade_id"], "quantity": 4}); resp["success"] != true {
+		t.Fatalf("execute trade: %v", resp)
+	}
+	var fill Fill
+	json.Unmarshal(readFeed(t, public, "trades", "trade").Data, &fill)
+	if fill.Side != "buy" || fill.Size != 4 || fill.Price != 0.1 {
+		t.Errorf("trade tape = %+v, want a 4 KCN buy at 0.1", fill)
+	}
+	var order BookOrder
+	updated := readFeed(t, public, "book", "order_updated")
+	json.Unmarshal(updated.Data, &order)
+	assertAmount(t, "remaining after partial fill", order.Remaining, 6)
+
+	json.Unmarshal(readFeed(t, private, "user", "fill").Data, &fill)
+	if fill.Role != "maker" {
+		t.Errorf("alice's fill role = %q, want maker", fill.Role)
+	}
+	var balance map[string]float64
+	json.Unmarshal(readFeed(t, private, "user", "balance").Data, &balance)
+	assertAmount(t, "alice LTC on the feed", balance["litecoin"], 0.4)
+
+	// Cancelling refunds only the unfilled 6 KCN
+	if resp := alice.call("/api/trade/cancel", map[string]interface{}{"trade_id": created["trade_id"]}); resp["success"] != true {
+		t.Fatalf("cancel trade: %v", resp)
+	}
+	removed := readFeed(t, public, "book", "order_removed")
+	assertAmount(t, "alice KCN after cancel", alice.balance()["kernelcoin"], 46)
+
+	// A client that reconnects after the order_added event replays what it missed
+	resync := bob.dialFeed()
+	subscribeFeed(t, resync, "book", &added.Seq, book.Epoch)
+	if missed := readFeed(t, resync, "book", "order_updated"); missed.Seq != updated.Seq {
+		t.Errorf("replayed seq = %d, want %d", missed.Seq, updated.Seq)
+	}
+	if ack := readFeed(t, resync, "book", "subscribed"); ack.Seq != removed.Seq || ack.Epoch != book.Epoch {
+		t.Errorf("subscribed at seq %d epoch %q, want %d %q", ack.Seq, ack.Epoch, removed.Seq, book.Epoch)
+	}
+
+	// Asking for events the feed never sent gets a fresh snapshot instead
+	future := removed.Seq + 100
+	subscribeFeed(t, resync, "book", &future, book.Epoch)
+	if snapshot := readFeed(t, resync, "book", "snapshot"); snapshot.Seq != removed.Seq {
+		t.Errorf("snapshot seq = %d, want %d", snapshot.Seq, removed.Seq)
+	}
+
+	// So does a sequence number from before a restart, even one that exists now
+	for _, epoch := range []string{"", "0123456789abcdef"} {
+		subscribeFeed(t, resync, "book", &added.Seq, epoch)
+		if snapshot := readFeed(t, resync, "book", "snapshot"); snapshot.Seq != removed.Seq || snapshot.Epoch != book.Epoch {
+			t.Errorf("resume from epoch %q: snapshot seq %d epoch %q", epoch, snapshot.Seq, snapshot.Epoch)
+		}
+	}
+	if book.Epoch == "" || book.Epoch == NewEventHub().Epoch() {
+		t.Errorf("epoch %q does not tell processes apart", book.Epoch)
+	}
+}
+
+func TestFeedUserChannelNeedsSession(t *testing.T) {
+	db := newTestDB(t)
+	ex := startTestExchange(t, db, newSimAssets(t, db))
+
+	// A client with no session can read the public channels only
+	client := *ex.ts.Client()
+	anonymous := &testUser{t: t, ex: ex, client: &client}
+	conn := anonymous.dialFeed()
+	subscribeFeed(t, conn, "user", nil, "")
+
+	var msg feedMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if msg.Type != "error" || msg.Error != "Unauthorized" {
+		t.Fatalf("user channel without a session = %+v, want an Unauthorized error", msg)
+	}
+}